@@ -10,6 +10,7 @@ import (
 	"github.com/jeffrom/logd/logd"
 	"github.com/jeffrom/logd/protocol"
 	"github.com/jeffrom/logd/stats"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -171,7 +172,7 @@ func (bc *benchConn) startRead() {
 			offset, nbatches, bs, err = bc.c.Tail(bc.topic, 15)
 		} else {
 			nbatches, bs, err = bc.c.ReadOffset(bc.topic, offset, 15)
-			if err == protocol.ErrNotFound {
+			if errors.Cause(err) == protocol.ErrNotFound {
 				offset = 0
 				continue
 			}
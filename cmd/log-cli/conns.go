@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var ConnsCmd = &cobra.Command{
+	Use:   "conns",
+	Short: "List server connections. Requires admin authentication",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		c := logd.New(tmpConfig)
+		conns, err := c.Conns()
+		if err != nil {
+			panic(err)
+		}
+		for _, info := range conns {
+			fmt.Printf("%s\t%s\t%s\t%s\n", info.ID, info.Addr, info.State, info.Principal)
+		}
+	},
+}
+
+var KillConnCmd = &cobra.Command{
+	Use:   "kill-conn ID",
+	Short: "Close a server connection. Requires admin authentication",
+	Long:  ``,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		c := logd.New(tmpConfig)
+		if err := c.KillConn(args[0]); err != nil {
+			panic(err)
+		}
+	},
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var EraseCmd = &cobra.Command{
+	Use:   "erase TOPIC START END",
+	Short: "Overwrite the batches from START up to END. Requires admin authentication",
+	Long: `Overwrite the batches in TOPIC starting from offset START up to END, so
+their messages can no longer be read. Offsets don't change: consumers read
+each erased batch as a single message of NUL bytes.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		start, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		end, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+
+		n, err := logd.New(tmpConfig).Erase([]byte(args[0]), start, end)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("erased %d batches\n", n)
+	},
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var setFormatFlag string
+
+func init() {
+	pflags := FormatCmd.PersistentFlags()
+	pflags.StringVar(&setFormatFlag, "set", "", "set the topic's format to `FORMAT`, such as json or protobuf")
+}
+
+var FormatCmd = &cobra.Command{
+	Use:   "format [TOPIC]",
+	Short: "Print or set a topic's format",
+	Long:  ``,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		var topic []byte
+		if len(args) > 0 {
+			topic = []byte(args[0])
+		}
+		c := logd.New(tmpConfig)
+		if setFormatFlag != "" {
+			if err := c.SetTopicFormat(topic, setFormatFlag); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		format, err := c.TopicFormat(topic)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(format)
+	},
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var HeadCmd = &cobra.Command{
+	Use:   "head [TOPIC]",
+	Short: "Print the offset of a topic's head",
+	Long:  ``,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		var topic []byte
+		if len(args) > 0 {
+			topic = []byte(args[0])
+		}
+		c := logd.New(tmpConfig)
+		off, err := c.Head(topic)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(off)
+	},
+}
+
+var HeadsCmd = &cobra.Command{
+	Use:   "heads",
+	Short: "Print the offset of every topic's head",
+	Long:  ``,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		c := logd.New(tmpConfig)
+		heads, err := c.TopicHeads()
+		if err != nil {
+			panic(err)
+		}
+
+		topics := make([]string, 0, len(heads))
+		for topic := range heads {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			fmt.Println(topic, heads[topic])
+		}
+	},
+}
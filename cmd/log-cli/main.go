@@ -24,6 +24,11 @@ func init() {
 	pflags.DurationVar(&tmpConfig.ConnectTimeout, "connect-timeout", logd.DefaultConfig.ConnectTimeout, "duration to wait for connection to establish. Overrides 'timeout' if set")
 	pflags.DurationVar(&tmpConfig.WriteTimeout, "write-timeout", logd.DefaultConfig.WriteTimeout, "duration to wait for writes to the server to complete. Overrides 'timeout' if set")
 	pflags.DurationVar(&tmpConfig.ReadTimeout, "read-timeout", logd.DefaultConfig.ReadTimeout, "duration to wait for reads from the server to complete. Overrides 'timeout' if set")
+	pflags.StringVar(&tmpConfig.AuthToken, "auth-token", logd.DefaultConfig.AuthToken, "a `TOKEN` to authenticate with after connecting")
+	pflags.BoolVar(&tmpConfig.VerifyIdentity, "verify-identity", logd.DefaultConfig.VerifyIdentity, "fail if the server or its log changed when reconnecting")
+	pflags.BoolVar(&tmpConfig.Preflight, "preflight", logd.DefaultConfig.Preflight, "check the server's protocol version, max batch size, and checksum after connecting")
+	pflags.BoolVar(&tmpConfig.ReconcileLimits, "reconcile-limits", logd.DefaultConfig.ReconcileLimits, "lower the batch size to the server's max batch size after connecting")
+	pflags.StringVar(&tmpConfig.Checksum, "checksum", logd.DefaultConfig.Checksum, "crc32 polynomial for batch checksums, ieee or castagnoli")
 	pflags.IntVar(&tmpConfig.BatchSize, "batch-size", logd.DefaultConfig.BatchSize, "maximum size of batch in bytes")
 	pflags.DurationVar(&tmpConfig.WaitInterval, "wait-interval", logd.DefaultConfig.WaitInterval, "duration to wait after the last write to flush the current batch")
 	pflags.BoolVarP(&tmpConfig.Count, "count", "c", logd.DefaultConfig.Count, "Print counts before exiting")
@@ -138,7 +143,17 @@ func main() {
 	RootCmd.AddCommand(WriteCmd)
 	RootCmd.AddCommand(ReadCmd)
 	RootCmd.AddCommand(ConfigCmd)
+	RootCmd.AddCommand(ConnsCmd)
+	RootCmd.AddCommand(KillConnCmd)
+	RootCmd.AddCommand(HeadCmd)
+	RootCmd.AddCommand(HeadsCmd)
+	RootCmd.AddCommand(FormatCmd)
+	RootCmd.AddCommand(TopicInfoCmd)
+	RootCmd.AddCommand(PauseCmd)
+	RootCmd.AddCommand(ResumeCmd)
+	RootCmd.AddCommand(EraseCmd)
 	RootCmd.AddCommand(BenchCmd)
+	RootCmd.AddCommand(InfoCmd)
 	RootCmd.AddCommand(VersionCmd)
 
 	if err := RootCmd.Execute(); err != nil {
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var PauseCmd = &cobra.Command{
+	Use:   "pause [TOPIC]",
+	Short: "Stop a topic from accepting batches",
+	Long:  ``,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		var topic []byte
+		if len(args) > 0 {
+			topic = []byte(args[0])
+		}
+		if err := logd.New(tmpConfig).PauseTopic(topic); err != nil {
+			panic(err)
+		}
+	},
+}
+
+var ResumeCmd = &cobra.Command{
+	Use:   "resume [TOPIC]",
+	Short: "Allow a paused topic to accept batches",
+	Long:  ``,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		var topic []byte
+		if len(args) > 0 {
+			topic = []byte(args[0])
+		}
+		if err := logd.New(tmpConfig).ResumeTopic(topic); err != nil {
+			panic(err)
+		}
+	},
+}
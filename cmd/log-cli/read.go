@@ -19,6 +19,8 @@ func init() {
 
 	pflags.BoolVarP(&tmpConfig.ReadForever, "read-forever", "F", dconf.WriteForever, "Keep reading input until the program is killed")
 	pflags.StringVar(&topicFlag, "topic", "default", "a `TOPIC` for the read")
+	pflags.BoolVar(&tmpConfig.Compress, "compress", dconf.Compress, "ask the server to gzip batches in READ responses")
+	pflags.Uint64Var(&tmpConfig.MaxCatchUp, "max-catch-up", dconf.MaxCatchUp, "with --read-forever, fail if reading would start more than `BYTES` behind the head. checked by the client, not the server. 0 for no limit")
 
 	pflags.IntVar(&tmpConfig.ConnRetries, "retries", dconf.ConnRetries, "total number of connection retries")
 	pflags.DurationVar(&tmpConfig.ConnRetryInterval, "retry-interval", dconf.ConnRetryInterval, "initial retry interval duration")
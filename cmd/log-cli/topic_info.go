@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
+	"github.com/spf13/cobra"
+)
+
+var setPartitionSizeFlag int
+
+func init() {
+	pflags := TopicInfoCmd.PersistentFlags()
+	pflags.IntVar(&setPartitionSizeFlag, "set-partition-size", 0, "set the size of the topic's new partitions to `BYTES`")
+}
+
+var TopicInfoCmd = &cobra.Command{
+	Use:   "topic-info [TOPIC]",
+	Short: "Print a topic's settings, or set its partition size",
+	Long:  ``,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		var topic []byte
+		if len(args) > 0 {
+			topic = []byte(args[0])
+		}
+		c := logd.New(tmpConfig)
+		if setPartitionSizeFlag > 0 {
+			if err := c.SetTopicPartitionSize(topic, setPartitionSizeFlag); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		info, err := c.TopicInfo(topic)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("format: %s\npartition-size: %d\n", info.Format, info.PartitionSize)
+	},
+}
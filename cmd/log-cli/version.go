@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logd"
 	"github.com/spf13/cobra"
 )
 
@@ -17,3 +18,19 @@ var VersionCmd = &cobra.Command{
 		fmt.Println(internal.Version)
 	},
 }
+
+var InfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Print the server's version and uptime",
+	Long:  ``,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Debugf(tmpConfig.ToGeneralConfig(), "%+v", tmpConfig)
+		c := logd.New(tmpConfig)
+		info, err := c.Info()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("version: %s\ncommit: %s\nstarted: %s\nuptime: %s\n", info.Version, info.Commit, info.Started, info.Uptime)
+	},
+}
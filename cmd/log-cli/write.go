@@ -75,6 +75,9 @@ func doWrite(conf *logd.Config, c *cobra.Command, args []string) error {
 		m = logd.NewStateOutputter(out)
 	}
 
+	// messages are already copied out of the args and the scanner's buffer,
+	// so the writer can borrow them.
+	conf.CopyOnWrite = false
 	w := logd.NewWriter(conf, t).WithStateHandler(m)
 	defer w.Close()
 
@@ -129,5 +132,6 @@ func doWrite(conf *logd.Config, c *cobra.Command, args []string) error {
 		_, err := fmt.Fprintln(os.Stderr, counts)
 		internal.LogError(err)
 	}
-	return w.Flush()
+	_, _, err = w.Flush()
+	return err
 }
@@ -7,14 +7,13 @@ import (
 	"os/signal"
 	"runtime/pprof"
 	"runtime/trace"
-	"strings"
 	"syscall"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/events"
 	"github.com/jeffrom/logd/internal"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 )
 
 var cfgFile string
@@ -24,74 +23,137 @@ var traceFile = ""
 var cpuProfile = ""
 
 func init() {
-	cobra.OnInitialize(initConfig)
-	viper.SetEnvPrefix("logd")
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	// NOTE this doesn't work unless you viper.Get flags
-	viper.AutomaticEnv()
-
 	pflags := RootCmd.PersistentFlags()
-	pflags.StringVar(&cfgFile, "config", config.Default.File, "config `FILE`")
+	pflags.StringVar(&cfgFile, "config", config.Default.File, "YAML or JSON config `FILE`. defaults to logd.yml, logd.yaml, or logd.json in /etc/logd or the current directory. settings can also be set with LOGD_ environment variables, such as LOGD_PARTITION_SIZE. flags take precedence over both")
 
 	pflags.BoolVar(&version, "version", false, "print version")
 	pflags.BoolVarP(&tmpConfig.Verbose, "verbose", "v", config.Default.Verbose, "print debug output")
-	viper.BindPFlag("verbose", pflags.Lookup("verbose"))
 
 	pflags.StringVar(&tmpConfig.Host, "host", config.Default.Host, "a `HOST:PORT` combination for the tcp server to listen on")
-	viper.BindPFlag("host", pflags.Lookup("host"))
 
 	pflags.StringVar(&tmpConfig.HttpHost, "http-host", config.Default.HttpHost, "a `HOST:PORT` combination for the http server to listen on")
-	viper.BindPFlag("host", pflags.Lookup("host"))
+
+	pflags.StringVar(&tmpConfig.AdminHost, "admin-host", config.Default.AdminHost, "a `HOST:PORT` combination for the admin http server, serving health checks, stats, and profiling, to listen on. disabled if empty")
+
+	pflags.BoolVar(&tmpConfig.AdminProfiling, "admin-profiling", config.Default.AdminProfiling, "serve pprof profiles under /debug/pprof/ on the admin http server")
+
+	pflags.StringVar(&tmpConfig.NodeID, "node-id", config.Default.NodeID, "an `ID` identifying this server to clients. generated and stored in the workdir if empty")
+
+	pflags.StringVar(&tmpConfig.AuthSecret, "auth-secret", config.Default.AuthSecret, "a shared `SECRET` clients must authenticate with")
+
+	pflags.StringVar(&tmpConfig.AdminSecret, "admin-secret", config.Default.AdminSecret, "a shared `SECRET` clients authenticate with to use admin commands")
+
+	pflags.StringSliceVar(&tmpConfig.ACL, "acl", config.Default.ACL, "`PRINCIPAL:TOPIC:ACTIONS` rules granting read (r) and write (w) access to topics")
 
 	pflags.DurationVar(&tmpConfig.Timeout, "timeout", config.Default.Timeout, "duration to wait for requests to complete")
-	viper.BindPFlag("timeout", pflags.Lookup("timeout"))
 
 	pflags.DurationVar(&tmpConfig.IdleTimeout, "idle-timeout", config.Default.IdleTimeout, "duration to wait for idle connections to be closed")
-	viper.BindPFlag("idle-timeout", pflags.Lookup("idle-timeout"))
 
 	pflags.DurationVar(&tmpConfig.ShutdownTimeout, "shutdown-timeout", config.Default.ShutdownTimeout, "duration to wait for requests to complete while shutting down")
-	viper.BindPFlag("shutdown-timeout", pflags.Lookup("shutdown-timeout"))
 
+	pflags.DurationVar(&tmpConfig.WriteShutdownTimeout, "write-shutdown-timeout", config.Default.WriteShutdownTimeout, "duration to wait for non-read requests to complete while shutting down. 0 uses --shutdown-timeout")
+
+	pflags.DurationVar(&tmpConfig.ReaderShutdownTimeout, "reader-shutdown-timeout", config.Default.ReaderShutdownTimeout, "duration to wait for read responses to complete while shutting down. 0 uses --shutdown-timeout")
+
+	pflags.DurationVar(&tmpConfig.ReaderTimeout, "reader-timeout", config.Default.ReaderTimeout, "duration to wait for a client to receive a read response before disconnecting it. 0 uses --timeout")
+
+	pflags.IntVar(&tmpConfig.ConnFlushBytes, "conn-flush-bytes", config.Default.ConnFlushBytes, "number of response bytes a connection buffers while it has more responses ready to write. 0 flushes after every response")
+
+	pflags.DurationVar(&tmpConfig.ConnFlushInterval, "conn-flush-interval", config.Default.ConnFlushInterval, "longest a buffered response waits to be flushed. 0 for no limit")
+
+	pflags.BoolVar(&tmpConfig.LogUnknownCommands, "log-unknown-commands", config.Default.LogUnknownCommands, "log requests with unknown commands and the address that sent them")
+
+	pflags.BoolVar(&tmpConfig.ReportHeadroom, "report-headroom", config.Default.ReportHeadroom, "report how far reads are from the oldest retained offset in READ and HEAD responses")
+
+	pflags.StringVar(&tmpConfig.WorkDir, "work-dir", config.Default.WorkDir, "working directory")
 	pflags.StringVar(&tmpConfig.WorkDir, "workdir", config.Default.WorkDir, "working directory")
-	viper.BindPFlag("workdir", pflags.Lookup("workdir"))
+	internal.LogError(pflags.MarkDeprecated("workdir", "use --work-dir instead"))
 
 	pflags.IntVar(&tmpConfig.LogFileMode, "file-mode", config.Default.LogFileMode, "mode used for log files")
-	viper.BindPFlag("file-mode", pflags.Lookup("file-mode"))
 
 	pflags.IntVar(&tmpConfig.MaxBatchSize, "batch-size", config.Default.MaxBatchSize, "maximum size of batch in bytes")
-	viper.BindPFlag("batch-size", pflags.Lookup("batch-size"))
 
 	pflags.IntVar(&tmpConfig.PartitionSize, "partition-size", config.Default.PartitionSize, "maximum size of a partitions in bytes")
-	viper.BindPFlag("partition-size", pflags.Lookup("partition-size"))
 
 	pflags.IntVar(&tmpConfig.MaxPartitions, "partitions", config.Default.MaxPartitions, "maximum number of partitions per topic")
-	viper.BindPFlag("partitions", pflags.Lookup("partitions"))
 
 	pflags.IntVar(&tmpConfig.FlushBatches, "flush-batches", config.Default.FlushBatches, "number of batches to write before flushing")
-	viper.BindPFlag("flush-batches", pflags.Lookup("flush-batches"))
 
 	pflags.DurationVar(&tmpConfig.FlushInterval, "flush-interval", config.Default.FlushInterval, "amount of time to wait before flushing")
-	viper.BindPFlag("flush-interval", pflags.Lookup("flush-interval"))
+
+	pflags.DurationVar(&tmpConfig.MaxBufferAge, "max-buffer-age", config.Default.MaxBufferAge, "longest a write waits to be flushed to disk. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.MaxReadBytes, "max-read-bytes", config.Default.MaxReadBytes, "maximum size of a read response in bytes. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.MaxReadBatches, "max-read-batches", config.Default.MaxReadBatches, "maximum number of batches in a read response. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.MaxSubscriptions, "max-subscriptions", config.Default.MaxSubscriptions, "maximum number of read responses being sent at once across all topics. 0 for no limit")
+	pflags.IntVar(&tmpConfig.MaxReads, "max-reads", config.Default.MaxReads, "maximum number of READ responses being sent at once across all topics, not counting TAIL. 0 for no limit")
+	pflags.IntVar(&tmpConfig.MaxResponseReaders, "max-response-readers", config.Default.MaxResponseReaders, "maximum number of partition files a read response opens before it's sent. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.MaxTopics, "max-topics", config.Default.MaxTopics, "maximum number of topics. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.MaxTopicCreations, "max-topic-creations", config.Default.MaxTopicCreations, "maximum number of new topics set up at once. 0 for no limit")
+
+	pflags.Float64Var(&tmpConfig.AcceptRate, "accept-rate", config.Default.AcceptRate, "maximum number of new connections accepted per second. 0 for no limit")
+
+	pflags.IntVar(&tmpConfig.AcceptBurst, "accept-burst", config.Default.AcceptBurst, "number of connections that can be accepted at once before --accept-rate applies")
+
+	pflags.IntVar(&tmpConfig.ConnWorkers, "conn-workers", config.Default.ConnWorkers, "number of goroutines serving connections, each serving one connection at a time. 0 serves each connection in its own goroutine")
+
+	pflags.IntVar(&tmpConfig.ConnQueueSize, "conn-queue-size", config.Default.ConnQueueSize, "number of accepted connections that wait for a free --conn-workers worker before accepting pauses")
+
+	pflags.IntVar(&tmpConfig.PartitionFanout, "partition-fanout", config.Default.PartitionFanout, "number of partitions per topic subdirectory. 0 stores all partitions in the topic directory")
+
+	pflags.BoolVar(&tmpConfig.DiskFullRetention, "disk-full-retention", config.Default.DiskFullRetention, "remove a topic's oldest partitions when the disk is full instead of rejecting batches")
+
+	pflags.IntVar(&tmpConfig.QueueSize, "queue-size", config.Default.QueueSize, "number of requests buffered per topic before connections block")
+
+	pflags.DurationVar(&tmpConfig.QueueStopTimeout, "queue-stop-timeout", config.Default.QueueStopTimeout, "duration to wait for each topic's event queue to stop while shutting down")
+
+	pflags.StringSliceVar(&tmpConfig.CoalesceTopics, "coalesce-topics", config.Default.CoalesceTopics, "`TOPIC` patterns whose small batches are written to the log together")
+
+	pflags.IntVar(&tmpConfig.CoalesceSize, "coalesce-size", config.Default.CoalesceSize, "largest batch, in bytes, that --coalesce-topics write together")
+
+	pflags.DurationVar(&tmpConfig.CoalesceWait, "coalesce-wait", config.Default.CoalesceWait, "how long --coalesce-topics wait for more small batches before writing")
+
+	pflags.IntVar(&tmpConfig.CoalesceBatches, "coalesce-batches", config.Default.CoalesceBatches, "maximum number of batches --coalesce-topics write together")
+
+	pflags.StringVar(&tmpConfig.Checksum, "checksum", config.Default.Checksum, "crc32 polynomial for batch checksums, ieee or castagnoli. must match the polynomial the workdir was written with")
 
 	pflags.StringVar(&traceFile, "trace", "", "save execution trace data")
 	pflags.StringVar(&cpuProfile, "cpuprofile", "", "save cpu profiling data")
 }
 
-func initConfig() {
-	if tmpConfig.File != "" {
-		viper.SetConfigFile(tmpConfig.File)
-	} else {
-		viper.SetConfigName("logd")
-		viper.AddConfigPath("/etc/logd")
-		viper.AddConfigPath(".")
-	}
+// flagKeys maps flags to config keys where their names differ.
+var flagKeys = map[string]string{
+	"workdir":    "work-dir", // deprecated
+	"file-mode":  "log-file-mode",
+	"batch-size": "max-batch-size",
+	"partitions": "max-partitions",
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-			fmt.Println("failed to read config:", err)
-			os.Exit(1)
+// loadConfig loads the config file and LOGD_ environment variables, with the
+// flags that were set taking precedence.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	overrides := make(map[string]string)
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		switch f.Name {
+		case "config", "version", "trace", "cpuprofile":
+			return
+		}
+		key := f.Name
+		if k, ok := flagKeys[key]; ok {
+			key = k
 		}
+		overrides[key] = f.Value.String()
+	})
+
+	file := cfgFile
+	if file == "" {
+		file = config.FindFile()
 	}
+	return config.Load(file, os.Environ(), overrides)
 }
 
 // RootCmd is the only entry point for the logd application
@@ -125,7 +187,11 @@ var RootCmd = &cobra.Command{
 			defer pprof.StopCPUProfile()
 		}
 
-		conf := tmpConfig
+		conf, err := loadConfig(cmd)
+		if err != nil {
+			fmt.Println("invalid config:", err)
+			os.Exit(1)
+		}
 		h := events.NewHandlers(conf)
 
 		stopC := make(chan os.Signal, 1)
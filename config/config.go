@@ -14,12 +14,86 @@ type Config struct {
 	Host        string `json:"host"`
 	HttpHost    string `json:"http-host"`
 
+	// AdminHost is a HOST:PORT for the admin http server, which serves
+	// health checks, stats, and profiling. It listens apart from Host and
+	// HttpHost so it can be firewalled separately. It's disabled if it's
+	// empty.
+	AdminHost string `json:"admin-host"`
+
+	// AdminProfiling serves net/http/pprof profiles under /debug/pprof/ on
+	// the admin server. Profiles can be expensive to collect and reveal a lot
+	// about the process, so they're off unless enabled.
+	AdminProfiling bool `json:"admin-profiling"`
+
+	// NodeID identifies the server to reconnecting clients. If it's empty, an
+	// id is generated and stored in the work directory.
+	NodeID string `json:"node-id"`
+
+	// LogID identifies the log stored in the work directory. It's generated
+	// when the work directory is first used, and changes if the log is
+	// reset, so clients can tell their offsets are no longer valid.
+	LogID string `json:"-"`
+
+	// AuthSecret is a shared secret clients must send in an AUTH request
+	// before making other requests. If it's empty, authentication is
+	// disabled.
+	AuthSecret string `json:"auth-secret"`
+
+	// AdminSecret is a shared secret that authenticates a connection as the
+	// admin principal, which may list and close other connections. Admin
+	// commands are disabled if it's empty. It has no effect unless
+	// AuthSecret is set.
+	AdminSecret string `json:"admin-secret"`
+
+	// ACL is a list of rules of the form `principal:topic:actions` granting
+	// access to topics. principal and topic may be glob patterns, and actions
+	// is any combination of r (read) and w (write). If it's empty, all
+	// principals can read and write all topics.
+	ACL []string `json:"acl"`
+
 	// Timeout determines how long to wait during requests before closing the
 	// connection if the request hasn't completed.
 	Timeout         time.Duration `json:"timeout"`
 	IdleTimeout     time.Duration `json:"idle-timeout"`
 	ShutdownTimeout time.Duration `json:"shutdown-timeout"`
 
+	// WriteShutdownTimeout and ReaderShutdownTimeout bound how long shutdown
+	// waits for a connection to finish its current request. Connections
+	// sending a READ or TAIL response get ReaderShutdownTimeout, and
+	// connections handling any other request, such as a BATCH, get
+	// WriteShutdownTimeout. If either is 0, ShutdownTimeout is used.
+	WriteShutdownTimeout  time.Duration `json:"write-shutdown-timeout"`
+	ReaderShutdownTimeout time.Duration `json:"reader-shutdown-timeout"`
+
+	// ReaderTimeout bounds how long writing each part of a READ or TAIL
+	// response to a client can take before the client is disconnected, so
+	// a slow reader can't hold its connection open forever. If it's 0,
+	// Timeout is used.
+	ReaderTimeout time.Duration `json:"reader-timeout"`
+
+	// ConnFlushBytes lets connections buffer responses until this many bytes
+	// are waiting, instead of flushing after each one, which saves syscalls
+	// for clients that send many small requests without waiting, such as
+	// busy tails. Buffered responses are flushed as soon as a connection has
+	// no more responses ready to write, so a single read isn't delayed, or
+	// once they've waited ConnFlushInterval, if it's set. Reads too large to
+	// buffer are sent with sendfile as usual. 0 flushes after every
+	// response.
+	ConnFlushBytes    int           `json:"conn-flush-bytes"`
+	ConnFlushInterval time.Duration `json:"conn-flush-interval"`
+
+	// LogUnknownCommands logs each request with a command the server doesn't
+	// recognize, along with the remote address of the client that sent it.
+	// Unknown commands are answered with an error either way.
+	LogUnknownCommands bool `json:"log-unknown-commands"`
+
+	// ReportHeadroom adds the retention headroom to READ, READRANGE, and HEAD
+	// responses: how far the response's offset is past the oldest offset
+	// retention has kept, and when the oldest batch was written. The time
+	// isn't known for partitions started before the server was. Clients that
+	// predate it ignore it.
+	ReportHeadroom bool `json:"report-headroom"`
+
 	WorkDir       string        `json:"work-dir"`
 	LogFileMode   int           `json:"log-file-mode"`
 	MaxBatchSize  int           `json:"max-batch-size"`
@@ -27,8 +101,119 @@ type Config struct {
 	MaxPartitions int           `json:"max-partitions"`
 	FlushBatches  int           `json:"flush-batches"`
 	FlushInterval time.Duration `json:"flush-interval"`
+
+	// MaxBufferAge bounds how long a write waits to be flushed to disk.
+	// FlushBatches and FlushInterval are only checked when a batch is
+	// written, so when writes are sparse the last one could otherwise wait
+	// until the next. Once a write has waited this long, the topic's active
+	// partition is flushed. 0 means no limit.
+	MaxBufferAge time.Duration `json:"max-buffer-age"`
+
+	// MaxReadBytes and MaxReadBatches bound the size of a single READ
+	// response. A response is cut short at the last batch that fits, and
+	// clients continue reading from the offset after it. At least one batch
+	// is always returned. TAIL responses aren't limited. 0 means no limit.
+	MaxReadBytes   int `json:"max-read-bytes"`
+	MaxReadBatches int `json:"max-read-batches"`
+
+	// MaxSubscriptions bounds the number of READ and TAIL responses being
+	// sent to clients at once, across all topics. Reads past the limit are
+	// rejected. 0 means no limit.
+	MaxSubscriptions int `json:"max-subscriptions"`
+
+	// MaxReads bounds the number of READ and SREAD responses being sent at
+	// once, across all topics, so reads from old partitions can't starve
+	// writes of disk IO. TAIL responses don't count against it. Reads past
+	// the limit are rejected. 0 means no limit.
+	MaxReads int `json:"max-reads"`
+
+	// MaxResponseReaders bounds the number of partition files a READ, TAIL or
+	// READRANGE response opens before it starts being sent. The rest are
+	// opened as the response reaches them, so a read spanning many partitions
+	// doesn't hold all of their files open at once. A partition removed by
+	// retention before it's opened ends the response early, and the client
+	// reads again from where it left off. 0 means no limit.
+	MaxResponseReaders int `json:"max-response-readers"`
+
+	// MaxTopics bounds the number of topics. Requests that would create a
+	// new topic past the limit are rejected. Topics that already exist when
+	// the server starts are always loaded. 0 means no limit.
+	MaxTopics int `json:"max-topics"`
+
+	// MaxTopicCreations bounds how many new topics are set up at once, so a
+	// burst of writes to new topics doesn't open their files all together.
+	// Writes that would create another wait until one of the topics is
+	// ready. Writes to a topic that's already being created wait for it
+	// either way. 0 means no limit.
+	MaxTopicCreations int `json:"max-topic-creations"`
+
+	// AcceptRate limits how many new connections are accepted per second,
+	// with bursts of up to AcceptBurst connections. Connections past the
+	// limit wait in the listen backlog until they can be accepted. 0 means
+	// no limit.
+	AcceptRate  float64 `json:"accept-rate"`
+	AcceptBurst int     `json:"accept-burst"`
+
+	// ConnWorkers is the number of goroutines serving connections. Each
+	// worker serves one connection until it closes, so at most ConnWorkers
+	// connections are served at once, and accepted connections wait in a
+	// queue of ConnQueueSize until a worker is free. Accepting pauses while
+	// the queue is full. If it's 0, each connection is served by its own
+	// goroutine.
+	ConnWorkers   int `json:"conn-workers"`
+	ConnQueueSize int `json:"conn-queue-size"`
+
+	// PartitionFanout is the number of partitions stored in each subdirectory
+	// of a topic. If it's 0, all partitions are stored in the topic
+	// directory. Subdirectories cover PartitionFanout * PartitionSize
+	// offsets, so topics whose partition size has been set with SETPARTSIZE
+	// store more or fewer partitions in each.
+	PartitionFanout int `json:"partition-fanout"`
+
+	// DiskFullRetention removes a topic's oldest partitions when a batch
+	// can't be written because the disk is full, retrying the write after
+	// each one, instead of rejecting the batch. The head partition is never
+	// removed. Space held by partitions that are still being read isn't freed
+	// until the reads finish.
+	DiskFullRetention bool `json:"disk-full-retention"`
+
+	// QueueSize is the number of requests each topic's event queue buffers
+	// before connections pushing requests to it block. A larger queue
+	// absorbs bigger bursts of writes, but each queued request holds its
+	// batch in memory until it's handled. If it's 0, 1000 is used.
+	QueueSize int `json:"queue-size"`
+
+	// QueueStopTimeout bounds how long shutdown waits for each topic's event
+	// queue to finish the request it's handling. A queue that doesn't is
+	// stopped forcibly: requests waiting on it fail, and shutdown continues
+	// and reports the timeout. If it's 0, 500ms is used.
+	QueueStopTimeout time.Duration `json:"queue-stop-timeout"`
+
+	// CoalesceTopics lists the topics, as path.Match patterns, whose small
+	// batches are written to the log together. Batches of at most
+	// CoalesceSize bytes that arrive within CoalesceWait of each other are
+	// written at once, up to CoalesceBatches at a time, and each batch is
+	// responded to with its own offset once the write succeeds. This trades
+	// a little latency for throughput with clients that send many tiny
+	// batches. No topics are coalesced by default.
+	CoalesceTopics  []string      `json:"coalesce-topics"`
+	CoalesceSize    int           `json:"coalesce-size"`
+	CoalesceWait    time.Duration `json:"coalesce-wait"`
+	CoalesceBatches int           `json:"coalesce-batches"`
+
+	// Checksum is the crc32 polynomial batch checksums are calculated with,
+	// either ieee or castagnoli. Clients must use the same one. Every batch
+	// in a log is checked with the same polynomial, so the server won't
+	// start on a work directory that was written with a different one.
+	Checksum string `json:"checksum"`
 }
 
+// The crc32 polynomials batch checksums can be calculated with.
+const (
+	ChecksumIEEE       = "ieee"
+	ChecksumCastagnoli = "castagnoli"
+)
+
 // New returns a new configuration object
 func New() *Config {
 	return &Config{}
@@ -40,16 +225,46 @@ func (c *Config) String() string {
 
 // Default is the default application config
 var Default = &Config{
-	Host:            "localhost:1774",
-	HttpHost:        "localhost:1775",
-	Timeout:         10 * time.Second,
-	IdleTimeout:     30 * time.Second,
-	ShutdownTimeout: 15 * time.Second,
-	WorkDir:         "logs/",
-	LogFileMode:     0600,
-	MaxBatchSize:    1024 * 64,
-	PartitionSize:   1024 * 1024 * 2000,
-	MaxPartitions:   8,
-	FlushBatches:    0,
-	FlushInterval:   -1,
+	Host:                  "localhost:1774",
+	HttpHost:              "localhost:1775",
+	AdminHost:             "",
+	AdminProfiling:        false,
+	Timeout:               10 * time.Second,
+	IdleTimeout:           30 * time.Second,
+	ShutdownTimeout:       15 * time.Second,
+	WriteShutdownTimeout:  0,
+	ReaderShutdownTimeout: 0,
+	ReaderTimeout:         0,
+	ConnFlushBytes:        0,
+	ConnFlushInterval:     0,
+	LogUnknownCommands:    false,
+	ReportHeadroom:        false,
+	WorkDir:               "logs/",
+	LogFileMode:           0600,
+	MaxBatchSize:          1024 * 64,
+	PartitionSize:         1024 * 1024 * 2000,
+	MaxPartitions:         8,
+	FlushBatches:          0,
+	FlushInterval:         -1,
+	MaxBufferAge:          0,
+	MaxReadBytes:          1024 * 1024 * 32,
+	MaxReadBatches:        0,
+	MaxSubscriptions:      0,
+	MaxReads:              0,
+	MaxResponseReaders:    0,
+	MaxTopics:             0,
+	MaxTopicCreations:     0,
+	AcceptRate:            0,
+	AcceptBurst:           100,
+	ConnWorkers:           0,
+	ConnQueueSize:         1000,
+	PartitionFanout:       0,
+	DiskFullRetention:     false,
+	QueueSize:             1000,
+	QueueStopTimeout:      500 * time.Millisecond,
+	CoalesceTopics:        nil,
+	CoalesceSize:          1024,
+	CoalesceWait:          time.Millisecond,
+	CoalesceBatches:       64,
+	Checksum:              ChecksumIEEE,
 }
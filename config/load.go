@@ -0,0 +1,270 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the name of each environment variable that sets a config
+// value. The rest of the name is the setting's key in upper case, with dashes
+// replaced by underscores, so LOGD_PARTITION_SIZE sets partition-size.
+const EnvPrefix = "LOGD_"
+
+// Load builds a config from Default, overlaid by each of the following, in
+// order of increasing precedence:
+//
+// 1. file, which is YAML or JSON, if it isn't empty.
+//
+// 2. environ, a list of environment variables as returned by os.Environ.
+// Variables that don't start with EnvPrefix are ignored.
+//
+// 3. overrides, such as command line flags that were set explicitly.
+//
+// Keys in the file and overrides are the json tags of Config's fields, such
+// as partition-size. The result is validated before it's returned.
+func Load(file string, environ []string, overrides map[string]string) (*Config, error) {
+	conf := &Config{}
+	*conf = *Default
+	conf.ACL = append([]string(nil), Default.ACL...)
+	conf.CoalesceTopics = append([]string(nil), Default.CoalesceTopics...)
+
+	if file != "" {
+		if err := conf.loadFile(file); err != nil {
+			return nil, err
+		}
+		conf.File = file
+	}
+
+	if err := conf.loadEnv(environ); err != nil {
+		return nil, err
+	}
+
+	for key, value := range overrides {
+		if err := conf.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// SearchPaths are the directories searched, in order, for a config file when
+// none is given. See FindFile.
+var SearchPaths = []string{"/etc/logd", "."}
+
+// configExts are the extensions a config file found by FindFile can have.
+var configExts = []string{".yml", ".yaml", ".json"}
+
+// FindFile returns the first file named logd.yml, logd.yaml, or logd.json in
+// SearchPaths, or an empty string if there isn't one.
+func FindFile() string {
+	for _, dir := range SearchPaths {
+		for _, ext := range configExts {
+			p := filepath.Join(dir, "logd"+ext)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+func (c *Config) loadFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	for key, v := range m {
+		var value string
+		if l, ok := v.([]interface{}); ok {
+			parts := make([]string, len(l))
+			for i, part := range l {
+				parts[i] = fmt.Sprint(part)
+			}
+			value = strings.Join(parts, ",")
+		} else {
+			value = fmt.Sprint(v)
+		}
+
+		if err := c.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], EnvPrefix) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	for _, key := range Keys() {
+		name := EnvPrefix + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		if value, ok := env[name]; ok {
+			if err := c.Set(key, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys of all settings, in the order they're declared in
+// Config.
+func Keys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("json"); key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Set parses value and assigns it to the setting named key. Durations are
+// parsed with time.ParseDuration, and lists are separated by commas.
+func (c *Config) Set(key string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField() && key != "-"; i++ {
+		if t.Field(i).Tag.Get("json") != key {
+			continue
+		}
+		if err := setValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, key, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config setting %q", key)
+}
+
+func setValue(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case int:
+		// base 0 so modes can be written in octal, like 0600
+		n, err := strconv.ParseInt(value, 0, 0)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		// pflag formats lists as [a,b]
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		var l []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				l = append(l, s)
+			}
+		}
+		field.Set(reflect.ValueOf(l))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate returns an error if the config has settings that can't work
+// together.
+func (c *Config) Validate() error {
+	if c.WorkDir == "" {
+		return fmt.Errorf("work-dir must be set")
+	}
+	if c.PartitionSize <= 0 {
+		return fmt.Errorf("partition-size must be positive, got %d", c.PartitionSize)
+	}
+	if c.MaxBatchSize <= 0 || c.MaxBatchSize > c.PartitionSize {
+		return fmt.Errorf("max-batch-size must be between 1 and partition-size (%d), got %d", c.PartitionSize, c.MaxBatchSize)
+	}
+	// the oldest partition is removed when a new one is started, so there
+	// must be room for at least the head partition and one more.
+	if c.MaxPartitions < 2 {
+		return fmt.Errorf("max-partitions must be at least 2, got %d", c.MaxPartitions)
+	}
+	if c.Timeout < 0 || c.IdleTimeout < 0 || c.ShutdownTimeout < 0 || c.WriteShutdownTimeout < 0 ||
+		c.ReaderShutdownTimeout < 0 || c.ReaderTimeout < 0 || c.ConnFlushInterval < 0 ||
+		c.QueueStopTimeout < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if c.MaxBufferAge < 0 {
+		return fmt.Errorf("max-buffer-age can't be negative, got %s", c.MaxBufferAge)
+	}
+	if c.MaxResponseReaders < 0 {
+		return fmt.Errorf("max-response-readers can't be negative, got %d", c.MaxResponseReaders)
+	}
+	if c.ConnFlushBytes < 0 {
+		return fmt.Errorf("conn-flush-bytes can't be negative, got %d", c.ConnFlushBytes)
+	}
+	if c.AcceptRate < 0 {
+		return fmt.Errorf("accept-rate can't be negative, got %g", c.AcceptRate)
+	}
+	if c.AcceptRate > 0 && c.AcceptBurst < 1 {
+		return fmt.Errorf("accept-burst must be at least 1 when accept-rate is set, got %d", c.AcceptBurst)
+	}
+	if c.MaxTopicCreations < 0 {
+		return fmt.Errorf("max-topic-creations can't be negative, got %d", c.MaxTopicCreations)
+	}
+	if c.ConnWorkers < 0 {
+		return fmt.Errorf("conn-workers can't be negative, got %d", c.ConnWorkers)
+	}
+	if c.ConnQueueSize < 0 {
+		return fmt.Errorf("conn-queue-size can't be negative, got %d", c.ConnQueueSize)
+	}
+	for _, pat := range c.CoalesceTopics {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid coalesce-topics pattern %q: %v", pat, err)
+		}
+	}
+	if len(c.CoalesceTopics) > 0 && (c.CoalesceSize < 1 || c.CoalesceWait <= 0 || c.CoalesceBatches < 1) {
+		return fmt.Errorf("coalesce-size, coalesce-wait, and coalesce-batches must be positive when coalesce-topics is set")
+	}
+	if c.AdminSecret != "" && c.AuthSecret == "" {
+		return fmt.Errorf("admin-secret has no effect unless auth-secret is set")
+	}
+	if c.Checksum != ChecksumIEEE && c.Checksum != ChecksumCastagnoli {
+		return fmt.Errorf("checksum must be %s or %s, got %q", ChecksumIEEE, ChecksumCastagnoli, c.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, body string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "logd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "logd.yml")
+	if err := ioutil.WriteFile(p, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadDefault(t *testing.T) {
+	conf, err := Load("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf, Default) {
+		t.Fatalf("expected default config:\n\n\t%s\n\nbut got:\n\n\t%s", Default, conf)
+	}
+	if conf == Default {
+		t.Fatal("expected a copy of the default config")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `
+host: file:1774
+partition-size: 4096
+timeout: 5s
+acl:
+  - "*:*:r"
+  - "writer:logs:w"
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	environ := []string{
+		"LOGD_PARTITION_SIZE=8192",
+		"LOGD_LOG_FILE_MODE=0640",
+		"LOGD_MAX_BATCH_SIZE=1024",
+		"LOGD_UNRELATED=1",
+		"PARTITION_SIZE=1",
+	}
+	overrides := map[string]string{
+		"partition-size": "16384",
+		"verbose":        "true",
+	}
+
+	conf, err := Load(file, environ, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.File != file {
+		t.Errorf("expected file %q but got %q", file, conf.File)
+	}
+	if conf.Host != "file:1774" {
+		t.Errorf("expected host from file but got %q", conf.Host)
+	}
+	if conf.Timeout != 5*time.Second {
+		t.Errorf("expected timeout from file but got %s", conf.Timeout)
+	}
+	if expected := []string{"*:*:r", "writer:logs:w"}; !reflect.DeepEqual(conf.ACL, expected) {
+		t.Errorf("expected acl %q but got %q", expected, conf.ACL)
+	}
+	if conf.LogFileMode != 0640 || conf.MaxBatchSize != 1024 {
+		t.Errorf("expected log file mode and max batch size from env but got %o and %d", conf.LogFileMode, conf.MaxBatchSize)
+	}
+	if conf.PartitionSize != 16384 || !conf.Verbose {
+		t.Errorf("expected partition size and verbose from overrides but got %d and %t", conf.PartitionSize, conf.Verbose)
+	}
+	if conf.IdleTimeout != Default.IdleTimeout {
+		t.Errorf("expected default idle timeout but got %s", conf.IdleTimeout)
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	defer func(paths []string) { SearchPaths = paths }(SearchPaths)
+	empty, err := ioutil.TempDir("", "logd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	file := writeConfigFile(t, "partition-size: 2048\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	SearchPaths = []string{empty}
+	if found := FindFile(); found != "" {
+		t.Fatalf("expected no config file but found %s", found)
+	}
+
+	// earlier directories take precedence
+	SearchPaths = []string{empty, filepath.Dir(file), "."}
+	if found := FindFile(); found != file {
+		t.Fatalf("expected to find %s but found %q", file, found)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]struct {
+		environ   []string
+		overrides map[string]string
+		expected  string
+	}{
+		"unknown key": {
+			overrides: map[string]string{"nonexistent": "1"},
+			expected:  "unknown config setting",
+		},
+		"bad int": {
+			environ:  []string{"LOGD_PARTITION_SIZE=big"},
+			expected: "LOGD_PARTITION_SIZE",
+		},
+		"bad duration": {
+			overrides: map[string]string{"timeout": "10"},
+			expected:  "invalid value",
+		},
+		"one partition": {
+			overrides: map[string]string{"max-partitions": "1"},
+			expected:  "max-partitions",
+		},
+		"batch larger than partition": {
+			overrides: map[string]string{"partition-size": "100", "max-batch-size": "200"},
+			expected:  "max-batch-size",
+		},
+		"negative max buffer age": {
+			overrides: map[string]string{"max-buffer-age": "-1s"},
+			expected:  "max-buffer-age",
+		},
+		"negative response readers": {
+			overrides: map[string]string{"max-response-readers": "-1"},
+			expected:  "max-response-readers",
+		},
+		"accept rate without burst": {
+			overrides: map[string]string{"accept-rate": "10", "accept-burst": "0"},
+			expected:  "accept-burst",
+		},
+		"coalescing without a wait": {
+			overrides: map[string]string{"coalesce-topics": "logs", "coalesce-wait": "0s"},
+			expected:  "coalesce-wait",
+		},
+		"negative conn workers": {
+			overrides: map[string]string{"conn-workers": "-1"},
+			expected:  "conn-workers",
+		},
+		"admin secret without auth": {
+			environ:  []string{"LOGD_ADMIN_SECRET=secret"},
+			expected: "auth-secret",
+		},
+		"unknown checksum": {
+			overrides: map[string]string{"checksum": "crc64"},
+			expected:  "checksum",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load("", tt.environ, tt.overrides)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected error containing %q but got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestSetList(t *testing.T) {
+	conf := New()
+	// pflag formats lists with brackets
+	if err := conf.Set("acl", "[a:b:r,c:d:w]"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a:b:r", "c:d:w"}; !reflect.DeepEqual(conf.ACL, expected) {
+		t.Fatalf("expected acl %q but got %q", expected, conf.ACL)
+	}
+	if err := conf.Set("acl", "[]"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.ACL != nil {
+		t.Fatalf("expected empty acl but got %q", conf.ACL)
+	}
+}
@@ -0,0 +1,44 @@
+package events
+
+import (
+	"log"
+
+	"github.com/jeffrom/logd/protocol"
+)
+
+// OffsetAllocator assigns the offset of each batch written to a topic. head is
+// the topic's current write position, and size is the size of the batch,
+// including its envelope. It can be overridden when offsets are sequenced
+// externally, such as by a replication leader.
+//
+// Offsets are byte positions in the log, so a batch can only be written at the
+// head of the topic. Writes are rejected if the allocated offset doesn't match
+// it, which means the topic is out of sync with the allocator.
+type OffsetAllocator interface {
+	Allocate(topic string, head uint64, size int) (uint64, error)
+}
+
+// headAllocator implements OffsetAllocator, assigning each batch the current
+// head of the topic.
+type headAllocator struct{}
+
+func (a headAllocator) Allocate(topic string, head uint64, size int) (uint64, error) {
+	return head, nil
+}
+
+var defaultAllocator OffsetAllocator = headAllocator{}
+
+// allocate returns the offset for a batch written to the topic at head, which
+// is past the end of the log when earlier batches are waiting to be written
+// with it.
+func (q *eventQ) allocate(t *topic, head uint64, size int) (uint64, error) {
+	off, err := q.alloc.Allocate(t.name, head, size)
+	if err != nil {
+		return 0, err
+	}
+	if off != head {
+		log.Printf("allocated offset %d for topic %s, but head is at %d", off, t.name, head)
+		return 0, protocol.ErrInvalidOffset
+	}
+	return off, nil
+}
@@ -0,0 +1,131 @@
+package events
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jeffrom/logd/protocol"
+)
+
+// Action is an operation a principal performs on a topic.
+type Action int
+
+const (
+	// ActionRead is used for READ and TAIL requests. HEADS only lists the
+	// topics the principal may read.
+	ActionRead Action = 1 << iota
+
+	// ActionWrite is used for BATCH and DRYBATCH requests, as well as requests that
+	// change a topic, such as SETFORMAT and PAUSE.
+	ActionWrite
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRead:
+		return "read"
+	case ActionWrite:
+		return "write"
+	}
+	return fmt.Sprintf("<unknown action %d>", int(a))
+}
+
+var reqActions = map[protocol.CmdType]Action{
+	protocol.CmdBatch:       ActionWrite,
+	protocol.CmdRead:        ActionRead,
+	protocol.CmdTail:        ActionRead,
+	protocol.CmdHead:        ActionRead,
+	protocol.CmdSRead:       ActionRead,
+	protocol.CmdFormat:      ActionRead,
+	protocol.CmdSetFormat:   ActionWrite,
+	protocol.CmdPause:       ActionWrite,
+	protocol.CmdResume:      ActionWrite,
+	protocol.CmdTailOffset:  ActionRead,
+	protocol.CmdSync:        ActionRead,
+	protocol.CmdOffsetTime:  ActionRead,
+	protocol.CmdDryBatch:    ActionWrite,
+	protocol.CmdReadRange:   ActionRead,
+	protocol.CmdTopicInfo:   ActionRead,
+	protocol.CmdSetPartSize: ActionWrite,
+	protocol.CmdRestore:     ActionWrite,
+	protocol.CmdErase:       ActionWrite,
+	protocol.CmdHeads:       ActionRead,
+}
+
+// Authorizer decides whether a principal may perform an action on a topic.
+// The principal is empty when the connection hasn't authenticated.
+type Authorizer interface {
+	Authorize(principal string, topic string, action Action) error
+}
+
+type aclRule struct {
+	principal string
+	topic     string
+	actions   Action
+}
+
+// ACLAuthorizer implements Authorizer using a list of rules. A request is
+// allowed if any rule matching its principal and topic grants the action.
+type ACLAuthorizer struct {
+	rules []aclRule
+}
+
+// NewACLAuthorizer returns a new instance of *ACLAuthorizer. Each rule is of
+// the form `principal:topic:actions`, where principal and topic are glob
+// patterns as used by path.Match and actions contains r, w, or both.
+func NewACLAuthorizer(rules []string) (*ACLAuthorizer, error) {
+	a := &ACLAuthorizer{}
+	for _, s := range rules {
+		rule, err := parseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func parseACLRule(s string) (aclRule, error) {
+	var rule aclRule
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return rule, fmt.Errorf("invalid acl rule %q", s)
+	}
+
+	for _, pat := range parts[:2] {
+		if _, err := path.Match(pat, ""); err != nil {
+			return rule, fmt.Errorf("invalid acl rule %q: %v", s, err)
+		}
+	}
+	rule.principal = parts[0]
+	rule.topic = parts[1]
+
+	for _, c := range parts[2] {
+		switch c {
+		case 'r':
+			rule.actions |= ActionRead
+		case 'w':
+			rule.actions |= ActionWrite
+		default:
+			return rule, fmt.Errorf("invalid acl rule %q: unknown action %q", s, c)
+		}
+	}
+	return rule, nil
+}
+
+// Authorize implements Authorizer.
+func (a *ACLAuthorizer) Authorize(principal string, topic string, action Action) error {
+	for _, rule := range a.rules {
+		if rule.actions&action == 0 {
+			continue
+		}
+		if ok, _ := path.Match(rule.principal, principal); !ok {
+			continue
+		}
+		if ok, _ := path.Match(rule.topic, topic); ok {
+			return nil
+		}
+	}
+	return protocol.ErrPermissionDenied
+}
@@ -0,0 +1,229 @@
+package events
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
+)
+
+// coalescer gathers small batches for a topic listed in
+// config.CoalesceTopics, so they're written to the log at once. See
+// eventQ.coalesce.
+type coalescer struct {
+	buf     *bytes.Buffer // the batches waiting to be written, as they're logged
+	pending []coalescedBatch
+	batch   *protocol.Batch // each request's batch is parsed into batch
+	added   *protocol.Batch // describes each batch to partitions.addBatch
+
+	// staging is the request whose batch is being added to the buffer, so
+	// it's answered if adding it panics.
+	staging *protocol.Request
+}
+
+// coalescedBatch is a batch in the coalescer's buffer.
+type coalescedBatch struct {
+	req       *protocol.Request
+	offset    uint64
+	size      int
+	messages  int
+	timestamp int64
+}
+
+func newCoalescer(conf *config.Config) *coalescer {
+	return &coalescer{
+		buf:   &bytes.Buffer{},
+		batch: protocol.NewBatch(conf),
+		added: protocol.NewBatch(conf),
+	}
+}
+
+// coalesceTopic returns true if the topic's batches are coalesced.
+func coalesceTopic(conf *config.Config, name string) bool {
+	for _, pat := range conf.CoalesceTopics {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldCoalesce returns true if req is a batch small enough to be written
+// along with others.
+func (q *eventQ) shouldCoalesce(req *protocol.Request) bool {
+	return q.coalescer != nil && req.Name == protocol.CmdBatch && req.FullSize() <= q.conf.CoalesceSize
+}
+
+// coalesce handles first, and any more small batches that arrive within
+// config.CoalesceWait, up to config.CoalesceBatches, writing them to the log
+// at once. No batch is responded to until the write it's part of succeeds, so
+// each response still means the batch was written. If a request that can't be
+// coalesced ends the wait, it's returned to be handled next.
+func (q *eventQ) coalesce(first *protocol.Request) (next *protocol.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			stats.HandlerPanics.Add(1)
+			log.Printf("panic coalescing batches: %v\n%s", r, debug.Stack())
+			q.failCoalesced(protocol.ErrInternal)
+			if req := q.coalescer.staging; req != nil {
+				q.coalescer.staging = nil
+				q.respondCoalesced(req, protocol.ErrInternal)
+			}
+		}
+	}()
+
+	q.stageBatch(first)
+	timer := time.NewTimer(q.conf.CoalesceWait)
+	defer timer.Stop()
+
+	for n := 1; n < q.conf.CoalesceBatches; n++ {
+		var req *protocol.Request
+		select {
+		case req = <-q.in:
+		case <-timer.C:
+		}
+		if req == nil {
+			break
+		}
+		if !q.shouldCoalesce(req) {
+			next = req
+			break
+		}
+		q.stageBatch(req)
+	}
+
+	q.writeCoalesced()
+	return next
+}
+
+// stageBatch adds req's batch to the coalescer's buffer, responding right away
+// if it can't be written.
+func (q *eventQ) stageBatch(req *protocol.Request) {
+	c := q.coalescer
+	c.staging = req
+	q.doStageBatch(req)
+	c.staging = nil
+}
+
+func (q *eventQ) doStageBatch(req *protocol.Request) {
+	c := q.coalescer
+	c.batch.Reset()
+	batch, err := q.acceptBatch(req, c.batch)
+	if err == nil {
+		batch, err = q.encodeBatch(q.topic, batch)
+	}
+	if err != nil {
+		q.respondCoalesced(req, err)
+		return
+	}
+
+	topic := q.topic
+	size := q.batchBuf.Len()
+	if topic.parts.shouldRotate(c.buf.Len() + size) {
+		// the batch starts a new partition, so the batches before it are
+		// written to the old one first.
+		q.writeCoalesced()
+		if topic.parts.shouldRotate(size) {
+			if err := topic.logw.SetPartition(topic.parts.nextOffset()); err != nil {
+				q.respondCoalesced(req, err)
+				return
+			}
+		}
+	}
+
+	off, err := q.allocate(topic, topic.parts.nextOffset()+uint64(c.buf.Len()), size)
+	if err != nil {
+		q.respondCoalesced(req, err)
+		return
+	}
+	c.buf.Write(q.batchBuf.Bytes())
+	c.pending = append(c.pending, coalescedBatch{
+		req:       req,
+		offset:    off,
+		size:      size,
+		messages:  batch.Messages,
+		timestamp: batch.Timestamp,
+	})
+}
+
+// writeCoalesced writes the coalescer's buffer to the log, responding to each
+// batch in it. If the write fails, every batch in it fails.
+func (q *eventQ) writeCoalesced() {
+	c := q.coalescer
+	if len(c.pending) == 0 {
+		return
+	}
+	defer c.buf.Reset()
+
+	topic := q.topic
+	last := c.pending[len(c.pending)-1]
+	end := last.offset + uint64(last.size)
+	if err := q.writeBatch(topic, c.buf.Bytes()); err != nil {
+		q.failCoalesced(err)
+		return
+	}
+	if err := topic.hwm.SetHighWaterMark(end); err != nil {
+		q.failCoalesced(err)
+		return
+	}
+	for i := 1; i < len(c.pending); i++ {
+		q.flushState.incr()
+	}
+	if err := q.doFlush(end); err != nil {
+		q.failCoalesced(err)
+		return
+	}
+
+	pending := c.pending
+	c.pending = c.pending[:0]
+	for _, b := range pending {
+		c.added.Timestamp = b.timestamp
+		err := topic.parts.addBatch(c.added, b.size)
+		if err == nil {
+			stats.BatchesWritten.Add(1)
+			stats.BatchMessages.Add(int64(b.messages))
+			stats.BatchBytes.Add(int64(b.size))
+
+			cr := b.req.Response.ClientResponse
+			cr.SetOffset(b.offset)
+			cr.SetBatches(1)
+		}
+		q.respondCoalesced(b.req, err)
+	}
+	stats.CoalescedWrites.Add(1)
+	q.publishHead()
+}
+
+// failCoalesced responds to every batch in the coalescer's buffer with err.
+func (q *eventQ) failCoalesced(err error) {
+	c := q.coalescer
+	for _, b := range c.pending {
+		q.respondCoalesced(b.req, err)
+	}
+	c.pending = c.pending[:0]
+	c.buf.Reset()
+}
+
+// respondCoalesced responds to a coalesced batch request, with err if it
+// isn't nil.
+func (q *eventQ) respondCoalesced(req *protocol.Request, err error) {
+	resp := req.Response
+	if err == nil {
+		_, err = req.WriteResponse(resp, req.Response.ClientResponse)
+	}
+	if err != nil {
+		resp, err = errResponse(q.conf, req, resp, err)
+		if errors.Cause(err) != protocol.ErrNotFound {
+			log.Printf("error handling %s request: %+v", &req.Name, err)
+		}
+	}
+	instrumentRequest(req, stats.BatchRequests, stats.BatchErrors, err)
+	q.respond(req, resp)
+}
@@ -1,11 +1,19 @@
 package events
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	stderrors "errors"
 	"expvar"
 	"io"
 	"log"
+	"math"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,10 +33,19 @@ var errInvalidFormat = stderrors.New("Invalid command format")
 
 const defaultTopic = "default"
 
+// maxRangeMessages is the message limit used to gather READRANGE responses,
+// which are bounded by an offset instead.
+const maxRangeMessages = math.MaxInt32
+
 type flushState struct {
 	conf    *config.Config
 	batches int
 	timer   *time.Timer
+
+	// ageTimer fires once a write has waited config.MaxBufferAge to be
+	// flushed. aging is set while it's running.
+	ageTimer *time.Timer
+	aging    bool
 }
 
 func newFlushState(conf *config.Config) *flushState {
@@ -38,9 +55,43 @@ func newFlushState(conf *config.Config) *flushState {
 	if conf.FlushInterval > 0 {
 		s.timer = time.NewTimer(conf.FlushInterval)
 	}
+	if conf.MaxBufferAge > 0 {
+		s.ageTimer = time.NewTimer(conf.MaxBufferAge)
+		s.ageTimer.Stop()
+	}
 	return s
 }
 
+// startAging starts the age timer for a write that wasn't flushed, unless an
+// earlier one is already waiting.
+func (s *flushState) startAging() {
+	if s.ageTimer == nil || s.aging {
+		return
+	}
+	s.ageTimer.Reset(s.conf.MaxBufferAge)
+	s.aging = true
+}
+
+// stopAging stops the age timer once the log has been flushed.
+func (s *flushState) stopAging() {
+	if !s.aging {
+		return
+	}
+	if !s.ageTimer.Stop() {
+		<-s.ageTimer.C
+	}
+	s.aging = false
+}
+
+// aged returns a channel that receives once the oldest write that hasn't been
+// flushed has waited config.MaxBufferAge, or nil if there isn't one.
+func (s *flushState) aged() <-chan time.Time {
+	if !s.aging {
+		return nil
+	}
+	return s.ageTimer.C
+}
+
 func (s *flushState) incr() {
 	if s.conf.FlushBatches > 0 {
 		s.batches++
@@ -70,34 +121,73 @@ func (s *flushState) shouldFlush() bool {
 	return false
 }
 
+// defaultQueueSize is the event queue size used when config.QueueSize isn't
+// set.
+const defaultQueueSize = 1000
+
+// defaultQueueStopTimeout is used when config.QueueStopTimeout isn't set.
+const defaultQueueStopTimeout = 500 * time.Millisecond
+
+// ErrStopTimeout is returned when an event queue doesn't stop within
+// config.QueueStopTimeout, and to requests waiting on it when it's stopped
+// forcibly.
+var ErrStopTimeout = stderrors.New("event queue failed to stop in time")
+
+// now returns the current time. It can be replaced in tests.
+var now = time.Now
+
 // eventQ synchronizes access to the log.
 type eventQ struct {
 	conf         *config.Config
 	in           chan *protocol.Request
 	stopC        chan error
 	shutdownC    chan error
+	killC        chan struct{} // closed when the queue is stopped forcibly
+	killOnce     sync.Once
 	topic        *topic
 	partArgBuf   *partitionArgList
 	batchScanner *protocol.BatchScanner
 	Stats        *internal.Stats
 	tmpBatch     *protocol.Batch
+	batchBuf     *bytes.Buffer
 	flushState   *flushState
 	confResp     *protocol.ConfigResponse
+	alloc        OffsetAllocator
+	paused       bool   // batches are rejected while set
+	durable      uint64 // the log has been synced to disk up to here
+	head         uint64 // published head offset, read atomically by HEADS
+	handling     int64  // unix nanoseconds the handled request was queued, or 0. read atomically
+
+	// intercepted batches are rebuilt in interceptBatch, with each message
+	// read into interceptMsg first
+	interceptor    MessageInterceptor
+	interceptBatch *protocol.Batch
+	interceptMsg   *protocol.Message
+
+	coalescer *coalescer // set if the topic's small batches are coalesced
 }
 
 // newEventQ creates a new instance of an EventQ
 func newEventQ(conf *config.Config) *eventQ {
+	size := conf.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
 	q := &eventQ{
 		conf:         conf,
 		Stats:        internal.NewStats(),
-		in:           make(chan *protocol.Request, 1000),
+		in:           make(chan *protocol.Request, size),
 		stopC:        make(chan error),
 		shutdownC:    make(chan error, 1),
+		killC:        make(chan struct{}),
 		partArgBuf:   newPartitionArgList(conf), // partition arguments buffer
 		batchScanner: protocol.NewBatchScanner(conf, nil),
 		tmpBatch:     protocol.NewBatch(conf),
+		batchBuf:     &bytes.Buffer{},
 		flushState:   newFlushState(conf),
 		confResp:     protocol.NewConfigResponse(conf),
+		alloc:        defaultAllocator,
 	}
 
 	return q
@@ -105,10 +195,27 @@ func newEventQ(conf *config.Config) *eventQ {
 
 func (q *eventQ) setTopic(t *topic) {
 	q.topic = t
+	q.coalescer = nil
+	if t != nil && coalesceTopic(q.conf, t.name) {
+		q.coalescer = newCoalescer(q.conf)
+	}
+}
+
+func (q *eventQ) setAllocator(alloc OffsetAllocator) {
+	q.alloc = alloc
+}
+
+func (q *eventQ) setInterceptor(i MessageInterceptor) {
+	q.interceptor = i
+	if i != nil && q.interceptBatch == nil {
+		q.interceptBatch = protocol.NewBatch(q.conf)
+		q.interceptMsg = protocol.NewMessage(q.conf)
+	}
 }
 
 // GoStart begins handling messages
 func (q *eventQ) GoStart() error {
+	q.publishHead()
 	go q.loop()
 	return nil
 }
@@ -140,28 +247,142 @@ func (q *eventQ) drainShutdownC() {
 
 func (q *eventQ) loop() { // nolint: gocyclo
 	q.drainShutdownC()
+	stats.RegisterQueue(q)
 	defer func() {
+		stats.UnregisterQueue(q)
+		// the paused state isn't kept when the queue stops
+		if q.paused {
+			q.paused = false
+			stats.PausedTopics.Add(-1)
+		}
+		// Handlers.Stop leaves the topic of a queue stopped forcibly open
+		// while the handler might still be using it
+		if q.killed() && q.topic != nil {
+			internal.LogError(errors.Wrapf(q.topic.Shutdown(), "shutting down topic %s", q.topic.name))
+		}
 		q.shutdownC <- nil
 	}()
 
 	for {
 		internal.Debugf(q.conf, "waiting for event")
+		if q.killed() {
+			return
+		}
 
 		select {
 		// new flow for handling requests passed in from servers
 		case req := <-q.in:
-			resp, err := q.handleRequest(req)
+			q.setHandling(req)
+			if q.shouldCoalesce(req) {
+				if req = q.coalesce(req); req == nil {
+					q.setHandling(nil)
+					continue
+				}
+				q.setHandling(req)
+			}
+			resp, err := q.safeHandleRequest(req)
+			q.publishHead()
 
-			if err != nil && err != protocol.ErrNotFound {
+			if err != nil && errors.Cause(err) != protocol.ErrNotFound {
 				log.Printf("error handling %s request: %+v", &req.Name, err)
 			}
-			req.Respond(resp)
+			q.setHandling(nil)
+			q.respond(req, resp)
+		case <-q.flushState.aged():
+			q.flushState.aging = false
+			q.flushAged()
 		case <-q.stopC:
 			return
+		case <-q.killC:
+			return
 		}
 	}
 }
 
+// respond passes resp to the PushRequest waiting for it. If the queue has
+// been stopped forcibly, PushRequest has already returned, so nothing is.
+func (q *eventQ) respond(req *protocol.Request, resp *protocol.Response) {
+	select {
+	case req.Responded() <- resp:
+	case <-q.killC:
+	}
+}
+
+// setHandling records when the request being handled was queued, for the
+// queue stats. It's called with nil once the request has been responded to.
+func (q *eventQ) setHandling(req *protocol.Request) {
+	var t int64
+	if req != nil {
+		t = req.Queued.UnixNano()
+	}
+	atomic.StoreInt64(&q.handling, t)
+}
+
+// Depth implements stats.Queue.
+func (q *eventQ) Depth() int {
+	return len(q.in)
+}
+
+// Handling implements stats.Queue.
+func (q *eventQ) Handling() time.Time {
+	t := atomic.LoadInt64(&q.handling)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// drainIn takes the requests left on a queue that's been stopped forcibly off
+// it, so they're no longer counted as queued.
+func (q *eventQ) drainIn() {
+	for {
+		select {
+		case <-q.in:
+		default:
+			return
+		}
+	}
+}
+
+// killed returns true if the queue has been stopped forcibly.
+func (q *eventQ) killed() bool {
+	select {
+	case <-q.killC:
+		return true
+	default:
+		return false
+	}
+}
+
+// publishHead makes the topic's head offset available to other goroutines.
+// The head only changes while the queue handles a request, so it's published
+// after each one.
+func (q *eventQ) publishHead() {
+	if q.topic != nil {
+		atomic.StoreUint64(&q.head, q.topic.parts.headOffset())
+	}
+}
+
+// Head returns the topic's head offset as of the last request the queue
+// handled.
+func (q *eventQ) Head() uint64 {
+	return atomic.LoadUint64(&q.head)
+}
+
+// safeHandleRequest handles req, recovering from any panic so the topic's
+// queue keeps running. The client gets ErrInternal for the request that
+// panicked.
+func (q *eventQ) safeHandleRequest(req *protocol.Request) (resp *protocol.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stats.HandlerPanics.Add(1)
+			log.Printf("panic handling %s request: %v\n%s", &req.Name, r, debug.Stack())
+			resp, err = errResponse(q.conf, req, req.Response, protocol.ErrInternal)
+		}
+	}()
+	return q.handleRequest(req)
+}
+
 // TODO maybe conns can just run this in their goroutine for nonblocking requests
 func (q *eventQ) handleRequest(req *protocol.Request) (*protocol.Response, error) {
 	var resp *protocol.Response
@@ -169,24 +390,60 @@ func (q *eventQ) handleRequest(req *protocol.Request) (*protocol.Response, error
 	internal.Debugf(q.conf, "request: %s", &req.Name)
 
 	switch req.Name {
-	case protocol.CmdBatch:
+	case protocol.CmdBatch, protocol.CmdDryBatch:
 		resp, err = q.handleBatch(req)
-		instrumentRequest(stats.BatchRequests, stats.BatchErrors, err)
-	case protocol.CmdRead:
+		instrumentRequest(req, stats.BatchRequests, stats.BatchErrors, err)
+	case protocol.CmdRestore:
+		resp, err = q.handleRestore(req)
+		instrumentRequest(req, stats.BatchRequests, stats.BatchErrors, err)
+	case protocol.CmdErase:
+		resp, err = q.handleErase(req)
+		instrumentRequest(req, stats.EraseRequests, stats.EraseErrors, err)
+	case protocol.CmdRead, protocol.CmdSRead:
 		resp, err = q.handleRead(req)
-		instrumentRequest(stats.ReadRequests, stats.ReadErrors, err)
+		instrumentRequest(req, stats.ReadRequests, stats.ReadErrors, err)
+	case protocol.CmdReadRange:
+		resp, err = q.handleReadRange(req)
+		instrumentRequest(req, stats.ReadRequests, stats.ReadErrors, err)
 	case protocol.CmdTail:
 		resp, err = q.handleTail(req)
-		instrumentRequest(stats.TailRequests, stats.TailErrors, err)
+		instrumentRequest(req, stats.TailRequests, stats.TailErrors, err)
+	case protocol.CmdHead:
+		resp, err = q.handleHead(req)
+		instrumentRequest(req, stats.HeadRequests, stats.HeadErrors, err)
+	case protocol.CmdTailOffset:
+		resp, err = q.handleTailOffset(req)
+		instrumentRequest(req, stats.TailOffsetRequests, stats.TailOffsetErrors, err)
+	case protocol.CmdSync:
+		resp, err = q.handleSync(req)
+		instrumentRequest(req, stats.SyncRequests, stats.SyncErrors, err)
+	case protocol.CmdOffsetTime:
+		resp, err = q.handleOffsetTime(req)
+		instrumentRequest(req, stats.OffsetTimeRequests, stats.OffsetTimeErrors, err)
+	case protocol.CmdFormat:
+		resp, err = q.handleFormat(req)
+		instrumentRequest(req, stats.FormatRequests, stats.FormatErrors, err)
+	case protocol.CmdSetFormat:
+		resp, err = q.handleSetFormat(req)
+		instrumentRequest(req, stats.FormatRequests, stats.FormatErrors, err)
+	case protocol.CmdTopicInfo:
+		resp, err = q.handleTopicInfo(req)
+		instrumentRequest(req, stats.TopicRequests, stats.TopicErrors, err)
+	case protocol.CmdSetPartSize:
+		resp, err = q.handleSetPartSize(req)
+		instrumentRequest(req, stats.TopicRequests, stats.TopicErrors, err)
+	case protocol.CmdPause, protocol.CmdResume:
+		resp, err = q.handlePause(req)
+		instrumentRequest(req, stats.PauseRequests, stats.PauseErrors, err)
 	case protocol.CmdStats:
 		resp, err = q.handleStats(req)
-		instrumentRequest(stats.StatsRequests, stats.StatsErrors, err)
+		instrumentRequest(req, stats.StatsRequests, stats.StatsErrors, err)
 	case protocol.CmdClose:
 		resp, err = q.handleClose(req)
-		instrumentRequest(stats.CloseRequests, stats.CloseErrors, err)
+		instrumentRequest(req, stats.CloseRequests, stats.CloseErrors, err)
 	case protocol.CmdConfig:
 		resp, err = q.handleConfig(req)
-		instrumentRequest(stats.ConfigRequests, stats.ConfigErrors, err)
+		instrumentRequest(req, stats.ConfigRequests, stats.ConfigErrors, err)
 	default:
 		log.Printf("unhandled request type passed: %v", req.Name)
 		resp = req.Response
@@ -201,24 +458,124 @@ func (q *eventQ) handleRequest(req *protocol.Request) (*protocol.Response, error
 	return resp, err
 }
 
-// Stop halts the event queue
+// Stop halts the event queue, waiting up to config.QueueStopTimeout for it to
+// finish the request it's handling. If it doesn't, the queue is stopped
+// forcibly and ErrStopTimeout is returned. Requests waiting on it, including
+// the one being handled, fail with ErrStopTimeout, and its loop exits once the
+// handler returns.
 func (q *eventQ) Stop() error {
-	var err error
+	timeout := q.conf.QueueStopTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueStopTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
 	select {
-	case q.stopC <- err:
-	case <-time.After(500 * time.Millisecond):
-		log.Printf("event queue failed to stop properly")
-		return errors.New("shutdown failed")
+	case q.stopC <- nil:
+		return nil
+	case <-q.killC:
+		return ErrStopTimeout
+	case <-timer.C:
 	}
 
-	return nil
+	// the loop is stuck handling a request. stop waiting for it: requests
+	// waiting on the queue fail, and the loop exits once the handler returns.
+	log.Printf("event queue failed to stop after %s, stopping it forcibly", timeout)
+	q.killOnce.Do(func() { close(q.killC) })
+	q.drainIn()
+	return ErrStopTimeout
 }
 
 func (q *eventQ) handleBatch(req *protocol.Request) (*protocol.Response, error) {
 	resp := req.Response
 	q.tmpBatch.Reset()
-	batch, err := q.tmpBatch.FromRequest(req)
+	batch, err := q.acceptBatch(req, q.tmpBatch)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if batch.DryRun {
+		// the interceptor may reject the batch, but nothing is written or
+		// allocated for a dry run.
+		if q.interceptor != nil {
+			if _, err := q.intercept(topic, batch); err != nil {
+				return errResponse(q.conf, req, resp, err)
+			}
+		}
+		return q.dryRunResponse(req, resp, topic)
+	}
+	batch, err = q.encodeBatch(topic, batch)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	size := q.batchBuf.Len()
+
+	respOffset, err := q.allocate(topic, topic.parts.nextOffset(), size)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	if err := q.appendBatch(topic, batch, respOffset); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	// respond
+	cr := req.Response.ClientResponse
+	cr.SetOffset(respOffset)
+	cr.SetBatches(1)
+	_, err = req.WriteResponse(resp, cr)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	return resp, nil
+}
+
+// acceptBatch parses req's batch into b, checking the topic will accept it.
+func (q *eventQ) acceptBatch(req *protocol.Request, b *protocol.Batch) (*protocol.Batch, error) {
+	batch, err := b.FromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if q.topic == nil {
+		return nil, protocol.ErrNotFound
+	}
+	if q.paused {
+		return nil, protocol.NewRespError(protocol.ErrTopicPaused, "topic %q is not accepting batches", q.topic.name)
+	}
+	return batch, nil
+}
+
+// encodeBatch passes batch to the MessageInterceptor, if there is one, and
+// writes the result to q.batchBuf as it's stored in the log. The batch that
+// was written is returned.
+func (q *eventQ) encodeBatch(topic *topic, batch *protocol.Batch) (*protocol.Batch, error) {
+	if q.interceptor != nil {
+		var err error
+		batch, err = q.intercept(topic, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// stamp the batch with the time it was received, which is stored in its
+	// envelope in the log.
+	batch.Timestamp = now().UnixNano()
+	q.batchBuf.Reset()
+	if _, err := batch.WriteTo(q.batchBuf); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// handleRestore writes a batch at the offset the client supplies, keeping its
+// timestamp, so a restored log has the same offsets as the one it was read
+// from. The offset must be the head of the topic, or any offset if the topic
+// is empty, in which case a new partition is started there.
+func (q *eventQ) handleRestore(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	restore, err := protocol.NewRestore(q.conf).FromRequest(req)
 	if err != nil {
 		return errResponse(q.conf, req, resp, err)
 	}
@@ -227,52 +584,286 @@ func (q *eventQ) handleBatch(req *protocol.Request) (*protocol.Response, error)
 	if topic == nil {
 		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
 	}
+	if q.paused {
+		return errResponse(q.conf, req, resp, protocol.NewRespError(protocol.ErrTopicPaused, "topic %q is not accepting batches", topic.name))
+	}
+
+	head := topic.parts.nextOffset()
+	if restore.Offset != head {
+		if topic.parts.bytes > 0 || restore.Offset < head {
+			return errResponse(q.conf, req, resp, protocol.NewRespError(protocol.ErrInvalidOffset, "restore offset %d is not the head of the topic (%d)", restore.Offset, head))
+		}
+		if err := q.startPartition(topic, restore.Offset); err != nil {
+			return errResponse(q.conf, req, resp, err)
+		}
+	}
+
+	q.batchBuf.Reset()
+	if _, err := restore.Batch.WriteTo(q.batchBuf); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	if err := q.appendBatch(topic, restore.Batch, restore.Offset); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(restore.Offset)
+	cr.SetBatches(1)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleErase overwrites the batches starting in the requested range with
+// erased batches of the same size, so the offsets of the batches around them
+// don't change. The response offset is the start of the range, and the number
+// of batches is how many were erased.
+func (q *eventQ) handleErase(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	erasereq, err := protocol.NewErase(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	// the batches are read back from the partition files
+	if err := q.sync(topic.parts.nextOffset()); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	n, err := q.eraseBatches(topic, erasereq.Start, erasereq.End)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	if n == 0 {
+		return errResponse(q.conf, req, resp, protocol.NewRespError(protocol.ErrNotFound, "no batches in %s between %d and %d", topic.name, erasereq.Start, erasereq.End))
+	}
+	stats.BatchesErased.Add(int64(n))
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(erasereq.Start)
+	cr.SetBatches(n)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// eraseBatches erases the batches starting from start up to end, returning
+// how many were erased.
+func (q *eventQ) eraseBatches(topic *topic, start, end uint64) (int, error) {
+	parts, err := topic.logp.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var erased int
+	for _, part := range parts {
+		partOff := part.Offset()
+		if partOff >= end {
+			break
+		}
+		if partOff+uint64(part.Size()) <= start {
+			continue
+		}
+
+		n, err := q.erasePartition(topic, partOff, start, end)
+		erased += n
+		if err != nil {
+			return erased, err
+		}
+	}
+	return erased, nil
+}
+
+// erasePartition erases the batches in a partition starting from start up to
+// end. The batches are overwritten once the partition has been read.
+func (q *eventQ) erasePartition(topic *topic, partOff uint64, start, end uint64) (int, error) {
+	r, err := topic.logrp.Data(partOff)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	batch := protocol.NewBatch(q.conf)
+	var positions []int64
+	var erased [][]byte
+	var pos int64
+	for {
+		off := partOff + uint64(pos)
+		if off >= end {
+			break
+		}
+		batch.Reset()
+		n, err := batch.ReadFrom(br)
+		if err == io.EOF && n == 0 {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if off >= start {
+			b, err := protocol.ErasedBatch(batch, int(n))
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to erase batch at %d", off)
+			}
+			positions = append(positions, pos)
+			erased = append(erased, b)
+		}
+		pos += n
+	}
+
+	for i, b := range erased {
+		if err := topic.logrp.Overwrite(partOff, positions[i], b); err != nil {
+			return i, err
+		}
+	}
+	return len(erased), nil
+}
+
+// startPartition starts an empty topic's log at off, as checkHighWaterMark
+// does for logs that end early.
+func (q *eventQ) startPartition(topic *topic, off uint64) error {
+	if err := topic.parts.add(off, 0); err != nil {
+		return err
+	}
+	if err := topic.logw.SetPartition(off); err != nil {
+		return err
+	}
+	// the high water mark is recorded so the log isn't started at an earlier
+	// offset after a restart.
+	return topic.hwm.SetHighWaterMark(off)
+}
+
+// appendBatch writes the batch in q.batchBuf to the head of the topic at off,
+// rotating partitions if needed.
+func (q *eventQ) appendBatch(topic *topic, batch *protocol.Batch, off uint64) error {
+	size := q.batchBuf.Len()
 
 	// set next write partition if needed
-	if topic.parts.shouldRotate(req.FullSize()) {
+	if topic.parts.shouldRotate(size) {
 		nextStartOffset := topic.parts.nextOffset()
 		if sperr := topic.logw.SetPartition(nextStartOffset); sperr != nil {
-			return errResponse(q.conf, req, resp, sperr)
+			return sperr
 		}
 	}
 	// write the log
-	_, err = topic.logw.Write(req.Bytes())
-	if err != nil {
-		return errResponse(q.conf, req, resp, err)
+	if err := q.writeBatch(topic, q.batchBuf.Bytes()); err != nil {
+		return err
+	}
+
+	// the offset is handed out once we respond, so record the end of the
+	// batch first. it's flushed along with the log.
+	if herr := topic.hwm.SetHighWaterMark(off + uint64(size)); herr != nil {
+		return herr
 	}
 
 	// maybe flush
-	if ferr := q.doFlush(); ferr != nil {
-		return errResponse(q.conf, req, resp, ferr)
+	if ferr := q.doFlush(off + uint64(size)); ferr != nil {
+		return ferr
 	}
 
 	// update log state
-	respOffset := topic.parts.nextOffset()
-	if aerr := topic.parts.addBatch(batch, req.FullSize()); aerr != nil {
-		return errResponse(q.conf, req, resp, aerr)
+	if aerr := topic.parts.addBatch(batch, size); aerr != nil {
+		return aerr
 	}
+	stats.BatchesWritten.Add(1)
+	stats.BatchMessages.Add(int64(batch.Messages))
+	stats.BatchBytes.Add(int64(size))
+	return nil
+}
 
-	// respond
+// writeBatch writes a batch to the topic's log, returning ErrDiskFull if
+// there's no space for it. If conf.DiskFullRetention is set, the topic's
+// oldest partitions are removed until the write succeeds or only the head
+// partition is left.
+func (q *eventQ) writeBatch(topic *topic, b []byte) error {
+	for {
+		_, err := topic.logw.Write(b)
+		if !stderrors.Is(err, syscall.ENOSPC) {
+			return err
+		}
+		stats.DiskFullErrors.Add(1)
+		if !q.conf.DiskFullRetention {
+			return protocol.ErrDiskFull
+		}
+
+		oldest := topic.parts.oldestOffset()
+		ok, rerr := topic.parts.removeOldest()
+		if rerr != nil {
+			return rerr
+		}
+		if !ok {
+			return protocol.ErrDiskFull
+		}
+		log.Printf("disk full: removed partition %s/%d", topic.name, oldest)
+		stats.DiskFullRetentions.Add(1)
+	}
+}
+
+// dryRunResponse responds to a DRYBATCH that would have been accepted with the
+// offset it would have been written at. The offset isn't allocated, so a
+// later batch may be written there instead.
+func (q *eventQ) dryRunResponse(req *protocol.Request, resp *protocol.Response, topic *topic) (*protocol.Response, error) {
 	cr := req.Response.ClientResponse
-	cr.SetOffset(respOffset)
-	cr.SetBatches(1)
-	_, err = req.WriteResponse(resp, cr)
-	if err != nil {
+	cr.SetOffset(topic.parts.nextOffset())
+	cr.SetBatches(0)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
 		return errResponse(q.conf, req, resp, err)
 	}
-
 	return resp, nil
 }
 
-func (q *eventQ) doFlush() error {
+// doFlush syncs the log if the flush policy calls for it. end is the end of
+// the batch that was just written.
+func (q *eventQ) doFlush(end uint64) error {
 	q.flushState.incr()
 	if q.flushState.shouldFlush() {
-		internal.Debugf(q.conf, "flushing topic %s", q.topic.name)
-		if err := q.topic.logw.Flush(); err != nil {
+		if err := q.sync(end); err != nil {
 			return err
 		}
 	}
 	q.flushState.update()
+	if q.durable < end {
+		q.flushState.startAging()
+	}
+	return nil
+}
+
+// flushAged syncs the log once a write has waited config.MaxBufferAge to be
+// flushed.
+func (q *eventQ) flushAged() {
+	if q.topic == nil {
+		return
+	}
+	head := q.topic.parts.nextOffset()
+	if q.durable >= head {
+		return
+	}
+	if err := q.sync(head); err != nil {
+		log.Printf("error flushing topic %s: %+v", q.topic.name, err)
+		return
+	}
+	stats.AgedFlushes.Add(1)
+}
+
+// sync flushes the log and high water mark to disk. end is the topic's head.
+func (q *eventQ) sync(end uint64) error {
+	internal.Debugf(q.conf, "flushing topic %s", q.topic.name)
+	if err := q.topic.logw.Flush(); err != nil {
+		return err
+	}
+	if err := q.topic.hwm.Flush(); err != nil {
+		return err
+	}
+	q.durable = end
+	q.flushState.stopAging()
 	return nil
 }
 
@@ -288,7 +879,7 @@ func (q *eventQ) handleRead(req *protocol.Request) (*protocol.Response, error) {
 		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
 	}
 
-	partArgs, err := q.gatherReadArgs(topic, readreq.Offset, readreq.Messages)
+	partArgs, err := q.gatherReadArgs(topic, readreq.Offset, readreq.Messages, 0, true)
 	if err != nil {
 		// fmt.Println("gatherReadArgs error:", err)
 
@@ -296,34 +887,116 @@ func (q *eventQ) handleRead(req *protocol.Request) (*protocol.Response, error) {
 		// is requested (which happens often when reading forever), we get
 		// io.ErrUnexpectedEOF
 		if err == io.ErrUnexpectedEOF {
-			return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+			err = protocol.ErrNotFound
 		}
-		return errResponse(q.conf, req, resp, err)
+		return errResponse(q.conf, req, resp, offsetError(topic, readreq.Offset, err))
 	}
 
 	// respond OK
 	cr := req.Response.ClientResponse
 	cr.SetOffset(readreq.Offset)
 	cr.SetBatches(partArgs.nbatches)
+	cr.SetStream(readreq.Stream)
+	q.setHeadroom(cr, topic, readreq.Offset)
 	_, err = req.WriteResponse(resp, cr)
 	if err != nil {
 		return errResponse(q.conf, req, resp, err)
 	}
 
 	// respond with the batch(es)
+	if err := q.addReadArgs(topic, resp, partArgs); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleReadRange handles READRANGE requests. The end of the range is clamped
+// to the head, and reading stops at the end instead of after a number of
+// messages. The client finds the end of the range that was served from the
+// batches in the response.
+func (q *eventQ) handleReadRange(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	rangereq, err := protocol.NewReadRange(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	// like READ, there's nothing to read from the head, so the range would
+	// be empty.
+	head := topic.parts.headOffset()
+	if rangereq.Start >= head {
+		return errResponse(q.conf, req, resp, offsetError(topic, rangereq.Start, protocol.ErrNotFound))
+	}
+	limit := rangereq.Limit()
+	if limit > head {
+		limit = head
+	}
+
+	partArgs, err := q.gatherReadArgs(topic, rangereq.Start, maxRangeMessages, limit, true)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = protocol.ErrNotFound
+		}
+		return errResponse(q.conf, req, resp, offsetError(topic, rangereq.Start, err))
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(rangereq.Start)
+	cr.SetBatches(partArgs.nbatches)
+	q.setHeadroom(cr, topic, rangereq.Start)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	if err := q.addReadArgs(topic, resp, partArgs); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// addReadArgs adds a reader to resp for each partition section in partArgs.
+// Past config.MaxResponseReaders, partitions are opened as the response is
+// sent instead, and are held until then so retention can't delete them first.
+func (q *eventQ) addReadArgs(topic *topic, resp *protocol.Response, partArgs *partitionArgList) error {
 	for i := 0; i < partArgs.nparts; i++ {
 		args := partArgs.parts[i]
-		p, gerr := topic.parts.logp.Get(args.offset, args.delta, args.limit)
-		if gerr != nil {
-			return errResponse(q.conf, req, resp, gerr)
+		if q.conf.MaxResponseReaders > 0 && i >= q.conf.MaxResponseReaders {
+			// partArgs is reused by the next read, so the section is copied
+			release := topic.parts.logp.Hold(args.offset)
+			if err := resp.AddReaderFunc(partitionOpener(topic, *args), release); err != nil {
+				release()
+				return err
+			}
+			continue
 		}
 
-		if aerr := resp.AddReader(p); aerr != nil {
-			return errResponse(q.conf, req, resp, aerr)
+		p, err := topic.parts.logp.Get(args.offset, args.delta, args.limit)
+		if err != nil {
+			return err
+		}
+
+		if err := resp.AddReader(p); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return resp, nil
+// partitionOpener returns a function that opens the partition section in args.
+func partitionOpener(topic *topic, args partitionArgs) func() (io.ReadCloser, error) {
+	logp := topic.parts.logp
+	return func() (io.ReadCloser, error) {
+		p, err := logp.Get(args.offset, args.delta, args.limit)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
 }
 
 func (q *eventQ) handleTail(req *protocol.Request) (*protocol.Response, error) {
@@ -340,11 +1013,11 @@ func (q *eventQ) handleTail(req *protocol.Request) (*protocol.Response, error) {
 
 	firstPart := topic.parts.parts[0]
 	if firstPart.size <= 0 {
-		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+		return errResponse(q.conf, req, resp, protocol.NewRespError(protocol.ErrNotFound, "topic %s is empty", topic.name))
 	}
 	off := firstPart.startOffset
 
-	partArgs, err := q.gatherReadArgs(topic, off, tailreq.Messages)
+	partArgs, err := q.gatherReadArgs(topic, off, tailreq.Messages, 0, false)
 	if err != nil {
 		return errResponse(q.conf, req, resp, err)
 	}
@@ -373,10 +1046,21 @@ func (q *eventQ) handleTail(req *protocol.Request) (*protocol.Response, error) {
 	return resp, nil
 }
 
-func (q *eventQ) handleStats(req *protocol.Request) (*protocol.Response, error) {
+func (q *eventQ) handleHead(req *protocol.Request) (*protocol.Response, error) {
 	resp := req.Response
+	if _, err := protocol.NewHead(q.conf).FromRequest(req); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
 	cr := req.Response.ClientResponse
-	cr.SetMultiResp(stats.MultiOK())
+	cr.SetOffset(topic.parts.headOffset())
+	cr.SetBatches(0)
+	q.setHeadroom(cr, topic, topic.parts.headOffset())
 	_, err := req.WriteResponse(resp, cr)
 	if err != nil {
 		return errResponse(q.conf, req, resp, err)
@@ -384,6 +1068,300 @@ func (q *eventQ) handleStats(req *protocol.Request) (*protocol.Response, error)
 	return resp, nil
 }
 
+// setHeadroom reports how far off is past the oldest offset retention has kept,
+// so consumers can tell when they're close to having batches removed before
+// they've read them. See config.ReportHeadroom.
+func (q *eventQ) setHeadroom(cr *protocol.ClientResponse, topic *topic, off uint64) {
+	if !q.conf.ReportHeadroom {
+		return
+	}
+	var headroom uint64
+	if oldest := topic.parts.oldestOffset(); off > oldest {
+		headroom = off - oldest
+	}
+	cr.SetHeadroom(headroom, topic.parts.oldestTimestamp())
+}
+
+func (q *eventQ) handleTailOffset(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	if _, err := protocol.NewTailOffset(q.conf).FromRequest(req); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(topic.parts.oldestOffset())
+	cr.SetBatches(0)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleSync responds once the batch at the requested offset has been synced
+// to disk. If the flush policy hasn't synced it yet, the log is synced
+// immediately rather than waiting for the policy. The response offset is how
+// far the log has been synced.
+func (q *eventQ) handleSync(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	syncreq, err := protocol.NewSync(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	head := topic.parts.nextOffset()
+	if syncreq.Offset >= head {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+	if syncreq.Offset >= q.durable {
+		if err := q.sync(head); err != nil {
+			return errResponse(q.conf, req, resp, err)
+		}
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(q.durable)
+	cr.SetBatches(0)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleOffsetTime responds with the timestamp in the envelope of the batch at
+// the requested offset. Only the envelope is read. Batches logged before
+// timestamps were stored respond with 0.
+func (q *eventQ) handleOffsetTime(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	otreq, err := protocol.NewOffsetTime(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	off := otreq.Offset
+	if off < topic.parts.oldestOffset() || off >= topic.parts.headOffset() {
+		return errResponse(q.conf, req, resp, offsetError(topic, off, protocol.ErrNotFound))
+	}
+	soff, delta, err := topic.parts.lookup(off)
+	if err != nil {
+		return errResponse(q.conf, req, resp, offsetError(topic, off, err))
+	}
+	p, err := topic.parts.logp.Get(soff, delta, 0)
+	if err != nil {
+		return errResponse(q.conf, req, resp, offsetError(topic, off, err))
+	}
+	defer p.Close()
+
+	batch := protocol.NewBatch(q.conf)
+	if _, err := batch.ReadEnvelope(bufio.NewReader(p)); err != nil {
+		if err == io.EOF {
+			err = protocol.ErrNotFound
+		} else {
+			err = errors.Wrap(protocol.ErrInvalidOffset, err.Error())
+		}
+		return errResponse(q.conf, req, resp, offsetError(topic, off, err))
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(uint64(batch.Timestamp))
+	cr.SetBatches(0)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (q *eventQ) handleFormat(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	if _, err := protocol.NewFormat(q.conf).FromRequest(req); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	format, err := topic.fmt.Format()
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetMultiResp([]byte(format))
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (q *eventQ) handleSetFormat(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	setreq, err := protocol.NewSetFormat(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	if err := topic.fmt.SetFormat(setreq.Format()); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOK()
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (q *eventQ) handleTopicInfo(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	if _, err := protocol.NewTopicInfo(q.conf).FromRequest(req); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	info := protocol.NewTopicInfoResponse(q.conf)
+	format, err := topic.fmt.Format()
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	info.Format = format
+	info.PartitionSize = topic.parts.partSize
+
+	cr := req.Response.ClientResponse
+	cr.SetMultiResp(info.MultiResponse())
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleSetPartSize sets the size the topic's partitions are rotated at. A
+// head partition that's been written to keeps the size it was created with,
+// so the new size applies once the topic rotates.
+func (q *eventQ) handleSetPartSize(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	setreq, err := protocol.NewSetPartSize(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	if setreq.Size < q.conf.MaxBatchSize {
+		return errResponse(q.conf, req, resp, protocol.NewRespError(protocol.ErrInvalid, "partition size must be at least max-batch-size (%d)", q.conf.MaxBatchSize))
+	}
+
+	topic := q.topic
+	if topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	if err := topic.psize.SetPartitionSize(setreq.Size); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	topic.parts.setPartSize(setreq.Size)
+
+	cr := req.Response.ClientResponse
+	cr.SetOK()
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (q *eventQ) handlePause(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	pausereq, err := protocol.NewPause(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	if q.topic == nil {
+		return errResponse(q.conf, req, resp, protocol.ErrNotFound)
+	}
+
+	paused := !pausereq.Resume
+	if paused != q.paused {
+		q.paused = paused
+		if paused {
+			log.Printf("pausing topic %s", q.topic.name)
+			stats.PausedTopics.Add(1)
+		} else {
+			log.Printf("resuming topic %s", q.topic.name)
+			stats.PausedTopics.Add(-1)
+		}
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOK()
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (q *eventQ) handleStats(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	cr := req.Response.ClientResponse
+	statsreq, err := protocol.NewStatsRequest(q.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+
+	body := stats.MultiOK()
+	if len(statsreq.Encoding()) > 0 {
+		body, err = gzipStats(body)
+		if err != nil {
+			return errResponse(q.conf, req, resp, err)
+		}
+		cr.SetEncoding(statsreq.Encoding())
+	}
+	cr.SetMultiResp(body)
+	_, err = req.WriteResponse(resp, cr)
+	if err != nil {
+		return errResponse(q.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// gzipStats compresses a STATS response body. Only gzip is accepted by
+// StatsRequest.Validate.
+func gzipStats(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	stats.CompressionBytesIn.Add(int64(len(body)))
+	stats.CompressionBytesOut.Add(int64(buf.Len()))
+	return buf.Bytes(), nil
+}
+
 func (q *eventQ) handleClose(req *protocol.Request) (*protocol.Response, error) {
 	resp := req.Response
 	cr := req.Response.ClientResponse
@@ -406,7 +1384,10 @@ func (q *eventQ) handleConfig(req *protocol.Request) (*protocol.Response, error)
 	return resp, nil
 }
 
-func (q *eventQ) gatherReadArgs(topic *topic, offset uint64, messages int) (*partitionArgList, error) {
+// gatherReadArgs collects the partition sections to respond with. If end is
+// set, only batches starting before it are included. If capped is true, the
+// response is limited by MaxReadBytes and MaxReadBatches.
+func (q *eventQ) gatherReadArgs(topic *topic, offset uint64, messages int, end uint64, capped bool) (*partitionArgList, error) {
 	soff, delta, err := topic.parts.lookup(offset)
 	// fmt.Printf("%v\ngatherReadArgs: offset: %d, partition: %d, delta: %d, err: %v\n", topic.parts, offset, soff, delta, err)
 	if err != nil {
@@ -416,6 +1397,7 @@ func (q *eventQ) gatherReadArgs(topic *topic, offset uint64, messages int) (*par
 	q.partArgBuf.reset()
 	scanner := q.batchScanner
 	n := 0
+	read := 0
 	currstart := soff
 Loop:
 	for n < messages {
@@ -432,7 +1414,24 @@ Loop:
 		defer p.Close()
 
 		scanner.Reset(p)
+		scanned := 0
 		for scanner.Scan() {
+			if end > 0 && currstart+uint64(delta+scanned) >= end {
+				if scanned > 0 {
+					q.partArgBuf.add(currstart, delta, scanned)
+				}
+				break Loop
+			}
+			size := scanner.Scanned() - scanned
+			if capped && q.readFull(q.partArgBuf.nbatches, read+size) {
+				if scanned > 0 {
+					q.partArgBuf.add(currstart, delta, scanned)
+				}
+				break Loop
+			}
+			scanned = scanner.Scanned()
+			read += size
+
 			q.partArgBuf.nbatches++
 			b := scanner.Batch()
 			n += b.Messages
@@ -451,6 +1450,9 @@ Loop:
 			q.partArgBuf.add(currstart, delta, p.Size()-delta)
 			currstart = p.Offset() + uint64(p.Size())
 			delta = 0
+			if end > 0 && currstart >= end {
+				break
+			}
 			// fmt.Println("next part", currstart, q.partArgBuf.parts[:q.partArgBuf.nparts])
 		} else if serr == io.EOF {
 			return nil, io.ErrUnexpectedEOF
@@ -462,6 +1464,18 @@ Loop:
 	return q.partArgBuf, nil
 }
 
+// readFull returns true if a read response with nbatches batches can't include
+// another batch, bringing its size to size bytes.
+func (q *eventQ) readFull(nbatches int, size int) bool {
+	if nbatches < 1 {
+		return false
+	}
+	if q.conf.MaxReadBatches > 0 && nbatches >= q.conf.MaxReadBatches {
+		return true
+	}
+	return q.conf.MaxReadBytes > 0 && size > q.conf.MaxReadBytes
+}
+
 // handleShutdown handles a shutdown request
 func (q *eventQ) handleShutdown() error {
 	// check if shutdown command is allowed and wait to finish any outstanding
@@ -473,20 +1487,44 @@ func (q *eventQ) handleShutdown() error {
 // PushRequest adds a request event to the queue, and waits for a response.
 // Called by server conn goroutines.
 func (q *eventQ) PushRequest(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if q.killed() {
+		return nil, ErrStopTimeout
+	}
+	req.Queued = time.Now()
 	select {
 	case q.in <- req:
+	case <-q.killC:
+		return nil, ErrStopTimeout
 	case <-ctx.Done():
 		internal.Debugf(q.conf, "request %s cancelled", req)
-		return nil, errors.New("request cancelled")
+		stats.CommandError(req.Name.String(), protocol.ErrorCategory(ctx.Err()))
+		return nil, errors.Wrap(ctx.Err(), "request cancelled")
 	}
 
 	select {
 	case resp := <-req.Responded():
 		return resp, nil
+	case <-q.killC:
+		// req may have been queued after Stop drained the queue
+		q.drainIn()
+		return nil, ErrStopTimeout
 	case <-ctx.Done():
 		internal.Debugf(q.conf, "request %s cancelled while waiting for a response", req)
-		return nil, errors.New("request cancelled")
+		stats.CommandError(req.Name.String(), protocol.ErrorCategory(ctx.Err()))
+		return nil, errors.Wrap(ctx.Err(), "request cancelled")
+	}
+}
+
+// offsetError describes a failed read from offset in topic.
+func offsetError(topic *topic, off uint64, err error) error {
+	switch errors.Cause(err) {
+	case protocol.ErrNotFound:
+		return protocol.NewRespError(protocol.ErrNotFound, "offset %d not found, oldest is %d and head is %d",
+			off, topic.parts.oldestOffset(), topic.parts.headOffset())
+	case protocol.ErrInvalidOffset:
+		return protocol.NewRespError(protocol.ErrInvalidOffset, "offset %d is not the start of a batch", off)
 	}
+	return err
 }
 
 func errResponse(conf *config.Config, req *protocol.Request, resp *protocol.Response, err error) (*protocol.Response, error) {
@@ -498,10 +1536,11 @@ func errResponse(conf *config.Config, req *protocol.Request, resp *protocol.Resp
 	return resp, err
 }
 
-func instrumentRequest(stat *expvar.Int, errStat *expvar.Int, err error) {
+func instrumentRequest(req *protocol.Request, stat *expvar.Int, errStat *expvar.Int, err error) {
 	stats.TotalRequests.Add(1)
 	if err != nil {
 		errStat.Add(1)
+		stats.CommandError(req.Name.String(), protocol.ErrorCategory(err))
 	} else {
 		stat.Add(1)
 	}
@@ -4,17 +4,32 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"reflect"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/logger"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 	"github.com/jeffrom/logd/testhelper"
+	"github.com/jeffrom/logd/transport"
 )
 
 func init() {
@@ -22,6 +37,27 @@ func init() {
 	// testhelper module.
 	flag.BoolVar(&testhelper.Golden, "golden", false, "write the golden file for this module")
 	flag.Parse()
+
+	now = func() time.Time { return testTime }
+}
+
+// testTime is the time batches are stamped with when they're written.
+var testTime = time.Unix(1500000000, 0)
+
+// logged returns the fixture batch as it's written to the log.
+func logged(t testing.TB, conf *config.Config, fixture []byte) []byte {
+	t.Helper()
+	batch := protocol.NewBatch(conf)
+	if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	batch.Timestamp = testTime.UnixNano()
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return b.Bytes()
 }
 
 func startHandlerConfig(t testing.TB, conf *config.Config) *Handlers {
@@ -129,8 +165,9 @@ func testHandlerFileLogger(t *testing.T, conf *config.Config) {
 	defer doShutdownHandler(t, h)
 
 	fixture := testhelper.LoadFixture("batch.small")
-	writesPerPartition := conf.PartitionSize / len(fixture)
-	n, interval := partitionIterations(conf, len(fixture))
+	size := len(logged(t, conf, fixture))
+	writesPerPartition := conf.PartitionSize / size
+	n, interval := partitionIterations(conf, size)
 	var offs []uint64
 
 	for i := 0; i < n; i += interval {
@@ -163,7 +200,7 @@ func addReadRespEnvelope(off uint64, batches int, b []byte) []byte {
 func checkBatch(t *testing.T, h *Handlers, fixture []byte, off uint64, batches int) {
 	t.Helper()
 	respb := pushRead(t, h, off, 3)
-	expect := addReadRespEnvelope(off, batches, fixture)
+	expect := addReadRespEnvelope(off, batches, logged(t, h.conf, fixture))
 	if !bytes.Equal(respb, expect) {
 		log.Panicf("expected (%d):\n\t%q\nbut got\n\t%q", off, expect, respb)
 		// t.Fatalf("expected (%d):\n\t%q\nbut got\n\t%q", off, fixture, respb)
@@ -175,6 +212,7 @@ func checkReadMultipleBatches(t *testing.T, h *Handlers, fixture []byte, offs []
 	if len(offs) <= 1 {
 		return
 	}
+	size := len(logged(t, h.conf, fixture))
 	for i, off := range offs {
 		left := len(offs) - i
 		if left <= 1 {
@@ -185,7 +223,7 @@ func checkReadMultipleBatches(t *testing.T, h *Handlers, fixture []byte, offs []
 		for j := 0; j < 3; j++ {
 			respb := pushRead(t, h, off, remainingMessages-j)
 			envelope := []byte(fmt.Sprintf("OK %d %d\r\n", off, (remainingMessages-j)/3))
-			if len(respb)-len(envelope) != len(fixture)*left {
+			if len(respb)-len(envelope) != size*left {
 				t.Logf("failed attempt at READ('default', %d, %d), expected %d remaining batches. Log location: %s", off, remainingMessages, left, h.conf.WorkDir)
 				log.Panicf("expected (%d):\n\t(%dx)%q\nbut got\n\t%q", off, left, fixture, respb)
 			}
@@ -220,6 +258,123 @@ func TestPartitionRemoval(t *testing.T) {
 	}
 }
 
+func TestPartitionStats(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	partitionsBefore := stats.Partitions.Value()
+	bytesBefore := stats.PartitionBytes.Value()
+	rotationsBefore := stats.PartitionRotations.Value()
+	deletedBefore := stats.PartitionsDeleted.Value()
+	reclaimedBefore := stats.BytesReclaimed.Value()
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < conf.MaxPartitions*2; i++ {
+		fillPartition(t, h)
+	}
+
+	parts, err := topic.parts.logp.List()
+	if err != nil {
+		t.Fatalf("unexpected failure listing partitions: %+v", err)
+	}
+	var size int64
+	for _, part := range parts {
+		size += int64(part.Size())
+	}
+
+	if n := stats.Partitions.Value() - partitionsBefore; n != int64(len(parts)) {
+		t.Errorf("expected partition count %d but got %d", len(parts), n)
+	}
+	if n := stats.PartitionBytes.Value() - bytesBefore; n != size {
+		t.Errorf("expected partition bytes %d but got %d", size, n)
+	}
+	if n := stats.PartitionRotations.Value() - rotationsBefore; n < int64(conf.MaxPartitions) {
+		t.Errorf("expected at least %d rotations but got %d", conf.MaxPartitions, n)
+	}
+	if n := stats.PartitionsDeleted.Value() - deletedBefore; n < 1 {
+		t.Errorf("expected deleted partitions but got %d", n)
+	}
+	if n := stats.BytesReclaimed.Value() - reclaimedBefore; n < 1 {
+		t.Errorf("expected reclaimed bytes but got %d", n)
+	}
+}
+
+func TestBatchStats(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	batchesBefore := stats.BatchesWritten.Value()
+	messagesBefore := stats.BatchMessages.Value()
+	bytesBefore := stats.BatchBytes.Value()
+
+	fixture := testhelper.LoadFixture("batch.small")
+	batch := protocol.NewBatch(conf)
+	if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pushBatch(t, h, fixture)
+	pushBatch(t, h, fixture)
+
+	if n := stats.BatchesWritten.Value() - batchesBefore; n != 2 {
+		t.Errorf("expected 2 batches written but got %d", n)
+	}
+	if n := stats.BatchMessages.Value() - messagesBefore; n != int64(2*batch.Messages) {
+		t.Errorf("expected %d messages but got %d", 2*batch.Messages, n)
+	}
+	if n := stats.BatchBytes.Value() - bytesBefore; n != int64(2*len(logged(t, conf, fixture))) {
+		t.Errorf("expected %d bytes but got %d", 2*len(logged(t, conf, fixture)), n)
+	}
+
+	if b := stats.MultiOK(); !bytes.Contains(b, []byte("batches.avg_messages: ")) {
+		t.Errorf("expected stats to include average messages per batch but got %q", b)
+	}
+}
+
+func TestCommandErrorStats(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	readsBefore := commandErrors("read.not_found")
+	diskBefore := commandErrors("batch.disk")
+
+	off := pushBatch(t, h, fixture).Offset()
+	checkNotFound(t, conf, pushRead(t, h, off+1000, 1))
+
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.logw = &fullDiskWriter{LogWriter: topic.logw, fails: 1}
+	if cr := pushRequest(t, h, string(fixture)); cr.Error() != protocol.ErrDiskFull {
+		t.Fatalf("expected %v but got %v", protocol.ErrDiskFull, cr.Error())
+	}
+
+	if n := commandErrors("read.not_found") - readsBefore; n != 1 {
+		t.Errorf("expected 1 read not found error but got %d", n)
+	}
+	if n := commandErrors("batch.disk") - diskBefore; n != 1 {
+		t.Errorf("expected 1 batch disk error but got %d", n)
+	}
+	if b := stats.MultiOK(); !bytes.Contains(b, []byte(`"read.not_found": `)) {
+		t.Errorf("expected stats to include errors by command but got %q", b)
+	}
+}
+
+func commandErrors(key string) int64 {
+	if v, ok := stats.CommandErrors.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
 func TestReadNotFound(t *testing.T) {
 	conf := testhelper.DefaultConfig(testing.Verbose())
 	h := NewHandlers(conf)
@@ -367,11 +522,12 @@ func fillPartition(t testing.TB, h *Handlers) []uint64 {
 	t.Helper()
 	var offs []uint64
 	fixture := testhelper.LoadFixture("batch.small")
+	size := len(logged(t, h.conf, fixture))
 	n := 0
-	for n+len(fixture) < h.conf.PartitionSize {
+	for n+size < h.conf.PartitionSize {
 		cr := pushBatch(t, h, fixture)
 		offs = append(offs, cr.Offset())
-		n += len(fixture)
+		n += size
 	}
 	return offs
 }
@@ -416,3 +572,1604 @@ func partitionIterations(conf *config.Config, fixtureLen int) (int, int) {
 	}
 	return n, interval
 }
+
+func TestAuthorization(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ACL = []string{"writer:default:rw", "reader:*:r"}
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	writerCtx := transport.WithPrincipal(context.Background(), "writer")
+	readerCtx := transport.WithPrincipal(context.Background(), "reader")
+
+	resp, err := h.PushRequest(writerCtx, newRequest(t, conf, fixture))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cr := checkBatchResp(t, conf, resp); cr.Error() != nil {
+		t.Fatalf("unexpected error writing batch: %+v", cr.Error())
+	}
+
+	resp, err = h.PushRequest(readerCtx, newRequest(t, conf, fixture))
+	if errors.Cause(err) != protocol.ErrPermissionDenied {
+		t.Fatalf("expected %v but got %+v", protocol.ErrPermissionDenied, err)
+	}
+	cr := checkBatchResp(t, conf, resp)
+	if errors.Cause(cr.Error()) != protocol.ErrPermissionDenied {
+		t.Fatalf("expected response error %v but got %+v", protocol.ErrPermissionDenied, cr.Error())
+	}
+	if msg := `"reader" may not write topic "default"`; !strings.HasSuffix(cr.Error().Error(), msg) {
+		t.Fatalf("expected response error to end with %s but got %q", msg, cr.Error())
+	}
+
+	for _, ctx := range []context.Context{writerCtx, readerCtx} {
+		req := newRequest(t, conf, []byte("READ default 0 3\r\n"))
+		resp, err := h.PushRequest(ctx, req)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if b := checkReadResp(t, conf, resp); !bytes.HasPrefix(b, []byte("OK")) {
+			t.Fatalf("expected OK response but got %q", b)
+		}
+	}
+
+	req := newRequest(t, conf, []byte("READ default 0 3\r\n"))
+	if _, err := h.PushRequest(context.Background(), req); errors.Cause(err) != protocol.ErrPermissionDenied {
+		t.Fatalf("expected %v but got %+v", protocol.ErrPermissionDenied, err)
+	}
+}
+
+func TestACLAuthorizerInvalid(t *testing.T) {
+	for _, rule := range []string{"", "default", "a:b", "a:b:", "a:b:x", "a:[:r", "a:b:rw:c"} {
+		if _, err := NewACLAuthorizer([]string{rule}); err == nil {
+			t.Errorf("expected acl rule %q to be invalid", rule)
+		}
+	}
+}
+
+type testAllocator struct {
+	calls int
+	skew  uint64
+}
+
+func (a *testAllocator) Allocate(topic string, head uint64, size int) (uint64, error) {
+	a.calls++
+	return head + a.skew, nil
+}
+
+func TestOffsetAllocator(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	alloc := &testAllocator{}
+	h := NewHandlers(conf)
+	h.SetOffsetAllocator(alloc)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := len(logged(t, conf, fixture))
+	for i := 0; i < 2; i++ {
+		expected := uint64(size * i)
+		if cr := pushBatch(t, h, fixture); cr.Offset() != expected {
+			t.Fatalf("expected offset %d but got %d", expected, cr.Offset())
+		}
+	}
+	if alloc.calls != 2 {
+		t.Fatalf("expected 2 allocations but got %d", alloc.calls)
+	}
+
+	alloc.skew = 1
+	resp, err := h.PushRequest(context.Background(), newRequest(t, conf, fixture))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cr := checkBatchResp(t, conf, resp); cr.Error() == nil {
+		t.Fatal("expected an error response when the allocated offset isn't the head")
+	}
+
+	alloc.skew = 0
+	if cr := pushBatch(t, h, fixture); cr.Offset() != uint64(size*2) {
+		t.Fatalf("expected offset %d but got %d", size*2, cr.Offset())
+	}
+	checkBatch(t, h, fixture, uint64(size*2), 1)
+}
+
+func TestReadLimits(t *testing.T) {
+	fixture := testhelper.LoadFixture("batch.small")
+	batchConf := testhelper.DefaultConfig(testing.Verbose())
+	batchConf.MaxReadBatches = 2
+	bytesConf := testhelper.DefaultConfig(testing.Verbose())
+	logb := logged(t, bytesConf, fixture)
+	bytesConf.MaxReadBytes = len(logb)*2 + 1
+
+	for name, conf := range map[string]*config.Config{"batches": batchConf, "bytes": bytesConf} {
+		t.Run(name, func(t *testing.T) {
+			h := NewHandlers(conf)
+			doStartHandler(t, h)
+			defer doShutdownHandler(t, h)
+
+			for i := 0; i < 5; i++ {
+				pushBatch(t, h, fixture)
+			}
+
+			two := append(append([]byte{}, logb...), logb...)
+			for _, off := range []uint64{0, uint64(len(logb) * 2)} {
+				respb := pushRead(t, h, off, 15)
+				if expect := addReadRespEnvelope(off, 2, two); !bytes.Equal(respb, expect) {
+					t.Fatalf("expected (%d):\n\t%q\nbut got\n\t%q", off, expect, respb)
+				}
+			}
+
+			off := uint64(len(logb) * 4)
+			if respb := pushRead(t, h, off, 15); !bytes.Equal(respb, addReadRespEnvelope(off, 1, logb)) {
+				t.Fatalf("expected the last batch but got %q", respb)
+			}
+
+			// tail responses aren't limited
+			req := newRequest(t, conf, []byte("TAIL default 15\r\n"))
+			resp, err := h.PushRequest(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if respb := checkReadResp(t, conf, resp); !bytes.HasPrefix(respb, []byte("OK 0 5\r\n")) {
+				t.Fatalf("expected all batches but got %q", respb)
+			}
+		})
+	}
+}
+
+func TestMaxSubscriptions(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxSubscriptions = 1
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	pushBatch(t, h, fixture)
+
+	ctx := context.Background()
+	readReq := []byte("READ default 0 3\r\n")
+	resp, err := h.PushRequest(ctx, newRequest(t, conf, readReq))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := h.Subscriptions(); n != 1 {
+		t.Fatalf("expected 1 subscription but got %d", n)
+	}
+
+	if _, err := h.PushRequest(ctx, newRequest(t, conf, readReq)); errors.Cause(err) != protocol.ErrTooManySubscriptions {
+		t.Fatalf("expected %v but got %+v", protocol.ErrTooManySubscriptions, err)
+	}
+
+	checkReadResp(t, conf, resp)
+	resp.Done()
+	resp.Done()
+	if n := h.Subscriptions(); n != 0 {
+		t.Fatalf("expected no subscriptions but got %d", n)
+	}
+
+	other, err := h.PushRequest(ctx, newRequest(t, conf, readReq))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	other.Done()
+}
+
+func TestMaxReads(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxReads = 1
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	pushBatch(t, h, fixture)
+
+	ctx := context.Background()
+	readReq := []byte("READ default 0 3\r\n")
+	resp, err := h.PushRequest(ctx, newRequest(t, conf, readReq))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := h.Reads(); n != 1 {
+		t.Fatalf("expected 1 read but got %d", n)
+	}
+
+	if _, err := h.PushRequest(ctx, newRequest(t, conf, readReq)); errors.Cause(err) != protocol.ErrTooBusy {
+		t.Fatalf("expected %v but got %+v", protocol.ErrTooBusy, err)
+	}
+	if n := h.Subscriptions(); n != 1 {
+		t.Fatalf("expected the rejected read to release its subscription but got %d", n)
+	}
+
+	// tails don't count against the limit
+	tail, err := h.PushRequest(ctx, newRequest(t, conf, []byte("TAIL default 3\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := h.Reads(); n != 1 {
+		t.Fatalf("expected 1 read but got %d", n)
+	}
+	checkReadResp(t, conf, tail)
+	tail.Done()
+
+	checkReadResp(t, conf, resp)
+	resp.Done()
+	if n := h.Reads(); n != 0 {
+		t.Fatalf("expected no reads but got %d", n)
+	}
+	if n := h.Subscriptions(); n != 0 {
+		t.Fatalf("expected no subscriptions but got %d", n)
+	}
+
+	other, err := h.PushRequest(ctx, newRequest(t, conf, readReq))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	other.Done()
+}
+
+func TestHighWaterMark(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	for i := uint64(0); i < 2; i++ {
+		if cr := pushBatch(t, h, fixture); cr.Offset() != size*i {
+			t.Fatalf("expected offset %d but got %d", size*i, cr.Offset())
+		}
+	}
+	doShutdownHandler(t, h)
+
+	// simulate a crash that lost the end of the log
+	if err := os.Truncate(partitionFullPath(conf, "default", 0), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	h = NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	if cr := pushBatch(t, h, fixture); cr.Offset() != size*2 {
+		t.Fatalf("expected offset %d after restart but got %d", size*2, cr.Offset())
+	}
+	checkBatch(t, h, fixture, size*2, 1)
+	checkBatch(t, h, fixture, 0, 1)
+}
+
+func pushHead(t testing.TB, h *Handlers, topic string) *protocol.ClientResponse {
+	t.Helper()
+	req := newRequest(t, h.conf, []byte(fmt.Sprintf("HEAD %s\r\n", topic)))
+	resp, err := h.PushRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return checkBatchResp(t, h.conf, resp)
+}
+
+func TestHead(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	if cr := pushHead(t, h, "default"); cr.Error() != nil || cr.Offset() != 0 {
+		t.Fatalf("expected head 0 but got %d (err: %v)", cr.Offset(), cr.Error())
+	}
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+	pushBatch(t, h, fixture)
+	pushBatch(t, h, fixture)
+
+	batch := protocol.NewBatch(conf)
+	batch.SetTopic([]byte("other"))
+	batch.Append([]byte("hi"))
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	pushBatch(t, h, b.Bytes())
+	otherSize := uint64(len(logged(t, conf, b.Bytes())))
+
+	if cr := pushHead(t, h, "default"); cr.Error() != nil || cr.Offset() != size*2 {
+		t.Fatalf("expected head %d but got %d (err: %v)", size*2, cr.Offset(), cr.Error())
+	}
+	if cr := pushHead(t, h, "other"); cr.Error() != nil || cr.Offset() != otherSize {
+		t.Fatalf("expected head %d but got %d (err: %v)", otherSize, cr.Offset(), cr.Error())
+	}
+	if cr := pushHead(t, h, "nonexistent"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ReportHeadroom = true
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	var offs []uint64
+	for i := 0; i < conf.MaxPartitions+1; i++ {
+		offs = append(offs, fillPartition(t, h)...)
+	}
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := topic.parts.oldestOffset()
+	if oldest == 0 {
+		t.Fatal("expected retention to have removed a partition")
+	}
+
+	off := offs[len(offs)-1]
+	cr := protocol.NewClientResponseConfig(conf)
+	if _, err := cr.ReadFrom(bufio.NewReader(bytes.NewReader(pushRead(t, h, off, 1)))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if headroom, ts, ok := cr.Headroom(); !ok || headroom != off-oldest || ts != testTime.UnixNano() {
+		t.Fatalf("expected headroom %d written at %d but got %d at %d (ok: %t)", off-oldest, testTime.UnixNano(), headroom, ts, ok)
+	}
+
+	head := topic.parts.headOffset()
+	if headroom, _, ok := pushHead(t, h, "default").Headroom(); !ok || headroom != head-oldest {
+		t.Fatalf("expected head headroom %d but got %d (ok: %t)", head-oldest, headroom, ok)
+	}
+}
+
+func TestCoalesceBatches(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.CoalesceTopics = []string{"def*"}
+	conf.CoalesceSize = 1024
+	conf.CoalesceWait = time.Second
+	conf.CoalesceBatches = 3
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	logb := logged(t, conf, fixture)
+	size := uint64(len(logb))
+
+	// the third batch fills the group, so they're written without waiting
+	pushGroup := func() []uint64 {
+		t.Helper()
+		type result struct {
+			resp *protocol.Response
+			err  error
+		}
+		resC := make(chan result, conf.CoalesceBatches)
+		for i := 0; i < conf.CoalesceBatches; i++ {
+			req := newRequest(t, conf, fixture)
+			go func() {
+				resp, err := h.PushRequest(context.Background(), req)
+				resC <- result{resp, err}
+			}()
+		}
+
+		var offs []uint64
+		for i := 0; i < conf.CoalesceBatches; i++ {
+			res := <-resC
+			if res.err != nil {
+				t.Fatalf("%+v", res.err)
+			}
+			cr := checkBatchResp(t, conf, res.resp)
+			if cr.Error() != nil {
+				t.Fatalf("%+v", cr.Error())
+			}
+			offs = append(offs, cr.Offset())
+		}
+		sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+		return offs
+	}
+
+	writes := stats.CoalescedWrites.Value()
+	if offs, expected := pushGroup(), []uint64{0, size, size * 2}; !reflect.DeepEqual(offs, expected) {
+		t.Fatalf("expected offsets %v but got %v", expected, offs)
+	}
+	if n := stats.CoalescedWrites.Value() - writes; n != 1 {
+		t.Fatalf("expected 1 coalesced write but got %d", n)
+	}
+	expected := addReadRespEnvelope(0, 3, bytes.Repeat(logb, 3))
+	if b := pushRead(t, h, 0, 9); !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\t%q\nbut got\n\t%q", expected, b)
+	}
+
+	// groups that don't fit in the partition are split across the next one
+	next := size * 3
+	for next < uint64(conf.PartitionSize*2) {
+		for _, off := range pushGroup() {
+			if off != next {
+				t.Fatalf("expected offset %d but got %d", next, off)
+			}
+			next += size
+			if b, expected := pushRead(t, h, off, 1), addReadRespEnvelope(off, 1, logb); !bytes.Equal(b, expected) {
+				t.Fatalf("expected:\n\t%q\nbut got\n\t%q", expected, b)
+			}
+		}
+	}
+}
+
+func TestCoalescePanic(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.CoalesceTopics = []string{"default"}
+	conf.CoalesceSize = 1024
+	conf.CoalesceWait = time.Second
+	conf.CoalesceBatches = 3
+	h := NewHandlers(conf)
+	h.SetMessageInterceptor(interceptorFunc(func(topic string, msg *protocol.Message) error {
+		if string(msg.BodyBytes()) == "panic" {
+			panic("intercepting")
+		}
+		return nil
+	}))
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	batch := protocol.NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("panic"))
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+
+	panicsBefore := stats.HandlerPanics.Value()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := h.PushRequest(ctx, newRequest(t, conf, b.Bytes()))
+	if err != nil {
+		t.Fatalf("expected the panicking batch to be answered but got %+v", err)
+	}
+	if cr := checkBatchResp(t, conf, resp); cr.Error() != protocol.ErrInternal {
+		t.Fatalf("expected %v but got %v", protocol.ErrInternal, cr.Error())
+	}
+	if n := stats.HandlerPanics.Value() - panicsBefore; n != 1 {
+		t.Fatalf("expected 1 handler panic but got %d", n)
+	}
+
+	// the queue keeps coalescing batches
+	if cr := pushBatch(t, h, testhelper.LoadFixture("batch.small")); cr.Error() != nil {
+		t.Fatalf("%+v", cr.Error())
+	}
+}
+
+func TestMaxBufferAge(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.FlushBatches = 100
+	conf.FlushInterval = time.Hour
+	conf.MaxBufferAge = 20 * time.Millisecond
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+
+	// each write is the only one for a while, so it's only flushed once it's
+	// waited MaxBufferAge.
+	for i := 1; i <= 3; i++ {
+		before := stats.AgedFlushes.Value()
+		start := time.Now()
+		pushBatch(t, h, fixture)
+
+		for stats.AgedFlushes.Value() == before {
+			if time.Since(start) > time.Second {
+				t.Fatalf("write %d wasn't flushed after %s", i, time.Since(start))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if n := stats.AgedFlushes.Value() - before; n != 1 {
+			t.Fatalf("expected write %d to be flushed once but got %d flushes", i, n)
+		}
+		if elapsed := time.Since(start); elapsed < conf.MaxBufferAge {
+			t.Fatalf("expected write %d to be flushed after %s but it was flushed after %s", i, conf.MaxBufferAge, elapsed)
+		}
+	}
+}
+
+type interceptorFunc func(topic string, msg *protocol.Message) error
+
+func (f interceptorFunc) Intercept(topic string, msg *protocol.Message) error {
+	return f(topic, msg)
+}
+
+func TestMessageInterceptor(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	h.SetMessageInterceptor(interceptorFunc(func(topic string, msg *protocol.Message) error {
+		if string(msg.BodyBytes()) == "reject" {
+			return protocol.ErrInvalid
+		}
+		msg.SetBody(append([]byte(topic+": "), msg.BodyBytes()...))
+		return nil
+	}))
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	pushBatch(t, h, testhelper.LoadFixture("batch.small"))
+
+	br := bufio.NewReader(bytes.NewReader(pushRead(t, h, 0, 3)))
+	cr := protocol.NewClientResponseConfig(conf)
+	if _, err := cr.ReadFrom(br); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bs := protocol.NewBatchScanner(conf, br)
+	if !bs.Scan() {
+		t.Fatalf("%+v", bs.Error())
+	}
+	batch := bs.Batch()
+	if err := batch.Validate(); err != nil {
+		t.Fatalf("expected a valid batch after intercepting but got %+v", err)
+	}
+
+	mr := bufio.NewReader(bytes.NewReader(batch.MessageBytes()))
+	for _, body := range []string{"hi", "hallo", "sup"} {
+		msg := protocol.NewMessage(conf)
+		if _, err := msg.ReadFrom(mr); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if expected := "default: " + body; string(msg.BodyBytes()) != expected {
+			t.Fatalf("expected %q but got %q", expected, msg.BodyBytes())
+		}
+	}
+
+	rejected := protocol.NewBatch(conf)
+	rejected.SetTopic([]byte("default"))
+	rejected.Append([]byte("ok"))
+	rejected.Append([]byte("reject"))
+	b := &bytes.Buffer{}
+	if _, err := rejected.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	head := pushHead(t, h, "default").Offset()
+	if cr := pushBatch(t, h, b.Bytes()); cr.Error() != protocol.ErrInvalid {
+		t.Fatalf("expected %v but got %v", protocol.ErrInvalid, cr.Error())
+	}
+	if off := pushHead(t, h, "default").Offset(); off != head {
+		t.Fatalf("expected rejected batch not to be written, but head moved from %d to %d", head, off)
+	}
+
+	// dry runs are intercepted too, including for topics that don't exist yet
+	dry := append([]byte("DRY"), b.Bytes()...)
+	if cr := pushRequest(t, h, string(dry)); cr.Error() != protocol.ErrInvalid {
+		t.Fatalf("expected %v but got %v", protocol.ErrInvalid, cr.Error())
+	}
+	other := bytes.Replace(dry, []byte(" default "), []byte(" other "), 1)
+	if _, err := h.PushRequest(context.Background(), newRequest(t, conf, other)); errors.Cause(err) != protocol.ErrInvalid {
+		t.Fatalf("expected %v but got %+v", protocol.ErrInvalid, err)
+	}
+	if off := pushHead(t, h, "default").Offset(); off != head {
+		t.Fatalf("expected dry runs not to be written, but head moved from %d to %d", head, off)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.QueueStopTimeout = 50 * time.Millisecond
+	h := NewHandlers(conf)
+
+	// once wedging is set, the next batch wedges the topic's event queue until
+	// unwedge is closed
+	var wedging int32
+	wedged := make(chan struct{})
+	unwedge := make(chan struct{})
+	var once sync.Once
+	h.SetMessageInterceptor(interceptorFunc(func(topic string, msg *protocol.Message) error {
+		if atomic.LoadInt32(&wedging) == 1 {
+			once.Do(func() { close(wedged) })
+			<-unwedge
+		}
+		return nil
+	}))
+	doStartHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	pushBatch(t, h, fixture)
+	q := h.h["default"]
+	w := &shutdownWriter{LogWriter: q.topic.logw}
+	q.topic.logw = w
+	atomic.StoreInt32(&wedging, 1)
+
+	errC := make(chan error, 3)
+	push := func() {
+		_, err := h.PushRequest(context.Background(), newRequest(t, conf, fixture))
+		errC <- err
+	}
+	go push()
+	<-wedged
+	go push()
+	go push()
+
+	start := time.Now()
+	err := h.Stop()
+	if errors.Cause(err) != ErrStopTimeout {
+		t.Fatalf("expected %v but got %+v", ErrStopTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed < conf.QueueStopTimeout {
+		t.Fatalf("expected stop to wait %s but it returned after %s", conf.QueueStopTimeout, elapsed)
+	}
+
+	// requests waiting on the queue fail instead of waiting for it forever
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errC:
+			if errors.Cause(err) != ErrStopTimeout {
+				t.Fatalf("expected %v but got %+v", ErrStopTimeout, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected requests waiting on the stopped queue to fail")
+		}
+	}
+
+	// the requests left on the queue are no longer counted as queued
+	if n := q.Depth(); n != 0 {
+		t.Fatalf("expected no queued requests but got %d", n)
+	}
+
+	// the topic is left open for the wedged handler
+	if w.isShutdown() {
+		t.Fatal("expected the topic to stay open while its handler is running")
+	}
+
+	// the loop exits once the handler returns, shutting the topic down
+	close(unwedge)
+	select {
+	case <-q.shutdownC:
+	case <-time.After(time.Second):
+		t.Fatal("expected the event queue's loop to exit")
+	}
+	if !w.isShutdown() {
+		t.Fatal("expected the topic to be shut down once its handler returned")
+	}
+}
+
+// shutdownWriter records whether the topic's log writer was shut down.
+type shutdownWriter struct {
+	logger.LogWriter
+	shutdown int32
+}
+
+func (w *shutdownWriter) Setup() error { return nil }
+
+func (w *shutdownWriter) Shutdown() error {
+	atomic.StoreInt32(&w.shutdown, 1)
+	return w.LogWriter.(internal.LifecycleManager).Shutdown()
+}
+
+func (w *shutdownWriter) isShutdown() bool {
+	return atomic.LoadInt32(&w.shutdown) == 1
+}
+
+func TestHeads(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+	pushBatch(t, h, fixture)
+
+	batch := protocol.NewBatch(conf)
+	batch.SetTopic([]byte("other"))
+	batch.Append([]byte("hi"))
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	pushBatch(t, h, b.Bytes())
+	otherSize := uint64(len(logged(t, conf, b.Bytes())))
+
+	heads := func(ctx context.Context) map[string]uint64 {
+		resp, err := h.PushRequest(ctx, newRequest(t, conf, []byte("HEADS\r\n")))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		cr := checkBatchResp(t, conf, resp)
+		if cr.Error() != nil {
+			t.Fatalf("%+v", cr.Error())
+		}
+		hr := protocol.NewHeadsResponse(conf)
+		if err := hr.Parse(cr.MultiResp()); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return hr.Heads()
+	}
+
+	expected := map[string]uint64{"default": size, "other": otherSize}
+	if got := heads(context.Background()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+
+	// only topics the principal can read are listed
+	authz, err := NewACLAuthorizer([]string{"reader:other:r"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuthorizer(authz)
+	expected = map[string]uint64{"other": otherSize}
+	if got := heads(transport.WithPrincipal(context.Background(), "reader")); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+	if got := heads(context.Background()); len(got) != 0 {
+		t.Fatalf("expected no topics for an unauthenticated connection but got %v", got)
+	}
+}
+
+func TestDryBatch(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxTopics = 2
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+	dry := append([]byte("DRY"), fixture...)
+	pushBatch(t, h, fixture)
+
+	for i := 0; i < 2; i++ {
+		if cr := pushRequest(t, h, string(dry)); cr.Error() != nil || cr.Offset() != size {
+			t.Fatalf("expected offset %d but got %d (err: %v)", size, cr.Offset(), cr.Error())
+		}
+	}
+	if cr := pushHead(t, h, "default"); cr.Offset() != size {
+		t.Fatalf("expected dry runs not to be written, but head is %d", cr.Offset())
+	}
+
+	corrupt := append([]byte(nil), dry...)
+	corrupt[len(corrupt)-1]++
+	if cr := pushRequest(t, h, string(corrupt)); cr.Error() == nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+
+	pushRequest(t, h, "PAUSE default\r\n")
+	if cr := pushRequest(t, h, string(dry)); errors.Cause(cr.Error()) != protocol.ErrTopicPaused {
+		t.Fatalf("expected %v but got %v", protocol.ErrTopicPaused, cr.Error())
+	}
+
+	// a dry run for a new topic doesn't create it
+	other := bytes.Replace(dry, []byte(" default "), []byte(" other "), 1)
+	for i := 0; i < 2; i++ {
+		if cr := pushRequest(t, h, string(other)); cr.Error() != nil || cr.Offset() != 0 {
+			t.Fatalf("expected offset 0 but got %d (err: %v)", cr.Offset(), cr.Error())
+		}
+	}
+	if cr := pushHead(t, h, "other"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+
+	// the topic limit still applies
+	pushRequest(t, h, string(bytes.Replace(other, []byte(" other "), []byte(" third "), 1)[3:]))
+	if _, err := h.PushRequest(context.Background(), newRequest(t, conf, other)); errors.Cause(err) != protocol.ErrTooManyTopics {
+		t.Fatalf("expected %v but got %+v", protocol.ErrTooManyTopics, err)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	now = func() time.Time { return testTime.Add(time.Minute) }
+	defer func() { now = func() time.Time { return testTime } }()
+
+	infos, statsReqs := stats.InfoRequests.Value(), stats.StatsRequests.Value()
+	resp, err := h.PushRequest(context.Background(), newRequest(t, conf, []byte("INFO\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cr := checkBatchResp(t, conf, resp)
+	if cr.Error() != nil {
+		t.Fatalf("%+v", cr.Error())
+	}
+	ir := protocol.NewInfoResponse(conf)
+	if err := ir.Parse(cr.MultiResp()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if ir.Version != internal.Version {
+		t.Fatalf("expected version %s but got %s", internal.Version, ir.Version)
+	}
+	if !ir.Started.Equal(testTime) {
+		t.Fatalf("expected start time %s but got %s", testTime, ir.Started)
+	}
+	if ir.Uptime != time.Minute {
+		t.Fatalf("expected uptime %s but got %s", time.Minute, ir.Uptime)
+	}
+	if started := stats.Started.Value(); started != testTime.UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("expected server.started_ms %d but got %d", testTime.UnixNano()/int64(time.Millisecond), started)
+	}
+	if n := stats.InfoRequests.Value() - infos; n != 1 {
+		t.Fatalf("expected 1 INFO request in the stats but got %d", n)
+	}
+	if n := stats.StatsRequests.Value() - statsReqs; n != 0 {
+		t.Fatalf("expected no STATS requests in the stats but got %d", n)
+	}
+}
+
+func TestSync(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	if cr := pushRequest(t, h, "SYNC nonexistent 0\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+	// nothing has been written at the head yet
+	if cr := pushRequest(t, h, "SYNC default 0\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+	pushBatch(t, h, fixture)
+	if cr := pushRequest(t, h, "SYNC default 0\r\n"); cr.Error() != nil || cr.Offset() != size {
+		t.Fatalf("expected to sync through %d but got %d (err: %v)", size, cr.Offset(), cr.Error())
+	}
+
+	// the first batch is already durable, so the log isn't synced again
+	pushBatch(t, h, fixture)
+	if cr := pushRequest(t, h, "SYNC default 0\r\n"); cr.Error() != nil || cr.Offset() != size {
+		t.Fatalf("expected to be synced through %d but got %d (err: %v)", size, cr.Offset(), cr.Error())
+	}
+	if cr := pushRequest(t, h, fmt.Sprintf("SYNC default %d\r\n", size)); cr.Error() != nil || cr.Offset() != size*2 {
+		t.Fatalf("expected to sync through %d but got %d (err: %v)", size*2, cr.Offset(), cr.Error())
+	}
+}
+
+func TestTailOffset(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	tailOffsets, heads := stats.TailOffsetRequests.Value(), stats.HeadRequests.Value()
+	if cr := pushRequest(t, h, "TAILOFFSET default\r\n"); cr.Error() != nil || cr.Offset() != 0 {
+		t.Fatalf("expected oldest offset 0 but got %d (err: %v)", cr.Offset(), cr.Error())
+	}
+	if n := stats.TailOffsetRequests.Value() - tailOffsets; n != 1 {
+		t.Fatalf("expected 1 TAILOFFSET request in the stats but got %d", n)
+	}
+	if n := stats.HeadRequests.Value() - heads; n != 0 {
+		t.Fatalf("expected no HEAD requests in the stats but got %d", n)
+	}
+	if cr := pushRequest(t, h, "TAILOFFSET nonexistent\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+
+	// fill enough partitions that the oldest ones are removed
+	for i := 0; i < conf.MaxPartitions*2; i++ {
+		fillPartition(t, h)
+	}
+
+	cr := pushRequest(t, h, "TAILOFFSET default\r\n")
+	if cr.Error() != nil || cr.Offset() == 0 {
+		t.Fatalf("expected oldest offset after retention but got %d (err: %v)", cr.Offset(), cr.Error())
+	}
+	oldest := cr.Offset()
+
+	ctx := context.Background()
+	resp, err := h.PushRequest(ctx, newRequest(t, conf, []byte(fmt.Sprintf("READ default %d 1\r\n", oldest))))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkReadResp(t, conf, resp)
+	resp.Done()
+
+	resp, err = h.PushRequest(ctx, newRequest(t, conf, []byte("READ default 0 1\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cr := checkBatchResp(t, conf, resp); errors.Cause(cr.Error()) != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, cr.Error())
+	}
+	resp.Done()
+}
+
+func TestOffsetTime(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	if cr := pushRequest(t, h, "OFFSETTIME nonexistent 0\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+	// nothing has been written at the head yet
+	if cr := pushRequest(t, h, "OFFSETTIME default 0\r\n"); errors.Cause(cr.Error()) != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, cr.Error())
+	}
+
+	offsetTimes := stats.OffsetTimeRequests.Value()
+	fillPartition(t, h)
+	cr := pushRequest(t, h, "OFFSETTIME default 0\r\n")
+	if cr.Error() != nil || cr.Offset() != uint64(testTime.UnixNano()) {
+		t.Fatalf("expected timestamp %d but got %d (err: %+v)", testTime.UnixNano(), cr.Offset(), cr.Error())
+	}
+	if n := stats.OffsetTimeRequests.Value() - offsetTimes; n != 1 {
+		t.Fatalf("expected 1 OFFSETTIME request in the stats but got %d", n)
+	}
+	if cr := pushRequest(t, h, "OFFSETTIME default 1\r\n"); errors.Cause(cr.Error()) != protocol.ErrInvalidOffset {
+		t.Fatalf("expected %v but got %+v", protocol.ErrInvalidOffset, cr.Error())
+	}
+
+	// fill enough partitions that the oldest ones are removed
+	for i := 0; i < conf.MaxPartitions*2; i++ {
+		fillPartition(t, h)
+	}
+	oldest := pushRequest(t, h, "TAILOFFSET default\r\n").Offset()
+	head := pushRequest(t, h, "HEAD default\r\n").Offset()
+	if oldest == 0 {
+		t.Fatal("expected retention to have removed the first batches")
+	}
+
+	if cr := pushRequest(t, h, fmt.Sprintf("OFFSETTIME default %d\r\n", oldest)); cr.Error() != nil || cr.Offset() != uint64(testTime.UnixNano()) {
+		t.Fatalf("expected timestamp %d but got %d (err: %+v)", testTime.UnixNano(), cr.Offset(), cr.Error())
+	}
+	for _, off := range []uint64{0, head, head + 100} {
+		cr := pushRequest(t, h, fmt.Sprintf("OFFSETTIME default %d\r\n", off))
+		if errors.Cause(cr.Error()) != protocol.ErrNotFound {
+			t.Fatalf("offset %d: expected %v but got %+v", off, protocol.ErrNotFound, cr.Error())
+		}
+	}
+}
+
+func TestReadErrorMessage(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := len(logged(t, conf, fixture))
+	pushBatch(t, h, fixture)
+
+	req := newRequest(t, conf, []byte("READ default 500 3\r\n"))
+	resp, err := h.PushRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cr := checkBatchResp(t, conf, resp)
+	if errors.Cause(cr.Error()) != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, cr.Error())
+	}
+	expected := fmt.Sprintf("offset 500 not found, oldest is 0 and head is %d", size)
+	if rerr, ok := cr.Error().(*protocol.RespError); !ok || rerr.Message != expected {
+		t.Fatalf("expected error message %q but got %+v", expected, cr.Error())
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	logb := logged(t, conf, fixture)
+	size := uint64(len(logb))
+	// two batches fit in each partition, so ranges cross partitions
+	conf.PartitionSize = len(logb) * 3
+	conf.MaxBatchSize = conf.PartitionSize
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	for i := 0; i < 5; i++ {
+		pushBatch(t, h, fixture)
+	}
+	batches := func(n int) []byte {
+		return bytes.Repeat(logb, n)
+	}
+
+	tests := []struct {
+		name     string
+		req      string
+		expected []byte
+	}{
+		{"exclusive", fmt.Sprintf("READRANGE default 0 %d 0\r\n", size*2), addReadRespEnvelope(0, 2, batches(2))},
+		{"inclusive", fmt.Sprintf("READRANGE default %d %d 1\r\n", size, size*2), addReadRespEnvelope(size, 2, batches(2))},
+		{"across partitions", fmt.Sprintf("READRANGE default %d %d 0\r\n", size, size*4), addReadRespEnvelope(size, 3, batches(3))},
+		{"past head", fmt.Sprintf("READRANGE default %d 1000000 1\r\n", size*2), addReadRespEnvelope(size*2, 3, batches(3))},
+		{"single batch", fmt.Sprintf("READRANGE default %d %d 1\r\n", size*4, size*4), addReadRespEnvelope(size*4, 1, batches(1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := h.PushRequest(context.Background(), newRequest(t, conf, []byte(tt.req)))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if respb := checkReadResp(t, conf, resp); !bytes.Equal(respb, tt.expected) {
+				t.Fatalf("expected:\n\t%q\nbut got\n\t%q", tt.expected, respb)
+			}
+		})
+	}
+
+	for _, start := range []uint64{size * 5, size * 6} {
+		req := newRequest(t, conf, []byte(fmt.Sprintf("READRANGE default %d %d 1\r\n", start, start+size)))
+		resp, err := h.PushRequest(context.Background(), req)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if cr := checkBatchResp(t, conf, resp); errors.Cause(cr.Error()) != protocol.ErrNotFound {
+			t.Fatalf("expected %v reading from %d but got %+v", protocol.ErrNotFound, start, cr.Error())
+		}
+	}
+}
+
+func TestMaxResponseReaders(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	logb := logged(t, conf, fixture)
+	// two batches fit in each partition, so the read spans five of them
+	conf.PartitionSize = len(logb) * 3
+	conf.MaxBatchSize = conf.PartitionSize
+	conf.MaxPartitions = 10
+	conf.MaxResponseReaders = 2
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	for i := 0; i < 10; i++ {
+		pushBatch(t, h, fixture)
+	}
+
+	open := stats.PartitionReaders.Value()
+	resp, err := h.PushRequest(context.Background(), newRequest(t, conf, []byte("READ default 0 30\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := resp.NumReaders(); n != 6 {
+		t.Fatalf("expected the envelope and 5 partition readers but got %d readers", n)
+	}
+	if n := stats.PartitionReaders.Value() - open; n != 2 {
+		t.Fatalf("expected 2 partitions to be open before sending but got %d", n)
+	}
+
+	b := &bytes.Buffer{}
+	for {
+		r, err := resp.ScanReader()
+		if err != nil {
+			t.Fatalf("unexpected error scanning response reader: %+v", err)
+		}
+		if r == nil {
+			break
+		}
+		if n := stats.PartitionReaders.Value() - open; n > 2 {
+			t.Fatalf("expected at most 2 open partitions but got %d", n)
+		}
+		if _, err := b.ReadFrom(r); err != nil {
+			t.Fatalf("unexpected error reading batch: %+v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	expected := addReadRespEnvelope(0, 10, bytes.Repeat(logb, 10))
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("expected:\n\t%q\nbut got\n\t%q", expected, b.Bytes())
+	}
+	if n := stats.PartitionReaders.Value() - open; n != 0 {
+		t.Fatalf("expected all partitions to be closed but %d are open", n)
+	}
+}
+
+func TestReadDuringRotation(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	logb := logged(t, conf, fixture)
+	conf.PartitionSize = len(logb) * 3
+	conf.MaxBatchSize = conf.PartitionSize
+	conf.MaxPartitions = 3
+	conf.MaxResponseReaders = 1
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	for i := 0; i < 4; i++ {
+		pushBatch(t, h, fixture)
+	}
+
+	// only the first partition is opened before sending
+	resp, err := h.PushRequest(context.Background(), newRequest(t, conf, []byte("READ default 0 12\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// keep writing, rotating partitions out from under the read
+	deleted := stats.PartitionsDeleted.Value()
+	stop := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		defer close(errC)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req := protocol.NewRequestConfig(conf)
+			if _, err := req.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+				errC <- err
+				return
+			}
+			if _, err := h.PushRequest(context.Background(), req); err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		if err := <-errC; err != nil {
+			t.Fatalf("error writing batches: %+v", err)
+		}
+	}()
+
+	for stats.PartitionsDeleted.Value()-deleted < int64(conf.MaxPartitions) {
+		time.Sleep(time.Millisecond)
+	}
+	// removed partitions are deleted in the background
+	time.Sleep(10 * time.Millisecond)
+
+	b := &bytes.Buffer{}
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error sending read after rotation: %+v", err)
+	}
+	resp.Done()
+	expected := addReadRespEnvelope(0, 4, bytes.Repeat(logb, 4))
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("expected:\n\t%q\nbut got\n\t%q", expected, b.Bytes())
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	if n := cap(newEventQ(conf).in); n != defaultQueueSize {
+		t.Fatalf("expected default queue size %d but got %d", defaultQueueSize, n)
+	}
+
+	conf.QueueSize = 10
+	if n := cap(newEventQ(conf).in); n != 10 {
+		t.Fatalf("expected queue size 10 but got %d", n)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.QueueSize = 1
+	h := NewHandlers(conf)
+
+	// the first batch wedges the topic's event queue until unwedge is closed
+	wedged := make(chan struct{})
+	unwedge := make(chan struct{})
+	var once sync.Once
+	h.SetMessageInterceptor(interceptorFunc(func(topic string, msg *protocol.Message) error {
+		once.Do(func() {
+			close(wedged)
+			<-unwedge
+		})
+		return nil
+	}))
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+
+	depth := queueDepth(t)
+	fixture := testhelper.LoadFixture("batch.small")
+	errC := make(chan error, 3)
+	push := func(b []byte) {
+		_, err := h.PushRequest(context.Background(), newRequest(t, conf, b))
+		errC <- err
+	}
+	go push(fixture)
+	<-wedged
+
+	// one request fills the queue and the other waits for room in it, which
+	// isn't counted
+	go push([]byte("HEAD default\r\n"))
+	go push([]byte("HEAD default\r\n"))
+	deadline := time.Now().Add(time.Second)
+	for queueDepth(t)-depth < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 queued request but got %d", queueDepth(t)-depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := queueDepth(t) - depth; n != 1 {
+		t.Fatalf("expected 1 queued request but got %d", n)
+	}
+
+	// the wedged batch is the oldest request
+	age, err := strconv.Atoi(expvar.Get("queue.oldest_age_ms").String())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if age < 20 {
+		t.Fatalf("expected the oldest request to have waited at least 20ms but got %dms", age)
+	}
+
+	close(unwedge)
+	for i := 0; i < 3; i++ {
+		if err := <-errC; err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if n := queueDepth(t) - depth; n != 0 {
+		t.Fatalf("expected no queued requests but got %d", n)
+	}
+	if n := h.h["default"].Handling(); !n.IsZero() {
+		t.Fatalf("expected no request to be handled but got one queued at %s", n)
+	}
+}
+
+func queueDepth(t testing.TB) int {
+	t.Helper()
+	n, err := strconv.Atoi(expvar.Get("queue.depth").String())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return n
+}
+
+func pushRequest(t testing.TB, h *Handlers, b string) *protocol.ClientResponse {
+	t.Helper()
+	resp, err := h.PushRequest(context.Background(), newRequest(t, h.conf, []byte(b)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return checkBatchResp(t, h.conf, resp)
+}
+
+func TestFormat(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+
+	if cr := pushRequest(t, h, "FORMAT other\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+	if cr := pushRequest(t, h, "FORMAT default\r\n"); cr.Error() != nil || len(cr.MultiResp()) != 0 {
+		t.Fatalf("expected empty format but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+
+	// setting the format creates the topic
+	if cr := pushRequest(t, h, "SETFORMAT other json\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+	if cr := pushRequest(t, h, "FORMAT other\r\n"); cr.Error() != nil || string(cr.MultiResp()) != "json" {
+		t.Fatalf("expected format json but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+	doShutdownHandler(t, h)
+
+	h = NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+	if cr := pushRequest(t, h, "FORMAT other\r\n"); cr.Error() != nil || string(cr.MultiResp()) != "json" {
+		t.Fatalf("expected format json after restart but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+}
+
+func TestPartitionSize(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := NewHandlers(conf)
+	doStartHandler(t, h)
+
+	if cr := pushRequest(t, h, "SETPARTSIZE default 100\r\n"); errors.Cause(cr.Error()) != protocol.ErrInvalid {
+		t.Fatalf("expected %v for a size smaller than max batch size but got %v", protocol.ErrInvalid, cr.Error())
+	}
+	// nothing has been written yet, so the head partition is resized too
+	if cr := pushRequest(t, h, "SETPARTSIZE default 3000\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := testhelper.LoadFixture("batch.small")
+	n := uint64(len(logged(t, conf, fixture)))
+	for topic.parts.head.startOffset == 0 {
+		pushBatch(t, h, fixture)
+	}
+	if off := topic.parts.head.startOffset; off >= 3000 || off+n < 3000 {
+		t.Fatalf("expected the first partition to rotate at 3000 bytes but the next started at %d", off)
+	}
+
+	pushBatch(t, h, fixture)
+	if cr := pushRequest(t, h, "SETPARTSIZE default 4000\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+	if topic.parts.head.maxSize != 3000 {
+		t.Fatalf("expected the head partition to keep its size of 3000 but got %d", topic.parts.head.maxSize)
+	}
+	if cr := pushRequest(t, h, "TOPICINFO default\r\n"); string(cr.MultiResp()) != "partition-size 4000\r\n" {
+		t.Fatalf("expected partition size 4000 but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+
+	// setting the partition size creates the topic
+	if cr := pushRequest(t, h, "SETPARTSIZE other 2048\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+	pushRequest(t, h, "SETFORMAT other json\r\n")
+	doShutdownHandler(t, h)
+
+	h = NewHandlers(conf)
+	doStartHandler(t, h)
+	defer doShutdownHandler(t, h)
+	if cr := pushRequest(t, h, "TOPICINFO default\r\n"); string(cr.MultiResp()) != "partition-size 4000\r\n" {
+		t.Fatalf("expected partition size 4000 after restart but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+	if cr := pushRequest(t, h, "TOPICINFO other\r\n"); string(cr.MultiResp()) != "format json\r\npartition-size 2048\r\n" {
+		t.Fatalf("expected format and partition size after restart but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+	if cr := pushRequest(t, h, "TOPICINFO nope\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+}
+
+// fullDiskWriter fails the next fails writes as though the disk were full.
+type fullDiskWriter struct {
+	logger.LogWriter
+	fails int
+}
+
+func (w *fullDiskWriter) Write(p []byte) (int, error) {
+	if w.fails > 0 {
+		w.fails--
+		return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+	}
+	return w.LogWriter.Write(p)
+}
+
+func TestDiskFull(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	h := startHandlerConfig(t, conf)
+	for i := 0; i < 3; i++ {
+		fillPartition(t, h)
+	}
+
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fullDiskWriter{LogWriter: topic.logw, fails: 1}
+	topic.logw = w
+	oldest := topic.parts.oldestOffset()
+	head := topic.parts.headOffset()
+
+	if cr := pushRequest(t, h, string(fixture)); cr.Error() != protocol.ErrDiskFull {
+		t.Fatalf("expected %v but got %v", protocol.ErrDiskFull, cr.Error())
+	}
+	if topic.parts.oldestOffset() != oldest || topic.parts.headOffset() != head {
+		t.Fatal("expected the log to be unchanged")
+	}
+	doShutdownHandler(t, h)
+
+	conf.DiskFullRetention = true
+	h = startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+	topic, err = h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := topic.parts.parts[2].startOffset
+	w = &fullDiskWriter{LogWriter: topic.logw, fails: 2}
+	topic.logw = w
+
+	cr := pushBatch(t, h, fixture)
+	if cr.Offset() != head {
+		t.Fatalf("expected batch to be written at %d but got %d", head, cr.Offset())
+	}
+	if off := topic.parts.oldestOffset(); off != third {
+		t.Fatalf("expected 2 partitions to be removed, leaving %d as the oldest, but got %d", third, off)
+	}
+	checkNotFound(t, conf, pushRead(t, h, oldest, 1))
+
+	// the head partition is never removed
+	w.fails = 100
+	if cr := pushRequest(t, h, string(fixture)); cr.Error() != protocol.ErrDiskFull {
+		t.Fatalf("expected %v but got %v", protocol.ErrDiskFull, cr.Error())
+	}
+	if topic.parts.nparts != 1 || topic.parts.headOffset() != head+uint64(len(logged(t, conf, fixture))) {
+		t.Fatalf("expected only the head partition to be left but got %s", topic.parts)
+	}
+}
+
+func TestMaxTopics(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxTopics = 2
+	h := startHandlerConfig(t, conf)
+
+	if cr := pushRequest(t, h, "SETFORMAT other json\r\n"); cr.Error() != nil {
+		t.Fatalf("%+v", cr.Error())
+	}
+
+	ctx := context.Background()
+	req := newRequest(t, conf, []byte("SETFORMAT third json\r\n"))
+	if _, err := h.PushRequest(ctx, req); errors.Cause(err) != protocol.ErrTooManyTopics {
+		t.Fatalf("expected %v but got %+v", protocol.ErrTooManyTopics, err)
+	}
+
+	// existing topics are unaffected
+	if cr := pushRequest(t, h, "SETFORMAT other protobuf\r\n"); cr.Error() != nil {
+		t.Fatalf("%+v", cr.Error())
+	}
+	doShutdownHandler(t, h)
+
+	// topics that already exist are loaded even past the limit
+	conf.MaxTopics = 1
+	h = startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+	if cr := pushRequest(t, h, "FORMAT other\r\n"); cr.Error() != nil || string(cr.MultiResp()) != "protobuf" {
+		t.Fatalf("expected format protobuf but got %q (err: %v)", cr.MultiResp(), cr.Error())
+	}
+}
+
+// slowTopicManager counts the topics created through it, and the most being
+// created at once, taking long enough that concurrent writes overlap.
+type slowTopicManager struct {
+	logger.TopicManager
+	mu        sync.Mutex
+	created   map[string]int
+	active    int
+	maxActive int
+}
+
+func (m *slowTopicManager) Create(topic string) error {
+	m.mu.Lock()
+	m.created[topic]++
+	m.active++
+	if m.active > m.maxActive {
+		m.maxActive = m.active
+	}
+	m.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	m.active--
+	m.mu.Unlock()
+	return m.TopicManager.Create(topic)
+}
+
+func TestConcurrentTopicCreation(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxTopicCreations = 2
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+	manager := &slowTopicManager{
+		TopicManager: h.topics.manager,
+		created:      make(map[string]int),
+	}
+	h.topics.manager = manager
+
+	const ntopics, writers = 10, 5
+	var size uint64
+	respC := make(chan *protocol.Response, ntopics*writers)
+	errC := make(chan error, ntopics*writers)
+	for i := 0; i < ntopics; i++ {
+		batch := protocol.NewBatch(conf)
+		batch.SetTopic([]byte(fmt.Sprintf("topic%d", i)))
+		batch.Append([]byte("hi"))
+		b := &bytes.Buffer{}
+		if _, err := batch.WriteTo(b); err != nil {
+			t.Fatal(err)
+		}
+		size = uint64(len(logged(t, conf, b.Bytes())))
+
+		for j := 0; j < writers; j++ {
+			req := newRequest(t, conf, b.Bytes())
+			go func() {
+				resp, err := h.PushRequest(context.Background(), req)
+				respC <- resp
+				errC <- err
+			}()
+		}
+	}
+	for i := 0; i < ntopics*writers; i++ {
+		resp := <-respC
+		if err := <-errC; err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if cr := checkBatchResp(t, conf, resp); cr.Error() != nil {
+			t.Fatalf("%+v", cr.Error())
+		}
+	}
+
+	// each topic was created once, and has one queue, which every write went
+	// through
+	for i := 0; i < ntopics; i++ {
+		if n := manager.created[fmt.Sprintf("topic%d", i)]; n != 1 {
+			t.Fatalf("expected topic%d to be created once but it was created %d times", i, n)
+		}
+	}
+	if manager.maxActive > conf.MaxTopicCreations {
+		t.Fatalf("expected at most %d topics created at once but got %d", conf.MaxTopicCreations, manager.maxActive)
+	}
+	h.mu.Lock()
+	nqueues := len(h.h)
+	h.mu.Unlock()
+	if nqueues != ntopics+1 {
+		t.Fatalf("expected %d queues but got %d", ntopics+1, nqueues)
+	}
+	for i := 0; i < ntopics; i++ {
+		name := fmt.Sprintf("topic%d", i)
+		topic, err := h.topics.get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := h.h[name]; q.topic != topic {
+			t.Fatalf("expected the %s queue to write to its topic", name)
+		}
+		if cr := pushHead(t, h, name); cr.Error() != nil || cr.Offset() != writers*size {
+			t.Fatalf("expected %s head %d but got %d (err: %v)", name, writers*size, cr.Offset(), cr.Error())
+		}
+	}
+}
+
+type panicFormatter struct{}
+
+func (f panicFormatter) Format() (string, error)       { panic("oh no") }
+func (f panicFormatter) SetFormat(format string) error { panic("oh no") }
+
+func TestHandlerPanic(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	pushBatch(t, h, fixture)
+
+	topic, err := h.topics.get("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmtr := topic.fmt
+	topic.fmt = panicFormatter{}
+	panicsBefore := stats.HandlerPanics.Value()
+
+	if cr := pushRequest(t, h, "FORMAT default\r\n"); cr.Error() != protocol.ErrInternal {
+		t.Fatalf("expected %v but got %v", protocol.ErrInternal, cr.Error())
+	}
+	if n := stats.HandlerPanics.Value() - panicsBefore; n != 1 {
+		t.Fatalf("expected 1 handler panic but got %d", n)
+	}
+
+	// the queue keeps handling requests
+	topic.fmt = fmtr
+	if cr := pushRequest(t, h, "FORMAT default\r\n"); cr.Error() != nil {
+		t.Fatalf("%+v", cr.Error())
+	}
+	pushBatch(t, h, fixture)
+}
+
+func TestPauseTopic(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	h := startHandlerConfig(t, conf)
+	defer doShutdownHandler(t, h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	pushBatch(t, h, fixture)
+
+	if cr := pushRequest(t, h, "PAUSE nonexistent\r\n"); cr.Error() != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %v", protocol.ErrNotFound, cr.Error())
+	}
+	if cr := pushRequest(t, h, "PAUSE default\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+
+	if cr := pushRequest(t, h, string(fixture)); errors.Cause(cr.Error()) != protocol.ErrTopicPaused {
+		t.Fatalf("expected %v but got %v", protocol.ErrTopicPaused, cr.Error())
+	}
+
+	// reads continue while paused
+	resp, err := h.PushRequest(context.Background(), newRequest(t, conf, []byte("READ default 0 3\r\n")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkReadResp(t, conf, resp)
+	resp.Done()
+
+	if cr := pushRequest(t, h, "RESUME default\r\n"); cr.Error() != nil || !cr.Ok() {
+		t.Fatalf("expected OK but got %s", cr)
+	}
+	pushBatch(t, h, fixture)
+}
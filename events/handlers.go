@@ -4,18 +4,38 @@ import (
 	"context"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
 	"github.com/jeffrom/logd/protocol"
 	"github.com/jeffrom/logd/server"
+	"github.com/jeffrom/logd/stats"
 	"github.com/jeffrom/logd/transport"
 )
 
 var blockingReqs = map[protocol.CmdType]bool{
-	protocol.CmdBatch: true,
-	protocol.CmdRead:  true,
-	protocol.CmdTail:  true,
+	protocol.CmdBatch:       true,
+	protocol.CmdRead:        true,
+	protocol.CmdTail:        true,
+	protocol.CmdHead:        true,
+	protocol.CmdSRead:       true,
+	protocol.CmdFormat:      true,
+	protocol.CmdSetFormat:   true,
+	protocol.CmdPause:       true,
+	protocol.CmdResume:      true,
+	protocol.CmdTailOffset:  true,
+	protocol.CmdSync:        true,
+	protocol.CmdOffsetTime:  true,
+	protocol.CmdDryBatch:    true,
+	protocol.CmdReadRange:   true,
+	protocol.CmdTopicInfo:   true,
+	protocol.CmdSetPartSize: true,
+	protocol.CmdRestore:     true,
+	protocol.CmdErase:       true,
 }
 
 // Handlers is a map of event queues, one for each topic as well as one for
@@ -23,11 +43,20 @@ var blockingReqs = map[protocol.CmdType]bool{
 type Handlers struct {
 	conf      *config.Config
 	h         map[string]*eventQ
-	mu        sync.Mutex // for h
+	creating  map[string]*topicCreation // new topics being set up
+	mu        sync.Mutex                // for h and creating
+	createSem chan struct{}             // held while creating a topic, if MaxTopicCreations is set
 	asyncQ    *eventQ
 	topics    *topics
 	servers   []transport.Server
+	authz     Authorizer
+	alloc     OffsetAllocator
+	intercept MessageInterceptor
 	shutdownC chan error
+	started   time.Time
+
+	subscriptions int64 // READ and TAIL responses being sent, across all topics
+	reads         int64 // the READ and SREAD responses among them
 }
 
 // NewHandlers returns a new instance of *Handlers.
@@ -37,10 +66,17 @@ func NewHandlers(conf *config.Config) *Handlers {
 	h := &Handlers{
 		conf:      conf,
 		h:         make(map[string]*eventQ),
+		creating:  make(map[string]*topicCreation),
 		asyncQ:    newEventQ(conf),
 		topics:    newTopics(conf),
 		servers:   []transport.Server{},
+		alloc:     defaultAllocator,
 		shutdownC: make(chan error, 1),
+		started:   now(),
+	}
+	stats.Started.Set(h.started.UnixNano() / int64(time.Millisecond))
+	if conf.MaxTopicCreations > 0 {
+		h.createSem = make(chan struct{}, conf.MaxTopicCreations)
 	}
 
 	if conf.Host != "" {
@@ -51,6 +87,10 @@ func NewHandlers(conf *config.Config) *Handlers {
 		h.Register(server.NewHttp(conf))
 	}
 
+	if conf.AdminHost != "" {
+		h.Register(server.NewAdmin(conf))
+	}
+
 	return h
 }
 
@@ -61,9 +101,39 @@ func (h *Handlers) Register(server transport.Server) {
 	h.servers = append(h.servers, server)
 }
 
+// SetAuthorizer sets the Authorizer used to check BATCH, READ, and TAIL
+// requests. It overrides the ACL configuration, and should be called before
+// the handlers are started.
+func (h *Handlers) SetAuthorizer(authz Authorizer) {
+	h.authz = authz
+}
+
+// SetOffsetAllocator sets the OffsetAllocator used to assign offsets to
+// batches. It should be called before the handlers are started.
+func (h *Handlers) SetOffsetAllocator(alloc OffsetAllocator) {
+	h.alloc = alloc
+}
+
+// SetMessageInterceptor sets the MessageInterceptor called with each message
+// before it's written. It's nil by default, so messages are written as they're
+// sent. It should be called before the handlers are started.
+func (h *Handlers) SetMessageInterceptor(i MessageInterceptor) {
+	h.intercept = i
+}
+
 // GoStart begins handling messages
 func (h *Handlers) GoStart() error {
 	h.drainShutdownC()
+	stats.MaxSubscriptions.Set(int64(h.conf.MaxSubscriptions))
+	stats.MaxReads.Set(int64(h.conf.MaxReads))
+	if h.authz == nil && len(h.conf.ACL) > 0 {
+		authz, err := NewACLAuthorizer(h.conf.ACL)
+		if err != nil {
+			return err
+		}
+		h.authz = authz
+	}
+
 	if err := h.topics.Setup(); err != nil {
 		return err
 	}
@@ -76,6 +146,8 @@ func (h *Handlers) GoStart() error {
 	for name, topic := range h.topics.m {
 		q := newEventQ(h.conf)
 		q.setTopic(topic)
+		q.setAllocator(h.alloc)
+		q.setInterceptor(h.intercept)
 		if err := q.GoStart(); err != nil {
 			h.mu.Unlock()
 			return err
@@ -116,6 +188,12 @@ func (h *Handlers) Start() error {
 
 // PushRequest implements transport.RequestHandler.
 func (h *Handlers) PushRequest(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if req.Name == protocol.CmdHeads {
+		return h.handleHeads(ctx, req)
+	}
+	if req.Name == protocol.CmdInfo {
+		return h.handleInfo(req)
+	}
 	if ok, _ := blockingReqs[req.Name]; ok {
 		return h.pushBlockingRequest(ctx, req)
 	} else {
@@ -131,6 +209,10 @@ func (h *Handlers) pushBlockingRequest(ctx context.Context, req *protocol.Reques
 		return h.asyncQ.PushRequest(ctx, req)
 	}
 
+	if err := h.authorize(ctx, req, name); err != nil {
+		return errResponse(h.conf, req, req.Response, err)
+	}
+
 	h.mu.Lock()
 	q, ok := h.h[name]
 	h.mu.Unlock()
@@ -138,38 +220,294 @@ func (h *Handlers) pushBlockingRequest(ctx context.Context, req *protocol.Reques
 		// if req.Name == protocol.CmdRead || req.Name == protocol.CmdTail {
 		// 	return q.handleRequest(req)
 		// }
+		if req.Name == protocol.CmdRead || req.Name == protocol.CmdTail || req.Name == protocol.CmdSRead || req.Name == protocol.CmdReadRange {
+			return h.pushSubscription(ctx, q, req)
+		}
 		return q.PushRequest(ctx, req)
 	}
 
 	// create a new topic if there isn't already one
-	if req.Name == protocol.CmdBatch {
-		// make sure we only create one new topic so we don't lose messages or
-		// do extra work.
-		h.mu.Lock()
-		if q, ok := h.h[name]; ok {
-			h.mu.Unlock()
-			return q.PushRequest(ctx, req)
+	if req.Name == protocol.CmdBatch || req.Name == protocol.CmdRestore || req.Name == protocol.CmdSetFormat || req.Name == protocol.CmdSetPartSize {
+		q, err := h.createQueue(ctx, name)
+		if errors.Cause(err) == protocol.ErrTooManyTopics {
+			return errResponse(h.conf, req, req.Response, err)
 		}
-
-		q := newEventQ(h.conf)
-		topic, err := h.topics.add(name)
 		if err != nil {
-			h.mu.Unlock()
 			return nil, err
 		}
-		q.setTopic(topic)
-		if err := q.GoStart(); err != nil {
-			h.mu.Unlock()
-			return nil, err
-		}
-
-		h.h[name] = q
-		h.mu.Unlock()
 		return q.PushRequest(ctx, req)
 	}
+	if req.Name == protocol.CmdDryBatch {
+		return h.handleDryBatch(req, name)
+	}
 	return h.asyncQ.PushRequest(ctx, req)
 }
 
+// topicCreation is a new topic being set up. Requests for the topic wait for
+// done, and then use q, or fail with err.
+type topicCreation struct {
+	done chan struct{}
+	q    *eventQ
+	err  error
+}
+
+// createQueue returns the queue for a topic that didn't exist, creating it.
+// Only one request sets up a topic, and any others for it wait until it's
+// ready, so a topic is never created twice. Other topics can be used and
+// created meanwhile, up to config.MaxTopicCreations at once.
+func (h *Handlers) createQueue(ctx context.Context, name string) (*eventQ, error) {
+	h.mu.Lock()
+	if q, ok := h.h[name]; ok {
+		h.mu.Unlock()
+		return q, nil
+	}
+	c, ok := h.creating[name]
+	if !ok {
+		c = &topicCreation{done: make(chan struct{})}
+		h.creating[name] = c
+	}
+	h.mu.Unlock()
+
+	if ok {
+		select {
+		case <-c.done:
+			return c.q, c.err
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "waiting for topic to be created")
+		}
+	}
+
+	c.q, c.err = h.setupQueue(ctx, name)
+	h.mu.Lock()
+	delete(h.creating, name)
+	if c.err == nil {
+		h.h[name] = c.q
+	}
+	h.mu.Unlock()
+	close(c.done)
+	return c.q, c.err
+}
+
+// setupQueue creates a topic and starts its queue, waiting for room under
+// config.MaxTopicCreations first.
+func (h *Handlers) setupQueue(ctx context.Context, name string) (*eventQ, error) {
+	if h.createSem != nil {
+		select {
+		case h.createSem <- struct{}{}:
+		default:
+			stats.TopicCreationWaits.Add(1)
+			select {
+			case h.createSem <- struct{}{}:
+			case <-ctx.Done():
+				return nil, errors.Wrap(ctx.Err(), "waiting to create topic")
+			}
+		}
+		defer func() { <-h.createSem }()
+	}
+
+	topic, err := h.topics.create(name)
+	if err != nil {
+		return nil, err
+	}
+	q := newEventQ(h.conf)
+	q.setTopic(topic)
+	q.setAllocator(h.alloc)
+	q.setInterceptor(h.intercept)
+	if err := q.GoStart(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// handleDryBatch handles DRYBATCH requests for topics that don't exist yet. A
+// BATCH would create the topic and be written at offset 0, but a dry run
+// shouldn't create anything, so it's checked here instead of in a topic's
+// queue.
+func (h *Handlers) handleDryBatch(req *protocol.Request, name string) (*protocol.Response, error) {
+	resp, err := h.doDryBatch(req, name)
+	instrumentRequest(req, stats.BatchRequests, stats.BatchErrors, err)
+	return resp, err
+}
+
+func (h *Handlers) doDryBatch(req *protocol.Request, name string) (*protocol.Response, error) {
+	resp := req.Response
+	batch, err := protocol.NewBatch(h.conf).FromRequest(req)
+	if err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+	if err := h.topics.checkLimit(name); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+	if h.intercept != nil {
+		if _, err := interceptMessages(h.intercept, name, batch, protocol.NewBatch(h.conf), protocol.NewMessage(h.conf)); err != nil {
+			return errResponse(h.conf, req, resp, err)
+		}
+	}
+
+	cr := req.Response.ClientResponse
+	cr.SetOffset(0)
+	cr.SetBatches(0)
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// pushSubscription handles READ, SREAD, READRANGE, and TAIL requests, which
+// hold a subscription until the server has finished sending the response.
+// All but TAIL also hold a read.
+func (h *Handlers) pushSubscription(ctx context.Context, q *eventQ, req *protocol.Request) (*protocol.Response, error) {
+	if !h.acquireSubscription() {
+		err := protocol.NewRespError(protocol.ErrTooManySubscriptions, "limit is %d", h.conf.MaxSubscriptions)
+		return errResponse(h.conf, req, req.Response, err)
+	}
+
+	release := h.releaseSubscription
+	if req.Name != protocol.CmdTail {
+		if !h.acquireRead() {
+			h.releaseSubscription()
+			err := protocol.NewRespError(protocol.ErrTooBusy, "read limit is %d", h.conf.MaxReads)
+			return errResponse(h.conf, req, req.Response, err)
+		}
+		release = h.releaseReadSubscription
+	}
+
+	resp, err := q.PushRequest(ctx, req)
+	if err != nil || resp == nil {
+		release()
+		return resp, err
+	}
+	resp.SetDoneFunc(release)
+	return resp, err
+}
+
+func (h *Handlers) acquireSubscription() bool {
+	n := atomic.AddInt64(&h.subscriptions, 1)
+	if h.conf.MaxSubscriptions > 0 && n > int64(h.conf.MaxSubscriptions) {
+		atomic.AddInt64(&h.subscriptions, -1)
+		return false
+	}
+	stats.Subscriptions.Add(1)
+	return true
+}
+
+func (h *Handlers) releaseSubscription() {
+	atomic.AddInt64(&h.subscriptions, -1)
+	stats.Subscriptions.Add(-1)
+}
+
+func (h *Handlers) acquireRead() bool {
+	n := atomic.AddInt64(&h.reads, 1)
+	if h.conf.MaxReads > 0 && n > int64(h.conf.MaxReads) {
+		atomic.AddInt64(&h.reads, -1)
+		return false
+	}
+	stats.Reads.Add(1)
+	return true
+}
+
+func (h *Handlers) releaseReadSubscription() {
+	atomic.AddInt64(&h.reads, -1)
+	stats.Reads.Add(-1)
+	h.releaseSubscription()
+}
+
+// Reads returns the number of READ and SREAD responses currently being sent
+// across all topics.
+func (h *Handlers) Reads() int {
+	return int(atomic.LoadInt64(&h.reads))
+}
+
+// Subscriptions returns the number of READ and TAIL responses currently being
+// sent across all topics.
+func (h *Handlers) Subscriptions() int {
+	return int(atomic.LoadInt64(&h.subscriptions))
+}
+
+// handleHeads responds with the head offset of each topic the principal may
+// read. Heads are read from each topic's queue without waiting on it, so the
+// response is a best-effort snapshot: topics may be written to while it's
+// gathered, and a topic created meanwhile may be missing.
+func (h *Handlers) handleHeads(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	resp, err := h.doHeads(ctx, req)
+	instrumentRequest(req, stats.HeadRequests, stats.HeadErrors, err)
+	return resp, err
+}
+
+func (h *Handlers) doHeads(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	if _, err := protocol.NewHeadsRequest(h.conf).FromRequest(req); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+
+	principal := transport.Principal(ctx)
+	action := reqActions[req.Name]
+	hr := protocol.NewHeadsResponse(h.conf)
+	h.mu.Lock()
+	for name, q := range h.h {
+		if h.authz != nil && h.authz.Authorize(principal, name, action) != nil {
+			continue
+		}
+		hr.Add(name, q.Head())
+	}
+	h.mu.Unlock()
+
+	cr := protocol.NewClientMultiResponse(h.conf, hr.MultiResponse())
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+// handleInfo responds with the server's version, build commit, and how long
+// it's been running.
+func (h *Handlers) handleInfo(req *protocol.Request) (*protocol.Response, error) {
+	resp, err := h.doInfo(req)
+	instrumentRequest(req, stats.InfoRequests, stats.InfoErrors, err)
+	return resp, err
+}
+
+func (h *Handlers) doInfo(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	if _, err := protocol.NewInfoRequest(h.conf).FromRequest(req); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+
+	ir := protocol.NewInfoResponse(h.conf)
+	ir.Version = internal.Version
+	ir.Commit = internal.Commit
+	ir.Started = h.started
+	ir.Uptime = now().Sub(h.started)
+
+	cr := protocol.NewClientMultiResponse(h.conf, ir.MultiResponse())
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return errResponse(h.conf, req, resp, err)
+	}
+	return resp, nil
+}
+
+func (h *Handlers) authorize(ctx context.Context, req *protocol.Request, topic string) error {
+	if h.authz == nil {
+		return nil
+	}
+
+	principal := transport.Principal(ctx)
+	action := reqActions[req.Name]
+	if err := h.authz.Authorize(principal, topic, action); err != nil {
+		stats.DeniedErrors.Add(1)
+		log.Printf("denied %s on topic %q for principal %q: %+v", action, topic, principal, err)
+		if err == protocol.ErrPermissionDenied {
+			return protocol.NewRespError(err, "%q may not %s topic %q", principal, action, topic)
+		}
+		return err
+	}
+	return nil
+}
+
+// Stop shuts down the servers and topics, returning the first error. Topics
+// whose event queues don't stop within config.QueueStopTimeout are stopped
+// forcibly, and the error's cause is ErrStopTimeout. Their topics are shut down
+// by the event queues once their handlers return.
 func (h *Handlers) Stop() error {
 	defer func() {
 		h.shutdownC <- nil
@@ -192,15 +530,20 @@ func (h *Handlers) Stop() error {
 		}
 	}
 
-	for _, q := range h.h {
-		if err := internal.LogAndReturnError(q.Stop()); err != nil {
+	killed := make(map[string]bool)
+	for name, q := range h.h {
+		err := q.Stop()
+		if err == ErrStopTimeout {
+			killed[name] = true
+		}
+		if err := internal.LogAndReturnError(errors.Wrapf(err, "stopping topic %s", name)); err != nil {
 			if firstErr == nil {
 				firstErr = err
 			}
 		}
 	}
 
-	if err := internal.LogAndReturnError(h.topics.Shutdown()); err != nil {
+	if err := internal.LogAndReturnError(h.topics.shutdownExcept(killed)); err != nil {
 		if firstErr == nil {
 			firstErr = err
 		}
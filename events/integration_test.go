@@ -1,7 +1,14 @@
 package events
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -10,6 +17,7 @@ import (
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/logd"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 	"github.com/jeffrom/logd/testhelper"
 	"github.com/pkg/errors"
 )
@@ -167,6 +175,884 @@ func TestIntegrationReconnect4(t *testing.T) {
 	testIntegrationReconnect(t, ts)
 }
 
+func TestIntegrationWriterClose(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	// the messages should only be sent by Close
+	cconf.WaitInterval = time.Hour
+
+	ts := newIntegrationTestState(conf, cconf, 1)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := ts.writers[0]
+	msgs := []string{"hi", "hallo", "sup"}
+	for _, msg := range msgs {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c, err := logd.DialConfig(ts.cconf.Hostport, ts.cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	_, bs, err := c.ReadOffset([]byte("default"), 0, len(msgs))
+	if err != nil {
+		t.Fatalf("expected messages written before Close to be persisted: %+v", err)
+	}
+	if !bs.Scan() {
+		t.Fatalf("expected a batch but got none: %+v", bs.Error())
+	}
+	if n := bs.Batch().Messages; n != len(msgs) {
+		t.Fatalf("expected %d messages but got %d", len(msgs), n)
+	}
+}
+
+func TestIntegrationTailEmpty(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = 10 * time.Millisecond
+	cconf.UseTail = true
+	cconf.ReadForever = true
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	s := logd.NewScanner(cconf, "default")
+	defer s.Close()
+	msgC := make(chan *protocol.Message, 1)
+	go func() {
+		if !s.Scan() {
+			msgC <- nil
+			return
+		}
+		msgC <- s.Message()
+	}()
+
+	// let the scanner find the topic empty a few times before the first
+	// message is written.
+	time.Sleep(5 * cconf.WaitInterval)
+	select {
+	case msg := <-msgC:
+		t.Fatalf("expected scanner to wait for the first message but got %v (err: %+v)", msg, s.Error())
+	default:
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	batch := protocol.NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	if err := batch.Append([]byte("first")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := c.Batch(batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	select {
+	case msg := <-msgC:
+		if msg == nil {
+			t.Fatalf("scan: %+v", s.Error())
+		}
+		if msg.Offset != 0 || !bytes.Equal(msg.BodyBytes(), []byte("first")) {
+			t.Fatalf("expected %q at offset 0 but got %q at %d", "first", msg.BodyBytes(), msg.Offset)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+}
+
+func TestIntegrationChecksumCastagnoli(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	conf.Checksum = config.ChecksumCastagnoli
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.Checksum = config.ChecksumCastagnoli
+
+	ts := newIntegrationTestState(conf, cconf, 1)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := ts.writers[0]
+	if _, err := w.Write([]byte("hi")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, _, err := w.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	msgs, err := c.ReadAll([]byte("default"), 0, 1)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].BodyBytes(), []byte("hi")) {
+		t.Fatalf("expected to read %q but got %+v", "hi", msgs)
+	}
+
+	// clients calculating ieee checksums can't write to the log, and fail the
+	// pre-flight check.
+	iconf := *cconf
+	iconf.Checksum = config.ChecksumIEEE
+	iconf.ConnRetries = 0
+	ic, err := logd.DialConfig(iconf.Hostport, &iconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ic.Close()
+	batch := protocol.NewBatch(iconf.ToGeneralConfig())
+	batch.SetTopic([]byte("default"))
+	if err := batch.Append([]byte("hi")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := ic.Batch(batch); err == nil {
+		t.Fatal("expected a batch with an ieee checksum to be rejected")
+	}
+
+	iconf.Preflight = true
+	if _, err := logd.DialConfig(iconf.Hostport, &iconf); err != logd.ErrIncompatible {
+		t.Fatalf("expected %v but got %+v", logd.ErrIncompatible, err)
+	}
+}
+
+func TestIntegrationConnFlushBytes(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	conf.ConnFlushBytes = 256
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.Limit = 1
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	// small batches are buffered with their response envelopes, and the large
+	// one is sent with sendfile.
+	var expected []string
+	for _, size := range []int{1, 10, 1000, 10} {
+		msg := strings.Repeat("a", size)
+		batch := protocol.NewBatch(conf)
+		batch.SetTopic([]byte("default"))
+		if err := batch.Append([]byte(msg)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err := c.Batch(batch); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		expected = append(expected, msg)
+	}
+
+	var read []string
+	err = c.ReadTo([]byte("default"), 0, 0, func(msg *protocol.Message) error {
+		read = append(read, string(msg.BodyBytes()))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Fatalf("expected messages of sizes 1, 10, 1000, 10 but got %d messages", len(read))
+	}
+}
+
+func TestIntegrationWriterFlushStats(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = time.Hour
+	cconf.BatchSize = 100
+
+	ts := newIntegrationTestState(conf, cconf, 1)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := ts.writers[0]
+	if _, err := w.Write([]byte("hi")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, _, err := w.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// flushing an empty batch isn't counted
+	if _, _, err := w.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for w.Stats().SizeFlushes == 0 {
+		if _, err := w.Write([]byte("hallo")); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	stats := w.Stats()
+	if stats.SizeFlushes != 1 || stats.ManualFlushes != 1 || stats.CloseFlushes != 1 || stats.TimerFlushes != 0 {
+		t.Fatalf("expected one size, manual, and close flush but got %+v", stats)
+	}
+}
+
+func TestIntegrationWriterFlushCounts(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = time.Hour
+
+	ts := newIntegrationTestState(conf, cconf, 1)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := ts.writers[0]
+	for _, msg := range []string{"hi", "hallo"} {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	msgs, n, err := w.Flush()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expectedN := protocol.MessageSize(2) + protocol.MessageSize(5)
+	if msgs != 2 || n != expectedN {
+		t.Fatalf("expected to flush 2 messages (%d bytes) but flushed %d (%d bytes)", expectedN, msgs, n)
+	}
+
+	msgs, n, err = w.Flush()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if msgs != 0 || n != 0 {
+		t.Fatalf("expected empty flush but flushed %d messages (%d bytes)", msgs, n)
+	}
+}
+
+func TestIntegrationReadMerged(t *testing.T) {
+	var clock int64
+	now = func() time.Time { return testTime.Add(time.Duration(atomic.LoadInt64(&clock)) * time.Second) }
+	defer func() { now = func() time.Time { return testTime } }()
+
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = time.Hour
+	// one batch per READ, so topics are read in several requests
+	cconf.Limit = 1
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	writers := map[string]*logd.Writer{
+		"a": logd.NewWriter(cconf, "a"),
+		"b": logd.NewWriter(cconf, "b"),
+	}
+	for _, w := range writers {
+		defer w.Close()
+	}
+
+	writes := []struct {
+		clock int64
+		topic string
+		msg   string
+	}{
+		{1, "b", "b1"},
+		{2, "a", "a2"},
+		{3, "b", "b3"},
+		{3, "a", "a3"},
+		{4, "b", "b4"},
+	}
+	for _, wr := range writes {
+		atomic.StoreInt64(&clock, wr.clock)
+		w := writers[wr.topic]
+		if _, err := w.Write([]byte(wr.msg)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, _, err := w.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	readMerged := func(start time.Time) []string {
+		s, err := c.ReadMerged([]string{"b", "a"}, start)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		var got []string
+		for s.Scan() {
+			msg := s.Message()
+			if s.Topic() != string(msg.Body[:1]) {
+				t.Fatalf("expected %q to be from topic %q", msg.Body, s.Topic())
+			}
+			got = append(got, string(msg.Body))
+		}
+		if err := s.Error(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return got
+	}
+
+	// ties are ordered by topic name
+	expected := []string{"b1", "a2", "a3", "b3", "b4"}
+	if got := readMerged(time.Time{}); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %q but got %q", expected, got)
+	}
+
+	expected = []string{"a3", "b3", "b4"}
+	if got := readMerged(testTime.Add(3 * time.Second)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %q but got %q", expected, got)
+	}
+}
+
+func TestIntegrationFollowTime(t *testing.T) {
+	var clock int64
+	now = func() time.Time { return testTime.Add(time.Duration(atomic.LoadInt64(&clock)) * time.Second) }
+	defer func() { now = func() time.Time { return testTime } }()
+
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = 10 * time.Millisecond
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := logd.NewWriter(cconf, "default")
+	defer w.Close()
+	write := func(at int64, msg string) error {
+		atomic.StoreInt64(&clock, at)
+		if _, err := w.Write([]byte(msg)); err != nil {
+			return err
+		}
+		_, _, err := w.Flush()
+		return err
+	}
+	for i, msg := range []string{"one", "two", "three"} {
+		if err := write(int64(i+1), msg); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	s, clamped, err := c.FollowTime([]byte("default"), testTime.Add(2*time.Second), 1)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer s.Stop()
+	if clamped {
+		t.Fatal("expected the start not to be clamped")
+	}
+
+	scan := func(expected string) {
+		if !s.Scan() {
+			t.Fatalf("expected to scan %q (err: %+v)", expected, s.Error())
+		}
+		if got := string(s.Message().BodyBytes()); got != expected {
+			t.Fatalf("expected %q but got %q", expected, got)
+		}
+	}
+	scan("two")
+	scan("three")
+
+	// the scanner keeps following the topic
+	errC := make(chan error, 1)
+	go func() {
+		time.Sleep(5 * cconf.WaitInterval)
+		errC <- write(4, "four")
+	}()
+	scan("four")
+	if err := <-errC; err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestIntegrationHeadroom(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	conf.ReportHeadroom = true
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := logd.NewWriter(cconf, "default")
+	defer w.Close()
+	for _, msg := range []string{"one", "two"} {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, _, err := w.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	head, err := c.Head([]byte("default"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	h, ok := c.Headroom()
+	if !ok {
+		t.Fatal("expected the server to report headroom")
+	}
+	if h.Offsets != head || !h.Oldest.Equal(testTime) {
+		t.Fatalf("expected headroom %d since %s but got %d since %s", head, testTime, h.Offsets, h.Oldest)
+	}
+	if d := h.Time(testTime.Add(time.Minute)); d != time.Minute {
+		t.Fatalf("expected a minute of headroom but got %s", d)
+	}
+}
+
+func TestIntegrationReadCompressed(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = time.Hour
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := logd.NewWriter(cconf, "default")
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 50; j++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("compress me %d", j))); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if _, _, err := w.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	readAll := func(c *logd.Client) []string {
+		msgs, err := c.ReadAll([]byte("default"), 0, 150)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		bodies := make([]string, len(msgs))
+		for i, msg := range msgs {
+			bodies[i] = string(msg.Body)
+		}
+		return bodies
+	}
+
+	plain, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer plain.Close()
+	expected := readAll(plain)
+	if len(expected) != 150 {
+		t.Fatalf("expected 150 messages but read %d", len(expected))
+	}
+
+	zconf := *cconf
+	zconf.Compress = true
+	c, err := logd.DialConfig(zconf.Hostport, &zconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+
+	in, out := stats.CompressionBytesIn.Value(), stats.CompressionBytesOut.Value()
+	// read twice to check each response's stream is read to its end
+	for i := 0; i < 2; i++ {
+		if got := readAll(c); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %q but got %q", expected, got)
+		}
+	}
+	if _, err := c.Head([]byte("default")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	in = stats.CompressionBytesIn.Value() - in
+	out = stats.CompressionBytesOut.Value() - out
+	if in == 0 || out >= in {
+		t.Fatalf("expected batches to be compressed, but %d bytes were sent as %d", in, out)
+	}
+	t.Logf("compressed %d batch bytes to %d (%.1f%%)", in, out, 100*float64(out)/float64(in))
+}
+
+func TestIntegrationServerStats(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	for _, compress := range []bool{false, true} {
+		zconf := *cconf
+		zconf.Compress = compress
+		c, err := logd.DialConfig(zconf.Hostport, &zconf)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		out := stats.CompressionBytesOut.Value()
+		res, err := c.ServerStats()
+		c.Close()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, ok := res["requests.stats"]; !ok {
+			t.Fatalf("expected requests.stats in %v", res)
+		}
+		if compressed := stats.CompressionBytesOut.Value() > out; compressed != compress {
+			t.Fatalf("expected compressed to be %t but got %t", compress, compressed)
+		}
+	}
+}
+
+func TestIntegrationReadRange(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = time.Hour
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	w := logd.NewWriter(cconf, "default")
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte(fmt.Sprintf("range %d", i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, _, err := w.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	topic := []byte("default")
+	head, err := c.Head(topic)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	readRange := func(start, end uint64, inclusive bool) (uint64, []uint64) {
+		t.Helper()
+		served, bs, err := c.ReadRange(topic, start, end, inclusive)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		var offs []uint64
+		for bs.Scan() {
+			offs = append(offs, bs.Offset())
+		}
+		return served, offs
+	}
+
+	served, offs := readRange(0, head, false)
+	if served != head || len(offs) != 5 {
+		t.Fatalf("expected 5 batches up to %d but got %v up to %d", head, offs, served)
+	}
+
+	tests := []struct {
+		name       string
+		start, end uint64
+		inclusive  bool
+		served     uint64
+		expected   []uint64
+	}{
+		{"exclusive", offs[1], offs[3], false, offs[3], offs[1:3]},
+		{"inclusive", offs[1], offs[3], true, offs[4], offs[1:4]},
+		{"past head", offs[3], head + 1000, true, head, offs[3:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served, actual := readRange(tt.start, tt.end, tt.inclusive)
+			if served != tt.served || !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected batches %v up to %d but got %v up to %d", tt.expected, tt.served, actual, served)
+			}
+		})
+	}
+
+	if _, _, err := c.ReadRange(topic, head, head+1, false); errors.Cause(err) != protocol.ErrNotFound {
+		t.Fatalf("expected %v reading from the head but got %+v", protocol.ErrNotFound, err)
+	}
+}
+
+func TestIntegrationRestore(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	topic := []byte("default")
+	for i := 0; i < 5; i++ {
+		batch := protocol.NewBatch(conf)
+		batch.SetTopic(topic)
+		if err := batch.Append([]byte(fmt.Sprintf("restore %d", i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err := c.Batch(batch); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	head, err := c.Head(topic)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// dump everything after the first batch, so the restored log starts at
+	// an offset other than 0.
+	_, bs, err := c.ReadRange(topic, 0, head, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var offs []uint64
+	var dumped []*protocol.Batch
+	for bs.Scan() {
+		offs = append(offs, bs.Offset())
+		dumped = append(dumped, bs.Batch().Copy())
+	}
+	if err := bs.Error(); err != nil && err != io.EOF {
+		t.Fatalf("%+v", err)
+	}
+	offs, dumped = offs[1:], dumped[1:]
+
+	rconf := testhelper.IntegrationTestConfig(testing.Verbose())
+	rconf.AuthSecret = "secret"
+	rconf.AdminSecret = "admin-secret"
+	rcconf := newIntegrationTestClientConfig(testing.Verbose())
+	rcconf.AuthToken = "secret"
+	rts := newIntegrationTestState(rconf, rcconf, 0)
+	rts.setup(t)
+	defer doShutdownHandler(t, rts.h)
+
+	user, err := logd.DialConfig(rcconf.Hostport, rcconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer user.Close()
+	if _, err := user.Restore(dumped[0], offs[0]); errors.Cause(err) != protocol.ErrPermissionDenied {
+		t.Fatalf("expected %v but got %+v", protocol.ErrPermissionDenied, err)
+	}
+
+	adminConf := *rcconf
+	adminConf.AuthToken = "admin-secret"
+	admin, err := logd.DialConfig(adminConf.Hostport, &adminConf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer admin.Close()
+	for i, batch := range dumped {
+		off, err := admin.Restore(batch, offs[i])
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if off != offs[i] {
+			t.Fatalf("expected batch %d to be restored at %d but got %d", i, offs[i], off)
+		}
+	}
+
+	// batches must be restored in order, without gaps
+	if _, err := admin.Restore(dumped[0], offs[0]); errors.Cause(err) != protocol.ErrInvalidOffset {
+		t.Fatalf("expected %v restoring behind the head but got %+v", protocol.ErrInvalidOffset, err)
+	}
+	if _, err := admin.Restore(dumped[0], head+1); errors.Cause(err) != protocol.ErrInvalidOffset {
+		t.Fatalf("expected %v restoring past the head but got %+v", protocol.ErrInvalidOffset, err)
+	}
+
+	rhead, err := user.Head(topic)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if rhead != head {
+		t.Fatalf("expected restored head %d but got %d", head, rhead)
+	}
+	_, rbs, err := user.ReadRange(topic, offs[0], rhead, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var roffs []uint64
+	for i := 0; rbs.Scan(); i++ {
+		roffs = append(roffs, rbs.Offset())
+		if b := rbs.Batch(); i < len(dumped) && !bytes.Equal(b.MessageBytes(), dumped[i].MessageBytes()) {
+			t.Fatalf("expected batch at %d to be:\n\n\t%q\n\nbut got:\n\n\t%q", rbs.Offset(), dumped[i].MessageBytes(), b.MessageBytes())
+		}
+	}
+	if !reflect.DeepEqual(roffs, offs) {
+		t.Fatalf("expected restored offsets %v but got %v", offs, roffs)
+	}
+}
+
+func TestIntegrationErase(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	conf.AuthSecret = "secret"
+	conf.AdminSecret = "admin-secret"
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.AuthToken = "secret"
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	c, err := logd.DialConfig(cconf.Hostport, cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	topic := []byte("default")
+	var offs []uint64
+	for i := 0; i < 5; i++ {
+		batch := protocol.NewBatch(conf)
+		batch.SetTopic(topic)
+		if err := batch.Append([]byte(fmt.Sprintf("erase %d", i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		off, err := c.Batch(batch)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		offs = append(offs, off)
+	}
+	head, err := c.Head(topic)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err := c.Erase(topic, offs[2], offs[3]); errors.Cause(err) != protocol.ErrPermissionDenied {
+		t.Fatalf("expected %v but got %+v", protocol.ErrPermissionDenied, err)
+	}
+
+	adminConf := *cconf
+	adminConf.AuthToken = "admin-secret"
+	admin, err := logd.DialConfig(adminConf.Hostport, &adminConf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer admin.Close()
+	n, err := admin.Erase(topic, offs[2], offs[3])
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 batch erased but got %d", n)
+	}
+	if _, err := admin.Erase(topic, head, head+100); errors.Cause(err) != protocol.ErrNotFound {
+		t.Fatalf("expected %v erasing past the head but got %+v", protocol.ErrNotFound, err)
+	}
+
+	if h, err := c.Head(topic); err != nil || h != head {
+		t.Fatalf("expected head %d but got %d (err: %+v)", head, h, err)
+	}
+	_, bs, err := c.ReadRange(topic, 0, head, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	msg := protocol.NewMessage(conf)
+	for i := 0; bs.Scan(); i++ {
+		if bs.Offset() != offs[i] {
+			t.Fatalf("expected batch %d at %d but got %d", i, offs[i], bs.Offset())
+		}
+		msg.Reset()
+		if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewReader(bs.Batch().MessageBytes()))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		expected := []byte(fmt.Sprintf("erase %d", i))
+		if i == 2 {
+			expected = make([]byte, msg.Size)
+		}
+		if !bytes.Equal(msg.BodyBytes(), expected) {
+			t.Fatalf("expected batch at %d to contain %q but got %q", offs[i], expected, msg.BodyBytes())
+		}
+	}
+	if err := bs.Error(); err != nil && err != io.EOF {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestIntegrationPipelinedBatches(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	fixture := testhelper.LoadFixture("batch.small")
+	size := uint64(len(logged(t, conf, fixture)))
+
+	conn, err := net.Dial("tcp", cconf.Hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// send every request before reading any of the responses
+	n := 10
+	b := &bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		b.Write(fixture)
+	}
+	b.WriteString("HEAD default\r\n")
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	cr := protocol.NewClientResponseConfig(conf)
+	for i := 0; i <= n; i++ {
+		cr.Reset()
+		if _, err := cr.ReadFrom(br); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := cr.Error(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if expected := size * uint64(i); cr.Offset() != expected {
+			t.Fatalf("expected response %d to have offset %d but got %d", i, expected, cr.Offset())
+		}
+	}
+}
+
 func testIntegrationWriter(t *testing.T, ts *integrationTest) {
 	n := 10000
 	errC := make(chan error, ts.n)
@@ -188,7 +1074,7 @@ func testIntegrationWriter(t *testing.T, ts *integrationTest) {
 				atomic.AddInt32(&wrote, 1)
 			}
 
-			if err := w.Flush(); err != nil {
+			if _, _, err := w.Flush(); err != nil {
 				errC <- errors.Wrap(err, "flush failed")
 				return
 			}
@@ -294,7 +1180,7 @@ func testIntegrationReconnect(t *testing.T, ts *integrationTest) {
 					atomic.AddInt32(&wrote, 1)
 				}
 
-				if err := w.Flush(); err != nil && !logd.IsRetryable(err) {
+				if _, _, err := w.Flush(); err != nil && !logd.IsRetryable(err) {
 					errC <- errors.Wrap(err, "flush failed")
 					return
 				}
@@ -322,7 +1208,7 @@ func testIntegrationReconnect(t *testing.T, ts *integrationTest) {
 			}
 			atomic.AddInt32(&wrote, 1)
 		}
-		if err := w.Flush(); err != nil {
+		if _, _, err := w.Flush(); err != nil {
 			t.Fatalf("failed to flush previously failed messages: %+v", err)
 		}
 		w.Close()
@@ -345,3 +1231,236 @@ func failOnErrors(t *testing.T, errC chan error) {
 		}
 	}
 }
+
+func TestIntegrationWriterStream(t *testing.T) {
+	conf := testhelper.IntegrationTestConfig(testing.Verbose())
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.WaitInterval = 10 * time.Millisecond
+
+	ts := newIntegrationTestState(conf, cconf, 0)
+	ts.setup(t)
+	defer doShutdownHandler(t, ts.h)
+
+	conns := stats.TotalConnections.Value()
+	w, err := logd.DialWriterConfig(cconf.Hostport, cconf, "default")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer w.Close()
+
+	// tail the topic over the writer's connection while it's being written
+	s, err := w.OpenStream([]byte("default"), 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	n := 100
+	errC := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("msg %d", i))); err != nil {
+				errC <- err
+				return
+			}
+			if i%10 == 9 {
+				if _, _, err := w.Flush(); err != nil {
+					errC <- err
+					return
+				}
+			}
+		}
+		errC <- nil
+	}()
+
+	var read []string
+	for len(read) < n {
+		batch, err := s.Next()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		br := bufio.NewReader(bytes.NewReader(batch.MessageBytes()))
+		for i := 0; i < batch.Messages; i++ {
+			msg := protocol.NewMessage(conf)
+			if _, err := msg.ReadFrom(br); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			read = append(read, string(msg.BodyBytes()))
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for i, body := range read {
+		if expected := fmt.Sprintf("msg %d", i); body != expected {
+			t.Fatalf("expected message %d to be %q but got %q", i, expected, body)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.TotalConnections.Value() - conns; n != 1 {
+		t.Fatalf("expected the writer and stream to share 1 connection but %d were made", n)
+	}
+}
+
+// testProxy forwards connections to a server until it's stopped, so tests can
+// make the server unreachable and bring it back at the same address.
+type testProxy struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestProxy(t *testing.T, addr, target string) *testProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	p := &testProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *testProxy) Stop() {
+	p.ln.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestIntegrationMultiClient(t *testing.T) {
+	cconf := newIntegrationTestClientConfig(testing.Verbose())
+	cconf.HealthCheckInterval = 50 * time.Millisecond
+
+	// each server's log has a message naming it, so reads show which server
+	// they were sent to.
+	names := []string{"leader", "replica1", "replica2"}
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		conf := testhelper.IntegrationTestConfig(testing.Verbose())
+		conf.Host = ":0"
+		conf.HttpHost = ""
+		h := NewHandlers(conf)
+		doStartHandler(t, h)
+		defer doShutdownHandler(t, h)
+		addrs[i] = h.servers[0].ListenAddr().String()
+
+		if i == 0 {
+			continue
+		}
+		c, err := logd.DialConfig(addrs[i], cconf)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		batch := protocol.NewBatch(cconf.ToGeneralConfig())
+		batch.SetTopic([]byte("default"))
+		batch.Append([]byte(name))
+		if _, err := c.Batch(batch); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		c.Close()
+	}
+
+	// the second replica is reached through a proxy, so it can go away
+	replica2 := addrs[2]
+	proxy := startTestProxy(t, "127.0.0.1:0", replica2)
+	defer func() { proxy.Stop() }()
+	addrs[2] = proxy.Addr()
+
+	m, err := logd.DialMulti(addrs[0], addrs[1:], cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer m.Close()
+
+	batch := protocol.NewBatch(cconf.ToGeneralConfig())
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("leader"))
+	if _, err := m.Batch(batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c, err := logd.DialConfig(addrs[0], cconf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer c.Close()
+	if msgs, err := c.ReadAll([]byte("default"), 0, 1); err != nil || len(msgs) != 1 || string(msgs[0].Body) != "leader" {
+		t.Fatalf("expected the batch to be written to the leader but got %v (err: %+v)", msgs, err)
+	}
+
+	read := func() string {
+		t.Helper()
+		_, bs, err := m.ReadOffset([]byte("default"), 0, 1)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !bs.Scan() {
+			t.Fatalf("expected a batch but got none (err: %+v)", bs.Error())
+		}
+		msg := protocol.NewMessage(cconf.ToGeneralConfig())
+		if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewReader(bs.Batch().MessageBytes()))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return string(msg.BodyBytes())
+	}
+	readN := func(n int) []string {
+		t.Helper()
+		var got []string
+		for i := 0; i < n; i++ {
+			got = append(got, read())
+		}
+		return got
+	}
+
+	expected := []string{"replica1", "replica2", "replica1", "replica2"}
+	if got := readN(4); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected reads to be spread across replicas but got %q", got)
+	}
+
+	// reads fail over to the healthy replica
+	proxy.Stop()
+	expected = []string{"replica1", "replica1", "replica1"}
+	if got := readN(3); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected reads to go to the healthy replica but got %q", got)
+	}
+	if healthy := m.Healthy(); !reflect.DeepEqual(healthy, addrs[1:2]) {
+		t.Fatalf("expected only %q to be healthy but got %q", addrs[1:2], healthy)
+	}
+
+	// once it's back, it's sent reads again after it's checked
+	proxy = startTestProxy(t, addrs[2], replica2)
+	time.Sleep(cconf.HealthCheckInterval)
+	expected = []string{"replica2", "replica1", "replica2", "replica1"}
+	if got := readN(4); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected reads to be spread across replicas again but got %q", got)
+	}
+	if healthy := m.Healthy(); !reflect.DeepEqual(healthy, addrs[1:]) {
+		t.Fatalf("expected %q to be healthy but got %q", addrs[1:], healthy)
+	}
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+
+	"github.com/jeffrom/logd/protocol"
+)
+
+// MessageInterceptor is called with each message of a BATCH before it's
+// written, so embedders can enrich or redact messages on the server. It may
+// change the message, such as with SetBody, or return an error to reject the
+// whole batch, which the client receives as the response.
+//
+// The client's checksum is validated before messages are intercepted. The
+// batch is then rebuilt from the intercepted messages, and its timestamp and
+// checksum are set afterwards, so the log holds a valid batch of what the
+// interceptor returned. DRYBATCH batches are intercepted so a rejection is
+// reported, but nothing is written. RESTORE batches aren't intercepted.
+type MessageInterceptor interface {
+	Intercept(topic string, msg *protocol.Message) error
+}
+
+// intercept passes each message in batch to the MessageInterceptor, returning
+// a batch of the results.
+func (q *eventQ) intercept(t *topic, batch *protocol.Batch) (*protocol.Batch, error) {
+	return interceptMessages(q.interceptor, t.name, batch, q.interceptBatch, q.interceptMsg)
+}
+
+// interceptMessages passes each message in batch to i, appending the results
+// to out. Each message is read into msg first.
+func interceptMessages(i MessageInterceptor, topic string, batch *protocol.Batch, out *protocol.Batch, msg *protocol.Message) (*protocol.Batch, error) {
+	out.Reset()
+	out.SetTopic(batch.TopicSlice())
+
+	br := bufio.NewReader(bytes.NewReader(batch.MessageBytes()))
+	for n := 0; n < batch.Messages; n++ {
+		msg.Reset()
+		if _, err := msg.ReadFrom(br); err != nil {
+			return nil, err
+		}
+		if err := i.Intercept(topic, msg); err != nil {
+			return nil, err
+		}
+
+		// the batch keeps references to what's appended, and msg is reused
+		body := append([]byte(nil), msg.BodyBytes()...)
+		var err error
+		if msg.Tombstone {
+			err = out.AppendTombstone(body)
+		} else if key := msg.Key(); key != nil {
+			err = out.AppendKeyed(append([]byte(nil), key...), body)
+		} else {
+			err = out.Append(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/logd"
@@ -80,6 +83,244 @@ func TestMockServerBatchAndRead(t *testing.T) {
 	// 	}
 }
 
+func TestMockServerStreams(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	q, s, shutdown := newMockServerQ(t, conf)
+	doStartHandler(t, q)
+	defer shutdown()
+	cconf := logd.DefaultTestConfig(testing.Verbose())
+	client, clientShutdown := newMockServerClient(t, cconf, s)
+	defer clientShutdown()
+
+	fixture := testhelper.LoadFixture("batch.small")
+	for i := 0; i < 2; i++ {
+		batch := protocol.NewBatch(conf)
+		if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Batch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := protocol.NewBatch(conf)
+	other.SetTopic([]byte("other"))
+	other.Append([]byte("hi"))
+	if _, err := client.Batch(other); err != nil {
+		t.Fatal(err)
+	}
+
+	s1, err := client.OpenStream([]byte("default"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := client.OpenStream([]byte("other"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never consumed, which shouldn't hold up the other streams
+	s3, err := client.OpenStream([]byte("default"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1.ID() == s2.ID() || s2.ID() == s3.ID() || s1.ID() == s3.ID() {
+		t.Fatalf("expected unique stream ids but got %d, %d, %d", s1.ID(), s2.ID(), s3.ID())
+	}
+
+	for i := 0; i < 2; i++ {
+		batch, err := s1.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Messages != 3 {
+			t.Fatalf("expected 3 messages but got %d", batch.Messages)
+		}
+	}
+
+	batch, err := s2.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Messages != 1 || batch.Topic() != "other" {
+		t.Fatalf("expected 1 message in topic other but got %d in %s", batch.Messages, batch.Topic())
+	}
+
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Next(); err != logd.ErrStopped {
+		t.Fatalf("expected %v but got %v", logd.ErrStopped, err)
+	}
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMockServerStreamExpired(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	logb := logged(t, conf, fixture)
+	conf.PartitionSize = len(logb) * 2
+	conf.MaxBatchSize = conf.PartitionSize
+	conf.MaxPartitions = 2
+	q, s, shutdown := newMockServerQ(t, conf)
+	doStartHandler(t, q)
+	defer shutdown()
+	cconf := logd.DefaultTestConfig(testing.Verbose())
+	cconf.WaitInterval = time.Millisecond
+	client, clientShutdown := newMockServerClient(t, cconf, s)
+	defer clientShutdown()
+
+	// enough batches that retention removes the first partition
+	for i := 0; i < 6; i++ {
+		batch := protocol.NewBatch(conf)
+		if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Batch(batch); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	oldest, err := client.Oldest(nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if oldest == 0 {
+		t.Fatal("expected retention to have removed the first batches")
+	}
+
+	// a stream on a topic that doesn't exist yet waits for it
+	waiting, err := client.OpenStream([]byte("other"), 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expired, err := client.OpenStream(nil, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := expired.Next(); errors.Cause(err) != logd.ErrStreamExpired {
+		t.Fatalf("expected %v but got %+v", logd.ErrStreamExpired, err)
+	}
+
+	resumed, err := client.OpenStream(nil, oldest)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := resumed.Next(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := waiting.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waiting.Next(); err != logd.ErrStopped {
+		t.Fatalf("expected %v but got %+v", logd.ErrStopped, err)
+	}
+	if err := resumed.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMockServerReadTo(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	q, s, shutdown := newMockServerQ(t, conf)
+	doStartHandler(t, q)
+	defer shutdown()
+	cconf := logd.DefaultTestConfig(testing.Verbose())
+	// each READ returns one batch, so ReadTo has to continue reading
+	cconf.Limit = 1
+	client, clientShutdown := newMockServerClient(t, cconf, s)
+	defer clientShutdown()
+
+	fixture := testhelper.LoadFixture("batch.small")
+	var offs []uint64
+	for i := 0; i < 3; i++ {
+		batch := protocol.NewBatch(conf)
+		if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+			t.Fatal(err)
+		}
+		off, err := client.Batch(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, off)
+	}
+
+	var bodies []string
+	collect := func(msg *protocol.Message) error {
+		bodies = append(bodies, string(msg.BodyBytes()))
+		return nil
+	}
+
+	if err := client.ReadTo(nil, 0, 0, collect); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []string{"hi", "hallo", "sup", "hi", "hallo", "sup", "hi", "hallo", "sup"}
+	if fmt.Sprint(bodies) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q but got %q", expected, bodies)
+	}
+
+	// batches starting before end are read in full
+	bodies = nil
+	if err := client.ReadTo(nil, offs[1], offs[2]-1, collect); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if fmt.Sprint(bodies) != fmt.Sprint(expected[:3]) {
+		t.Fatalf("expected %q but got %q", expected[:3], bodies)
+	}
+
+	stopErr := errors.New("stop")
+	n := 0
+	err := client.ReadTo(nil, 0, 0, func(msg *protocol.Message) error {
+		n++
+		return stopErr
+	})
+	if err != stopErr || n != 1 {
+		t.Fatalf("expected to stop after 1 message with %v but got %d messages and %+v", stopErr, n, err)
+	}
+}
+
+func TestMockServerReadSubscriptions(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxSubscriptions = 1
+	q, s, shutdown := newMockServerQ(t, conf)
+	doStartHandler(t, q)
+	defer shutdown()
+	cconf := logd.DefaultTestConfig(testing.Verbose())
+	client, clientShutdown := newMockServerClient(t, cconf, s)
+	defer clientShutdown()
+
+	fixture := testhelper.LoadFixture("batch.small")
+	batch := protocol.NewBatch(conf)
+	if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Batch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// each read on the connection holds its own subscription until its
+	// response is sent, so reads one after another, including failed ones,
+	// don't hit the limit or leave subscriptions behind.
+	for i := 0; i < 3; i++ {
+		if _, _, err := client.ReadOffset([]byte("default"), 0, 3); err != nil {
+			t.Fatalf("read %d: %+v", i, err)
+		}
+		if _, _, err := client.ReadOffset([]byte("default"), 1000, 3); errors.Cause(err) != protocol.ErrNotFound {
+			t.Fatalf("read %d: expected %v but got %+v", i, protocol.ErrNotFound, err)
+		}
+	}
+
+	// the subscription is released just after the response is sent
+	deadline := time.Now().Add(time.Second)
+	for q.Subscriptions() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := q.Subscriptions(); n != 0 {
+		t.Fatalf("expected no subscriptions but got %d", n)
+	}
+}
+
 func newMockServerQ(t testing.TB, conf *config.Config) (*Handlers, *server.MockSocket, func()) {
 	h := NewHandlers(conf)
 	s := server.NewMockSocket(conf)
@@ -96,7 +337,7 @@ func newMockServerClient(t testing.TB, conf *logd.Config, s *server.MockSocket)
 	if err != nil {
 		t.Fatal(err)
 	}
-	client := logd.New(logd.DefaultTestConfig(testing.Verbose())).SetConn(c)
+	client := logd.New(conf).SetConn(c)
 	return client, func() {
 		if err := client.Close(); err != nil {
 			t.Fatal(err)
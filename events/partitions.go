@@ -8,6 +8,7 @@ import (
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/logger"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 )
 
 type partitions struct {
@@ -16,13 +17,23 @@ type partitions struct {
 	head   *partition
 	parts  []*partition
 	nparts int
+
+	// partSize is the size new partitions are rotated at. Partitions keep the
+	// size they were added with if it changes, though the head partition
+	// loaded at startup uses the current size.
+	partSize int
+
+	// the partitions and bytes this topic contributes to the stats gauges
+	count int64
+	bytes int64
 }
 
 func newPartitions(conf *config.Config, logp logger.PartitionManager) *partitions {
 	p := &partitions{
-		conf:  conf,
-		parts: make([]*partition, conf.MaxPartitions),
-		logp:  logp,
+		conf:     conf,
+		parts:    make([]*partition, conf.MaxPartitions),
+		logp:     logp,
+		partSize: conf.PartitionSize,
 	}
 
 	for i := 0; i < len(p.parts); i++ {
@@ -39,15 +50,22 @@ func (p *partitions) String() string {
 func (p *partitions) reset() {
 	p.nparts = 0
 	p.head = p.parts[0]
+
+	stats.Partitions.Add(-p.count)
+	stats.PartitionBytes.Add(-p.bytes)
+	p.count = 0
+	p.bytes = 0
 }
 
 // add is used when loading the log from disk
 func (p *partitions) add(offset uint64, size int) error {
 	last := p.parts[p.nparts]
 	if p.nparts == p.conf.MaxPartitions-1 && last.startOffset != 0 {
-		if err := p.logp.Remove(p.parts[0].startOffset); err != nil {
+		removed := p.parts[0]
+		if err := p.logp.Remove(removed.startOffset); err != nil {
 			return err
 		}
+		p.removed(int64(removed.size))
 		p.rotate()
 	}
 
@@ -55,7 +73,9 @@ func (p *partitions) add(offset uint64, size int) error {
 	part.reset()
 	part.startOffset = offset
 	part.size = size
+	part.maxSize = p.partSize
 	p.head = part
+	p.added(int64(size))
 
 	if p.nparts < p.conf.MaxPartitions-1 {
 		p.nparts++
@@ -63,6 +83,43 @@ func (p *partitions) add(offset uint64, size int) error {
 	return nil
 }
 
+// removeOldest removes the oldest partition to free disk space, returning
+// false if only the head partition is left.
+func (p *partitions) removeOldest() (bool, error) {
+	full := p.nparts == p.conf.MaxPartitions-1 && p.parts[p.nparts].startOffset != 0
+	if !full && p.nparts <= 1 {
+		return false, nil
+	}
+
+	removed := p.parts[0]
+	if err := p.logp.Remove(removed.startOffset); err != nil {
+		return false, err
+	}
+	p.removed(int64(removed.size))
+	p.rotate()
+	removed.reset()
+	if !full {
+		p.nparts--
+	}
+	return true, nil
+}
+
+func (p *partitions) added(size int64) {
+	p.count++
+	p.bytes += size
+	stats.Partitions.Add(1)
+	stats.PartitionBytes.Add(size)
+}
+
+func (p *partitions) removed(size int64) {
+	p.count--
+	p.bytes -= size
+	stats.Partitions.Add(-1)
+	stats.PartitionBytes.Add(-size)
+	stats.PartitionsDeleted.Add(1)
+	stats.BytesReclaimed.Add(size)
+}
+
 func (p *partitions) rotate() {
 	parts := p.parts
 	if len(parts) <= 1 {
@@ -75,12 +132,21 @@ func (p *partitions) rotate() {
 	// fmt.Println("after rotate", parts)
 }
 
+// setPartSize sets the size new partitions are rotated at. The head partition
+// is resized too if nothing has been written to it yet.
+func (p *partitions) setPartSize(size int) {
+	p.partSize = size
+	if p.head.size == 0 {
+		p.head.maxSize = size
+	}
+}
+
 func (p *partitions) available() int {
-	return p.conf.PartitionSize - p.head.size
+	return p.head.maxSize - p.head.size
 }
 
 func (p *partitions) shouldRotate(size int) bool {
-	return size >= p.conf.PartitionSize-p.head.size
+	return size >= p.head.maxSize-p.head.size
 }
 
 func (p *partitions) nextOffset() uint64 {
@@ -93,8 +159,11 @@ func (p *partitions) addBatch(b *protocol.Batch, size int) error {
 		if err := p.add(p.nextOffset(), 0); err != nil {
 			return err
 		}
+		stats.PartitionRotations.Add(1)
 	}
 	p.head.addBatch(b, size)
+	p.bytes += int64(size)
+	stats.PartitionBytes.Add(int64(size))
 	return nil
 }
 
@@ -102,6 +171,18 @@ func (p *partitions) headOffset() uint64 {
 	return p.head.startOffset + uint64(p.head.size)
 }
 
+// oldestOffset returns the start offset of the oldest partition that hasn't
+// been removed by retention.
+func (p *partitions) oldestOffset() uint64 {
+	return p.parts[0].startOffset
+}
+
+// oldestTimestamp returns when the oldest batch retention has kept was
+// written, or 0 if it isn't known.
+func (p *partitions) oldestTimestamp() int64 {
+	return p.parts[0].timestamp
+}
+
 // getStartOffset gets the start offset from a global offset
 func (p *partitions) getStartOffset(off uint64) (uint64, error) {
 	for i := 0; i < p.nparts; i++ {
@@ -135,6 +216,12 @@ type partition struct {
 	startOffset uint64
 	nbatches    int
 	size        int
+	maxSize     int
+
+	// timestamp is when the partition's first batch was written, in
+	// nanoseconds since the unix epoch. It's 0 for partitions loaded from
+	// disk, as it isn't read back.
+	timestamp int64
 }
 
 func newPartition(conf *config.Config) *partition {
@@ -154,9 +241,14 @@ func (p *partition) reset() {
 	p.startOffset = 0
 	p.nbatches = 0
 	p.size = 0
+	p.maxSize = 0
+	p.timestamp = 0
 }
 
 func (p *partition) addBatch(b *protocol.Batch, size int) {
+	if p.size == 0 {
+		p.timestamp = b.Timestamp
+	}
 	p.nbatches++
 	p.size += size
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/jeffrom/logd/internal"
 	"github.com/jeffrom/logd/logger"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 )
 
 // topics manages the topic filesystem for the event queues.
@@ -17,7 +18,8 @@ type topics struct {
 	conf    *config.Config
 	manager logger.TopicManager
 	m       map[string]*topic
-	mu      sync.Mutex // for m
+	adding  int        // topics being created, counted against MaxTopics
+	mu      sync.Mutex // for m and adding
 }
 
 func newTopics(conf *config.Config) *topics {
@@ -81,9 +83,19 @@ func (t *topics) Setup() error {
 
 // Shutdown implements LifecycleManager
 func (t *topics) Shutdown() error {
+	return t.shutdownExcept(nil)
+}
+
+// shutdownExcept shuts down every topic but those in skip, which are left for
+// their event queues to shut down.
+func (t *topics) shutdownExcept(skip map[string]bool) error {
 	var firstErr error
 	t.mu.Lock()
-	for _, topic := range t.m {
+	for name, topic := range t.m {
+		if skip[name] {
+			log.Printf("shutdown: leaving topic %s open until its event queue stops", name)
+			continue
+		}
 		err := topic.Shutdown()
 		if err != nil && firstErr == nil {
 			firstErr = err
@@ -116,6 +128,49 @@ func (t *topics) add(name string) (*topic, error) {
 	return topic, nil
 }
 
+// create adds a topic, enforcing the topic limit if the topic doesn't exist
+// yet. Topics being created count against the limit, so different topics can
+// be created at once without going over it.
+func (t *topics) create(name string) (*topic, error) {
+	t.mu.Lock()
+	_, ok := t.m[name]
+	err := t.limitErr(ok)
+	if !ok && err == nil {
+		t.adding++
+	}
+	t.mu.Unlock()
+	if err != nil {
+		stats.TopicCreationRejected.Add(1)
+		return nil, err
+	}
+	if !ok {
+		defer func() {
+			t.mu.Lock()
+			t.adding--
+			t.mu.Unlock()
+		}()
+	}
+	return t.add(name)
+}
+
+// checkLimit returns ErrTooManyTopics if the topic doesn't exist and there's
+// no room for another.
+func (t *topics) checkLimit(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.m[name]
+	return t.limitErr(ok)
+}
+
+// limitErr returns ErrTooManyTopics if a topic that doesn't exist can't be
+// added. t.mu must be held.
+func (t *topics) limitErr(exists bool) error {
+	if t.conf.MaxTopics > 0 && !exists && len(t.m)+t.adding >= t.conf.MaxTopics {
+		return protocol.NewRespError(protocol.ErrTooManyTopics, "limit is %d", t.conf.MaxTopics)
+	}
+	return nil
+}
+
 func (t *topics) get(name string) (*topic, error) {
 	return t.add(name)
 }
@@ -127,6 +182,9 @@ type topic struct {
 	logp  logger.PartitionManager
 	logw  logger.LogWriter
 	logrp logger.LogRepairer
+	hwm   logger.HighWaterMarker
+	fmt   logger.TopicFormatter
+	psize logger.TopicPartitionSizer
 }
 
 func newTopic(conf *config.Config, name string) *topic {
@@ -138,6 +196,9 @@ func newTopic(conf *config.Config, name string) *topic {
 		logp:  logp,
 		logw:  logger.NewWriter(conf, name),
 		logrp: logger.NewRepairer(conf, name),
+		hwm:   logger.NewHighWaterMark(conf, name),
+		fmt:   logger.NewTopicFormat(conf, name),
+		psize: logger.NewTopicPartitionSize(conf, name),
 	}
 }
 
@@ -159,6 +220,29 @@ func (t *topic) Setup() error {
 		}
 	}
 
+	if m, ok := t.hwm.(internal.LifecycleManager); ok {
+		if err := m.Setup(); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := t.fmt.(internal.LifecycleManager); ok {
+		if err := f.Setup(); err != nil {
+			return err
+		}
+	}
+
+	if s, ok := t.psize.(internal.LifecycleManager); ok {
+		if err := s.Setup(); err != nil {
+			return err
+		}
+	}
+	size, err := t.psize.PartitionSize()
+	if err != nil {
+		return err
+	}
+	t.parts.setPartSize(size)
+
 	if err := t.setupPartitions(); err != nil {
 		return err
 	}
@@ -178,6 +262,24 @@ func (t *topic) Shutdown() error {
 			return err
 		}
 	}
+
+	if m, ok := t.hwm.(internal.LifecycleManager); ok {
+		if err := m.Shutdown(); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := t.fmt.(internal.LifecycleManager); ok {
+		if err := f.Shutdown(); err != nil {
+			return err
+		}
+	}
+
+	if s, ok := t.psize.(internal.LifecycleManager); ok {
+		if err := s.Shutdown(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -200,10 +302,13 @@ func (t *topic) setupPartitions() error {
 		}
 	}
 
-	head := t.parts.head
 	if err := t.check(); err != nil {
 		return err
 	}
+	if err := t.checkHighWaterMark(); err != nil {
+		return err
+	}
+	head := t.parts.head
 	if serr := t.logw.SetPartition(head.startOffset); serr != nil {
 		return serr
 	}
@@ -211,6 +316,23 @@ func (t *topic) setupPartitions() error {
 	return nil
 }
 
+// checkHighWaterMark starts a new partition at the topic's high water mark if
+// the log ends before it, which happens when the end of the log was lost or
+// truncated. Offsets that were already handed out are never reused.
+func (t *topic) checkHighWaterMark() error {
+	hwm, err := t.hwm.HighWaterMark()
+	if err != nil {
+		return err
+	}
+	head := t.parts.nextOffset()
+	if hwm <= head {
+		return nil
+	}
+
+	log.Printf("topic %s ends at offset %d, before its high water mark %d. starting a new partition at %d", t.name, head, hwm, hwm)
+	return t.parts.add(hwm, 0)
+}
+
 func (t *topic) check() error {
 	if t.parts.head.size == 0 {
 		return nil
@@ -1,20 +1,9 @@
 module github.com/jeffrom/logd
 
 require (
-	github.com/fsnotify/fsnotify v1.4.7
-	github.com/hashicorp/hcl v1.0.0
 	github.com/inconshreveable/mousetrap v1.0.0
-	github.com/magiconair/properties v1.8.0
-	github.com/mitchellh/mapstructure v1.0.0
-	github.com/pelletier/go-toml v1.2.0
 	github.com/pkg/errors v0.8.0
-	github.com/spf13/afero v1.1.1
-	github.com/spf13/cast v1.2.0
 	github.com/spf13/cobra v0.0.3
-	github.com/spf13/jwalterweatherman v0.0.0-20180814060501-14d3d4c51834
 	github.com/spf13/pflag v1.0.2
-	github.com/spf13/viper v1.1.0
-	golang.org/x/sys v0.0.0-20180831094639-fa5fdf94c789
-	golang.org/x/text v0.3.0
 	gopkg.in/yaml.v2 v2.2.1
 )
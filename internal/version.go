@@ -2,3 +2,8 @@ package internal
 
 // Version specifies the current version of logd.
 const Version = "0.1.0"
+
+// Commit is the commit logd was built from. It's empty unless set at build
+// time:
+// go build -ldflags "-X github.com/jeffrom/logd/internal.Commit=<commit>"
+var Commit string
@@ -3,21 +3,49 @@ package logd
 import (
 	"bufio"
 	"bytes"
-	"errors"
+	"compress/gzip"
+	stderrors "errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
 	"github.com/jeffrom/logd/protocol"
 )
 
 // ErrEmptyBatch is returned when an empty batch write is attempted.
-var ErrEmptyBatch = errors.New("attempted to send an empty batch")
+var ErrEmptyBatch = stderrors.New("attempted to send an empty batch")
+
+// ErrTailing is returned when a request is attempted while the client is
+// still streaming a TAIL response.
+var ErrTailing = stderrors.New("client is tailing")
+
+// ErrNodeChanged is returned when the client reconnects to a different server
+// than it was connected to before.
+var ErrNodeChanged = stderrors.New("server node id changed")
+
+// ErrLogChanged is returned when the client reconnects to a server whose log
+// has been reset since it was last connected, so previous offsets are no
+// longer valid.
+var ErrLogChanged = stderrors.New("server log id changed")
+
+// ErrIncompatible is returned by the pre-flight check when the server's
+// protocol version doesn't match the client's, its max batch size is smaller
+// than the client's batch size, or it calculates checksums with a different
+// polynomial.
+var ErrIncompatible = stderrors.New("server is incompatible")
+
+// defaultTopic is used by requests that don't specify a topic.
+var defaultTopic = []byte("default")
 
 // Dialer defines an interface for connecting to servers. It can be used for
 // mocking in tests.
@@ -41,6 +69,7 @@ type Client struct { // nolint: golint
 	dialer        Dialer
 	readTimeout   time.Duration
 	writeTimeout  time.Duration
+	timeoutMu     sync.Mutex // for readTimeout and writeTimeout
 	retries       int
 	retryInterval time.Duration
 
@@ -60,10 +89,38 @@ type Client struct { // nolint: golint
 	rawbatchbuf *bytes.Buffer
 
 	// can cache these here since client should not be used concurrently
-	cr      *protocol.ClientResponse
-	readreq *protocol.Read
-	tailreq *protocol.Tail
-	bs      *protocol.BatchScanner
+	cr       *protocol.ClientResponse
+	readreq  *protocol.Read
+	rangereq *protocol.ReadRange
+	tailreq  *protocol.Tail
+	bs       *protocol.BatchScanner
+
+	// set while a TAIL response is being streamed from the connection
+	tailing     bool
+	tailBatches int
+
+	// set once the server has agreed to compress READ responses
+	compressed bool
+	zr         *gzip.Reader
+	zbr        *bufio.Reader
+
+	// the identity of the server, as of the last CONFIG response
+	nodeID          string
+	logID           string
+	protocolVersion int
+	limits          *ServerLimits
+
+	// the batch size for the connection, if ReconcileLimits lowered it to the
+	// server's max batch size. see batchSize.
+	reconciledBatchSize int
+
+	stats *Stats
+
+	// reads multiplexed streams, once one has been opened
+	mux *streamMux
+	// held for each BATCH and SREAD request and its response, so batches can
+	// be sent while streams are open. see OpenStream.
+	connMu sync.Mutex
 
 	done chan struct{}
 }
@@ -82,12 +139,14 @@ func New(conf *Config) *Client {
 		cr:           protocol.NewClientResponseConfig(gconf),
 		bs:           protocol.NewBatchScanner(gconf, nil),
 		readreq:      protocol.NewRead(gconf),
+		rangereq:     protocol.NewReadRange(gconf),
 		tailreq:      protocol.NewTail(gconf),
 		done:         make(chan struct{}),
 		batch:        protocol.NewBatch(gconf),
 		batchbuf:     &bytes.Buffer{},
 		rawbatchbuf:  &bytes.Buffer{},
 		batchbr:      bufio.NewReaderSize(nil, conf.BatchSize),
+		stats:        &Stats{},
 	}
 
 	return c
@@ -112,6 +171,11 @@ func DialConfig(addr string, conf *Config) (*Client, error) {
 
 func (c *Client) reset() {
 	c.cr.Reset()
+	c.tailing = false
+	c.tailBatches = 0
+	c.compressed = false
+	c.limits = nil
+	c.reconciledBatchSize = 0
 	// c.readreq.Reset()
 	// c.tailreq.Reset()
 	c.unsetConn()
@@ -142,9 +206,203 @@ func (c *Client) connect(addr string) error {
 	c.reset()
 	c.resetRetries()
 	c.SetConn(conn)
+	atomic.AddInt64(&c.stats.Connects, 1)
+
+	if c.conf.AuthToken != "" {
+		if err := c.Auth([]byte(c.conf.AuthToken)); err != nil {
+			return err
+		}
+	}
+	if c.conf.VerifyIdentity {
+		if err := c.verifyIdentity(); err != nil {
+			return err
+		}
+	}
+	if c.conf.Compress {
+		if err := c.compress(); err != nil {
+			return err
+		}
+	}
+	if c.conf.ReconcileLimits {
+		if err := c.reconcileLimits(); err != nil {
+			return err
+		}
+	}
+	if c.conf.Preflight {
+		return c.preflight()
+	}
+	return nil
+}
+
+// compress asks the server to gzip the batches in READ responses for the rest
+// of the connection.
+func (c *Client) compress() error {
+	compreq := protocol.NewCompressRequest(c.gconf)
+	compreq.SetCodec([]byte(protocol.CompressGzip))
+	if _, _, err := c.do(compreq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	c.compressed = true
+	return nil
+}
+
+// preflight checks the server is responding and is compatible with the
+// client before any other requests are made.
+func (c *Client) preflight() error {
+	var conf *config.Config
+	_, _, err := c.do(protocol.NewConfigRequest(c.gconf))
+	if err == nil {
+		conf, err = c.parseConfigResponse()
+	}
+	if err == nil && c.protocolVersion != protocol.Version {
+		log.Printf("%s: server protocol version is %d, but the client's is %d",
+			c.RemoteAddr(), c.protocolVersion, protocol.Version)
+		err = ErrIncompatible
+	}
+	if err == nil && conf.MaxBatchSize < c.batchSize() {
+		log.Printf("%s: server max batch size is %d, but the client's batch size is %d",
+			c.RemoteAddr(), conf.MaxBatchSize, c.batchSize())
+		err = ErrIncompatible
+	}
+	if err == nil {
+		// servers that don't send a checksum only support ieee
+		checksum := conf.Checksum
+		if checksum == "" {
+			checksum = config.ChecksumIEEE
+		}
+		if checksum != c.conf.getChecksum() {
+			log.Printf("%s: server checksum is %s, but the client's is %s",
+				c.RemoteAddr(), checksum, c.conf.getChecksum())
+			err = ErrIncompatible
+		}
+	}
+
+	if err != nil && c.Conn != nil {
+		internal.IgnoreError(c.conf.Verbose, c.Conn.Close())
+		c.unsetConn()
+	}
+	return err
+}
+
+// reconcileLimits requests the server's limits, lowering the batch size for
+// the connection if it's larger than the server's max batch size. Other
+// mismatches the client can't fix are only logged, so they're noticed before
+// requests start failing.
+func (c *Client) reconcileLimits() error {
+	if _, _, err := c.do(protocol.NewConfigRequest(c.gconf)); err != nil {
+		return err
+	}
+	conf, err := c.parseConfigResponse()
+	if err != nil {
+		return err
+	}
+
+	limits := c.limits
+	if limits.MaxBatchSize > 0 && limits.MaxBatchSize < c.conf.BatchSize {
+		log.Printf("%s: server max batch size is %d, lowering the client's batch size from %d",
+			c.RemoteAddr(), limits.MaxBatchSize, c.conf.BatchSize)
+		c.reconciledBatchSize = limits.MaxBatchSize
+	}
+	if limits.PartitionSize > 0 && limits.PartitionSize < c.batchSize() {
+		log.Printf("%s: server partition size is %d, smaller than the client's batch size of %d",
+			c.RemoteAddr(), limits.PartitionSize, c.batchSize())
+	}
+	if c.protocolVersion != protocol.Version {
+		log.Printf("%s: server protocol version is %d, but the client's is %d",
+			c.RemoteAddr(), c.protocolVersion, protocol.Version)
+	}
+	if conf.Checksum != "" && conf.Checksum != c.conf.getChecksum() {
+		log.Printf("%s: server checksum is %s, but the client's is %s",
+			c.RemoteAddr(), conf.Checksum, c.conf.getChecksum())
+	}
+	return nil
+}
+
+// batchSize returns the largest batch the client sends, which is the
+// configured batch size unless ReconcileLimits lowered it for the connection.
+func (c *Client) batchSize() int {
+	if c.reconciledBatchSize > 0 {
+		return c.reconciledBatchSize
+	}
+	return c.conf.BatchSize
+}
+
+// verifyIdentity requests the server's identity and checks it against the one
+// seen on the previous connection, if any.
+func (c *Client) verifyIdentity() error {
+	nodeID, logID := c.nodeID, c.logID
+	if _, _, err := c.do(protocol.NewConfigRequest(c.gconf)); err != nil {
+		return err
+	}
+	if _, err := c.parseConfigResponse(); err != nil {
+		return err
+	}
+
+	var err error
+	if nodeID != "" && nodeID != c.nodeID {
+		err = ErrNodeChanged
+	} else if logID != "" && logID != c.logID {
+		err = ErrLogChanged
+	}
+	if err != nil {
+		log.Printf("%s: expected node %s (log %s) but got node %s (log %s)",
+			c.RemoteAddr(), nodeID, logID, c.nodeID, c.logID)
+		c.nodeID, c.logID = nodeID, logID
+		internal.IgnoreError(c.conf.Verbose, c.Conn.Close())
+		c.unsetConn()
+		return err
+	}
 	return nil
 }
 
+// NodeID returns the id of the server the client is connected to. It's set
+// after connecting when VerifyIdentity is configured, or by calling Config.
+func (c *Client) NodeID() string {
+	return c.nodeID
+}
+
+// Stats returns a snapshot of the client's counters.
+func (c *Client) Stats() Stats {
+	return c.stats.load()
+}
+
+// ReadTimeout returns how long the client waits for a response.
+func (c *Client) ReadTimeout() time.Duration {
+	c.timeoutMu.Lock()
+	defer c.timeoutMu.Unlock()
+	return c.readTimeout
+}
+
+// SetReadTimeout sets how long the client waits for a response. It takes
+// effect on the next operation.
+func (c *Client) SetReadTimeout(timeout time.Duration) {
+	c.timeoutMu.Lock()
+	c.readTimeout = timeout
+	c.timeoutMu.Unlock()
+}
+
+// WriteTimeout returns how long the client waits to send a request.
+func (c *Client) WriteTimeout() time.Duration {
+	c.timeoutMu.Lock()
+	defer c.timeoutMu.Unlock()
+	return c.writeTimeout
+}
+
+// SetWriteTimeout sets how long the client waits to send a request. It takes
+// effect on the next operation.
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.timeoutMu.Lock()
+	c.writeTimeout = timeout
+	c.timeoutMu.Unlock()
+}
+
 // Stop causes any pending blocking operation to return ErrStopped
 func (c *Client) Stop() {
 	c.done <- struct{}{}
@@ -216,11 +474,14 @@ func (c *Client) unsetSticky() {
 }
 
 // Batch sends a BATCH request and returns the response. Batch does not retry.
-// If you want reconnect functionality, use a Writer
+// If you want reconnect functionality, use a Writer. It may be called while
+// streams are open, sharing the connection with them. See OpenStream.
 func (c *Client) Batch(batch *protocol.Batch) (uint64, error) {
 	if batch.Empty() {
 		return 0, ErrEmptyBatch
 	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 
 	// TODO we don't retry BATCH requests. We probably should, but there's an
 	// async retry loop the writer uses. Should probably be possible to
@@ -234,6 +495,97 @@ func (c *Client) Batch(batch *protocol.Batch) (uint64, error) {
 	return off, err
 }
 
+// BatchResult describes where a batch's messages were written, as returned by
+// Client.BatchOffsets.
+type BatchResult struct {
+	// Offset is the offset the batch was written at.
+	Offset uint64
+
+	// Messages is the number of messages in the batch.
+	Messages int
+
+	deltas []uint64
+}
+
+// OffsetFor returns the offset of the message at index in the batch. Messages
+// are read by their batch's offset, so it's the same for every message in the
+// batch. See DeltaFor.
+func (r *BatchResult) OffsetFor(index int) uint64 {
+	return r.Offset
+}
+
+// DeltaFor returns the delta of the message at index in the batch, which, with
+// OffsetFor, identifies the message as Message.Offset and Message.Delta do when
+// it's read.
+func (r *BatchResult) DeltaFor(index int) uint64 {
+	return r.deltas[index]
+}
+
+// BatchOffsets sends a BATCH request like Batch, returning where each of the
+// batch's messages was written. The server writes a batch as a whole, so the
+// messages' positions are computed from the batch that was sent, without the
+// server returning them.
+func (c *Client) BatchOffsets(batch *protocol.Batch) (*BatchResult, error) {
+	off, err := c.Batch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := batch.MessageDeltas()
+	if err != nil {
+		return nil, err
+	}
+	return &BatchResult{
+		Offset:   off,
+		Messages: batch.Messages,
+		deltas:   deltas,
+	}, nil
+}
+
+// ValidateBatch sends a DRYBATCH request, which the server checks as it would
+// a BATCH request without writing it. That includes the batch's size and
+// checksum, whether the client may write the topic, whether it's paused, the
+// topic limit, and whether the server's message interceptor rejects it. It
+// returns the offset the batch would have been written at if it had been sent
+// instead.
+func (c *Client) ValidateBatch(batch *protocol.Batch) (uint64, error) {
+	if batch.Empty() {
+		return 0, ErrEmptyBatch
+	}
+
+	batch.DryRun = true
+	defer func() { batch.DryRun = false }()
+	internal.Debugf(c.gconf, "%v (dry run) -> %s", batch, c.RemoteAddr())
+	if _, _, err := c.do(batch); err != nil {
+		return 0, err
+	}
+
+	off, _, err := c.readBatchResponse()
+	return off, err
+}
+
+// Restore sends a RESTORE request, which writes a batch at off, the offset it
+// was read from, keeping its timestamp. It's meant for replaying batches read
+// from another log, such as a backup, into a topic of the same name, so the
+// restored log has the same offsets. off must be the head of the topic unless
+// the topic is empty. It requires admin access.
+func (c *Client) Restore(batch *protocol.Batch, off uint64) (uint64, error) {
+	if batch.Empty() {
+		return 0, ErrEmptyBatch
+	}
+
+	req := protocol.NewRestore(c.gconf)
+	req.Batch = batch
+	req.Offset = off
+	internal.Debugf(c.gconf, "%v (restore at %d) -> %s", batch, off, c.RemoteAddr())
+	if _, _, err := c.do(req); err != nil {
+		return 0, err
+	}
+
+	roff, _, err := c.readBatchResponse()
+	return roff, err
+}
+
 // BatchRaw sends a BATCH request with a raw batch
 func (c *Client) BatchRaw(b []byte) (uint64, error) {
 	internal.Debugf(c.gconf, "%q -> %s", b, c.RemoteAddr())
@@ -260,6 +612,9 @@ func (c *Client) readBatches(nbatches int, r *bufio.Reader) (int64, error) {
 		c.batch.Reset()
 		n, err = c.batch.ReadFrom(r)
 		total += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, protocol.ErrTruncatedChunk
+		}
 		if err != nil {
 			return total, err
 		}
@@ -271,6 +626,34 @@ func (c *Client) readBatches(nbatches int, r *bufio.Reader) (int64, error) {
 	return total, err
 }
 
+// readCompressedBatches reads batches from the gzip stream following a READ
+// response envelope. The stream is read to its end so the next response can be
+// read from the connection.
+func (c *Client) readCompressedBatches(nbatches int) error {
+	var err error
+	if c.zr == nil {
+		c.zr, err = gzip.NewReader(c.br)
+	} else {
+		err = c.zr.Reset(c.br)
+	}
+	if err != nil {
+		return err
+	}
+	// the response is a single gzip member, so stop reading at its end
+	c.zr.Multistream(false)
+	if c.zbr == nil {
+		c.zbr = bufio.NewReaderSize(c.zr, c.conf.BatchSize)
+	} else {
+		c.zbr.Reset(c.zr)
+	}
+
+	if _, err := c.readBatches(nbatches, c.zbr); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, c.zbr)
+	return err
+}
+
 // ReadOffset sends a READ request, returning a scanner that can be used to
 // iterate over the messages in the response.
 func (c *Client) ReadOffset(topic []byte, offset uint64, limit int) (int, *protocol.BatchScanner, error) {
@@ -285,26 +668,187 @@ func (c *Client) ReadOffset(topic []byte, offset uint64, limit int) (int, *proto
 		return 0, nil, err
 	}
 
-	respOff, nbatches, err := c.readBatchResponse()
+	nbatches, err := c.readBatchesResponse(offset)
 	if err != nil {
+		return nbatches, nil, err
+	}
+	return nbatches, c.bs, nil
+}
+
+// ReadRange sends a READRANGE request for the batches in topic from start up
+// to end, including the batch starting at end if inclusive is set. It returns
+// the offset following the last batch in the response, where the range that
+// was served ends, and a scanner over the batches. The range can end before
+// end if end is past the head, or the response would exceed the server's read
+// limits.
+func (c *Client) ReadRange(topic []byte, start, end uint64, inclusive bool) (uint64, *protocol.BatchScanner, error) {
+	internal.Debugf(c.gconf, "READRANGE %s %d %d %t", topic, start, end, inclusive)
+	req := c.rangereq
+	req.Reset()
+	req.SetTopic(topic)
+	req.Start = start
+	req.End = end
+	req.Inclusive = inclusive
+
+	if _, _, err := c.doRequest(req); err != nil {
+		return 0, nil, err
+	}
+
+	if _, err := c.readBatchesResponse(start); err != nil {
 		return 0, nil, err
 	}
+	// batches are buffered as they were read, so their size is the length of
+	// the range.
+	return start + uint64(c.batchbuf.Len()), c.bs, nil
+}
+
+// readBatchesResponse reads the response to a request for the batches starting
+// at offset, buffering the batches for c.bs to scan.
+func (c *Client) readBatchesResponse(offset uint64) (int, error) {
+	respOff, nbatches, err := c.readBatchResponse()
+	if err != nil {
+		return 0, err
+	}
 	if respOff != offset {
 		log.Printf("response offset (%d) did not match request (%d)", respOff, offset)
-		return 0, nil, protocol.ErrInternal
+		return 0, protocol.ErrInternal
 	}
 
-	if _, err := c.readBatches(nbatches, c.br); err != nil {
-		return nbatches, nil, err
+	c.batchbuf.Reset()
+	if c.compressed && nbatches > 0 {
+		err = c.readCompressedBatches(nbatches)
+	} else {
+		_, err = c.readBatches(nbatches, c.br)
+	}
+	if err != nil {
+		return nbatches, err
 	}
 	c.batchbr.Reset(c.batchbuf)
 	c.bs.Reset(c.batchbr)
-	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.readTimeout)))
-	return nbatches, c.bs, nil
+	c.bs.SetOffset(respOff)
+	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.ReadTimeout())))
+	return nbatches, nil
+}
+
+// ReadAll sends a READ request and drains the response into a slice of at
+// most limit messages. It is a convenience for simple consumers; ReadOffset
+// should be used to stream large reads. It returns protocol.ErrInvalid if
+// limit is less than 1.
+func (c *Client) ReadAll(topic []byte, offset uint64, limit int) ([]*protocol.Message, error) {
+	if limit < 1 {
+		return nil, protocol.ErrInvalid
+	}
+	_, bs, err := c.ReadOffset(topic, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response is capped by the server's read limits, so limit may be far
+	// more than the number of messages read.
+	var msgs []*protocol.Message
+	msg := protocol.NewMessage(c.gconf)
+	br := bufio.NewReader(nil)
+	for len(msgs) < limit {
+		if !bs.Scan() {
+			break
+		}
+
+		batch := bs.Batch()
+		br.Reset(bytes.NewReader(batch.MessageBytes()))
+		var delta int64
+		for i := 0; i < batch.Messages && len(msgs) < limit; i++ {
+			msg.Reset()
+			n, rerr := msg.ReadFrom(br)
+			if rerr != nil {
+				return msgs, rerr
+			}
+			msg.Offset = bs.Offset()
+			msg.Delta = uint64(delta)
+			msg.Timestamp = batch.Timestamp
+			delta += n
+
+			msgs = append(msgs, msg.Copy())
+		}
+	}
+
+	if serr := bs.Error(); serr != nil && serr != io.EOF {
+		return msgs, serr
+	}
+	return msgs, nil
+}
+
+// ReadTo reads topic from start up to end, calling fn for each message. It
+// sends as many READ requests as it takes, continuing from the end of each
+// response. Every batch that starts before end is read in full. If end is 0,
+// topic is read up to its head at the time of the call. If topic is empty,
+// the default topic is used.
+//
+// The message passed to fn is reused, so it must be copied if it's kept. If fn
+// returns an error, reading stops and the error is returned.
+func (c *Client) ReadTo(topic []byte, start, end uint64, fn func(*protocol.Message) error) error {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	if end == 0 {
+		head, err := c.Head(topic)
+		if err != nil {
+			return err
+		}
+		end = head
+	}
+
+	limit := c.conf.Limit
+	if limit < 1 {
+		limit = DefaultConfig.Limit
+	}
+
+	msg := protocol.NewMessage(c.gconf)
+	br := bufio.NewReader(nil)
+	off := start
+	for off < end {
+		respOff := off
+		_, bs, err := c.ReadOffset(topic, off, limit)
+		if err != nil {
+			return err
+		}
+
+		for off < end && bs.Scan() {
+			batch := bs.Batch()
+			br.Reset(bytes.NewReader(batch.MessageBytes()))
+			var delta int64
+			for i := 0; i < batch.Messages; i++ {
+				msg.Reset()
+				n, rerr := msg.ReadFrom(br)
+				if rerr != nil {
+					return rerr
+				}
+				msg.Offset = bs.Offset()
+				msg.Delta = uint64(delta)
+				msg.Timestamp = batch.Timestamp
+				delta += n
+
+				if ferr := fn(msg); ferr != nil {
+					return ferr
+				}
+			}
+			off = respOff + uint64(bs.Scanned())
+		}
+
+		if serr := bs.Error(); serr != nil && serr != io.EOF {
+			return serr
+		}
+		if bs.Batches() == 0 {
+			// the server should have responded with not found instead
+			return protocol.ErrNotFound
+		}
+	}
+	return nil
 }
 
 // Tail sends a TAIL request, returning the initial offset and a scanner
-// starting from the first available batch.
+// starting from the first available batch. The scanner reads directly from the
+// connection, so it is dedicated to the tail until all batches in the
+// response have been scanned. Other requests return ErrTailing until then.
 func (c *Client) Tail(topic []byte, limit int) (uint64, int, *protocol.BatchScanner, error) {
 	internal.Debugf(c.gconf, "TAIL %s %d", topic, limit)
 	req := c.tailreq
@@ -322,10 +866,453 @@ func (c *Client) Tail(topic []byte, limit int) (uint64, int, *protocol.BatchScan
 	}
 
 	c.bs.Reset(c.br)
-	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.readTimeout)))
+	c.bs.SetOffset(respOff)
+	c.tailing = true
+	c.tailBatches = nbatches
+	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.ReadTimeout())))
 	return respOff, nbatches, c.bs, nil
 }
 
+// TailN sends a TAIL request and follows the topic until n messages have been
+// read, returning them. If there are fewer than n messages in the topic, it
+// polls for more every WaitInterval. If the client is stopped first, the
+// messages read so far are returned with ErrStopped. If topic is empty, the
+// default topic is used.
+//
+// The client is closed when TailN returns, however it returns. If it stops
+// partway through a TAIL response, the connection is closed rather than left
+// with the rest of the response on it.
+func (c *Client) TailN(topic []byte, n int) ([]*protocol.Message, error) {
+	defer func() {
+		internal.IgnoreError(c.conf.Verbose, c.Close())
+	}()
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+
+	msgs := make([]*protocol.Message, 0, n)
+	off, nbatches, bs, err := c.Tail(topic, n)
+	for errors.Cause(err) == protocol.ErrNotFound {
+		if werr := c.wait(); werr != nil {
+			return msgs, werr
+		}
+		off, nbatches, bs, err = c.Tail(topic, n)
+	}
+	if err != nil {
+		return msgs, err
+	}
+
+	msg := protocol.NewMessage(c.gconf)
+	br := bufio.NewReader(nil)
+	for {
+		// the TAIL response is read from the connection, so scanning past its
+		// last batch would block on the next response.
+		for len(msgs) < n && bs.Batches() < nbatches && bs.Scan() {
+			batch := bs.Batch()
+			br.Reset(bytes.NewReader(batch.MessageBytes()))
+			var delta int64
+			for i := 0; i < batch.Messages && len(msgs) < n; i++ {
+				msg.Reset()
+				nread, rerr := msg.ReadFrom(br)
+				if rerr != nil {
+					return msgs, rerr
+				}
+				msg.Offset = bs.Offset()
+				msg.Delta = uint64(delta)
+				msg.Timestamp = batch.Timestamp
+				delta += nread
+
+				msgs = append(msgs, msg.Copy())
+			}
+		}
+		if len(msgs) >= n {
+			return msgs, nil
+		}
+		if serr := bs.Error(); serr != nil && serr != io.EOF {
+			return msgs, serr
+		}
+
+		off += uint64(bs.Scanned())
+		nbatches, bs, err = c.ReadOffset(topic, off, n-len(msgs))
+		for errors.Cause(err) == protocol.ErrNotFound {
+			if werr := c.wait(); werr != nil {
+				return msgs, werr
+			}
+			nbatches, bs, err = c.ReadOffset(topic, off, n-len(msgs))
+		}
+		if err != nil {
+			return msgs, err
+		}
+	}
+}
+
+// wait blocks for WaitInterval, returning ErrStopped if the client is stopped
+// first.
+func (c *Client) wait() error {
+	select {
+	case <-time.After(c.conf.WaitInterval):
+		return nil
+	case <-c.done:
+		return ErrStopped
+	}
+}
+
+// Head sends a HEAD request, returning the offset the next batch written to
+// the topic will have. If topic is empty, the default topic is used.
+func (c *Client) Head(topic []byte) (uint64, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	headreq := protocol.NewHead(c.gconf)
+	headreq.SetTopic(topic)
+	if _, _, err := c.doRequest(headreq); err != nil {
+		return 0, err
+	}
+
+	off, _, err := c.readBatchResponse()
+	return off, err
+}
+
+// TopicHeads sends a HEADS request, returning the head offset of every topic
+// the client may read, keyed by topic, in one round trip. The server doesn't
+// stop writes while it gathers the heads, so they're a best-effort snapshot
+// rather than a consistent one across topics.
+func (c *Client) TopicHeads() (map[string]uint64, error) {
+	headsreq := protocol.NewHeadsRequest(c.gconf)
+	if _, _, err := c.doRequest(headsreq); err != nil {
+		return nil, err
+	}
+	if err := c.cr.Error(); err != nil {
+		return nil, err
+	}
+
+	headsResp := protocol.NewHeadsResponse(c.gconf)
+	if err := headsResp.Parse(c.cr.MultiResp()); err != nil {
+		return nil, err
+	}
+	return headsResp.Heads(), nil
+}
+
+// Oldest sends a TAILOFFSET request, returning the offset of the oldest batch
+// still available in the topic. Reads from offsets before it fail, as those
+// batches have been removed by retention. If topic is empty, the default topic
+// is used.
+func (c *Client) Oldest(topic []byte) (uint64, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	tailreq := protocol.NewTailOffset(c.gconf)
+	tailreq.SetTopic(topic)
+	if _, _, err := c.doRequest(tailreq); err != nil {
+		return 0, err
+	}
+
+	off, _, err := c.readBatchResponse()
+	return off, err
+}
+
+// Headroom is how far a read was past the oldest offset retention has kept, as
+// reported by servers with config.ReportHeadroom set. A consumer whose headroom
+// is shrinking toward 0 is about to have batches removed before it reads them.
+type Headroom struct {
+	// Offsets is how far the read's offset was past the oldest retained
+	// offset, in bytes of log.
+	Offsets uint64
+
+	// Oldest is when the oldest retained batch was written, or the zero time
+	// if the server doesn't know.
+	Oldest time.Time
+}
+
+// Time returns the headroom in time of a batch written at written, such as a
+// message's Timestamp: how long after the oldest retained batch it was
+// written. It's 0 if the oldest batch's time isn't known.
+func (h Headroom) Time(written time.Time) time.Duration {
+	if h.Oldest.IsZero() || written.Before(h.Oldest) {
+		return 0
+	}
+	return written.Sub(h.Oldest)
+}
+
+// Headroom returns the retention headroom reported in the last response the
+// client read, which is set for READ, READRANGE, and HEAD responses. ok is
+// false if the response didn't report it.
+func (c *Client) Headroom() (h Headroom, ok bool) {
+	off, oldest, ok := c.cr.Headroom()
+	if !ok {
+		return h, false
+	}
+	h.Offsets = off
+	if oldest > 0 {
+		h.Oldest = time.Unix(0, oldest)
+	}
+	return h, true
+}
+
+// WaitDurable sends a SYNC request, returning once the batch at offset has
+// been synced to disk by the server. If the server's flush policy hasn't
+// synced it yet, the server syncs the topic before responding, so it returns
+// immediately if the batch is already durable. It returns ErrNotFound if no
+// batch has been written at offset. If topic is empty, the default topic is
+// used.
+func (c *Client) WaitDurable(topic []byte, offset uint64) error {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	syncreq := protocol.NewSync(c.gconf)
+	syncreq.SetTopic(topic)
+	syncreq.Offset = offset
+	if _, _, err := c.doRequest(syncreq); err != nil {
+		return err
+	}
+
+	_, _, err := c.readBatchResponse()
+	return err
+}
+
+// OffsetTime sends an OFFSETTIME request, returning when the batch at offset
+// was written. It returns the zero time for batches written before the server
+// stored timestamps, and ErrNotFound if offset has been removed by retention or
+// no batch has been written there yet. If topic is empty, the default topic is
+// used.
+func (c *Client) OffsetTime(topic []byte, offset uint64) (time.Time, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	otreq := protocol.NewOffsetTime(c.gconf)
+	otreq.SetTopic(topic)
+	otreq.Offset = offset
+	if _, _, err := c.doRequest(otreq); err != nil {
+		return time.Time{}, err
+	}
+
+	ts, _, err := c.readBatchResponse()
+	if err != nil || ts == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(ts)), nil
+}
+
+// TopicFormat sends a FORMAT request, returning the topic's format. The format
+// is empty if it hasn't been set. If topic is empty, the default topic is used.
+func (c *Client) TopicFormat(topic []byte) (string, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	fmtreq := protocol.NewFormat(c.gconf)
+	fmtreq.SetTopic(topic)
+	if _, _, err := c.doRequest(fmtreq); err != nil {
+		return "", err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return "", err
+	}
+	return string(c.cr.MultiResp()), nil
+}
+
+// SetTopicFormat sends a SETFORMAT request, setting the topic's format, such
+// as "json" or "protobuf", and creating the topic if it doesn't exist. The
+// format is advisory: the server doesn't check messages against it. If topic
+// is empty, the default topic is used.
+func (c *Client) SetTopicFormat(topic []byte, format string) error {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	if len(format) > protocol.MaxFormatSize {
+		return protocol.ErrInvalid
+	}
+	setreq := protocol.NewSetFormat(c.gconf)
+	setreq.SetTopic(topic)
+	setreq.SetFormat([]byte(format))
+	if err := setreq.Validate(); err != nil {
+		return err
+	}
+	if _, _, err := c.doRequest(setreq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	return nil
+}
+
+// TopicInfo is a topic's settings, as returned by Client.TopicInfo.
+type TopicInfo struct {
+	// Format is the topic's format, or empty if it hasn't been set.
+	Format string
+
+	// PartitionSize is the size in bytes the topic's new partitions are
+	// rotated at.
+	PartitionSize int
+}
+
+// TopicInfo sends a TOPICINFO request, returning the topic's settings. If
+// topic is empty, the default topic is used.
+func (c *Client) TopicInfo(topic []byte) (*TopicInfo, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	inforeq := protocol.NewTopicInfo(c.gconf)
+	inforeq.SetTopic(topic)
+	if _, _, err := c.doRequest(inforeq); err != nil {
+		return nil, err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return nil, err
+	}
+	infoResp := protocol.NewTopicInfoResponse(c.gconf)
+	if err := infoResp.Parse(c.cr.MultiResp()); err != nil {
+		return nil, err
+	}
+	return &TopicInfo{
+		Format:        infoResp.Format,
+		PartitionSize: infoResp.PartitionSize,
+	}, nil
+}
+
+// SetTopicPartitionSize sends a SETPARTSIZE request, setting the size in bytes
+// the topic's partitions are rotated at and creating the topic if it doesn't
+// exist. Existing partitions keep their size. The server rejects sizes smaller
+// than its max batch size. If topic is empty, the default topic is used.
+func (c *Client) SetTopicPartitionSize(topic []byte, size int) error {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	setreq := protocol.NewSetPartSize(c.gconf)
+	setreq.SetTopic(topic)
+	setreq.Size = size
+	if err := setreq.Validate(); err != nil {
+		return err
+	}
+	if _, _, err := c.doRequest(setreq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	return nil
+}
+
+// Erase sends an ERASE request, which overwrites the batches in topic starting
+// from start up to end so their messages can't be read, such as to comply with
+// a request to delete personal data. It returns the number of batches erased.
+// The offsets of the batches don't change: each one is replaced with a batch
+// of the same size holding a single message of NUL bytes, which consumers
+// read in its place. See protocol.ErasedBatch. Batches already being sent to readers, or in partitions
+// removed by retention that are still being read, aren't affected. It
+// requires admin access. If topic is empty, the default topic is used.
+func (c *Client) Erase(topic []byte, start, end uint64) (int, error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	erasereq := protocol.NewErase(c.gconf)
+	erasereq.SetTopic(topic)
+	erasereq.Start = start
+	erasereq.End = end
+	if err := erasereq.Validate(); err != nil {
+		return 0, err
+	}
+	if _, _, err := c.doRequest(erasereq); err != nil {
+		return 0, err
+	}
+
+	_, n, err := c.readBatchResponse()
+	return n, err
+}
+
+// PauseTopic stops topic from accepting batches, which fail with
+// protocol.ErrTopicPaused until ResumeTopic is called. Reads continue as
+// usual. Topics are no longer paused once the server restarts. If topic is
+// empty, the default topic is used.
+func (c *Client) PauseTopic(topic []byte) error {
+	return c.pause(topic, false)
+}
+
+// ResumeTopic allows a paused topic to accept batches again. If topic is
+// empty, the default topic is used.
+func (c *Client) ResumeTopic(topic []byte) error {
+	return c.pause(topic, true)
+}
+
+func (c *Client) pause(topic []byte, resume bool) error {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	pausereq := protocol.NewPause(c.gconf)
+	pausereq.SetTopic(topic)
+	pausereq.Resume = resume
+	if _, _, err := c.doRequest(pausereq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	return nil
+}
+
+// OpenStream starts reading topic from offset on a new logical stream. Streams
+// share the client's connection, and are read in turn with SREAD requests
+// tagged with the stream's id. A stream isn't read from while its buffer is
+// full, so a slow consumer doesn't block the client's other streams. If topic
+// is empty, the default topic is used.
+//
+// Streams are read by polling: the server doesn't push batches to them. A
+// stream that reaches the head of its topic keeps following it, like a tail,
+// polling every WaitInterval until more is written. If retention removes the
+// batches at a stream's offset before it reads them, it stops with
+// ErrStreamExpired. Other errors the server responds with stop only the stream
+// whose read failed. When the connection fails, it's closed, and the streams
+// carry on from their offsets once the client reconnects.
+//
+// While streams are open, batches can still be written over the same
+// connection with Batch or BatchOffsets, from any goroutine, or by a Writer
+// whose streams were opened with Writer.OpenStream. Each BATCH request and its
+// response take their turn between the streams' SREAD requests, so a batch
+// waits for at most one read, and a stream doesn't read while a batch is
+// being sent. The client shouldn't be used for any other requests while
+// streams are open.
+func (c *Client) OpenStream(topic []byte, offset uint64) (*Stream, error) {
+	if c.Tailing() {
+		return nil, ErrTailing
+	}
+	c.connMu.Lock()
+	err := c.ensureConn()
+	c.connMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	if c.mux == nil {
+		c.mux = newStreamMux(c)
+	}
+	return c.mux.open(topic, offset), nil
+}
+
+// Tailing returns true if the client is streaming a TAIL response that hasn't
+// been fully scanned.
+func (c *Client) Tailing() bool {
+	if c.tailing && c.bs.Batches() >= c.tailBatches {
+		c.tailing = false
+	}
+	return c.tailing
+}
+
 // Close sends a CLOSE request and then closes the connection
 func (c *Client) Close() error {
 	defer func() {
@@ -334,6 +1321,18 @@ func (c *Client) Close() error {
 		}
 	}()
 
+	// open streams share the connection, so they need to be finished with it
+	// before it's closed.
+	if c.mux != nil {
+		c.mux.closeAll()
+	}
+
+	// the rest of the tail response is still on the wire, so there's no way to
+	// read the CLOSE response. just close the connection.
+	if c.Tailing() {
+		return nil
+	}
+
 	closereq := protocol.NewCloseRequest(c.gconf)
 	if _, _, err := c.do(closereq); err != nil {
 		return err
@@ -346,6 +1345,24 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Auth sends an AUTH request. If a token is configured, the client
+// authenticates automatically each time it connects.
+func (c *Client) Auth(token []byte) error {
+	authreq := protocol.NewAuthRequest(c.gconf)
+	authreq.SetToken(token)
+	if _, _, err := c.do(authreq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	return nil
+}
+
 // Config sends a CONFIG request, returning parts the server's configuration
 // relevant to the client.
 func (c *Client) Config() (*config.Config, error) {
@@ -354,12 +1371,173 @@ func (c *Client) Config() (*config.Config, error) {
 		return nil, err
 	}
 
+	return c.parseConfigResponse()
+}
+
+// ServerLimits are the server's operational limits that clients should
+// configure themselves within. Limits older servers don't send are 0.
+type ServerLimits struct {
+	// MaxBatchSize is the largest batch the server accepts, in bytes.
+	MaxBatchSize int
+	// PartitionSize is the server's default partition size. Topics can be
+	// configured with their own, which TopicInfo returns.
+	PartitionSize int
+	// MaxReadBytes and MaxReadBatches bound the size of a READ response. 0
+	// means no limit.
+	MaxReadBytes   int
+	MaxReadBatches int
+}
+
+// ServerLimits returns the server's limits, as of the last CONFIG response on
+// the connection. If there hasn't been one, a CONFIG request is sent.
+func (c *Client) ServerLimits() (*ServerLimits, error) {
+	if c.limits == nil {
+		if _, err := c.Config(); err != nil {
+			return nil, err
+		}
+	}
+	limits := *c.limits
+	return &limits, nil
+}
+
+// Conns sends a CONNS request, returning the server's connections. The client
+// must be authenticated as the admin principal.
+func (c *Client) Conns() ([]*protocol.ConnInfo, error) {
+	connsreq := protocol.NewConnsRequest(c.gconf)
+	if _, _, err := c.doRequest(connsreq); err != nil {
+		return nil, err
+	}
+	if err := c.cr.Error(); err != nil {
+		return nil, err
+	}
+
+	connsResp := protocol.NewConnsResponse(c.gconf)
+	if err := connsResp.Parse(c.cr.MultiResp()); err != nil {
+		return nil, err
+	}
+	return connsResp.Conns(), nil
+}
+
+// ServerInfo describes a server, as returned by Client.Info.
+type ServerInfo struct {
+	// Version is the server's version.
+	Version string
+
+	// Commit is the commit the server was built from, or empty if it wasn't
+	// built with one.
+	Commit string
+
+	// Started is when the server started.
+	Started time.Time
+
+	// Uptime is how long the server had been running when it responded,
+	// measured by the server's clock.
+	Uptime time.Duration
+}
+
+// Info sends an INFO request, returning the server's version and how long
+// it's been running.
+func (c *Client) Info() (ServerInfo, error) {
+	inforeq := protocol.NewInfoRequest(c.gconf)
+	if _, _, err := c.doRequest(inforeq); err != nil {
+		return ServerInfo{}, err
+	}
+	if err := c.cr.Error(); err != nil {
+		return ServerInfo{}, err
+	}
+
+	infoResp := protocol.NewInfoResponse(c.gconf)
+	if err := infoResp.Parse(c.cr.MultiResp()); err != nil {
+		return ServerInfo{}, err
+	}
+	return ServerInfo{
+		Version: infoResp.Version,
+		Commit:  infoResp.Commit,
+		Started: infoResp.Started,
+		Uptime:  infoResp.Uptime,
+	}, nil
+}
+
+// ServerStats sends a STATS request, returning the server's stats by name. If
+// compression is configured, the server is asked to gzip the response body.
+func (c *Client) ServerStats() (map[string]string, error) {
+	statsreq := protocol.NewStatsRequest(c.gconf)
+	if c.conf.Compress {
+		statsreq.SetEncoding([]byte(protocol.CompressGzip))
+	}
+	if _, _, err := c.doRequest(statsreq); err != nil {
+		return nil, err
+	}
+	if err := c.cr.Error(); err != nil {
+		return nil, err
+	}
+
+	body := c.cr.MultiResp()
+	if enc := c.cr.Encoding(); enc != "" {
+		if enc != protocol.CompressGzip {
+			return nil, protocol.ErrInvalid
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]string)
+	for _, line := range bytes.Split(body, []byte("\r\n")) {
+		parts := bytes.SplitN(line, []byte(": "), 2)
+		if len(parts) != 2 {
+			continue
+		}
+		res[string(parts[0])] = string(parts[1])
+	}
+	return res, nil
+}
+
+// KillConn sends a KILLCONN request, closing the server connection with the
+// given id. It returns protocol.ErrNotFound if there's no such connection. The
+// client must be authenticated as the admin principal.
+func (c *Client) KillConn(id string) error {
+	killreq := protocol.NewKillConnRequest(c.gconf)
+	killreq.SetID([]byte(id))
+	if _, _, err := c.doRequest(killreq); err != nil {
+		return err
+	}
+
+	if err := c.cr.Error(); err != nil {
+		return err
+	}
+	if !c.cr.Ok() {
+		return protocol.ErrInternal
+	}
+	return nil
+}
+
+func (c *Client) parseConfigResponse() (*config.Config, error) {
+	if err := c.cr.Error(); err != nil {
+		return nil, err
+	}
+
 	confResp := protocol.NewConfigResponse(c.gconf)
 	if err := confResp.Parse(c.cr.MultiResp()); err != nil {
 		return nil, err
 	}
 
-	return confResp.Config(), nil
+	conf := confResp.Config()
+	c.nodeID = conf.NodeID
+	c.logID = conf.LogID
+	c.protocolVersion = confResp.ProtocolVersion()
+	c.limits = &ServerLimits{
+		MaxBatchSize:   conf.MaxBatchSize,
+		PartitionSize:  conf.PartitionSize,
+		MaxReadBytes:   conf.MaxReadBytes,
+		MaxReadBatches: conf.MaxReadBatches,
+	}
+	return conf, nil
 }
 
 func (c *Client) doRequest(wt io.WriterTo) (int64, int64, error) {
@@ -371,11 +1549,25 @@ func (c *Client) doRequest(wt io.WriterTo) (int64, int64, error) {
 }
 
 func (c *Client) do(wt io.WriterTo) (int64, int64, error) {
+	sent, recv, err := c.send(wt)
+	atomic.AddInt64(&c.stats.Requests, 1)
+	atomic.AddInt64(&c.stats.BytesSent, sent)
+	atomic.AddInt64(&c.stats.BytesReceived, recv)
+	if err != nil {
+		atomic.AddInt64(&c.stats.Errors, 1)
+	}
+	return sent, recv, err
+}
+
+func (c *Client) send(wt io.WriterTo) (int64, int64, error) {
+	if c.Tailing() {
+		return 0, 0, ErrTailing
+	}
 	if err := c.ensureConn(); err != nil {
 		return 0, 0, err
 	}
 
-	internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Now().Add(c.writeTimeout)))
+	internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Now().Add(c.WriteTimeout())))
 	sent, err := wt.WriteTo(c.bw)
 	internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Time{}))
 	if err != nil {
@@ -417,6 +1609,7 @@ func (c *Client) retryRequest(wt io.WriterTo, origSent, origRecv int64, err erro
 			break
 		}
 		c.retries++
+		atomic.AddInt64(&c.stats.Retries, 1)
 		c.setNextInterval()
 
 		select {
@@ -465,8 +1658,9 @@ func (c *Client) setNextInterval() {
 func (c *Client) flush() error {
 	if c.bw != nil && c.bw.Buffered() > 0 {
 		internal.Debugf(c.gconf, "client.Flush() initiated (%d bytes)", c.bw.Buffered())
-		internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Now().Add(c.writeTimeout)))
+		internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Now().Add(c.WriteTimeout())))
 		err := c.bw.Flush()
+		atomic.AddInt64(&c.stats.Flushes, 1)
 		internal.Debugf(c.gconf, "client.Flush() complete (err: %v)", err)
 		internal.IgnoreError(c.conf.Verbose, c.SetWriteDeadline(time.Time{}))
 		return err
@@ -476,7 +1670,7 @@ func (c *Client) flush() error {
 
 func (c *Client) readClientResponse() (int64, error) {
 	c.cr.Reset()
-	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.readTimeout)))
+	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.ReadTimeout())))
 	n, err := c.cr.ReadFrom(c.br)
 	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Time{}))
 	internal.Debugf(c.gconf, "read %d bytes from %s: %+v (err: %v)", n, c.RemoteAddr(), c.cr, err)
@@ -489,7 +1683,7 @@ func (c *Client) readBatchResponse() (uint64, int, error) {
 
 func (c *Client) readCloseResponse() error {
 	if !c.cr.Ok() {
-		return errors.New("close failed")
+		return stderrors.New("close failed")
 	}
 	return nil
 }
@@ -497,7 +1691,7 @@ func (c *Client) readCloseResponse() error {
 func (c *Client) readConfigResponse() error {
 	b := c.cr.MultiResp()
 	if len(b) < 1 {
-		return errors.New("multi response empty")
+		return stderrors.New("multi response empty")
 	}
 
 	return nil
@@ -3,6 +3,7 @@ package logd
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"net"
 	"testing"
@@ -150,3 +151,29 @@ func readBenchmark(conf *Config) (*Client, func() error) {
 		return nil
 	}
 }
+
+func BenchmarkWriterWrite(b *testing.B) {
+	for _, copyOnWrite := range []bool{true, false} {
+		b.Run(fmt.Sprintf("copy-on-write=%t", copyOnWrite), func(b *testing.B) {
+			benchmarkWriterWrite(b, copyOnWrite)
+		})
+	}
+}
+
+func benchmarkWriterWrite(b *testing.B, copyOnWrite bool) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.CopyOnWrite = copyOnWrite
+	w := NewWriter(conf, "default")
+	w.Client.dialer = &batchDialer{conf: conf.ToGeneralConfig()}
+	defer w.Close()
+	p := bytes.Repeat([]byte("a"), 100)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
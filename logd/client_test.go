@@ -1,13 +1,18 @@
 package logd
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"flag"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"reflect"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/protocol"
@@ -66,6 +71,132 @@ func TestBatchWrite(t *testing.T) {
 	}
 }
 
+func TestBatchOffsets(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.Offset = 10
+	conf.Limit = 3
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	batch.Append([]byte("hallo"))
+	batch.Append([]byte("sup"))
+
+	server.Expect(func(p []byte) io.WriterTo {
+		if !bytes.Equal(fixture, p) {
+			log.Panicf("expected:\n\n\t%q\n\nbut got:\n\n\t%q\n", fixture, p)
+		}
+		return protocol.NewClientBatchResponse(gconf, 10, 1)
+	})
+
+	res, err := c.BatchOffsets(batch)
+	if err != nil {
+		t.Fatalf("sending batch: %+v", err)
+	}
+	if res.Offset != 10 || res.Messages != 3 {
+		t.Fatalf("expected 3 messages at offset 10 but got %d at %d", res.Messages, res.Offset)
+	}
+
+	// the messages are identified as they are when they're read back
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 1, fixture)
+	})
+	s := ScannerForClient(c)
+	defer s.Close()
+	defer expectServerClose(t, gconf, server)
+	s.SetTopic("default")
+	for i := 0; i < res.Messages; i++ {
+		if !s.Scan() {
+			t.Fatalf("stopped scanning too early (%d/%d) (err: %+v)", i, res.Messages, s.Error())
+		}
+		msg := s.Message()
+		if res.OffsetFor(i) != msg.Offset || res.DeltaFor(i) != msg.Delta {
+			t.Fatalf("expected message %d at %d/%d but it was read at %d/%d", i, res.OffsetFor(i), res.DeltaFor(i), msg.Offset, msg.Delta)
+		}
+	}
+	if res.DeltaFor(2) == 0 {
+		t.Fatal("expected the last message to have a delta")
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := append([]byte("DRY"), testhelper.LoadFixture("batch.small")...)
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	batch.Append([]byte("hallo"))
+	batch.Append([]byte("sup"))
+
+	server.Expect(func(p []byte) io.WriterTo {
+		if !bytes.Equal(fixture, p) {
+			log.Panicf("expected:\n\n\t%q\n\nbut got:\n\n\t%q\n", fixture, p)
+		}
+		return protocol.NewClientBatchResponse(gconf, 10, 0)
+	})
+
+	off, err := c.ValidateBatch(batch)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if off != 10 {
+		t.Fatalf("expected offset 10 but got %d", off)
+	}
+	if batch.DryRun {
+		t.Fatal("expected the batch to be usable for a BATCH request afterwards")
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	batch.Append([]byte("hallo"))
+	batch.Append([]byte("sup"))
+
+	resp := []byte("OK 10 1\r\n")
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientBatchResponse(gconf, 10, 1)
+	})
+	if _, err := c.Batch(batch); err != nil {
+		t.Fatalf("sending batch: %+v", err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrNotFound)
+	})
+	if _, err := c.Batch(batch); err != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, err)
+	}
+
+	expected := Stats{
+		Requests:      2,
+		BytesSent:     int64(len(fixture) * 2),
+		BytesReceived: int64(len(resp) + len("ERR not found\r\n")),
+		Flushes:       2,
+	}
+	if stats := c.Stats(); stats != expected {
+		t.Fatalf("expected stats %+v but got %+v", expected, stats)
+	}
+}
+
 func TestBatchEmpty(t *testing.T) {
 	conf := DefaultTestConfig(testing.Verbose())
 	gconf := conf.ToGeneralConfig()
@@ -149,6 +280,103 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadAll(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 1, fixture)
+	})
+
+	msgs, err := c.ReadAll([]byte("default"), 10, 2)
+	if err != nil {
+		t.Fatalf("ReadAll: %+v", err)
+	}
+
+	expected := []string{"hi", "hallo"}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages but got %d", len(expected), len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg.BodyBytes()) != expected[i] {
+			t.Fatalf("expected message %d to be %q but got %q", i, expected[i], msg.BodyBytes())
+		}
+		if msg.Offset != 10 {
+			t.Fatalf("expected offset 10 but got %d", msg.Offset)
+		}
+	}
+	if msgs[0].Delta != 0 || msgs[1].Delta == 0 {
+		t.Fatalf("unexpected message deltas: %d, %d", msgs[0].Delta, msgs[1].Delta)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrNotFound)
+	})
+
+	msgs, err = c.ReadAll([]byte("default"), 10, 3)
+	if err != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, err)
+	}
+	if msgs != nil {
+		t.Fatalf("expected no messages but got %d", len(msgs))
+	}
+
+	// invalid limits aren't sent
+	for _, limit := range []int{0, -1} {
+		if _, err := c.ReadAll([]byte("default"), 10, limit); err != protocol.ErrInvalid {
+			t.Fatalf("limit %d: expected %v but got %+v", limit, protocol.ErrInvalid, err)
+		}
+	}
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("READ default 10 1\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return readOKResponse(gconf, 10, 1, fixture)
+	})
+	if msgs, err := c.ReadAll([]byte("default"), 10, 1); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message but got %d (err: %+v)", len(msgs), err)
+	}
+}
+
+func TestReadOffsetMultipleBatches(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 3, fixture, fixture, fixture)
+	})
+
+	nbatches, bs, err := c.ReadOffset([]byte("default"), 10, 9)
+	if err != nil {
+		t.Fatalf("ReadOffset: %+v", err)
+	}
+
+	expected := uint64(10)
+	n := 0
+	for bs.Scan() {
+		if bs.Offset() != expected {
+			t.Fatalf("batch %d: expected offset %d but got %d", n, expected, bs.Offset())
+		}
+		expected += uint64(len(fixture))
+		n++
+	}
+	if err := bs.Error(); err != nil && err != io.EOF {
+		t.Fatalf("unexpected scan error: %+v", err)
+	}
+	if n != nbatches {
+		t.Fatalf("expected %d batches but scanned %d", nbatches, n)
+	}
+}
+
 func TestReadErrors(t *testing.T) {
 	conf := DefaultTestConfig(testing.Verbose())
 	conf.ConnRetries = 0
@@ -281,6 +509,36 @@ func TestReadTimeout(t *testing.T) {
 	}
 }
 
+func TestSetReadTimeout(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.ReadTimeout = 10 * time.Second
+	conf.ConnRetries = 0
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := net.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	// read requests but never respond
+	go io.Copy(ioutil.Discard, server)
+
+	c.SetReadTimeout(10 * time.Millisecond)
+	if c.ReadTimeout() != 10*time.Millisecond {
+		t.Fatalf("expected read timeout %s but got %s", 10*time.Millisecond, c.ReadTimeout())
+	}
+
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+
+	start := time.Now()
+	if _, err := c.Batch(batch); err == nil {
+		t.Fatal("expected timeout error but got none")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the new read timeout to be used but request took %s", elapsed)
+	}
+}
+
 type closedWriter struct{}
 
 func (w closedWriter) Write(p []byte) (int, error) {
@@ -321,6 +579,136 @@ func TestTail(t *testing.T) {
 	}
 }
 
+func TestTailGuard(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 1, fixture)
+	})
+
+	_, _, scanner, err := c.Tail([]byte("default"), 3)
+	if err != nil {
+		t.Fatalf("Tail: %+v", err)
+	}
+	if !c.Tailing() {
+		t.Fatal("expected client to be tailing")
+	}
+
+	if _, _, err := c.ReadOffset([]byte("default"), 10, 3); err != ErrTailing {
+		t.Fatalf("expected %v but got %+v", ErrTailing, err)
+	}
+
+	if !scanner.Scan() {
+		t.Fatalf("failed to scan: %+v", scanner.Error())
+	}
+	if c.Tailing() {
+		t.Fatal("expected client not to be tailing after scanning the response")
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 1, fixture)
+	})
+
+	if _, _, err := c.ReadOffset([]byte("default"), 10, 3); err != nil {
+		t.Fatalf("ReadOffset: %+v", err)
+	}
+}
+
+func TestTailN(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	expected := [][]byte{
+		[]byte("TAIL default 4\r\n"),
+		[]byte("TAIL default 4\r\n"),
+		[]byte("READ default 77 1\r\n"),
+		[]byte("CLOSE\r\n"),
+	}
+	responses := []io.WriterTo{
+		// the server describes why, as it does for an empty topic
+		protocol.NewClientErrResponse(gconf, protocol.NewRespError(protocol.ErrNotFound, "topic default is empty")),
+		readOKResponse(gconf, 10, 1, fixture),
+		readOKResponse(gconf, 77, 1, fixture),
+		protocol.NewClientOKResponse(gconf),
+	}
+	for i := range expected {
+		exp := expected[i]
+		resp := responses[i]
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, exp) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", exp, p)
+			}
+			return resp
+		})
+	}
+
+	msgs, err := c.TailN(nil, 4)
+	if err != nil {
+		t.Fatalf("TailN: %+v", err)
+	}
+
+	expectedMsgs := []string{"hi", "hallo", "sup", "hi"}
+	expectedOffs := []uint64{10, 10, 10, 77}
+	if len(msgs) != len(expectedMsgs) {
+		t.Fatalf("expected %d messages but got %d", len(expectedMsgs), len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg.BodyBytes()) != expectedMsgs[i] {
+			t.Fatalf("expected message %d to be %q but got %q", i, expectedMsgs[i], msg.BodyBytes())
+		}
+		if msg.Offset != expectedOffs[i] {
+			t.Fatalf("expected message %d offset to be %d but got %d", i, expectedOffs[i], msg.Offset)
+		}
+	}
+}
+
+func TestTailNStopsEarly(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	conn := &closeRecorder{Conn: clientConn}
+	c := New(conf).SetConn(conn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 10, 2, fixture, fixture)
+	})
+
+	msgs, err := c.TailN([]byte("default"), 1)
+	if err != nil {
+		t.Fatalf("TailN: %+v", err)
+	}
+	if len(msgs) != 1 || string(msgs[0].BodyBytes()) != "hi" {
+		t.Fatalf("expected one message, \"hi\", but got %+v", msgs)
+	}
+
+	// the rest of the TAIL response was left on the connection, so it should
+	// have been closed.
+	if !conn.closed {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+type closeRecorder struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
 func TestClose(t *testing.T) {
 	conf := DefaultTestConfig(testing.Verbose())
 	gconf := conf.ToGeneralConfig()
@@ -341,6 +729,33 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestAuth(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		if !bytes.Equal(p, []byte("AUTH secret\r\n")) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", "AUTH secret\r\n", p)
+		}
+		return protocol.NewClientOKResponse(gconf)
+	})
+
+	if err := c.Auth([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrUnauthorized)
+	})
+
+	if err := c.Auth([]byte("wrong")); err != protocol.ErrUnauthorized {
+		t.Fatalf("expected %v but got %+v", protocol.ErrUnauthorized, err)
+	}
+}
+
 func TestConfig(t *testing.T) {
 	conf := DefaultTestConfig(testing.Verbose())
 	gconf := conf.ToGeneralConfig()
@@ -376,10 +791,220 @@ func TestConfig(t *testing.T) {
 	if rconf.MaxBatchSize != gconf.MaxBatchSize {
 		t.Errorf("expected %d but got %d", gconf.MaxBatchSize, rconf.MaxBatchSize)
 	}
+	if rconf.PartitionSize != gconf.PartitionSize {
+		t.Errorf("expected %d but got %d", gconf.PartitionSize, rconf.PartitionSize)
+	}
 }
 
-func TestReconnect(t *testing.T) {
-	// t.Skip("mock server race")
+func TestVerifyIdentity(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.VerifyIdentity = true
+	gconf := conf.ToGeneralConfig()
+	server, _ := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf)
+
+	// the mock server may read from the previous connection if an expectation
+	// is set before dialing, so reconnect manually.
+	reconnect := func(nodeID, logID string) error {
+		conn, err := server.DialTimeout("tcp", conf.Hostport, conf.Timeout)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		c.SetConn(conn)
+
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, []byte("CONFIG\r\n")) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", "CONFIG\r\n", p)
+			}
+			sconf := &config.Config{}
+			*sconf = *gconf
+			sconf.NodeID = nodeID
+			sconf.LogID = logID
+			respb := &bytes.Buffer{}
+			protocol.NewConfigResponse(sconf).WriteTo(respb)
+			return protocol.NewClientMultiResponse(gconf, respb.Bytes())
+		})
+		return c.verifyIdentity()
+	}
+
+	if err := reconnect("node1", "log1"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if c.NodeID() != "node1" {
+		t.Fatalf("expected node id %q but got %q", "node1", c.NodeID())
+	}
+
+	if err := reconnect("node1", "log2"); err != ErrLogChanged {
+		t.Fatalf("expected %v but got %+v", ErrLogChanged, err)
+	}
+
+	if err := reconnect("node2", "log1"); err != ErrNodeChanged {
+		t.Fatalf("expected %v but got %+v", ErrNodeChanged, err)
+	}
+
+	if err := reconnect("node1", "log1"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.Preflight = true
+	gconf := conf.ToGeneralConfig()
+	server, _ := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf)
+
+	preflight := func(modify func(sconf *config.Config, b []byte) []byte) error {
+		conn, err := server.DialTimeout("tcp", conf.Hostport, conf.Timeout)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		c.SetConn(conn)
+
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, []byte("CONFIG\r\n")) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", "CONFIG\r\n", p)
+			}
+			sconf := &config.Config{}
+			*sconf = *gconf
+			sconf.MaxBatchSize = conf.BatchSize
+			respb := &bytes.Buffer{}
+			protocol.NewConfigResponse(sconf).WriteTo(respb)
+			b := respb.Bytes()
+			if modify != nil {
+				b = modify(sconf, b)
+			}
+			return protocol.NewClientMultiResponse(gconf, b)
+		})
+		return c.preflight()
+	}
+
+	if err := preflight(nil); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	err := preflight(func(sconf *config.Config, b []byte) []byte {
+		return append(b, []byte("SomethingNew: 1\r\n")...)
+	})
+	if err != nil {
+		t.Fatalf("expected unknown config fields to be ignored but got %+v", err)
+	}
+
+	err = preflight(func(sconf *config.Config, b []byte) []byte {
+		// older servers don't send a protocol version
+		return bytes.Replace(b, []byte("ProtocolVersion: 1\r\n"), nil, 1)
+	})
+	if err != ErrIncompatible {
+		t.Fatalf("expected %v but got %+v", ErrIncompatible, err)
+	}
+	if c.Conn != nil {
+		t.Fatal("expected connection to be closed after failed pre-flight check")
+	}
+
+	err = preflight(func(sconf *config.Config, b []byte) []byte {
+		sconf.MaxBatchSize = conf.BatchSize - 1
+		respb := &bytes.Buffer{}
+		protocol.NewConfigResponse(sconf).WriteTo(respb)
+		return respb.Bytes()
+	})
+	if err != ErrIncompatible {
+		t.Fatalf("expected %v but got %+v", ErrIncompatible, err)
+	}
+
+	err = preflight(func(sconf *config.Config, b []byte) []byte {
+		sconf.Checksum = config.ChecksumCastagnoli
+		respb := &bytes.Buffer{}
+		protocol.NewConfigResponse(sconf).WriteTo(respb)
+		return respb.Bytes()
+	})
+	if err != ErrIncompatible {
+		t.Fatalf("expected %v but got %+v", ErrIncompatible, err)
+	}
+
+	err = preflight(func(sconf *config.Config, b []byte) []byte {
+		// older servers don't send a checksum, and only support ieee
+		return bytes.Replace(b, []byte("Checksum: ieee\r\n"), nil, 1)
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestReconcileLimits(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.ReconcileLimits = true
+	conf.Preflight = true
+	gconf := conf.ToGeneralConfig()
+	server, _ := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf)
+
+	reconcile := func(maxBatchSize int) error {
+		conn, err := server.DialTimeout("tcp", conf.Hostport, conf.Timeout)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		c.reset()
+		c.SetConn(conn)
+
+		sconf := &config.Config{}
+		*sconf = *gconf
+		sconf.MaxBatchSize = maxBatchSize
+		sconf.PartitionSize = 1024 * 1024
+		sconf.MaxReadBytes = 4096
+		sconf.MaxReadBatches = 10
+		for i := 0; i < 2; i++ {
+			server.Expect(func(p []byte) io.WriterTo {
+				if !bytes.Equal(p, []byte("CONFIG\r\n")) {
+					log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", "CONFIG\r\n", p)
+				}
+				respb := &bytes.Buffer{}
+				protocol.NewConfigResponse(sconf).WriteTo(respb)
+				return protocol.NewClientMultiResponse(gconf, respb.Bytes())
+			})
+		}
+		if err := c.reconcileLimits(); err != nil {
+			return err
+		}
+		return c.preflight()
+	}
+
+	if err := reconcile(conf.BatchSize); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if c.batchSize() != conf.BatchSize {
+		t.Fatalf("expected batch size %d but got %d", conf.BatchSize, c.batchSize())
+	}
+
+	if err := reconcile(conf.BatchSize / 2); err != nil {
+		t.Fatalf("expected pre-flight check to pass after reconciling but got %+v", err)
+	}
+	if c.batchSize() != conf.BatchSize/2 {
+		t.Fatalf("expected batch size %d but got %d", conf.BatchSize/2, c.batchSize())
+	}
+	if conf.BatchSize != DefaultTestConfig(false).BatchSize {
+		t.Fatalf("expected the client's config not to change, but batch size is %d", conf.BatchSize)
+	}
+
+	limits, err := c.ServerLimits()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := ServerLimits{
+		MaxBatchSize:   conf.BatchSize / 2,
+		PartitionSize:  1024 * 1024,
+		MaxReadBytes:   4096,
+		MaxReadBatches: 10,
+	}
+	if *limits != expected {
+		t.Fatalf("expected limits %+v but got %+v", expected, *limits)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// t.Skip("mock server race")
 	conf := DefaultTestConfig(testing.Verbose())
 	gconf := conf.ToGeneralConfig()
 	fixture := testhelper.LoadFixture("batch.small")
@@ -421,6 +1046,23 @@ func (wt *multiWriterTo) WriteTo(w io.Writer) (int64, error) {
 	return b.WriteTo(w)
 }
 
+func TestClientReadTruncatedResponse(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+	c := New(conf)
+
+	// the response promised two batches but only one was sent
+	r := bufio.NewReader(bytes.NewReader(fixture))
+	if _, err := c.readBatches(2, r); err != protocol.ErrTruncatedChunk {
+		t.Fatalf("expected ErrTruncatedChunk but got %+v", err)
+	}
+
+	r = bufio.NewReader(bytes.NewReader(fixture[:len(fixture)-2]))
+	if _, err := c.readBatches(1, r); err != protocol.ErrTruncatedChunk {
+		t.Fatalf("expected ErrTruncatedChunk but got %+v", err)
+	}
+}
+
 func readOKResponse(gconf *config.Config, off uint64, nbatches int, batches ...[]byte) io.WriterTo {
 	wt := []io.WriterTo{protocol.NewClientBatchResponse(gconf, off, nbatches)}
 	for _, b := range batches {
@@ -429,3 +1071,295 @@ func readOKResponse(gconf *config.Config, off uint64, nbatches int, batches ...[
 
 	return &multiWriterTo{wt}
 }
+
+func TestHead(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	for _, topic := range []string{"", "other"} {
+		expected := []byte("HEAD other\r\n")
+		if topic == "" {
+			expected = []byte("HEAD default\r\n")
+		}
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, expected) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+			}
+			return protocol.NewClientBatchResponse(gconf, 100, 0)
+		})
+
+		off, err := c.Head([]byte(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off != 100 {
+			t.Fatalf("expected offset 100 but got %d", off)
+		}
+	}
+}
+
+func TestTopicHeads(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("HEADS\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientMultiResponse(gconf, []byte("default 100\r\nother 0\r\n"))
+	})
+
+	heads, err := c.TopicHeads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint64{"default": 100, "other": 0}
+	if !reflect.DeepEqual(heads, expected) {
+		t.Fatalf("expected %v but got %v", expected, heads)
+	}
+}
+
+func TestTopicFormat(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("SETFORMAT default json\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientOKResponse(gconf)
+	})
+	if err := c.SetTopicFormat(nil, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("FORMAT other\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientMultiResponse(gconf, []byte("json"))
+	})
+	format, err := c.TopicFormat([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "json" {
+		t.Fatalf("expected format json but got %q", format)
+	}
+
+	if err := c.SetTopicFormat(nil, "two words"); err != protocol.ErrInvalid {
+		t.Fatalf("expected %v but got %+v", protocol.ErrInvalid, err)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("INFO\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientMultiResponse(gconf, []byte("version 0.1.0\r\ncommit abc123\r\nstarted 2018-03-04T05:06:07Z\r\nuptime 90000\r\n"))
+	})
+
+	info, err := c.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ServerInfo{
+		Version: "0.1.0",
+		Commit:  "abc123",
+		Started: time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC),
+		Uptime:  90 * time.Second,
+	}
+	if info.Version != expected.Version || info.Commit != expected.Commit || !info.Started.Equal(expected.Started) || info.Uptime != expected.Uptime {
+		t.Fatalf("expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestTopicInfo(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("SETPARTSIZE default 4096\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientOKResponse(gconf)
+	})
+	if err := c.SetTopicPartitionSize(nil, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("TOPICINFO other\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientMultiResponse(gconf, []byte("format json\r\npartition-size 4096\r\n"))
+	})
+	info, err := c.TopicInfo([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (TopicInfo{Format: "json", PartitionSize: 4096}); *info != expected {
+		t.Fatalf("expected %+v but got %+v", expected, *info)
+	}
+
+	if err := c.SetTopicPartitionSize(nil, 0); err != protocol.ErrInvalid {
+		t.Fatalf("expected %v but got %+v", protocol.ErrInvalid, err)
+	}
+}
+
+func TestPauseTopic(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("PAUSE default\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientOKResponse(gconf)
+	})
+	if err := c.PauseTopic(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrTopicPaused)
+	})
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	if _, err := c.Batch(batch); err != protocol.ErrTopicPaused {
+		t.Fatalf("expected %v but got %+v", protocol.ErrTopicPaused, err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("RESUME other\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientOKResponse(gconf)
+	})
+	if err := c.ResumeTopic([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitDurable(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("SYNC default 100\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientBatchResponse(gconf, 1024, 0)
+	})
+	if err := c.WaitDurable(nil, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrNotFound)
+	})
+	if err := c.WaitDurable(nil, 2048); err != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, err)
+	}
+}
+
+func TestOldest(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("TAILOFFSET default\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientBatchResponse(gconf, 1024, 0)
+	})
+	off, err := c.Oldest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != 1024 {
+		t.Fatalf("expected oldest offset 1024 but got %d", off)
+	}
+}
+
+func TestOffsetTime(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	now := time.Now()
+	server.Expect(func(p []byte) io.WriterTo {
+		expected := []byte("OFFSETTIME default 100\r\n")
+		if !bytes.Equal(p, expected) {
+			log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", expected, p)
+		}
+		return protocol.NewClientBatchResponse(gconf, uint64(now.UnixNano()), 0)
+	})
+	ts, err := c.OffsetTime(nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(time.Unix(0, now.UnixNano())) {
+		t.Fatalf("expected time %v but got %v", now, ts)
+	}
+
+	// batches logged before timestamps were stored
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientBatchResponse(gconf, 0, 0)
+	})
+	ts, err = c.OffsetTime(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.IsZero() {
+		t.Fatalf("expected the zero time but got %v", ts)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return protocol.NewClientErrResponse(gconf, protocol.ErrNotFound)
+	})
+	if _, err := c.OffsetTime(nil, 2048); err != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, err)
+	}
+}
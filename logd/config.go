@@ -24,17 +24,53 @@ type Config struct {
 	ConnRetryInterval    time.Duration `json:"connection-retry-interval"`
 	ConnRetryMaxInterval time.Duration `json:"connection-retry-max-interval"`
 	ConnRetryMultiplier  float64       `json:"connection-retry-multiplier"`
+	AuthToken            string        `json:"auth-token"`
+	VerifyIdentity       bool          `json:"verify-identity"`
+	Preflight            bool          `json:"preflight"`
+
+	// ReconcileLimits requests the server's limits after connecting. If the
+	// batch size is larger than the server's max batch size, batches are
+	// limited to the server's for the connection. Other mismatches are
+	// logged. See Client.ServerLimits.
+	ReconcileLimits bool `json:"reconcile-limits"`
+
+	// HealthCheckInterval is how often a MultiClient checks whether an
+	// unhealthy server has recovered. 0 checks before every request.
+	HealthCheckInterval time.Duration `json:"health-check-interval"`
+
+	// Checksum is the crc32 polynomial batch checksums are calculated with,
+	// either ieee or castagnoli. It must match the server's. If it's empty,
+	// ieee is used.
+	Checksum string `json:"checksum"`
 
 	// write options
 	BatchSize    int    `json:"batch-size"`
 	WriteForever bool   `json:"write-forever"`
 	InputPath    string `json:"input"`
+	CopyOnWrite  bool   `json:"copy-on-write"`
 
 	// read options
 	Limit       int    `json:"limit"`
 	Offset      uint64 `json:"offset"`
 	ReadForever bool   `json:"read-forever"`
 	UseTail     bool   `json:"use-tail"`
+	Compress    bool   `json:"compress"`
+
+	// MaxCatchUp limits how far behind the head, in bytes of log, a scanner
+	// reading forever may start. Starting further back fails with
+	// ErrOffsetTooOld, so following doesn't begin with a long backlog; read
+	// the backlog with a scanner that doesn't read forever instead. 0 means
+	// no limit.
+	//
+	// The limit is only enforced by the client. A follow's reads are plain
+	// READ requests, so the server can't tell them apart from other reads,
+	// and clients without the limit can still start anywhere.
+	MaxCatchUp uint64 `json:"max-catch-up"`
+
+	// MaxCatchUpAge limits how far back FollowTime may start. Earlier start
+	// times fail with ErrOffsetTooOld. 0 means no limit. Like MaxCatchUp, it's
+	// only enforced by the client.
+	MaxCatchUpAge time.Duration `json:"max-catch-up-age"`
 }
 
 // DefaultConfig is the default client configuration
@@ -52,9 +88,12 @@ var DefaultConfig = &Config{
 	ConnRetryInterval:    1 * time.Second,
 	ConnRetryMaxInterval: 30 * time.Second,
 	ConnRetryMultiplier:  2.0,
+	Checksum:             config.ChecksumIEEE,
+	HealthCheckInterval:  5 * time.Second,
 
-	BatchSize: 1024 * 64,
-	InputPath: "-",
+	BatchSize:   1024 * 64,
+	InputPath:   "-",
+	CopyOnWrite: true,
 
 	Limit: 15,
 }
@@ -72,6 +111,9 @@ func (c *Config) Validate() error {
 	if c.ConnRetryMultiplier < 1.0 {
 		return errors.New("conn-retry-multiplier must be >= 1.0")
 	}
+	if c.Checksum != "" && c.Checksum != config.ChecksumIEEE && c.Checksum != config.ChecksumCastagnoli {
+		return fmt.Errorf("checksum must be %s or %s", config.ChecksumIEEE, config.ChecksumCastagnoli)
+	}
 	return nil
 }
 
@@ -100,6 +142,13 @@ func (c *Config) getWriteTimeout() time.Duration {
 	return c.Timeout
 }
 
+func (c *Config) getChecksum() string {
+	if c.Checksum != "" {
+		return c.Checksum
+	}
+	return config.ChecksumIEEE
+}
+
 // ToGeneralConfig copies what is needed for shared modules (internal,
 // protocol) to the server config struct.
 func (c *Config) ToGeneralConfig() *config.Config {
@@ -108,6 +157,7 @@ func (c *Config) ToGeneralConfig() *config.Config {
 	gconf.Verbose = c.Verbose
 	gconf.Host = c.Hostport
 	gconf.MaxBatchSize = c.BatchSize
+	gconf.Checksum = c.getChecksum()
 	return gconf
 }
 
@@ -119,6 +169,7 @@ func (c *Config) FromGeneralConfig(conf *config.Config) *Config {
 	c.Verbose = conf.Verbose
 	c.Hostport = conf.Host
 	c.BatchSize = conf.MaxBatchSize
+	c.Checksum = conf.Checksum
 
 	return newc
 }
@@ -0,0 +1,161 @@
+package logd
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/jeffrom/logd/protocol"
+)
+
+// MergedScanner reads messages from several topics, interleaved in the order
+// the server received them. It's returned by Client.ReadMerged.
+type MergedScanner struct {
+	c       *Client
+	start   int64
+	limit   int
+	cursors []*mergeCursor
+	msg     *protocol.Message
+	topic   string
+	err     error
+}
+
+// mergeCursor tracks a topic's position in a merged read. msgs holds the
+// messages from the topic's last READ response that haven't been scanned.
+type mergeCursor struct {
+	topic []byte
+	off   uint64
+	end   uint64
+	msgs  []*protocol.Message
+}
+
+// ReadMerged returns a scanner that reads topics from start up to their heads
+// at the time of the call, merging their messages in timestamp order. Messages
+// with the same timestamp are ordered by topic name, and messages within a
+// topic keep their order in the log. If start is the zero time, topics are read
+// from their oldest batch, including batches logged before timestamps were
+// stored. Otherwise those batches are skipped.
+//
+// Each topic is read from its oldest batch, as the server doesn't index
+// batches by time, and a READ request is sent whenever a topic's buffered
+// messages run out.
+func (c *Client) ReadMerged(topics []string, start time.Time) (*MergedScanner, error) {
+	names := append([]string(nil), topics...)
+	sort.Strings(names)
+
+	limit := c.conf.Limit
+	if limit < 1 {
+		limit = DefaultConfig.Limit
+	}
+	s := &MergedScanner{
+		c:       c,
+		limit:   limit,
+		cursors: make([]*mergeCursor, 0, len(names)),
+	}
+	if !start.IsZero() {
+		s.start = start.UnixNano()
+	}
+
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+
+		topic := []byte(name)
+		end, err := c.Head(topic)
+		if err != nil {
+			return nil, err
+		}
+		off, err := c.Oldest(topic)
+		if err != nil {
+			return nil, err
+		}
+		s.cursors = append(s.cursors, &mergeCursor{topic: topic, off: off, end: end})
+	}
+	return s, nil
+}
+
+// Scan reads the next message. It returns false when all topics have been
+// read, or an error is encountered.
+func (s *MergedScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	var next *mergeCursor
+	for _, cur := range s.cursors {
+		if err := s.fill(cur); err != nil {
+			s.err = err
+			return false
+		}
+		if len(cur.msgs) == 0 {
+			continue
+		}
+		// cursors are sorted by topic name, so the first of any with the
+		// same timestamp wins.
+		if next == nil || cur.msgs[0].Timestamp < next.msgs[0].Timestamp {
+			next = cur
+		}
+	}
+	if next == nil {
+		return false
+	}
+
+	s.msg = next.msgs[0]
+	s.topic = string(next.topic)
+	next.msgs[0] = nil
+	next.msgs = next.msgs[1:]
+	return true
+}
+
+// fill reads batches into the cursor until it has a message to scan or the
+// topic has been read to its end.
+func (s *MergedScanner) fill(cur *mergeCursor) error {
+	msg := protocol.NewMessage(s.c.gconf)
+	br := bufio.NewReader(nil)
+	for len(cur.msgs) == 0 && cur.off < cur.end {
+		off, err := s.c.scanBatches(cur.topic, cur.off, cur.end, s.limit, func(boff uint64, batch *protocol.Batch) error {
+			if batch.Timestamp < s.start {
+				return nil
+			}
+
+			br.Reset(bytes.NewReader(batch.MessageBytes()))
+			var delta int64
+			for i := 0; i < batch.Messages; i++ {
+				msg.Reset()
+				n, err := msg.ReadFrom(br)
+				if err != nil {
+					return err
+				}
+				msg.Offset = boff
+				msg.Delta = uint64(delta)
+				msg.Timestamp = batch.Timestamp
+				delta += n
+
+				cur.msgs = append(cur.msgs, msg.Copy())
+			}
+			return nil
+		})
+		cur.off = off
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Message returns the current message. It isn't reused, so it can be kept.
+func (s *MergedScanner) Message() *protocol.Message {
+	return s.msg
+}
+
+// Topic returns the topic of the current message.
+func (s *MergedScanner) Topic() string {
+	return s.topic
+}
+
+// Error returns the error that stopped the scanner, if any.
+func (s *MergedScanner) Error() error {
+	return s.err
+}
@@ -0,0 +1,248 @@
+package logd
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/protocol"
+)
+
+// ErrUnhealthy is returned by MultiClient when there's no healthy server to
+// send a request to.
+var ErrUnhealthy = errors.New("no healthy server")
+
+// MultiClient sends reads to several servers, such as replicas of a leader,
+// and writes to the leader. Reads are sent to each healthy server in turn.
+// A server that fails a request with a connection error becomes unhealthy,
+// and isn't sent requests again until it answers a CONFIG request, which is
+// tried at most once every HealthCheckInterval. Errors a server responds
+// with, like protocol.ErrNotFound, don't make it unhealthy.
+//
+// Each server has its own Client, which doesn't retry requests, so a read
+// that fails is sent to the next healthy server instead. Like Client, a
+// MultiClient shouldn't be used by more than one goroutine at a time.
+type MultiClient struct {
+	conf   *Config
+	leader *multiNode
+	nodes  []*multiNode // the servers reads are sent to
+	next   int          // the index in nodes of the server for the next read
+}
+
+// multiNode is one of a MultiClient's servers.
+type multiNode struct {
+	addr    string
+	c       *Client
+	healthy bool
+	checked time.Time // when the server was last found unhealthy
+}
+
+// DialMulti returns a MultiClient that sends writes to leader and reads to
+// addrs, which may include the leader. Servers that can't be connected to
+// start out unhealthy. It fails if none of addrs can be connected to.
+func DialMulti(leader string, addrs []string, conf *Config) (*MultiClient, error) {
+	m := newMultiClient(leader, addrs, conf)
+	m.connect()
+	if len(m.Healthy()) == 0 {
+		internal.IgnoreError(conf.Verbose, m.Close())
+		return nil, ErrUnhealthy
+	}
+	return m, nil
+}
+
+func newMultiClient(leader string, addrs []string, conf *Config) *MultiClient {
+	m := &MultiClient{conf: conf}
+	seen := make(map[string]*multiNode)
+	node := func(addr string) *multiNode {
+		if n, ok := seen[addr]; ok {
+			return n
+		}
+		nconf := &Config{}
+		*nconf = *conf
+		nconf.Hostport = addr
+		nconf.ConnRetries = 0
+		n := &multiNode{addr: addr, c: New(nconf)}
+		seen[addr] = n
+		return n
+	}
+
+	m.leader = node(leader)
+	for _, addr := range addrs {
+		n := node(addr)
+		if !m.hasNode(n) {
+			m.nodes = append(m.nodes, n)
+		}
+	}
+	return m
+}
+
+func (m *MultiClient) hasNode(n *multiNode) bool {
+	for _, other := range m.nodes {
+		if other == n {
+			return true
+		}
+	}
+	return false
+}
+
+// connect connects to every server, marking those that fail as unhealthy.
+func (m *MultiClient) connect() {
+	for _, n := range m.all() {
+		if err := n.c.connect(n.addr); err != nil {
+			m.setUnhealthy(n, err)
+			continue
+		}
+		n.healthy = true
+	}
+}
+
+// all returns the leader and the servers reads are sent to.
+func (m *MultiClient) all() []*multiNode {
+	if m.hasNode(m.leader) {
+		return m.nodes
+	}
+	return append([]*multiNode{m.leader}, m.nodes...)
+}
+
+// Healthy returns the addresses of the servers reads are currently sent to.
+func (m *MultiClient) Healthy() []string {
+	var addrs []string
+	for _, n := range m.nodes {
+		if n.healthy {
+			addrs = append(addrs, n.addr)
+		}
+	}
+	return addrs
+}
+
+// Leader returns the leader's Client, for writes other than Batch. Requests
+// made with it don't change the leader's health.
+func (m *MultiClient) Leader() *Client {
+	return m.leader.c
+}
+
+// Batch sends a BATCH request to the leader. Like Client.Batch, it doesn't
+// retry.
+func (m *MultiClient) Batch(batch *protocol.Batch) (uint64, error) {
+	n := m.leader
+	if !m.available(n) {
+		return 0, ErrUnhealthy
+	}
+	off, err := n.c.Batch(batch)
+	if err != nil {
+		m.failed(n, err)
+	}
+	return off, err
+}
+
+// ReadOffset sends a READ request to the next healthy server, returning a
+// scanner over the messages in the response, as Client.ReadOffset does.
+func (m *MultiClient) ReadOffset(topic []byte, offset uint64, limit int) (int, *protocol.BatchScanner, error) {
+	var nbatches int
+	var bs *protocol.BatchScanner
+	err := m.read(func(c *Client) error {
+		var err error
+		nbatches, bs, err = c.ReadOffset(topic, offset, limit)
+		return err
+	})
+	return nbatches, bs, err
+}
+
+// Tail sends a TAIL request to the next healthy server, as Client.Tail does.
+// The server isn't sent other reads until the scanner has read the whole
+// response.
+func (m *MultiClient) Tail(topic []byte, limit int) (uint64, int, *protocol.BatchScanner, error) {
+	var off uint64
+	var nbatches int
+	var bs *protocol.BatchScanner
+	err := m.read(func(c *Client) error {
+		var err error
+		off, nbatches, bs, err = c.Tail(topic, limit)
+		return err
+	})
+	return off, nbatches, bs, err
+}
+
+// read calls fn with the client of each healthy server in turn until it
+// succeeds or fails with an error the server responded with. Servers still
+// sending a TAIL response are skipped.
+func (m *MultiClient) read(fn func(c *Client) error) error {
+	err := ErrUnhealthy
+	for i := 0; i < len(m.nodes); i++ {
+		n := m.nodes[m.next]
+		m.next = (m.next + 1) % len(m.nodes)
+		if !m.available(n) {
+			continue
+		}
+		if n.c.Tailing() {
+			err = ErrTailing
+			continue
+		}
+
+		err = fn(n.c)
+		if err == nil || !m.failed(n, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// available returns true if requests can be sent to the server. An unhealthy
+// server that hasn't been checked for HealthCheckInterval is sent a CONFIG
+// request, and becomes healthy again if it answers.
+func (m *MultiClient) available(n *multiNode) bool {
+	if n.healthy {
+		return true
+	}
+	if time.Since(n.checked) < m.conf.HealthCheckInterval {
+		return false
+	}
+
+	if _, err := n.c.Config(); err != nil {
+		m.setUnhealthy(n, err)
+		return false
+	}
+	log.Printf("%s: healthy again", n.addr)
+	n.healthy = true
+	return true
+}
+
+// failed marks the server unhealthy if err means the connection to it
+// failed, returning true if it did.
+func (m *MultiClient) failed(n *multiNode, err error) bool {
+	if !IsRetryable(err) {
+		return false
+	}
+	if n.healthy {
+		log.Printf("%s: unhealthy: %+v", n.addr, err)
+	}
+	m.setUnhealthy(n, err)
+	return true
+}
+
+func (m *MultiClient) setUnhealthy(n *multiNode, err error) {
+	internal.Debugf(n.c.gconf, "%s: unhealthy: %+v", n.addr, err)
+	n.healthy = false
+	n.checked = time.Now()
+
+	// the client reconnects when the server is next checked
+	if n.c.closer != nil {
+		internal.IgnoreError(m.conf.Verbose, n.c.closer.Close())
+	}
+	n.c.unsetConn()
+}
+
+// Close closes the connection to every server, returning the first error.
+func (m *MultiClient) Close() error {
+	var err error
+	for _, n := range m.all() {
+		if n.c.Conn == nil {
+			continue
+		}
+		if cerr := n.c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
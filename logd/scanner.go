@@ -15,6 +15,10 @@ import (
 // ErrStopped indicates the scanner was stopped
 var ErrStopped = stderrors.New("stopped")
 
+// ErrOffsetTooOld is returned when following a topic would start further back
+// than Config.MaxCatchUp or Config.MaxCatchUpAge allow.
+var ErrOffsetTooOld = stderrors.New("offset too old for tail")
+
 // Scanner is used to read batches from the log, scanning message by message
 type Scanner struct {
 	*Client
@@ -86,6 +90,125 @@ func DialScanner(addr string) (*Scanner, error) {
 	return DialScannerConfig(addr, DefaultConfig)
 }
 
+// FollowTime returns a scanner that reads topic from the first batch the
+// server received at or after start, and keeps reading new messages as
+// they're written, as with Config.ReadForever. limit is the number of
+// messages requested at a time. If start is the zero time, the topic is read
+// from its oldest batch.
+//
+// clamped is true if batches have been removed by retention and the oldest
+// remaining batch is the first one at or after start, but was received after
+// start, so messages since start may have been missed. It's never set for the
+// zero start time. Batches logged before timestamps were stored are
+// skipped. The server doesn't index batches by time, so the topic is read
+// from its oldest batch to find the starting offset.
+//
+// If start is older than Config.MaxCatchUpAge, ErrOffsetTooOld is returned
+// without reading anything. The scanner reads forever, so Config.MaxCatchUp
+// also applies, and its first Scan fails with ErrOffsetTooOld if the starting
+// offset is too far behind the head.
+func (c *Client) FollowTime(topic []byte, start time.Time, limit int) (s *Scanner, clamped bool, err error) {
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	if age := c.conf.MaxCatchUpAge; age > 0 && !start.IsZero() && time.Since(start) > age {
+		return nil, false, errors.Wrapf(ErrOffsetTooOld, "%s is more than %s ago", start, age)
+	}
+	if limit < 1 {
+		limit = c.conf.Limit
+	}
+	if limit < 1 {
+		limit = DefaultConfig.Limit
+	}
+
+	off, clamped, err := c.offsetSince(topic, start, limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conf := *c.conf
+	conf.ReadForever = true
+	conf.Limit = limit
+	s = NewScanner(&conf, "")
+	s.Client = c
+	s.topic = topic
+	s.SetOffset(off)
+	return s, clamped, nil
+}
+
+// offsetSince returns the offset of the first batch in topic the server
+// received at or after start, or the head if there isn't one. If the topic
+// doesn't exist yet, it's 0. It's clamped if that's the oldest batch and it
+// was received after start, as retention may have removed batches since start.
+func (c *Client) offsetSince(topic []byte, start time.Time, limit int) (uint64, bool, error) {
+	oldest, err := c.Oldest(topic)
+	if errors.Cause(err) == protocol.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if start.IsZero() {
+		return oldest, false, nil
+	}
+	head, err := c.Head(topic)
+	if err != nil {
+		return 0, false, err
+	}
+
+	since := start.UnixNano()
+	found := false
+	var foundOff uint64
+	var foundTs int64
+	off := oldest
+	for off < head && !found {
+		off, err = c.scanBatches(topic, off, head, limit, func(boff uint64, batch *protocol.Batch) error {
+			if ts := batch.Timestamp; !found && ts > 0 && ts >= since {
+				found = true
+				foundOff, foundTs = boff, ts
+			}
+			return nil
+		})
+		if errors.Cause(err) == protocol.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if !found {
+		return off, false, nil
+	}
+	return foundOff, foundOff == oldest && oldest > 0 && foundTs > since, nil
+}
+
+// scanBatches sends a READ request for topic at off, calling fn with each
+// batch in the response that starts before end, along with its offset. It
+// returns the offset following the last batch fn was called with.
+func (c *Client) scanBatches(topic []byte, off, end uint64, limit int, fn func(off uint64, batch *protocol.Batch) error) (uint64, error) {
+	respOff := off
+	_, bs, err := c.ReadOffset(topic, off, limit)
+	if err != nil {
+		return off, err
+	}
+
+	for off < end && bs.Scan() {
+		batchOff := off
+		off = respOff + uint64(bs.Scanned())
+		if err := fn(batchOff, bs.Batch()); err != nil {
+			return off, err
+		}
+	}
+	if serr := bs.Error(); serr != nil && serr != io.EOF {
+		return off, serr
+	}
+	if bs.Batches() == 0 {
+		// the server should have responded with not found instead
+		return off, protocol.ErrNotFound
+	}
+	return off, nil
+}
+
 // Reset sets the scanner to it's initial values so it can be reused.
 func (s *Scanner) Reset() {
 	s.msg.Reset()
@@ -208,6 +331,7 @@ func (s *Scanner) readMessage() error {
 	}
 	s.msg.Offset = s.curr
 	s.msg.Delta = uint64(s.batchRead)
+	s.msg.Timestamp = s.batch.Timestamp
 
 	s.batchRead += int(n)
 	s.messagesRead++
@@ -216,6 +340,90 @@ func (s *Scanner) readMessage() error {
 }
 
 func (s *Scanner) doInitialRead() error {
+	if err := s.checkCatchUp(); err != nil {
+		return err
+	}
+
+	nbatches, bs, delta, err := s.initialRead()
+	// the topic is empty or the offset hasn't been written yet. when reading
+	// forever, wait for the first batch instead of failing.
+	for s.conf.ReadForever && errors.Cause(err) == protocol.ErrNotFound {
+		select {
+		case <-time.After(s.conf.WaitInterval):
+		case <-s.done:
+			return ErrStopped
+		}
+		nbatches, bs, delta, err = s.initialRead()
+	}
+	if err != nil {
+		return err
+	}
+
+	s.s = bs
+	s.nbatches = nbatches
+	internal.Debugf(s.gconf, "started reading from %d", s.curr)
+	if !s.s.Scan() {
+		return s.truncatedErr(s.s.Error())
+	}
+
+	if err := s.setNextBatch(); err != nil {
+		return err
+	}
+
+	for uint64(s.batchRead) < delta {
+		if err := s.readMessage(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// checkCatchUp returns ErrOffsetTooOld if the scanner reads forever and would
+// start more than Config.MaxCatchUp behind the head.
+func (s *Scanner) checkCatchUp() error {
+	if !s.conf.ReadForever || s.conf.MaxCatchUp == 0 {
+		return nil
+	}
+	head, err := s.Client.Head(s.topic)
+	if errors.Cause(err) == protocol.ErrNotFound {
+		// the topic doesn't exist yet, so there's nothing to catch up on
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	off := s.startoff
+	if s.usetail {
+		off, err = s.tailStart()
+		if err != nil {
+			return err
+		}
+	}
+	if off < head && head-off > s.conf.MaxCatchUp {
+		return errors.Wrapf(ErrOffsetTooOld, "offset %d is %d behind the head", off, head-off)
+	}
+	return nil
+}
+
+// tailStart returns the offset a scanner that didn't set an offset starts
+// reading from: the previous state's if there is one, or else the oldest.
+func (s *Scanner) tailStart() (uint64, error) {
+	if s.statem != nil {
+		if off, _, err := s.statem.Get(); err == nil {
+			return off, nil
+		}
+	}
+	off, err := s.Client.Oldest(s.topic)
+	if errors.Cause(err) == protocol.ErrNotFound {
+		return 0, nil
+	}
+	return off, err
+}
+
+// initialRead makes the first request for batches, returning the message
+// delta to start from if a previous state was found.
+func (s *Scanner) initialRead() (int, *protocol.BatchScanner, uint64, error) {
 	var bs *protocol.BatchScanner
 	var err error
 	var nbatches int
@@ -234,14 +442,11 @@ func (s *Scanner) doInitialRead() error {
 			off, delt, err := s.statem.Get()
 			delta = delt
 			if err != nil {
-				return err
+				return 0, nil, 0, err
 			}
 			s.curr = off
 			internal.Debugf(s.gconf, "starting from previous state: offset %d, delta %d", off, delta)
 			nbatches, bs, err = s.Client.ReadOffset(s.topic, s.curr, s.limit)
-			if err != nil {
-				return err
-			}
 		} else {
 			s.curr, nbatches, bs, err = s.Client.Tail(s.topic, s.limit)
 			internal.Debugf(s.gconf, "starting with %d batches from log tail at %d (err: %+v)", nbatches, s.curr, err)
@@ -251,34 +456,14 @@ func (s *Scanner) doInitialRead() error {
 		nbatches, bs, err = s.Client.ReadOffset(s.topic, s.curr, s.limit)
 		internal.Debugf(s.gconf, "starting with %d batches from offset %d (err: %+v)", nbatches, s.curr, err)
 	}
-	if err != nil {
-		return err
-	}
-
-	s.s = bs
-	s.nbatches = nbatches
-	internal.Debugf(s.gconf, "started reading from %d", s.curr)
-	if !s.s.Scan() {
-		return s.s.Error()
-	}
-
-	if err := s.setNextBatch(); err != nil {
-		return err
-	}
-
-	for uint64(s.batchRead) < delta {
-		if err := s.readMessage(); err != nil {
-			return err
-		}
-	}
-	return err
+	return nbatches, bs, delta, err
 }
 
 func (s *Scanner) scanNextBatch() error {
 	if s.batchRead >= s.batch.Size {
 		if s.batchesRead >= s.nbatches {
 			err := s.requestMoreBatches(false)
-			if err == protocol.ErrNotFound {
+			if errors.Cause(err) == protocol.ErrNotFound {
 				if !s.conf.ReadForever {
 					return protocol.ErrNotFound
 				}
@@ -291,7 +476,7 @@ func (s *Scanner) scanNextBatch() error {
 		}
 
 		if !s.s.Scan() {
-			err := s.s.Error()
+			err := s.truncatedErr(s.s.Error())
 			if err != nil && err != io.EOF {
 				return err
 			}
@@ -346,6 +531,15 @@ func (s *Scanner) setNextBatch() error {
 	return err
 }
 
+// truncatedErr returns ErrTruncatedChunk if the batch scanner reached EOF
+// before all the batches in the response were read.
+func (s *Scanner) truncatedErr(err error) error {
+	if err == io.EOF && s.batchesRead < s.nbatches {
+		return protocol.ErrTruncatedChunk
+	}
+	return err
+}
+
 func (s *Scanner) pollBatch() error {
 	go func() {
 		for {
@@ -353,7 +547,7 @@ func (s *Scanner) pollBatch() error {
 			case <-time.After(s.conf.WaitInterval):
 				err := s.requestMoreBatches(true)
 				if err != nil {
-					if err == protocol.ErrNotFound {
+					if errors.Cause(err) == protocol.ErrNotFound {
 						continue
 					}
 					s.pollC <- err
@@ -7,10 +7,12 @@ import (
 	"io"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/protocol"
 	"github.com/jeffrom/logd/testhelper"
+	"github.com/pkg/errors"
 )
 
 // TODO that if the server doesn't send back enough to reach conf.Limit, the
@@ -66,6 +68,168 @@ func TestScanner(t *testing.T) {
 	}
 }
 
+func TestScannerKeys(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.Offset = 0
+	conf.Limit = 3
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+	s := ScannerForClient(c)
+	defer s.Close()
+	defer expectServerClose(t, gconf, server)
+	s.SetTopic("default")
+
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.AppendKeyed([]byte("a"), []byte("hi"))
+	batch.Append([]byte("hallo"))
+	batch.AppendKeyed([]byte("b"), []byte("sup"))
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect(func(p []byte) io.WriterTo {
+		return readOKResponse(gconf, 0, 1, b.Bytes())
+	})
+
+	expectedKeys := [][]byte{[]byte("a"), nil, []byte("b")}
+	var msgs []*protocol.Message
+	for i, expectedKey := range expectedKeys {
+		if !s.Scan() {
+			t.Fatalf("stopped scanning too early (%d/%d) (err: %+v)", i, len(expectedKeys), s.Error())
+		}
+		if key := s.Message().Key(); !bytes.Equal(key, expectedKey) {
+			t.Fatalf("expected key %q but got %q", expectedKey, key)
+		}
+		msgs = append(msgs, s.Message().Copy())
+	}
+	if err := s.Error(); err != nil {
+		t.Fatalf("scan: %+v", err)
+	}
+
+	// keys stay with copied messages after the scanner moves on
+	if !bytes.Equal(msgs[0].Key(), []byte("a")) || msgs[1].Key() != nil {
+		t.Fatalf("expected copied keys %q and nil but got %q and %q", "a", msgs[0].Key(), msgs[1].Key())
+	}
+}
+
+func TestFollowTimeClamped(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	gconf := conf.ToGeneralConfig()
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	start := time.Unix(100, 0)
+	batch := protocol.NewBatch(gconf)
+	batch.SetTopic([]byte("default"))
+	batch.Timestamp = start.Add(time.Second).UnixNano()
+	batch.Append([]byte("hi"))
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(req string, resp io.WriterTo) {
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, []byte(req)) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", req, p)
+			}
+			return resp
+		})
+	}
+	// retention has removed the batches before 50, and the oldest batch left
+	// is after start
+	expect("TAILOFFSET default\r\n", protocol.NewClientBatchResponse(gconf, 50, 0))
+	expect("HEAD default\r\n", protocol.NewClientBatchResponse(gconf, 50+uint64(b.Len()), 0))
+	expect("READ default 50 2\r\n", readOKResponse(gconf, 50, 1, b.Bytes()))
+
+	s, clamped, err := c.FollowTime(nil, start, 2)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !clamped {
+		t.Fatal("expected the start to be clamped to the oldest batch")
+	}
+
+	expect("READ default 50 2\r\n", readOKResponse(gconf, 50, 1, b.Bytes()))
+	if !s.Scan() {
+		t.Fatalf("expected to scan a message (err: %+v)", s.Error())
+	}
+	if msg := s.Message(); msg.Offset != 50 || !bytes.Equal(msg.BodyBytes(), []byte("hi")) {
+		t.Fatalf("expected %q at offset 50 but got %q at %d", "hi", msg.BodyBytes(), msg.Offset)
+	}
+
+	// the oldest batch was received at the requested time, so nothing since
+	// then has been removed
+	expect("TAILOFFSET default\r\n", protocol.NewClientBatchResponse(gconf, 50, 0))
+	expect("HEAD default\r\n", protocol.NewClientBatchResponse(gconf, 50+uint64(b.Len()), 0))
+	expect("READ default 50 2\r\n", readOKResponse(gconf, 50, 1, b.Bytes()))
+	if _, clamped, err = c.FollowTime(nil, start.Add(time.Second), 2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if clamped {
+		t.Fatal("expected a start at the oldest batch not to be clamped")
+	}
+
+	// without a start time, the topic is read from its oldest batch
+	expect("TAILOFFSET default\r\n", protocol.NewClientBatchResponse(gconf, 50, 0))
+	if _, clamped, err = c.FollowTime(nil, time.Time{}, 2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if clamped {
+		t.Fatal("expected the zero start time not to be clamped")
+	}
+}
+
+func TestScannerMaxCatchUp(t *testing.T) {
+	conf := DefaultTestConfig(testing.Verbose())
+	conf.ReadForever = true
+	conf.MaxCatchUp = 100
+	conf.MaxCatchUpAge = time.Hour
+	gconf := conf.ToGeneralConfig()
+	fixture := testhelper.LoadFixture("batch.small")
+	server, clientConn := testhelper.Pipe()
+	defer server.Close()
+	c := New(conf).SetConn(clientConn)
+
+	expect := func(req string, resp io.WriterTo) {
+		server.Expect(func(p []byte) io.WriterTo {
+			if !bytes.Equal(p, []byte(req)) {
+				log.Panicf("expected:\n\n\t%q\n\n but got:\n\n\t%q", req, p)
+			}
+			return resp
+		})
+	}
+
+	s := ScannerForClient(c)
+	s.SetTopic("default")
+	s.SetOffset(50)
+	expect("HEAD default\r\n", protocol.NewClientBatchResponse(gconf, 200, 0))
+	if s.Scan() {
+		t.Fatal("expected not to scan a message starting 150 behind the head")
+	}
+	if err := s.Error(); errors.Cause(err) != ErrOffsetTooOld {
+		t.Fatalf("expected %v but got %+v", ErrOffsetTooOld, err)
+	}
+
+	s = ScannerForClient(c)
+	s.SetTopic("default")
+	s.SetOffset(150)
+	expect("HEAD default\r\n", protocol.NewClientBatchResponse(gconf, 200, 0))
+	expect(fmt.Sprintf("READ default 150 %d\r\n", conf.Limit), readOKResponse(gconf, 150, 1, fixture))
+	if !s.Scan() {
+		t.Fatalf("expected to scan a message (err: %+v)", s.Error())
+	}
+
+	if _, _, err := c.FollowTime(nil, time.Now().Add(-2*time.Hour), 1); errors.Cause(err) != ErrOffsetTooOld {
+		t.Fatalf("expected %v but got %+v", ErrOffsetTooOld, err)
+	}
+}
+
 func TestScannerLimit(t *testing.T) {
 	nbatches := 5
 	conf := DefaultTestConfig(testing.Verbose())
@@ -0,0 +1,63 @@
+package logd
+
+import "sync/atomic"
+
+// Stats holds counters describing a Client's activity. They're updated with
+// atomic increments, so the Client can be inspected while it's in use.
+type Stats struct {
+	Requests      int64 // requests sent, including retries
+	Errors        int64 // requests that failed to send or get a response
+	BytesSent     int64
+	BytesReceived int64
+	Flushes       int64 // flushes of the connection's write buffer
+	Connects      int64 // successful connections, including reconnects
+	Retries       int64 // request retry attempts
+}
+
+// load returns a copy of the stats.
+func (s *Stats) load() Stats {
+	return Stats{
+		Requests:      atomic.LoadInt64(&s.Requests),
+		Errors:        atomic.LoadInt64(&s.Errors),
+		BytesSent:     atomic.LoadInt64(&s.BytesSent),
+		BytesReceived: atomic.LoadInt64(&s.BytesReceived),
+		Flushes:       atomic.LoadInt64(&s.Flushes),
+		Connects:      atomic.LoadInt64(&s.Connects),
+		Retries:       atomic.LoadInt64(&s.Retries),
+	}
+}
+
+// WriterStats holds counters describing a Writer's activity, as well as the
+// stats of its Client.
+type WriterStats struct {
+	Stats
+
+	Messages       int64 // messages written
+	Batches        int64 // batches sent successfully
+	BatchErrors    int64 // batches that failed to send
+	BacklogDropped int64 // failed batches discarded because the backlog was full
+	Reconnects     int64 // successful reconnects after failures
+
+	// Flushes of pending messages, by what triggered them. Mostly
+	// TimerFlushes suggests raising BatchSize, while mostly SizeFlushes
+	// suggests raising WaitInterval. Flushes of empty batches aren't counted.
+	SizeFlushes   int64 // the next message wouldn't fit in the batch
+	TimerFlushes  int64 // WaitInterval passed
+	ManualFlushes int64 // Flush was called
+	CloseFlushes  int64 // Close was called
+}
+
+// load returns a copy of the stats. The client stats aren't included.
+func (s *WriterStats) load() WriterStats {
+	return WriterStats{
+		Messages:       atomic.LoadInt64(&s.Messages),
+		Batches:        atomic.LoadInt64(&s.Batches),
+		BatchErrors:    atomic.LoadInt64(&s.BatchErrors),
+		BacklogDropped: atomic.LoadInt64(&s.BacklogDropped),
+		Reconnects:     atomic.LoadInt64(&s.Reconnects),
+		SizeFlushes:    atomic.LoadInt64(&s.SizeFlushes),
+		TimerFlushes:   atomic.LoadInt64(&s.TimerFlushes),
+		ManualFlushes:  atomic.LoadInt64(&s.ManualFlushes),
+		CloseFlushes:   atomic.LoadInt64(&s.CloseFlushes),
+	}
+}
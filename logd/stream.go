@@ -0,0 +1,344 @@
+package logd
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jeffrom/logd/internal"
+	"github.com/jeffrom/logd/protocol"
+)
+
+// ErrStreamMismatch is returned when an SREAD response is tagged with a
+// different stream than the request was made for.
+var ErrStreamMismatch = errors.New("response stream id did not match request")
+
+// ErrStreamExpired is returned by Stream.Next when retention has removed the
+// batches at the stream's offset before they were read. A new stream can be
+// opened from the topic's oldest offset, which Client.Oldest returns.
+var ErrStreamExpired = errors.New("stream offset removed by retention")
+
+// streamBufferBatches is how many batches a stream buffers before it stops
+// being read from. A stream whose consumer falls behind stops requesting
+// batches without holding up the other streams on the connection.
+const streamBufferBatches = 32
+
+// Stream reads batches from a topic over a connection shared with other
+// streams. Streams are opened with Client.OpenStream. The server doesn't push
+// batches to streams: the client polls each stream's topic in turn.
+type Stream struct {
+	id    uint64
+	topic []byte
+	mux   *streamMux
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	off     uint64
+	batches []*protocol.Batch
+	err     error
+}
+
+func newStream(mux *streamMux, id uint64, topic []byte, off uint64) *Stream {
+	s := &Stream{
+		id:    id,
+		topic: append([]byte{}, topic...),
+		mux:   mux,
+		off:   off,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the stream's id, which tags its responses on the connection.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Topic returns the topic the stream is reading.
+func (s *Stream) Topic() string {
+	return string(s.topic)
+}
+
+// Offset returns the offset of the next batch the stream will request.
+func (s *Stream) Offset() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.off
+}
+
+// Next returns the stream's next batch, blocking until one is available. It
+// returns ErrStopped once the stream has been closed, or the error that
+// stopped it, such as ErrStreamExpired.
+func (s *Stream) Next() (*protocol.Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.batches) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.batches) == 0 {
+		return nil, s.err
+	}
+
+	batch := s.batches[0]
+	s.batches[0] = nil
+	s.batches = s.batches[1:]
+	return batch, nil
+}
+
+// Close stops reading the stream. Batches that have already been read are
+// discarded.
+func (s *Stream) Close() error {
+	s.stop(ErrStopped)
+	s.mux.remove(s)
+	return nil
+}
+
+func (s *Stream) stop(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	if err == ErrStopped {
+		s.batches = nil
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// wantsMore returns the offset to read from if the stream has room for more
+// batches.
+func (s *Stream) wantsMore() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.off, s.err == nil && len(s.batches) < streamBufferBatches
+}
+
+func (s *Stream) push(batches []*protocol.Batch, next uint64) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.batches = append(s.batches, batches...)
+		s.off = next
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// streamMux polls the open streams' topics, taking turns sending SREAD
+// requests for each stream with room for more batches, and waiting
+// WaitInterval when none of them had any. It shares the client's connection
+// with Client.Batch while any streams are open.
+type streamMux struct {
+	c       *Client
+	readreq *protocol.Read
+
+	mu      sync.Mutex
+	streams []*Stream
+	nextID  uint64
+	running bool
+	wg      sync.WaitGroup
+}
+
+func newStreamMux(c *Client) *streamMux {
+	return &streamMux{
+		c:       c,
+		readreq: protocol.NewRead(c.gconf),
+	}
+}
+
+func (m *streamMux) open(topic []byte, off uint64) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// stream ids start at 1, as 0 means an untagged READ.
+	m.nextID++
+	s := newStream(m, m.nextID, topic, off)
+	m.streams = append(m.streams, s)
+	if !m.running {
+		m.running = true
+		m.wg.Add(1)
+		go m.loop()
+	}
+	return s
+}
+
+func (m *streamMux) remove(s *Stream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, other := range m.streams {
+		if other == s {
+			m.streams = append(m.streams[:i], m.streams[i+1:]...)
+			return
+		}
+	}
+}
+
+// active returns the open streams. If there are none, the loop is stopped.
+func (m *streamMux) active() []*Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.streams) == 0 {
+		m.running = false
+		return nil
+	}
+	return append([]*Stream{}, m.streams...)
+}
+
+// closeAll stops all open streams and waits for the loop to exit.
+func (m *streamMux) closeAll() {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = nil
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.stop(ErrStopped)
+	}
+	m.wg.Wait()
+}
+
+func (m *streamMux) loop() {
+	defer m.wg.Done()
+	for {
+		streams := m.active()
+		if streams == nil {
+			return
+		}
+
+		var read bool
+		for _, s := range streams {
+			off, ok := s.wantsMore()
+			if !ok {
+				continue
+			}
+
+			n, err := m.read(s, off)
+			if errors.Cause(err) == protocol.ErrNotFound {
+				if err = m.expired(s, off); err == nil {
+					// the stream has caught up with the head of the topic
+					continue
+				}
+			}
+			if err != nil && m.connFailed(err) {
+				// the stream is read from its offset again once the client
+				// has reconnected
+				log.Printf("stream %d (%s): %+v", s.id, s.topic, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("stream %d (%s): %+v", s.id, s.topic, err)
+				s.stop(err)
+				m.remove(s)
+				continue
+			}
+			if n > 0 {
+				read = true
+			}
+		}
+
+		if !read {
+			time.Sleep(m.c.conf.WaitInterval)
+		}
+	}
+}
+
+// expired returns ErrStreamExpired if the stream's offset is before the oldest
+// batch in its topic. Otherwise, including when the topic doesn't exist yet,
+// the stream has caught up with the head of the topic.
+func (m *streamMux) expired(s *Stream, off uint64) error {
+	c := m.c
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	oldest, err := c.Oldest(s.topic)
+	if errors.Cause(err) == protocol.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if off < oldest {
+		return errors.Wrapf(ErrStreamExpired, "offset %d is before the oldest, %d", off, oldest)
+	}
+	return nil
+}
+
+// connFailed returns true if err means the connection failed, or its
+// responses can't be trusted, rather than the server rejecting the stream's
+// read. The connection is closed so the next request reconnects, and the
+// streams aren't stopped.
+func (m *streamMux) connFailed(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(net.Error); !ok && !IsRetryable(cause) &&
+		cause != protocol.ErrTruncatedChunk && cause != ErrStreamMismatch {
+		return false
+	}
+
+	c := m.c
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closer != nil {
+		internal.IgnoreError(c.conf.Verbose, c.closer.Close())
+	}
+	c.unsetConn()
+	return true
+}
+
+// read sends an SREAD request for the stream, buffering the batches in the
+// response. It returns the number of batches read.
+func (m *streamMux) read(s *Stream, off uint64) (int, error) {
+	c := m.c
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	req := m.readreq
+	req.Reset()
+	req.Stream = s.id
+	req.SetTopic(s.topic)
+	req.Offset = off
+	req.Messages = c.conf.Limit
+	if req.Messages < 1 {
+		req.Messages = DefaultConfig.Limit
+	}
+
+	internal.Debugf(c.gconf, "SREAD %d %s %d %d", s.id, s.topic, off, req.Messages)
+	if _, _, err := c.doRequest(req); err != nil {
+		return 0, err
+	}
+
+	respOff, nbatches, err := c.readBatchResponse()
+	if err != nil {
+		return 0, err
+	}
+	if c.cr.Stream() != s.id {
+		return 0, ErrStreamMismatch
+	}
+	if respOff != off {
+		log.Printf("response offset (%d) did not match request (%d)", respOff, off)
+		return 0, protocol.ErrInternal
+	}
+
+	internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Now().Add(c.ReadTimeout())))
+	defer func() {
+		internal.IgnoreError(c.conf.Verbose, c.SetReadDeadline(time.Time{}))
+	}()
+
+	batches := make([]*protocol.Batch, nbatches)
+	next := off
+	for i := 0; i < nbatches; i++ {
+		batch := protocol.NewBatch(c.gconf)
+		n, err := batch.ReadFrom(c.br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, protocol.ErrTruncatedChunk
+		}
+		if err != nil {
+			return 0, err
+		}
+		batches[i] = batch
+		next += uint64(n)
+	}
+
+	s.push(batches, next)
+	return nbatches, nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jeffrom/logd/config"
@@ -68,6 +69,14 @@ type writerCmd struct {
 	data []byte
 }
 
+// writerResult is the client goroutine's response to a writerCmd. For FLUSH
+// commands, it includes what the flush sent.
+type writerResult struct {
+	err      error
+	messages int
+	bytes    int
+}
+
 var cachedFlushCmd = &writerCmd{kind: cmdFlush}
 var cachedCloseCmd = &writerCmd{kind: cmdClose}
 
@@ -84,7 +93,7 @@ type Writer struct {
 	gconf        *config.Config
 	topic        []byte
 	state        writerState
-	resC         chan error
+	resC         chan writerResult
 	stateManager StatePusher
 	backlog      Backlogger
 	backlogC     chan *Backlog
@@ -94,9 +103,11 @@ type Writer struct {
 	timer        *time.Timer
 	timerStarted bool
 	batch        *protocol.Batch // owned by client goroutine
+	bodies       []byte          // copies of the batch's message bodies, if CopyOnWrite is set
 	err          error
 	inC          chan *writerCmd
 	stopC        chan struct{}
+	stats        *WriterStats
 }
 
 // NewWriter returns a new instance of Writer for a topic
@@ -111,11 +122,12 @@ func NewWriter(conf *Config, topic string) *Writer {
 		timer:        time.NewTimer(-1),
 		batch:        protocol.NewBatch(gconf),
 		inC:          make(chan *writerCmd),
-		resC:         make(chan error),
+		resC:         make(chan writerResult),
 		stopC:        make(chan struct{}, 1),
 		stateManager: &NoopStatePusher{},
 		backlog:      &NoopBacklogger{},
 		errh:         &NoopErrorHandler{},
+		stats:        &WriterStats{},
 	}
 
 	w.stopTimer()
@@ -125,6 +137,22 @@ func NewWriter(conf *Config, topic string) *Writer {
 	return w
 }
 
+// DialWriterConfig returns a new writer with a connection to addr. Unlike
+// NewWriter, which connects on the first write, connection errors, including
+// those from the pre-flight check, are returned immediately.
+func DialWriterConfig(addr string, conf *Config, topic string) (*Writer, error) {
+	if addr == "" {
+		addr = conf.Hostport
+	}
+	w := NewWriter(conf, topic)
+	w.hostport = addr
+	if err := w.connect(addr); err != nil {
+		w.stop()
+		return nil, err
+	}
+	return w, nil
+}
+
 // WithStateHandler sets a state pusher on the writer. It should be called as
 // part of initialization.
 func (w *Writer) WithStateHandler(m StatePusher) *Writer {
@@ -142,10 +170,19 @@ func (w *Writer) WithErrorHandler(eh ErrorHandler) *Writer {
 	return w
 }
 
+// Stats returns a snapshot of the writer's counters, including those of its
+// client.
+func (w *Writer) Stats() WriterStats {
+	stats := w.stats.load()
+	stats.Stats = w.Client.Stats()
+	return stats
+}
+
 // Reset sets the writer to its initial values
 func (w *Writer) Reset(topic string) {
-	w.topic = []byte(topic)
+	w.topic = append(w.topic[:0], topic...)
 	w.batch.Reset()
+	w.bodies = w.bodies[:0]
 	w.err = nil
 	w.retries = 0
 	w.stopTimer()
@@ -164,12 +201,15 @@ func (w *Writer) Reset(topic string) {
 	}
 }
 
+// Write adds p to the pending batch as a message. If CopyOnWrite is set, as it
+// is by default, p is copied. Otherwise the batch borrows p, so it must not be
+// modified until the batch has been flushed, such as by calling Flush.
 func (w *Writer) Write(p []byte) (int, error) {
 	cmd := cmdPool.Get().(*writerCmd)
 	cmd.kind = cmdMsg
 	cmd.data = p
 
-	err := w.doCommand(cmd)
+	err := w.doCommand(cmd).err
 	cmdPool.Put(cmd)
 	if err != nil {
 		return 0, err
@@ -177,24 +217,27 @@ func (w *Writer) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-// Flush implements the LogWriter interface
-func (w *Writer) Flush() error {
-	return w.doCommand(cachedFlushCmd)
+// Flush sends any pending messages to the server. It returns the number of
+// messages sent and their size in bytes, including protocol framing. Both are
+// 0 if nothing was pending or the batch failed.
+func (w *Writer) Flush() (int, int, error) {
+	res := w.doCommand(cachedFlushCmd)
+	return res.messages, res.bytes, res.err
 }
 
-// Close implements the LogWriter interface
+// Close implements the LogWriter interface. Pending messages are flushed
+// before the connection is closed. If the flush fails, the connection is
+// still closed and the flush error is returned.
 func (w *Writer) Close() error {
 	internal.Debugf(w.gconf, "closing writer")
-	err := w.doCommand(cachedCloseCmd)
+	err := w.doCommand(cachedCloseCmd).err
 	w.stop()
 	return err
 }
 
-func (w *Writer) doCommand(cmd *writerCmd) error {
+func (w *Writer) doCommand(cmd *writerCmd) writerResult {
 	w.inC <- cmd
-
-	err := <-w.resC
-	return err
+	return <-w.resC
 }
 
 func (w *Writer) stopTimer() {
@@ -223,24 +266,24 @@ func (w *Writer) loop() {
 				return
 			}
 			if w.err != nil {
-				w.resC <- w.err
+				w.resC <- writerResult{err: w.err}
 				continue
 			}
 
-			var err error
+			var res writerResult
 			switch cmd.kind {
 			case cmdMsg:
-				err = w.handleMsg(cmd.data)
+				res.err = w.handleMsg(cmd.data)
 			case cmdFlush:
-				err = w.handleFlush()
+				res.messages, res.bytes, res.err = w.handleFlush(&w.stats.ManualFlushes)
 			case cmdClose:
-				err = w.handleClose()
+				res.err = w.handleClose()
 			default:
 				log.Panicf("invalid command type: %v", cmd.kind)
 			}
 
-			w.err = err
-			w.resC <- err
+			w.err = res.err
+			w.resC <- res
 
 		case <-w.timer.C:
 			internal.Debugf(w.gconf, "<-timer.C %s", w.state)
@@ -248,7 +291,7 @@ func (w *Writer) loop() {
 			// case stateClosed:
 			// 	w.stopTimer()
 			case stateConnected:
-				err := w.handleFlush()
+				_, _, err := w.handleFlush(&w.stats.TimerFlushes)
 				w.err = err
 				if err == nil {
 					w.resetTimer(w.conf.WaitInterval)
@@ -263,21 +306,33 @@ func (w *Writer) loop() {
 }
 
 func (w *Writer) handleMsg(p []byte) error {
-	if err := w.setErr(w.ensureConn()); err != nil {
+	w.connMu.Lock()
+	err := w.ensureConn()
+	w.connMu.Unlock()
+	if err := w.setErr(err); err != nil {
 		w.startReconnect()
 		return err
 	}
 	w.state = stateConnected
 
 	if w.shouldFlush(len(p)) {
-		if err := w.handleFlush(); err != nil {
+		if _, _, err := w.handleFlush(&w.stats.SizeFlushes); err != nil {
 			return err
 		}
 	}
 
+	if w.conf.CopyOnWrite {
+		// bodies are copied into one buffer that's reused for each batch.
+		// when it grows, messages already in the batch keep referring to the
+		// old buffer, which is fine as it isn't reused.
+		start := len(w.bodies)
+		w.bodies = append(w.bodies, p...)
+		p = w.bodies[start:len(w.bodies):len(w.bodies)]
+	}
 	if err := w.batch.Append(p); err != nil {
 		return err
 	}
+	atomic.AddInt64(&w.stats.Messages, 1)
 
 	if !w.timerStarted {
 		w.resetTimer(w.conf.WaitInterval)
@@ -288,47 +343,57 @@ func (w *Writer) handleMsg(p []byte) error {
 }
 
 func (w *Writer) shouldFlush(size int) bool {
-	return (w.batch.CalcSize()+protocol.MessageSize(size)+8 >= w.conf.BatchSize)
+	return (w.batch.CalcSize()+protocol.MessageSize(size)+8 >= w.batchSize())
 }
 
-func (w *Writer) handleFlush() error {
+// handleFlush sends the pending batch, if there is one, returning the number
+// of messages sent and their size in bytes. trigger is the stats counter for
+// what caused the flush.
+func (w *Writer) handleFlush(trigger *int64) (int, int, error) {
 	if w.err != nil {
-		return w.err
+		return 0, 0, w.err
 	}
 
 	batch := w.batch
 	batch.SetTopic(w.topic)
 	if batch.Empty() {
-		return nil
+		return 0, 0, nil
 	}
+	atomic.AddInt64(trigger, 1)
 
 	w.state = stateFlushing
 	off, err := w.Batch(batch)
 	internal.Debugf(w.gconf, "flush complete, err: %+v", err)
 	if serr := w.setErr(err); serr != nil {
 		defer w.startReconnect()
+		atomic.AddInt64(&w.stats.BatchErrors, 1)
 
 		if w.backlogC != nil {
 			select {
 			case w.backlogC <- &Backlog{Batch: batch.Copy(), Err: serr}:
 			default:
+				atomic.AddInt64(&w.stats.BacklogDropped, 1)
 				log.Print("batch discarded because backlog channel was full")
 			}
 		}
 		w.errh.HandleError(serr)
 
 		batch.Reset()
-		return err
+		w.bodies = w.bodies[:0]
+		return 0, 0, err
 	}
+	messages, size := batch.Messages, batch.Size
 	batch.Reset()
+	w.bodies = w.bodies[:0]
 	w.state = stateConnected
+	atomic.AddInt64(&w.stats.Batches, 1)
 
 	if w.stateManager != nil {
 		if perr := w.stateManager.Push(off); perr != nil {
-			return perr
+			return messages, size, perr
 		}
 	}
-	return err
+	return messages, size, err
 }
 
 func (w *Writer) handleClose() error {
@@ -336,7 +401,20 @@ func (w *Writer) handleClose() error {
 		w.state = stateClosed
 		return w.Client.Conn.Close()
 	}
+
+	if _, _, err := w.handleFlush(&w.stats.CloseFlushes); err != nil {
+		// don't try to reconnect, as the writer is closing
+		w.stopTimer()
+		w.state = stateClosed
+		if w.Client.Conn != nil {
+			internal.LogError(w.Client.Conn.Close())
+		}
+		return err
+	}
+
+	w.connMu.Lock()
 	internal.LogError(w.Client.flush())
+	w.connMu.Unlock()
 	err := w.Client.Close()
 	w.state = stateClosed
 	return err
@@ -356,7 +434,10 @@ func (w *Writer) resetTimer(interval time.Duration) {
 
 func (w *Writer) handleReconnect() error {
 	internal.Debugf(w.gconf, "attempting reconnect, attempt: %d", w.retries+1)
-	if err := w.connect(w.conf.Hostport); err != nil {
+	w.connMu.Lock()
+	err := w.connect(w.conf.Hostport)
+	w.connMu.Unlock()
+	if err != nil {
 		w.retries++
 		if w.conf.ConnRetries > 0 && w.retries >= w.conf.ConnRetries {
 			internal.Debugf(w.gconf, "giving up after %d attempts", w.retries+1)
@@ -376,6 +457,7 @@ func (w *Writer) handleReconnect() error {
 	}
 
 	internal.Debugf(w.gconf, "successfully reconnected after %d attempts", w.retries+1)
+	atomic.AddInt64(&w.stats.Reconnects, 1)
 	w.retries = 0
 	w.state = stateConnected
 	w.stopTimer()
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -90,7 +91,7 @@ func TestWriterConcurrent(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := w.Flush(); err != nil {
+		if _, _, err := w.Flush(); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -173,7 +174,7 @@ func TestWriterTwoBatches(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := w.Flush(); err != nil {
+	if _, _, err := w.Flush(); err != nil {
 		t.Fatal(err)
 	}
 
@@ -245,7 +246,7 @@ func TestWriterStatePusher(t *testing.T) {
 
 	server.Close()
 	writeBatch(t, w, "hi", "hallo", "sup")
-	if err := w.Flush(); err == nil {
+	if _, _, err := w.Flush(); err == nil {
 		t.Fatal("expected error but got none")
 	}
 
@@ -268,6 +269,84 @@ func TestWriterStatePusher(t *testing.T) {
 	// }
 }
 
+func TestWriterCopyOnWrite(t *testing.T) {
+	for _, copyOnWrite := range []bool{true, false} {
+		t.Run(fmt.Sprintf("copy-on-write=%t", copyOnWrite), func(t *testing.T) {
+			conf := DefaultTestConfig(testing.Verbose())
+			conf.CopyOnWrite = copyOnWrite
+			dialer := &batchDialer{conf: conf.ToGeneralConfig(), bodyC: make(chan []byte, 1)}
+			w := NewWriter(conf, "default")
+			w.Client.dialer = dialer
+			defer w.Close()
+
+			p := []byte("before")
+			writeBatch(t, w, "first")
+			if _, err := w.Write(p); err != nil {
+				t.Fatal(err)
+			}
+			copy(p, "after!")
+			flushBatch(t, w)
+
+			body := <-dialer.bodyC
+			expected, unexpected := []byte("before"), []byte("after!")
+			if !copyOnWrite {
+				// the batch borrowed p, so it has the modified message
+				expected, unexpected = unexpected, expected
+			}
+			if !bytes.Contains(body, expected) || bytes.Contains(body, unexpected) || !bytes.Contains(body, []byte("first")) {
+				t.Fatalf("expected batch with %q but got %q", expected, body)
+			}
+		})
+	}
+}
+
+// batchDialer dials servers that respond OK to every batch, sending the
+// message bytes of each batch on bodyC if it's set.
+type batchDialer struct {
+	conf  *config.Config
+	bodyC chan []byte
+}
+
+func (d *batchDialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	server, client := net.Pipe()
+	go d.serve(server)
+	return client, nil
+}
+
+func (d *batchDialer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var off uint64
+	for {
+		req := protocol.NewRequestConfig(d.conf)
+		n, err := req.ReadFrom(br)
+		if err != nil {
+			return
+		}
+		if req.Name == protocol.CmdClose {
+			internal.LogError(writeResponse(conn, protocol.NewClientOKResponse(d.conf)))
+			return
+		}
+
+		batch, err := protocol.NewBatch(d.conf).FromRequest(req)
+		if err != nil {
+			log.Panicf("unexpected request %s: %+v", &req.Name, err)
+		}
+		if d.bodyC != nil {
+			d.bodyC <- append([]byte(nil), batch.MessageBytes()...)
+		}
+		if err := writeResponse(conn, protocol.NewClientBatchResponse(d.conf, off, 1)); err != nil {
+			return
+		}
+		off += uint64(n)
+	}
+}
+
+func writeResponse(w io.Writer, cr *protocol.ClientResponse) error {
+	_, err := cr.WriteTo(w)
+	return err
+}
+
 func writeBatch(t *testing.T, w *Writer, msgs ...string) {
 	t.Helper()
 	for _, msg := range msgs {
@@ -284,7 +363,7 @@ func writeBatch(t *testing.T, w *Writer, msgs ...string) {
 
 func flushBatch(t *testing.T, w *Writer) {
 	t.Helper()
-	if err := w.Flush(); err != nil {
+	if _, _, err := w.Flush(); err != nil {
 		t.Fatal(err)
 	}
 }
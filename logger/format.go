@@ -0,0 +1,87 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jeffrom/logd/config"
+)
+
+const formatFile = ".format"
+
+// TopicFormatter stores a topic's format, which describes how its messages are
+// encoded, such as "json" or "protobuf". It's advisory: messages aren't
+// checked against it.
+type TopicFormatter interface {
+	Format() (string, error)
+	SetFormat(format string) error
+}
+
+// TopicFormat implements TopicFormatter using a file in the topic directory.
+type TopicFormat struct {
+	conf   *config.Config
+	topic  string
+	format string
+}
+
+// NewTopicFormat returns a new instance of *TopicFormat
+func NewTopicFormat(conf *config.Config, topic string) *TopicFormat {
+	return &TopicFormat{
+		conf:  conf,
+		topic: topic,
+	}
+}
+
+func (f *TopicFormat) path() string {
+	return path.Join(f.conf.WorkDir, f.topic, formatFile)
+}
+
+// Setup implements internal.LifecycleManager
+func (f *TopicFormat) Setup() error {
+	b, err := ioutil.ReadFile(f.path())
+	if os.IsNotExist(err) {
+		f.format = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.format = strings.TrimSpace(string(b))
+	return nil
+}
+
+// Shutdown implements internal.LifecycleManager
+func (f *TopicFormat) Shutdown() error {
+	return nil
+}
+
+// Format implements TopicFormatter interface. It returns an empty string if
+// no format has been set.
+func (f *TopicFormat) Format() (string, error) {
+	return f.format, nil
+}
+
+// SetFormat implements TopicFormatter interface. The file is replaced with a
+// rename so it's never partially written.
+func (f *TopicFormat) SetFormat(format string) error {
+	if format == f.format {
+		return nil
+	}
+
+	dir := path.Join(f.conf.WorkDir, f.topic)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp := f.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(format+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path()); err != nil {
+		return err
+	}
+	f.format = format
+	return nil
+}
@@ -0,0 +1,114 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/jeffrom/logd/config"
+)
+
+const hwmFile = ".hwm"
+
+// hwmSize is the size of the high water mark file: a uint64 padded with
+// spaces, and a newline. It's fixed so the mark can be overwritten in place.
+const hwmSize = 21
+
+// HighWaterMarker persists the end of the last batch written to a topic,
+// separately from the log, so offsets that were handed out aren't reused if
+// the end of the log is lost.
+type HighWaterMarker interface {
+	HighWaterMark() (uint64, error)
+	SetHighWaterMark(off uint64) error
+	Flush() error
+}
+
+// HighWaterMark implements HighWaterMarker using a file in the topic
+// directory.
+type HighWaterMark struct {
+	conf  *config.Config
+	topic string
+	f     *os.File
+	off   uint64
+	buf   []byte
+}
+
+// NewHighWaterMark returns a new instance of *HighWaterMark
+func NewHighWaterMark(conf *config.Config, topic string) *HighWaterMark {
+	return &HighWaterMark{
+		conf:  conf,
+		topic: topic,
+		buf:   make([]byte, 0, hwmSize),
+	}
+}
+
+// Setup implements internal.LifecycleManager
+func (m *HighWaterMark) Setup() error {
+	dir := path.Join(m.conf.WorkDir, m.topic)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path.Join(dir, hwmFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	m.f = f
+
+	b := make([]byte, hwmSize)
+	n, err := io.ReadFull(f, b)
+	if err == io.EOF {
+		m.off = 0
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	off, err := strconv.ParseUint(string(bytes.TrimSpace(b[:n])), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid high water mark for topic %s: %q", m.topic, b[:n])
+	}
+	m.off = off
+	return nil
+}
+
+// Shutdown implements internal.LifecycleManager
+func (m *HighWaterMark) Shutdown() error {
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f = nil
+	return err
+}
+
+// HighWaterMark implements HighWaterMarker interface
+func (m *HighWaterMark) HighWaterMark() (uint64, error) {
+	return m.off, nil
+}
+
+// SetHighWaterMark implements HighWaterMarker interface. The mark is written
+// in a single write at the start of the file so it's never partially updated.
+func (m *HighWaterMark) SetHighWaterMark(off uint64) error {
+	if off <= m.off {
+		return nil
+	}
+	m.buf = strconv.AppendUint(m.buf[:0], off, 10)
+	for len(m.buf) < hwmSize-1 {
+		m.buf = append(m.buf, ' ')
+	}
+	m.buf = append(m.buf, '\n')
+	if _, err := m.f.WriteAt(m.buf, 0); err != nil {
+		return err
+	}
+	m.off = off
+	return nil
+}
+
+// Flush implements HighWaterMarker interface
+func (m *HighWaterMark) Flush() error {
+	return m.f.Sync()
+}
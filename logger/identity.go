@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jeffrom/logd/config"
+)
+
+const (
+	nodeIDFile   = ".node-id"
+	logIDFile    = ".log-id"
+	checksumFile = ".checksum"
+)
+
+// loadIdentity populates the config's node and log ids, generating and
+// storing them in the work directory if they don't exist yet. A configured
+// node id is used as is.
+func loadIdentity(conf *config.Config) error {
+	if conf.NodeID == "" {
+		id, err := loadOrCreateID(filepath.Join(conf.WorkDir, nodeIDFile))
+		if err != nil {
+			return err
+		}
+		conf.NodeID = id
+	}
+
+	id, err := loadOrCreateID(filepath.Join(conf.WorkDir, logIDFile))
+	if err != nil {
+		return err
+	}
+	conf.LogID = id
+	return nil
+}
+
+// loadChecksum checks the configured checksum polynomial is the one the log
+// in the work directory was written with, storing it if the log is new. A
+// log that was written before the polynomial was stored used ieee. It must
+// be called before loadIdentity, which creates the log id of a new log.
+func loadChecksum(conf *config.Config) error {
+	want := conf.Checksum
+	if want == "" {
+		want = config.ChecksumIEEE
+	}
+
+	p := filepath.Join(conf.WorkDir, checksumFile)
+	b, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	have := string(bytes.TrimSpace(b))
+	if have == "" {
+		have = want
+		if _, err := os.Stat(filepath.Join(conf.WorkDir, logIDFile)); err == nil {
+			have = config.ChecksumIEEE
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(have+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+
+	if have != want {
+		return fmt.Errorf("%s was written with %s checksums, but checksum is %s", conf.WorkDir, have, want)
+	}
+	return nil
+}
+
+func loadOrCreateID(p string) (string, error) {
+	b, err := ioutil.ReadFile(p)
+	if err == nil {
+		if id := bytes.TrimSpace(b); len(id) > 0 {
+			return string(id), nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(p, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jeffrom/logd/config"
+)
+
+const partitionSizeFile = ".partition-size"
+
+// TopicPartitionSizer stores the size a topic's partitions are rotated at,
+// overriding conf.PartitionSize for the topic.
+type TopicPartitionSizer interface {
+	PartitionSize() (int, error)
+	SetPartitionSize(size int) error
+}
+
+// TopicPartitionSize implements TopicPartitionSizer using a file in the topic
+// directory.
+type TopicPartitionSize struct {
+	conf  *config.Config
+	topic string
+	size  int
+}
+
+// NewTopicPartitionSize returns a new instance of *TopicPartitionSize
+func NewTopicPartitionSize(conf *config.Config, topic string) *TopicPartitionSize {
+	return &TopicPartitionSize{
+		conf:  conf,
+		topic: topic,
+	}
+}
+
+func (s *TopicPartitionSize) path() string {
+	return path.Join(s.conf.WorkDir, s.topic, partitionSizeFile)
+}
+
+// Setup implements internal.LifecycleManager
+func (s *TopicPartitionSize) Setup() error {
+	b, err := ioutil.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		s.size = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// Shutdown implements internal.LifecycleManager
+func (s *TopicPartitionSize) Shutdown() error {
+	return nil
+}
+
+// PartitionSize implements TopicPartitionSizer interface. It returns
+// conf.PartitionSize if no size has been set.
+func (s *TopicPartitionSize) PartitionSize() (int, error) {
+	if s.size <= 0 {
+		return s.conf.PartitionSize, nil
+	}
+	return s.size, nil
+}
+
+// SetPartitionSize implements TopicPartitionSizer interface. The file is
+// replaced with a rename so it's never partially written.
+func (s *TopicPartitionSize) SetPartitionSize(size int) error {
+	if size == s.size {
+		return nil
+	}
+
+	dir := path.Join(s.conf.WorkDir, s.topic)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(size)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path()); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
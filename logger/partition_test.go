@@ -1,8 +1,14 @@
 package logger
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jeffrom/logd/testhelper"
 )
@@ -78,3 +84,298 @@ func checkList(t testing.TB, p PartitionManager, l int, offs []uint64) []Partiti
 	}
 	return parts
 }
+
+func TestPartitionSharded(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	t.Log("starting in", conf.WorkDir)
+	w := NewWriter(conf, defaultTopic)
+	defer w.Close()
+
+	if err := w.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64(conf.PartitionSize)
+	offs := []uint64{0, size, size * 2, size * 3}
+	for _, off := range offs {
+		if err := w.SetPartition(off); err != nil {
+			t.Fatalf("unexpected error setting partition: %+v", err)
+		}
+	}
+
+	// switch to a sharded layout. partitions should be migrated on setup.
+	conf.PartitionFanout = 2
+	p := NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	checkList(t, p, len(offs), offs)
+	for _, off := range offs {
+		expected := filepath.Join(conf.WorkDir, defaultTopic, partitionShard(conf, off), strconv.FormatUint(off, 10)+".log")
+		if _, err := os.Stat(expected); err != nil {
+			t.Fatalf("expected partition %d at %s: %+v", off, expected, err)
+		}
+	}
+
+	part, err := p.Get(size*3, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error getting partition: %+v", err)
+	}
+	if cerr := part.Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	// and back to the flat layout
+	conf.PartitionFanout = 0
+	p = NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	checkList(t, p, len(offs), offs)
+	for _, off := range offs {
+		expected := filepath.Join(conf.WorkDir, defaultTopic, strconv.FormatUint(off, 10)+".log")
+		if _, err := os.Stat(expected); err != nil {
+			t.Fatalf("expected partition %d at %s: %+v", off, expected, err)
+		}
+	}
+}
+
+func TestPartitionShardedTopicSize(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.PartitionFanout = 2
+	p := NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	w := NewWriter(conf, defaultTopic)
+	defer w.Close()
+	if err := w.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a topic with a quarter of the server's partition size keeps four times
+	// as many partitions in each shard.
+	psize := NewTopicPartitionSize(conf, defaultTopic)
+	size := uint64(conf.PartitionSize)
+	if err := psize.SetPartitionSize(int(size / 4)); err != nil {
+		t.Fatal(err)
+	}
+	var offs []uint64
+	shards := make(map[uint64]string)
+	for i := uint64(0); i < 8; i++ {
+		off := i * size / 4
+		if err := w.SetPartition(off); err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, off)
+		shards[off] = "0"
+	}
+
+	// changing the topic's size again doesn't move the partitions already
+	// written
+	if err := psize.SetPartitionSize(int(size)); err != nil {
+		t.Fatal(err)
+	}
+	for i, off := range []uint64{size * 2, size * 3, size * 4} {
+		if err := w.SetPartition(off); err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, off)
+		shards[off] = strconv.Itoa(1 + i/2)
+	}
+
+	checkList(t, p, len(offs), offs)
+	for _, off := range offs {
+		expected := shards[off]
+		if shard := partitionShard(conf, off); shard != expected {
+			t.Fatalf("expected partition %d in shard %s but got %s", off, expected, shard)
+		}
+		part, err := p.Get(off, 0, 0)
+		if err != nil {
+			t.Fatalf("unexpected error getting partition %d: %+v", off, err)
+		}
+		if err := part.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPartitionRemoveSharded(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.PartitionFanout = 2
+	p := NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	w := NewWriter(conf, defaultTopic)
+	defer w.Close()
+	if err := w.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64(conf.PartitionSize)
+	offs := []uint64{0, size, size * 2}
+	for _, off := range offs {
+		if err := w.SetPartition(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shard := filepath.Join(conf.WorkDir, defaultTopic, partitionShard(conf, 0))
+
+	// the shard is only removed once its last partition is
+	if err := p.Remove(0); err != nil {
+		t.Fatalf("error removing 0: %+v", err)
+	}
+	if _, err := os.Stat(shard); err != nil {
+		t.Fatalf("expected shard %s to be kept: %+v", shard, err)
+	}
+	if err := p.Remove(size); err != nil {
+		t.Fatalf("error removing %d: %+v", size, err)
+	}
+	if _, err := os.Stat(shard); !os.IsNotExist(err) {
+		t.Fatalf("expected shard %s to be removed but got %v", shard, err)
+	}
+	checkList(t, p, 1, []uint64{size * 2})
+}
+
+func TestPartitionHold(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	p := NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	w := NewWriter(conf, defaultTopic)
+	defer w.Close()
+	if err := w.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPartition(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("cool")); err != nil {
+		t.Fatal(err)
+	}
+
+	release := p.Hold(0)
+	if err := p.Remove(0); err != nil {
+		t.Fatalf("error removing 0: %+v", err)
+	}
+	checkList(t, p, 0, []uint64{})
+
+	// the held partition can still be read after it's been removed
+	part, err := p.Get(0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected to get the held partition but got %+v", err)
+	}
+	release()
+	release()
+	if n := p.getRefs(0); n != 1 {
+		t.Fatalf("expected 1 reference after releasing but got %d", n)
+	}
+	b, err := ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "cool" {
+		t.Fatalf("expected %q but read %q", "cool", b)
+	}
+	if err := part.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.getRefs(0); n != 0 {
+		t.Fatalf("expected no references after closing but got %d", n)
+	}
+}
+
+func TestPartitionHoldRemoveConcurrent(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	p := NewPartitions(conf, defaultTopic)
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	w := NewWriter(conf, defaultTopic)
+	defer w.Close()
+	if err := w.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// files are left in place, so a partition deleted twice is counted twice
+	// rather than the second deletion finding nothing to delete. they're
+	// cleaned up with the temp directory.
+	var mu sync.Mutex
+	deleted := make(map[string]int)
+	removePartition = func(name string) error {
+		mu.Lock()
+		deleted[name]++
+		mu.Unlock()
+		return nil
+	}
+	// the holds are released while Remove is between moving the partition
+	// and deciding whether to delete it.
+	var renamed chan struct{}
+	var wg sync.WaitGroup
+	renamePartition = func(from, to string) error {
+		err := os.Rename(from, to)
+		close(renamed)
+		wg.Wait()
+		return err
+	}
+	defer func() {
+		renamePartition = os.Rename
+		removePartition = os.Remove
+	}()
+
+	n := 20
+	for off := uint64(0); off < uint64(n); off++ {
+		if err := w.SetPartition(off); err != nil {
+			t.Fatal(err)
+		}
+		renamed = make(chan struct{})
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(release func()) {
+				defer wg.Done()
+				<-renamed
+				release()
+			}(p.Hold(off))
+		}
+		if err := p.Remove(off); err != nil {
+			t.Fatalf("error removing %d: %+v", off, err)
+		}
+	}
+
+	// files are deleted in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		l := len(deleted)
+		mu.Unlock()
+		if l == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d partitions to be deleted but %d were", n, l)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, times := range deleted {
+		if times != 1 {
+			t.Fatalf("expected %s to be deleted once but it was deleted %d times", name, times)
+		}
+	}
+	if len(p.refs) != 0 || len(p.removed) != 0 {
+		t.Fatalf("expected no references or removed partitions left but got %v and %v", p.refs, p.removed)
+	}
+}
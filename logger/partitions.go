@@ -18,11 +18,20 @@ import (
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 )
 
 // ErrNotFound is returned when a partition could not be found
 var ErrNotFound = errors.New("partition not found")
 
+// renamePartition moves a removed partition to the temp directory, and
+// removePartition deletes its file once nothing references it. Tests replace
+// them to interleave with removals.
+var (
+	renamePartition = os.Rename
+	removePartition = os.Remove
+)
+
 // PartitionManager gets, create, and otherwise manages partitions
 type PartitionManager interface {
 	// Remove deletes a partition. If the partition doesn't exist, return an
@@ -33,6 +42,9 @@ type PartitionManager interface {
 	Get(offset uint64, delta, limit int) (Partitioner, error)
 	// List returns a list of the currently available partition offsets
 	List() ([]Partitioner, error)
+	// Hold keeps the partition at offset from being deleted until release is
+	// called, so it can still be read with Get after it's been removed.
+	Hold(offset uint64) (release func())
 }
 
 // Partitioner wraps the log partition. in most usage, an *os.File
@@ -51,9 +63,17 @@ type Partitions struct {
 	partitions []Partitioner
 	tempDir    string
 
-	refs map[uint64]int
-	mu   sync.Mutex
-
+	// removed partitions have been moved to the temp directory but not
+	// deleted yet, as they were referenced. Whichever of Remove and release
+	// finds the partition both removed and unreferenced takes the flag and
+	// deletes it.
+	refs    map[uint64]int
+	removed map[uint64]bool
+	mu      sync.Mutex // for refs and removed
+
+	// partitions may be opened from connection goroutines, so the path cache
+	// has its own lock.
+	pathMu    sync.Mutex
 	pathb     *bytes.Buffer
 	pathCache map[string]map[uint64]string
 }
@@ -66,6 +86,7 @@ func NewPartitions(conf *config.Config, topic string) *Partitions {
 		topic:      topic,
 		partitions: make([]Partitioner, conf.MaxPartitions),
 		refs:       make(map[uint64]int),
+		removed:    make(map[uint64]bool),
 		pathb:      &bytes.Buffer{},
 		pathCache:  make(map[string]map[uint64]string),
 	}
@@ -80,7 +101,47 @@ func (p *Partitions) reset() {
 
 // Setup implements internal.LifecycleManager
 func (p *Partitions) Setup() error {
-	return p.ensureTempDir()
+	if err := p.ensureTempDir(); err != nil {
+		return err
+	}
+	return p.migrate()
+}
+
+// migrate moves any partition files that don't match the configured layout
+// into place, so switching between flat and sharded layouts, or changing the
+// fanout, doesn't lose partitions.
+func (p *Partitions) migrate() error {
+	topicDir := path.Join(p.conf.WorkDir, p.topic)
+	matches, err := globPartitions(topicDir)
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		off, perr := p.extractOffset(match, false)
+		if perr != nil {
+			return perr
+		}
+
+		fullpath := partitionFullPath(p.conf, p.topic, off)
+		if filepath.Clean(match) == filepath.Clean(fullpath) {
+			continue
+		}
+
+		log.Printf("migrating partition %s to %s", match, fullpath)
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(match, fullpath); err != nil {
+			return err
+		}
+
+		// clean up the old shard directory. this fails if it isn't empty yet.
+		if dir := filepath.Dir(match); dir != filepath.Dir(fullpath) {
+			internal.IgnoreError(p.conf.Verbose, removeEmptyShard(topicDir, dir))
+		}
+	}
+	return nil
 }
 
 func (p *Partitions) ensureTempDir() error {
@@ -108,8 +169,10 @@ func (p *Partitions) ensureTempDir() error {
 			return err
 		}
 
+		p.pathMu.Lock()
 		p.tempDir = tmpDir
 		p.pathCache[p.tempDir] = make(map[uint64]string)
+		p.pathMu.Unlock()
 	}
 	return nil
 }
@@ -126,15 +189,26 @@ func (p *Partitions) Remove(off uint64) error {
 		return err
 	}
 	internal.Debugf(p.conf, "uncirculating %s", fname)
-	if err := os.Rename(partitionFullPath(p.conf, p.topic, off), p.tmpPath(off)); err != nil {
+	fullpath := partitionFullPath(p.conf, p.topic, off)
+	if err := renamePartition(fullpath, p.tmpPath(off)); err != nil {
 		return err
 	}
+	// clean up the partition's shard directory. this fails if it isn't empty
+	// yet.
+	topicDir := path.Join(p.conf.WorkDir, p.topic)
+	internal.IgnoreError(p.conf.Verbose, removeEmptyShard(topicDir, filepath.Dir(fullpath)))
 
-	if p.getRefs(off) <= 0 {
+	p.mu.Lock()
+	p.removed[off] = true
+	remove := p.refs[off] <= 0 && p.takeRemoved(off)
+	p.mu.Unlock()
+	if remove {
 		return p.removeFile(off)
 	}
 
+	p.pathMu.Lock()
 	delete(p.pathCache[p.conf.WorkDir], off)
+	p.pathMu.Unlock()
 	return nil
 }
 
@@ -149,6 +223,8 @@ func (p *Partitions) lookup(workdir string, off uint64) (string, bool) {
 }
 
 func (p *Partitions) filePath(workdir string, off uint64) string {
+	p.pathMu.Lock()
+	defer p.pathMu.Unlock()
 	if s, ok := p.lookup(workdir, off); ok {
 		return s
 	}
@@ -158,6 +234,11 @@ func (p *Partitions) filePath(workdir string, off uint64) string {
 	p.pathb.WriteString("/")
 	p.pathb.WriteString(p.topic)
 	p.pathb.WriteString("/")
+	// only the working directory is sharded. the temp directory is short-lived.
+	if shard := partitionShard(p.conf, off); shard != "" && workdir == p.conf.WorkDir {
+		p.pathb.WriteString(shard)
+		p.pathb.WriteString("/")
+	}
 	p.pathb.WriteString(strconv.FormatUint(off, 10))
 	p.pathb.WriteString(".log")
 
@@ -166,24 +247,27 @@ func (p *Partitions) filePath(workdir string, off uint64) string {
 	return s
 }
 
-// Get implements PartitionManager
+// Get implements PartitionManager. The partition is referenced before it's
+// opened, and its size is taken from the open file, so it can be read to the
+// end even if it's removed while it's open.
 func (p *Partitions) Get(off uint64, delta, limit int) (Partitioner, error) {
-	fname := p.filePath(p.conf.WorkDir, off)
-	info, err := os.Stat(fname)
+	p.incRefs(off)
+	f, err := p.open(off)
 	if err != nil {
+		internal.LogError(p.release(off))
 		return nil, err
 	}
 
-	if size := info.Size(); size > 0 && size <= int64(delta) {
-		return nil, protocol.ErrNotFound
+	info, err := f.Stat()
+	if err == nil && info.Size() > 0 && info.Size() <= int64(delta) {
+		err = protocol.ErrNotFound
 	}
-
-	f, err := os.Open(fname)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		_, err = f.Seek(int64(delta), io.SeekStart)
 	}
-
-	if _, err := f.Seek(int64(delta), io.SeekStart); err != nil {
+	if err != nil {
+		internal.IgnoreError(p.conf.Verbose, f.Close())
+		internal.LogError(p.release(off))
 		return nil, err
 	}
 
@@ -195,22 +279,44 @@ func (p *Partitions) Get(off uint64, delta, limit int) (Partitioner, error) {
 	r := NewPartition(p.conf, off, size).withTmpDir(p.tempDir)
 	if err := r.setFile(f); err != nil {
 		internal.IgnoreError(p.conf.Verbose, f.Close())
+		internal.LogError(p.release(off))
 		return nil, err
 	}
 	r.wrapCloser(func(closer io.Closer) error {
 		if err := closer.Close(); err != nil {
 			log.Printf("error closing %d: %+v", off, err)
 		}
-		if p.decRefs(off) <= 0 {
-			return p.removeFile(off)
-		}
-		return nil
+		stats.PartitionReaders.Add(-1)
+		return p.release(off)
 	})
-	p.incRefs(off)
+	stats.PartitionReaders.Add(1)
 	r.setReader(io.LimitReader(f, int64(limit)))
 	return r, nil
 }
 
+// open opens the partition at off, which is in the temp directory if it's been
+// removed while it was held.
+func (p *Partitions) open(off uint64) (*os.File, error) {
+	f, err := os.Open(p.filePath(p.conf.WorkDir, off))
+	if os.IsNotExist(err) && p.tempDir != "" {
+		if tf, terr := os.Open(p.tmpPath(off)); terr == nil {
+			return tf, nil
+		}
+	}
+	return f, err
+}
+
+// Hold implements PartitionManager
+func (p *Partitions) Hold(off uint64) func() {
+	p.incRefs(off)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			internal.LogError(p.release(off))
+		})
+	}
+}
+
 // List implements PartitionManager
 func (p *Partitions) List() ([]Partitioner, error) {
 	return p.list(path.Join(p.conf.WorkDir, p.topic)+"/", false)
@@ -222,10 +328,7 @@ func (p *Partitions) listTempDir() ([]Partitioner, error) {
 }
 
 func (p *Partitions) list(prefix string, tmp bool) ([]Partitioner, error) {
-	dir, file := path.Split(prefix)
-	pat := path.Join(dir, file+"[0-9]*.log")
-	// fmt.Println("coolpat", pat)
-	matches, err := filepath.Glob(pat)
+	matches, err := globPartitions(prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -275,12 +378,31 @@ func (p *Partitions) incRefs(off uint64) {
 	p.mu.Unlock()
 }
 
-func (p *Partitions) decRefs(off uint64) int {
+// release drops a reference to the partition at off, deleting it if it's been
+// removed and nothing else references it.
+func (p *Partitions) release(off uint64) error {
 	p.mu.Lock()
 	p.refs[off]--
-	refs := p.refs[off]
+	remove := false
+	if p.refs[off] <= 0 {
+		delete(p.refs, off)
+		remove = p.takeRemoved(off)
+	}
 	p.mu.Unlock()
-	return refs
+	if remove {
+		return p.removeFile(off)
+	}
+	return nil
+}
+
+// takeRemoved clears the removed flag for the partition at off, returning true
+// if it was set, so only one caller deletes the partition. p.mu must be held.
+func (p *Partitions) takeRemoved(off uint64) bool {
+	if !p.removed[off] {
+		return false
+	}
+	delete(p.removed, off)
+	return true
 }
 
 func (p *Partitions) getRefs(off uint64) int {
@@ -295,33 +417,21 @@ func (p *Partitions) withCloser(part *Partition) *Partition {
 }
 
 func (p *Partitions) extractOffset(filename string, tmp bool) (uint64, error) {
-	logfname := path.Join(p.conf.WorkDir, p.topic) + "/"
-	if tmp {
-		logfname = p.tempDir + "/"
-	}
-	dir, suf := filepath.Split(logfname)
-	if tmp {
-		_, suf = filepath.Split(p.conf.WorkDir)
-	}
-	s := strings.TrimPrefix(filename, dir)
-	s = strings.TrimPrefix(s, suf)
-	s = strings.TrimPrefix(s, p.topic+"/")
-	s = strings.TrimSuffix(s, ".log")
-	// fmt.Println("extractOffset", filename, dir, suf, "\n", s)
+	// partitions may be in a shard subdirectory, so only the file name is
+	// considered.
+	s := strings.TrimSuffix(filepath.Base(filename), ".log")
 	return strconv.ParseUint(s, 10, 64)
 }
 
 // removeFile deletes the file from the filesystem. Remove must have been called
-// first.
+// first, and the caller must have taken the removed flag.
 func (p *Partitions) removeFile(off uint64) error {
 	if p.tempDir == "" {
 		return errors.New("Partitions.Remove: temp dir not set")
 	}
 
 	// we just remove it. if it's not removed, it's not in the tempdir
-	ppath := partitionPath(p.conf, p.topic, off)
-	fullpath := filepath.Join(p.tempDir, ppath)
-	// fmt.Println("removeFile", ppath, fullpath)
+	fullpath := p.tmpPath(off)
 
 	if _, err := os.Stat(fullpath); err != nil {
 		if os.IsNotExist(err) {
@@ -330,14 +440,17 @@ func (p *Partitions) removeFile(off uint64) error {
 		}
 		return err
 	}
+	remove := removePartition
 	go func() {
 		internal.Debugf(p.conf, "removing %s", fullpath)
-		err := os.Remove(fullpath)
+		err := remove(fullpath)
 		if err != nil {
 			log.Printf("error removing %s: %+v", fullpath, err)
 		}
 	}()
+	p.pathMu.Lock()
 	delete(p.pathCache[p.tempDir], off)
+	p.pathMu.Unlock()
 	return nil
 }
 
@@ -477,7 +590,46 @@ type PartitionFile struct {
 
 func partitionPath(conf *config.Config, topic string, off uint64) string {
 	_, prefix := filepath.Split(conf.WorkDir)
-	return path.Join(prefix, topic, strconv.FormatUint(off, 10)+".log")
+	return path.Join(prefix, topic, partitionShard(conf, off), strconv.FormatUint(off, 10)+".log")
+}
+
+// partitionShard returns the subdirectory of the topic directory the
+// partition at off belongs in. Partitions are grouped by index ranges of
+// conf.PartitionFanout partitions. If no fanout is configured, all partitions
+// are kept in the topic directory and an empty string is returned.
+//
+// The index is always taken from conf.PartitionSize, not the topic's own
+// partition size, so a topic's layout doesn't change when SETPARTSIZE does.
+// Topics with smaller partitions just keep more of them in each shard.
+func partitionShard(conf *config.Config, off uint64) string {
+	if conf.PartitionFanout <= 0 || conf.PartitionSize <= 0 {
+		return ""
+	}
+	idx := off / uint64(conf.PartitionSize)
+	return strconv.FormatUint(idx/uint64(conf.PartitionFanout), 10)
+}
+
+// globPartitions returns all partition files in dir, whether they're in the
+// flat or sharded layout.
+func globPartitions(dir string) ([]string, error) {
+	dir = strings.TrimSuffix(dir, "/")
+	matches, err := filepath.Glob(path.Join(dir, "[0-9]*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	sharded, err := filepath.Glob(path.Join(dir, "[0-9]*", "[0-9]*.log"))
+	if err != nil {
+		return nil, err
+	}
+	return append(matches, sharded...), nil
+}
+
+func removeEmptyShard(topicDir string, dir string) error {
+	if filepath.Clean(topicDir) == filepath.Clean(dir) {
+		return nil
+	}
+	return os.Remove(dir)
 }
 
 func partitionFullPath(conf *config.Config, topic string, off uint64) string {
@@ -7,10 +7,11 @@ import (
 	"github.com/jeffrom/logd/config"
 )
 
-// LogRepairer truncates corrupted data
+// LogRepairer truncates corrupted data and overwrites erased data in place
 type LogRepairer interface {
 	Truncate(part uint64, size int64) error
 	Data(part uint64) (io.ReadCloser, error)
+	Overwrite(part uint64, pos int64, p []byte) error
 }
 
 // Repairer implements LogRepairer using the filesystem
@@ -38,3 +39,21 @@ func (r *Repairer) Data(part uint64) (io.ReadCloser, error) {
 	p := partitionFullPath(r.conf, r.topic, part)
 	return os.Open(p)
 }
+
+// Overwrite implements LogRepairer interface. The partition is synced before
+// returning, so the overwritten data is gone from disk.
+func (r *Repairer) Overwrite(part uint64, pos int64, p []byte) error {
+	f, err := os.OpenFile(partitionFullPath(r.conf, r.topic, part), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(p, pos); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -86,6 +86,13 @@ func (t *Topics) Setup() error {
 		return err
 	}
 
+	if err := loadChecksum(t.conf); err != nil {
+		return err
+	}
+	if err := loadIdentity(t.conf); err != nil {
+		return err
+	}
+
 	f, err := os.Open(t.conf.WorkDir)
 	if err != nil {
 		return err
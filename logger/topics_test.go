@@ -1,8 +1,11 @@
 package logger
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/testhelper"
 )
 
@@ -50,3 +53,32 @@ func TestTopics(t *testing.T) {
 		}
 	}
 }
+
+func TestTopicsChecksum(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.Checksum = config.ChecksumCastagnoli
+	if err := NewTopics(conf).Setup(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := NewTopics(conf).Setup(); err != nil {
+		t.Fatalf("expected the same checksum to be accepted but got %+v", err)
+	}
+
+	conf.Checksum = config.ChecksumIEEE
+	if err := NewTopics(conf).Setup(); err == nil {
+		t.Fatal("expected a log written with castagnoli checksums to be rejected")
+	}
+
+	// logs from before the checksum was stored were written with ieee
+	if err := os.Remove(filepath.Join(conf.WorkDir, checksumFile)); err != nil {
+		t.Fatal(err)
+	}
+	conf.Checksum = config.ChecksumCastagnoli
+	if err := NewTopics(conf).Setup(); err == nil {
+		t.Fatal("expected a log written with ieee checksums to be rejected")
+	}
+	conf.Checksum = config.ChecksumIEEE
+	if err := NewTopics(conf).Setup(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
@@ -1,15 +1,21 @@
 package logger
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path"
-	"strconv"
+	"path/filepath"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
 )
 
+// ErrPartitionBackwards is returned when a writer is set to a partition that
+// starts before the one it's writing to. Batches are only appended at the head
+// of the log, so this is a bug in the caller.
+var ErrPartitionBackwards = errors.New("partition is before the current partition")
+
 // LogWriter is the new log writer interface
 type LogWriter interface {
 	io.WriteCloser
@@ -22,6 +28,7 @@ type Writer struct {
 	conf  *config.Config
 	f     *os.File
 	topic string
+	part  uint64 // start offset of the open partition, if f is set
 }
 
 // NewWriter returns a new instance of Writer
@@ -32,8 +39,22 @@ func NewWriter(conf *config.Config, topic string) *Writer {
 	}
 }
 
+// Write implements io.Writer. If only part of p is written, as can happen when
+// the disk is full, the partition is truncated to where it was so a retry
+// doesn't append after a partial batch.
 func (w *Writer) Write(p []byte) (int, error) {
-	return w.f.Write(p)
+	n, err := w.f.Write(p)
+	if err != nil && n > 0 {
+		end, serr := w.f.Seek(0, io.SeekCurrent)
+		if serr == nil {
+			serr = w.f.Truncate(end - int64(n))
+		}
+		if serr != nil {
+			return n, serr
+		}
+		return 0, err
+	}
+	return n, err
 }
 
 // Flush implements LogWriter interface
@@ -41,24 +62,46 @@ func (w *Writer) Flush() error {
 	return w.f.Sync()
 }
 
-// SetPartition implements LogWriter interface
+// SetPartition implements LogWriter interface. It returns
+// ErrPartitionBackwards if off is before the open partition. Once the writer
+// is closed, as it is during shutdown, any partition can be set, so the log
+// can be reopened after it's been repaired.
 func (w *Writer) SetPartition(off uint64) error {
+	if w.f != nil && off < w.part {
+		return ErrPartitionBackwards
+	}
+	// sync the previous partition so it's durable once the writer moves on
+	if w.f != nil {
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
 	if err := w.Close(); err != nil {
 		return err
 	}
 
-	s := strconv.FormatUint(off, 10)
-	p := path.Join(w.conf.WorkDir, w.topic, s+".log")
+	p := partitionFullPath(w.conf, w.topic, off)
+	if partitionShard(w.conf, off) != "" {
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+	}
 	internal.Debugf(w.conf, "opening partition %s", p)
 	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
 	w.f = f
-	return err
+	w.part = off
+	return nil
 }
 
 // Close implements LogWriter interface
 func (w *Writer) Close() error {
 	if w.f != nil {
-		return w.f.Close()
+		f := w.f
+		w.f = nil
+		return f.Close()
 	}
 	return nil
 }
@@ -37,3 +37,34 @@ func TestWrite(t *testing.T) {
 		t.Fatalf("unexpected error closing: %+v", err)
 	}
 }
+
+func TestSetPartitionBackwards(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	logw := NewWriter(conf, defaultTopic)
+	if err := logw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer logw.Close()
+
+	if err := logw.SetPartition(100); err != nil {
+		t.Fatalf("unexpected error setting partition: %+v", err)
+	}
+	if err := logw.SetPartition(100); err != nil {
+		t.Fatalf("unexpected error setting the same partition: %+v", err)
+	}
+	if err := logw.SetPartition(0); err != ErrPartitionBackwards {
+		t.Fatalf("expected %v but got %+v", ErrPartitionBackwards, err)
+	}
+	if err := logw.SetPartition(200); err != nil {
+		t.Fatalf("unexpected error setting partition: %+v", err)
+	}
+
+	// the log can be reopened anywhere after it's closed, such as after
+	// repairing it.
+	if err := logw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logw.SetPartition(0); err != nil {
+		t.Fatalf("unexpected error reopening partition: %+v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// AuthRequest is an incoming AUTH command
+// AUTH <token>\r\n
+type AuthRequest struct {
+	conf   *config.Config
+	token  []byte
+	ntoken int
+}
+
+// NewAuthRequest returns a new instance of AuthRequest. The token's buffer is
+// allocated when it's set, to the token's size.
+func NewAuthRequest(conf *config.Config) *AuthRequest {
+	return &AuthRequest{conf: conf}
+}
+
+// Reset sets the AuthRequest to its initial values
+func (r *AuthRequest) Reset() {
+	r.ntoken = 0
+}
+
+// SetToken sets the token for the AUTH request
+func (r *AuthRequest) SetToken(token []byte) {
+	if len(r.token) < len(token) {
+		r.token = make([]byte, len(token))
+	}
+	copy(r.token, token)
+	r.ntoken = len(token)
+}
+
+// Token returns the token as a byte slice reference. It is not copied.
+func (r *AuthRequest) Token() []byte {
+	return r.token[:r.ntoken]
+}
+
+// FromRequest parses a request, populating the AuthRequest
+func (r *AuthRequest) FromRequest(req *Request) (*AuthRequest, error) {
+	if req.nargs != argLens[CmdAuth] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetToken(req.args[0])
+	return r, r.Validate()
+}
+
+// Validate checks the AUTH arguments are valid
+func (r *AuthRequest) Validate() error {
+	if r.ntoken < 1 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *AuthRequest) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bauthStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.Token())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
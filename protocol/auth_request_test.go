@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestAuthRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	ar := NewAuthRequest(conf)
+	fixture := []byte("AUTH secret\r\n")
+	buf := &bytes.Buffer{}
+
+	_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ar.FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(ar.Token(), []byte("secret")) {
+		t.Fatalf("expected token %q but got %q", "secret", ar.Token())
+	}
+
+	_, err = ar.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+var invalidAuthRequests = map[string][]byte{
+	"no token":      []byte("AUTH\r\n"),
+	"no newline":    []byte("AUTH secret"),
+	"leading space": []byte(" AUTH secret\r\n"),
+
+	// "extra args":    []byte("AUTH secret sup\r\n"),
+}
+
+func TestAuthRequestInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	ar := NewAuthRequest(conf)
+
+	for name, b := range invalidAuthRequests {
+		t.Run(name, func(t *testing.T) {
+			ar.Reset()
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, rerr := ar.FromRequest(req)
+			if err == nil && rerr == nil {
+				t.Fatalf("%s case: auth request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
@@ -17,21 +17,34 @@ const MaxTopicSize = 255
 
 // Batch represents a collection of Messages
 // BATCH <size> <topic> <checksum> <messages>\r\n<data>
+// Batches written to the log also include the time the server received them:
+// BATCH <size> <topic> <checksum> <messages> <timestamp>\r\n<data>
+// DRYBATCH requests have the same format as BATCH:
+// DRYBATCH <size> <topic> <checksum> <messages>\r\n<data>
 // NOTE no trailing newline after the data
 type Batch struct {
 	conf     *config.Config
 	Size     int
 	Checksum uint32
 	Messages int
-	topic    []byte
-	ntopic   int
-	msgs     []*Message
-	body     []byte
-	digitbuf [32]byte
-	msgBuf   *bytes.Buffer
-	firstOff uint64
-	wasRead  bool
-	nread    int
+	// Timestamp is the time the server received the batch, in nanoseconds
+	// since the unix epoch. It's 0 if the batch hasn't been written to the log,
+	// or was written before timestamps were stored.
+	Timestamp int64
+	topic     []byte
+	ntopic    int
+	msgs      []*Message
+	body      []byte
+	digitbuf  [32]byte
+	msgBuf    *bytes.Buffer
+	firstOff  uint64
+	wasRead   bool
+	fromReq   bool
+	nread     int
+
+	// DryRun is set for DRYBATCH requests, which the server validates but
+	// doesn't write. It's never set for batches read from the log.
+	DryRun bool
 }
 
 // NewBatch returns a new instance of a batch
@@ -50,14 +63,22 @@ func (b *Batch) String() string {
 	return fmt.Sprintf("Batch<%p Messages: %d, Size: %d>", b, b.Messages, b.Size)
 }
 
-// Reset puts a batch in an initial state so it can be reused
+// Reset puts a batch in an initial state so it can be reused. The batch's
+// buffers and messages are kept, so reused batches don't need to allocate.
 func (b *Batch) Reset() {
+	if b.fromReq {
+		// the body belongs to the request, so it can't be written to.
+		b.body = nil
+	}
 	b.Size = 0
 	b.Checksum = 0
 	b.Messages = 0
+	b.Timestamp = 0
+	b.DryRun = false
 	b.ntopic = 0
 	b.firstOff = 0
 	b.wasRead = false
+	b.fromReq = false
 	b.msgBuf.Reset()
 }
 
@@ -75,10 +96,11 @@ func (b *Batch) ensureBuf() {
 	}
 }
 
-// SetTopic sets the topic for a batch.
+// SetTopic sets the topic for a batch. It doesn't affect the batch's
+// messages, so a batch can be moved to another topic without being Reset.
+// Topics longer than MaxTopicSize are truncated.
 func (b *Batch) SetTopic(topic []byte) {
-	copy(b.topic, topic)
-	b.ntopic = len(topic)
+	b.ntopic = copy(b.topic, topic)
 }
 
 // Topic returns the topic for the batch.
@@ -98,7 +120,12 @@ func (b *Batch) FromRequest(req *Request) (*Batch, error) {
 	if req.nargs != argLens[CmdBatch] {
 		return b, errInvalidNumArgs
 	}
+	return b.fromRequest(req)
+}
 
+// fromRequest parses the arguments and body BATCH has in common with other
+// requests that write a batch.
+func (b *Batch) fromRequest(req *Request) (*Batch, error) {
 	// fmt.Printf("%s(%q, %q)\n", &req.Name, req.args[0], req.args[1])
 	n, err := asciiToUint(req.args[0])
 	if err != nil {
@@ -107,6 +134,7 @@ func (b *Batch) FromRequest(req *Request) (*Batch, error) {
 	b.Size = int(n)
 
 	b.SetTopic(req.args[1])
+	b.DryRun = req.Name == CmdDryBatch
 
 	n, err = asciiToUint(req.args[2])
 	if err != nil {
@@ -124,6 +152,7 @@ func (b *Batch) FromRequest(req *Request) (*Batch, error) {
 		return nil, errors.New("request body too small")
 	}
 	b.body = req.body[:req.bodysize]
+	b.fromReq = true
 
 	b.firstOff = uint64(len(req.envelope) + termLen)
 	return b, b.Validate()
@@ -154,6 +183,25 @@ func (b *Batch) Bytes() []byte {
 
 // Append adds a new message's bytes to the batch
 func (b *Batch) Append(p []byte) error {
+	return b.append(nil, p, false)
+}
+
+// AppendTombstone adds a tombstone for key to the batch. See
+// Message.Tombstone.
+func (b *Batch) AppendTombstone(key []byte) error {
+	return b.append(nil, key, true)
+}
+
+// AppendKeyed adds a new message's bytes to the batch with a key. See
+// Message.Key.
+func (b *Batch) AppendKeyed(key []byte, p []byte) error {
+	if key == nil {
+		key = []byte{}
+	}
+	return b.append(key, p, false)
+}
+
+func (b *Batch) append(key []byte, p []byte, tombstone bool) error {
 	if b.Messages > len(b.msgs)-1 {
 		msgs := make([]*Message, len(b.msgs)*2)
 		copy(msgs, b.msgs)
@@ -166,6 +214,8 @@ func (b *Batch) Append(p []byte) error {
 	msg.Reset()
 	msg.Body = p
 	msg.Size = len(p)
+	msg.key = key
+	msg.Tombstone = tombstone
 
 	b.Messages++
 	b.Size += msg.calcSize()
@@ -184,6 +234,40 @@ func (b *Batch) MessageBytes() []byte {
 	return b.body[:b.Size]
 }
 
+// MessageDeltas returns the delta of each message in the batch, which is its
+// position in bytes from the start of the batch's messages. A message is
+// identified by its batch's offset and its delta, as in Message.Delta. The
+// batch's messages must have been built, such as by writing the batch, or
+// read.
+func (b *Batch) MessageDeltas() ([]uint64, error) {
+	p := b.MessageBytes()
+	deltas := make([]uint64, 0, b.Messages)
+	for read := 0; read < len(p); {
+		deltas = append(deltas, uint64(read))
+		line := p[read:]
+		i := bytes.Index(line, bnewLine)
+		if i < 0 || !bytes.HasPrefix(line, bmsgStart) {
+			return nil, errInvalidProtocolLine
+		}
+		word := line[len(bmsgStart):i]
+		if j := bytes.IndexByte(word, ' '); j >= 0 {
+			word = word[:j]
+		}
+		size, err := asciiToUint(word)
+		if err != nil {
+			return nil, err
+		}
+		read += i + termLen + int(size) + termLen
+		if read > len(p) {
+			return nil, errInvalidProtocolLine
+		}
+	}
+	if len(deltas) != b.Messages {
+		return nil, errInvalidProtocolLine
+	}
+	return deltas, nil
+}
+
 // SetChecksum sets the batch's crc32
 func (b *Batch) SetChecksum() {
 	b.Checksum = b.calculateChecksum()
@@ -202,13 +286,17 @@ func (b *Batch) CalcSize() int {
 	l += maxCRCSize            // <crc>
 	l += len(bspace)           // ` `
 	l += asciiSize(b.Messages) // <messages>
-	l += termLen               // `\r\n`
-	l += b.Size                // <data>
+	if b.Timestamp > 0 {
+		l += len(bspace)                 // ` `
+		l += asciiSize(int(b.Timestamp)) // <timestamp>
+	}
+	l += termLen // `\r\n`
+	l += b.Size  // <data>
 	return l
 }
 
 func (b *Batch) calculateChecksum() uint32 {
-	return crc32.Checksum(b.Bytes(), crcTable)
+	return crc32.Checksum(b.Bytes(), checksumTable(b.conf))
 }
 
 func (b *Batch) buildBodyBytes() error {
@@ -238,7 +326,7 @@ func (b *Batch) buildBodyBytes() error {
 
 // WriteTo implements io.WriterTo.
 func (b *Batch) WriteTo(w io.Writer) (int64, error) {
-	if !b.wasRead {
+	if !b.wasRead && !b.fromReq {
 		if err := b.buildBodyBytes(); err != nil {
 			return 0, err
 		}
@@ -246,8 +334,13 @@ func (b *Batch) WriteTo(w io.Writer) (int64, error) {
 		b.SetChecksum()
 	}
 
+	start := bbatchStart
+	if b.DryRun {
+		start = bdryBatchStart
+	}
+
 	var total int64
-	n, err := w.Write(bbatchStart)
+	n, err := w.Write(start)
 	total += int64(n)
 	if err != nil {
 		return total, err
@@ -298,6 +391,21 @@ func (b *Batch) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if b.Timestamp > 0 {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l = uintToASCII(uint64(b.Timestamp), &b.digitbuf)
+		n, err = w.Write(b.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(bnewLine)
 	total += int64(n)
 	if err != nil {
@@ -323,6 +431,12 @@ func (b *Batch) ReadFrom(r io.Reader) (int64, error) {
 	return b.finishRead(n, err)
 }
 
+// ReadEnvelope reads only the batch's envelope, leaving its messages unread,
+// for when a batch's size, message count or timestamp is all that's needed.
+func (b *Batch) ReadEnvelope(r *bufio.Reader) (int64, error) {
+	return b.readEnvelope(r)
+}
+
 // FirstOffset returns the offset delta of the first message
 func (b *Batch) FirstOffset() uint64 {
 	if b.firstOff == 0 {
@@ -352,7 +466,7 @@ func (b *Batch) finishRead(size int64, err error) (int64, error) {
 // readEnvelope reads the batch protocol envelope
 func (b *Batch) readEnvelope(r *bufio.Reader) (int64, error) {
 	var total int64
-	word, err := r.ReadSlice(' ')
+	word, err := readSlice(r, ' ')
 	total += int64(len(word))
 
 	// fmt.Printf("%q %+v\n", word, err)
@@ -370,7 +484,7 @@ func (b *Batch) readEnvelope(r *bufio.Reader) (int64, error) {
 		return total, err
 	}
 
-	word, err = r.ReadSlice(' ')
+	word, err = readSlice(r, ' ')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
@@ -383,7 +497,7 @@ func (b *Batch) readEnvelope(r *bufio.Reader) (int64, error) {
 	}
 	b.Size = int(n)
 
-	word, err = r.ReadSlice(' ')
+	word, err = readSlice(r, ' ')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
@@ -391,7 +505,7 @@ func (b *Batch) readEnvelope(r *bufio.Reader) (int64, error) {
 
 	b.SetTopic(word[:len(word)-1])
 
-	word, err = r.ReadSlice(' ')
+	word, err = readSlice(r, ' ')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
@@ -403,12 +517,25 @@ func (b *Batch) readEnvelope(r *bufio.Reader) (int64, error) {
 	}
 	b.Checksum = uint32(n)
 
-	word, err = r.ReadSlice('\n')
+	word, err = readSlice(r, '\n')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
 	}
-	n, err = asciiToUint(word[:len(word)-termLen])
+	word = word[:len(word)-termLen]
+
+	// the timestamp is optional, as batches sent by clients, and those logged
+	// before timestamps were stored, don't have one.
+	if i := bytes.IndexByte(word, ' '); i >= 0 {
+		n, err = asciiToUint(word[i+1:])
+		if err != nil {
+			return total, err
+		}
+		b.Timestamp = int64(n)
+		word = word[:i]
+	}
+
+	n, err = asciiToUint(word)
 	if err != nil {
 		return total, err
 	}
@@ -448,6 +575,7 @@ func (b *Batch) Copy() *Batch {
 	batch.Size = b.Size
 	batch.Checksum = b.Checksum
 	batch.Messages = b.Messages
+	batch.Timestamp = b.Timestamp
 	batch.SetTopic(b.TopicSlice())
 	batch.body = make([]byte, len(b.body))
 	copy(batch.body, b.body)
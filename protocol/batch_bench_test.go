@@ -32,7 +32,7 @@ func BenchmarkBatchWriteNew(b *testing.B) {
 	conf := protocolBenchConfig()
 
 	batch := NewBatch(conf)
-	batch.topic = []byte("default")
+	batch.SetTopic([]byte("default"))
 	batch.AppendMessage(newTestMessage(conf, string(testhelper.SomeLines[0])))
 	batch.AppendMessage(newTestMessage(conf, string(testhelper.SomeLines[1])))
 	batch.AppendMessage(newTestMessage(conf, string(testhelper.SomeLines[2])))
@@ -66,3 +66,25 @@ func BenchmarkBatchRead(b *testing.B) {
 		br.Reset(buf)
 	}
 }
+
+func BenchmarkBatchReuse(b *testing.B) {
+	conf := protocolBenchConfig()
+	batch := NewBatch(conf)
+	topics := [][]byte{[]byte("default"), []byte("another-topic")}
+	w := ioutil.Discard
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch.SetTopic(topics[i%len(topics)])
+		for _, line := range testhelper.SomeLines[:2] {
+			if err := batch.Append(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := batch.WriteTo(w); err != nil {
+			b.Fatal(err)
+		}
+		batch.Reset()
+	}
+}
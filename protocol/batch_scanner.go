@@ -2,11 +2,16 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
 	"io"
 
 	"github.com/jeffrom/logd/config"
 )
 
+// ErrTruncatedChunk is returned when the reader ends before a batch, or the
+// number of batches a response promised, has been read in full.
+var ErrTruncatedChunk = errors.New("truncated chunk")
+
 // BatchScanner can be used to scan through a reader, iterating over batches
 type BatchScanner struct {
 	conf    *config.Config
@@ -15,6 +20,9 @@ type BatchScanner struct {
 	batch   *Batch
 	err     error
 	scanned int
+	batches int
+	offset  uint64 // log offset of the first batch in the reader
+	curr    uint64 // log offset of the current batch
 }
 
 // NewBatchScanner returns a new instance of *BatchScanner
@@ -35,18 +43,38 @@ func (s *BatchScanner) Reset(r io.Reader) {
 	s.br.Reset(r)
 	s.err = nil
 	s.scanned = 0
+	s.batches = 0
+	s.offset = 0
+	s.curr = 0
+}
+
+// SetOffset sets the log offset of the first batch in the reader, which is
+// used to calculate the offsets of scanned batches. It should be called after
+// Reset and before Scan.
+func (s *BatchScanner) SetOffset(off uint64) {
+	s.offset = off
+	s.curr = off
 }
 
 // Scan iterates through the reader, stopping when a batch is read and
 // populating the batch
 func (s *BatchScanner) Scan() bool {
 	s.batch.Reset()
+	s.curr = s.offset + uint64(s.scanned)
 	n, err := s.batch.ReadFrom(s.br)
 	s.scanned += int(n)
 	// if err != nil {
 	// 	err = errors.Wrap(ErrInvalidOffset, err.Error())
 	// }
+	// EOF partway through a batch means the reader was cut short, which is
+	// different from running out of batches.
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+		err = ErrTruncatedChunk
+	}
 	s.err = err
+	if err == nil {
+		s.batches++
+	}
 	return err == nil
 }
 
@@ -64,3 +92,15 @@ func (s *BatchScanner) Error() error {
 func (s *BatchScanner) Scanned() int {
 	return s.scanned
 }
+
+// Offset returns the log offset of the current batch. Each message in the
+// batch is addressed by this offset and its delta, the message's byte
+// position within the batch.
+func (s *BatchScanner) Offset() uint64 {
+	return s.curr
+}
+
+// Batches returns the number of batches scanned
+func (s *BatchScanner) Batches() int {
+	return s.batches
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -130,6 +132,40 @@ func TestReadBatchTooLarge(t *testing.T) {
 	}
 }
 
+func TestDryBatchRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := append([]byte("DRY"), testhelper.LoadFixture("batch.small")...)
+
+	req := NewRequestConfig(conf)
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if req.Name != CmdDryBatch || req.Topic() != "default" {
+		t.Fatalf("expected DRYBATCH for topic default but got %s for %q", &req.Name, req.Topic())
+	}
+
+	batch, err := NewBatch(conf).FromRequest(req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !batch.DryRun {
+		t.Fatal("expected batch to be a dry run")
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(b.Bytes(), fixture) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, b.Bytes())
+	}
+
+	batch.Reset()
+	if batch.DryRun {
+		t.Fatal("expected reset to clear the dry run flag")
+	}
+}
+
 func TestScanBatches(t *testing.T) {
 	conf := testhelper.DefaultConfig(testing.Verbose())
 	data := testhelper.LoadFixture("batch.small")
@@ -315,6 +351,103 @@ func TestBatchReadTooLarge(t *testing.T) {
 	}
 }
 
+func TestBatchTimestamp(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := NewBatch(conf)
+	fixture := testhelper.LoadFixture("batch.small")
+
+	if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Timestamp != 0 {
+		t.Fatalf("expected no timestamp but got %d", batch.Timestamp)
+	}
+
+	batch.Timestamp = 1500000000000000000
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if n := batch.CalcSize(); n < b.Len() {
+		t.Fatalf("expected calculated size %d to be at least written size %d", n, b.Len())
+	}
+
+	other := NewBatch(conf)
+	if _, err := other.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error reading batch: %v\n%q", err, b.Bytes())
+	}
+	if other.Timestamp != batch.Timestamp {
+		t.Fatalf("expected timestamp %d but got %d", batch.Timestamp, other.Timestamp)
+	}
+	if other.Messages != 3 {
+		t.Fatal("expected 3 messages but got:", other.Messages)
+	}
+}
+
+func TestBatchChecksumCastagnoli(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.Checksum = config.ChecksumCastagnoli
+	batch := NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	batch.Append([]byte("hallo"))
+	batch.Append([]byte("sup"))
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := crc32.Checksum(batch.MessageBytes(), crc32.MakeTable(crc32.Castagnoli))
+	if batch.Checksum != expected {
+		t.Fatalf("expected castagnoli checksum %d but got %d", expected, batch.Checksum)
+	}
+
+	other := NewBatch(conf)
+	if _, err := other.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error reading batch: %v\n%q", err, b.Bytes())
+	}
+	if err := other.Validate(); err != nil {
+		t.Fatalf("expected batch to be valid but got %+v", err)
+	}
+
+	// batch.small was written with an ieee checksum
+	fixture := testhelper.LoadFixture("batch.small")
+	other.Reset()
+	_, err := other.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture)))
+	if err == nil {
+		err = other.Validate()
+	}
+	if err != errCrcMismatch {
+		t.Fatalf("expected %v but got %+v", errCrcMismatch, err)
+	}
+}
+
+func TestBatchScannerTruncated(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := testhelper.LoadFixture("batch.small")
+
+	for _, n := range []int{10, len(fixture) - 1} {
+		s := NewBatchScanner(conf, bytes.NewReader(fixture[:n]))
+		if s.Scan() {
+			t.Fatalf("expected scan of %d/%d bytes to fail", n, len(fixture))
+		}
+		if err := s.Error(); err != ErrTruncatedChunk {
+			t.Fatalf("expected ErrTruncatedChunk reading %d/%d bytes but got %+v", n, len(fixture), err)
+		}
+	}
+
+	s := NewBatchScanner(conf, bytes.NewReader(fixture))
+	if !s.Scan() {
+		t.Fatalf("unexpected error: %+v", s.Error())
+	}
+	if s.Scan() {
+		t.Fatal("expected no more batches")
+	}
+	if err := s.Error(); err != io.EOF {
+		t.Fatalf("expected io.EOF but got %+v", err)
+	}
+}
+
 func testRead(t *testing.T, conf *config.Config, fixtureName string) {
 	testReadBatch(t, conf, fixtureName, NewBatch(conf))
 }
@@ -341,3 +474,69 @@ func testReadBatch(t *testing.T, conf *config.Config, fixtureName string, batch
 	actual := b.Bytes()
 	testhelper.CheckGoldenFile(fixtureName, actual, testhelper.Golden)
 }
+
+func TestBatchReuse(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := NewBatch(conf)
+	topics := [][]byte{[]byte("default"), []byte("another-topic")}
+	lines := [][]byte{[]byte("hi"), []byte("hallo"), []byte("sup")}
+	var i int
+	writeBatch := func() {
+		batch.SetTopic(topics[i%len(topics)])
+		i++
+		for _, line := range lines {
+			if err := batch.Append(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := batch.WriteTo(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		batch.Reset()
+	}
+
+	// the first batch allocates the buffers that later batches reuse
+	writeBatch()
+	if n := testing.AllocsPerRun(100, writeBatch); n > 0 {
+		t.Fatalf("expected no allocations after the first batch but got %v", n)
+	}
+}
+
+func TestBatchMessageDeltas(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	batch.Append([]byte("hi"))
+	batch.AppendKeyed([]byte("mykey"), []byte("hallo"))
+	batch.AppendTombstone([]byte("mykey"))
+	batch.Append([]byte("sup"))
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{0}
+	for _, size := range []int{MessageSize(2), KeyedMessageSize(5, 5), TombstoneSize(5)} {
+		expected = append(expected, expected[len(expected)-1]+uint64(size))
+	}
+
+	deltas, err := batch.MessageDeltas()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("expected deltas %v but got %v", expected, deltas)
+	}
+
+	read := NewBatch(conf)
+	if _, err := read.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	deltas, err = read.MessageDeltas()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("expected deltas of a read batch %v but got %v", expected, deltas)
+	}
+}
@@ -10,15 +10,33 @@ import (
 )
 
 var respBytes = map[error][]byte{
-	ErrNotFound:            []byte("not found"),
-	ErrInvalid:             ErrRespInvalid,
-	errTooLarge:            []byte(errTooLarge.Error()),
-	errInvalidProtocolLine: []byte("invalid protocol"),
-	errCrcMismatch:         []byte("checksum mismatch"),
-	errNoTopic:             []byte("request missing topic"),
+	ErrNotFound:             []byte("not found"),
+	ErrInvalid:              ErrRespInvalid,
+	ErrUnknownCommand:       []byte("unknown command"),
+	errTooLarge:             []byte(errTooLarge.Error()),
+	errInvalidProtocolLine:  []byte("invalid protocol"),
+	errCrcMismatch:          []byte("checksum mismatch"),
+	errNoTopic:              []byte("request missing topic"),
+	ErrUnauthorized:         []byte("unauthorized"),
+	ErrPermissionDenied:     []byte("permission denied"),
+	ErrTooManySubscriptions: []byte("too many subscriptions"),
+	ErrInvalidOffset:        []byte("invalid offset"),
+	ErrTooManyTopics:        []byte("too many topics"),
+	ErrTopicPaused:          []byte("topic paused"),
+	ErrTooBusy:              []byte("too busy"),
+	ErrDiskFull:             []byte("disk full"),
 }
 
 func parseError(p []byte) error {
+	reason, msg := splitError(p)
+	err := parseReason(reason)
+	if len(msg) > 0 {
+		return &RespError{Err: err, Message: string(msg)}
+	}
+	return err
+}
+
+func parseReason(p []byte) error {
 	if len(p) == 0 {
 		return ErrInternal
 	}
@@ -28,6 +46,9 @@ func parseError(p []byte) error {
 	if bytes.Equal(p, respBytes[ErrInvalid]) {
 		return ErrInvalid
 	}
+	if bytes.Equal(p, respBytes[ErrUnknownCommand]) {
+		return ErrUnknownCommand
+	}
 	if bytes.Equal(p, respBytes[errInvalidProtocolLine]) {
 		return errInvalidProtocolLine
 	}
@@ -37,6 +58,30 @@ func parseError(p []byte) error {
 	if bytes.Equal(p, respBytes[errNoTopic]) {
 		return errNoTopic
 	}
+	if bytes.Equal(p, respBytes[ErrUnauthorized]) {
+		return ErrUnauthorized
+	}
+	if bytes.Equal(p, respBytes[ErrPermissionDenied]) {
+		return ErrPermissionDenied
+	}
+	if bytes.Equal(p, respBytes[ErrTooManySubscriptions]) {
+		return ErrTooManySubscriptions
+	}
+	if bytes.Equal(p, respBytes[ErrInvalidOffset]) {
+		return ErrInvalidOffset
+	}
+	if bytes.Equal(p, respBytes[ErrTooManyTopics]) {
+		return ErrTooManyTopics
+	}
+	if bytes.Equal(p, respBytes[ErrTopicPaused]) {
+		return ErrTopicPaused
+	}
+	if bytes.Equal(p, respBytes[ErrTooBusy]) {
+		return ErrTooBusy
+	}
+	if bytes.Equal(p, respBytes[ErrDiskFull]) {
+		return ErrDiskFull
+	}
 	return ErrInternal
 }
 
@@ -44,19 +89,31 @@ func parseError(p []byte) error {
 // There are a few possible responses:
 // OK\r\n
 // OK <offset> <batches>\r\n
+// OK <offset> <batches> <stream>\r\n
+// OK <offset> <batches> <stream> <headroom> <oldest>\r\n
 // BATCH <size> <checksum> <messages>\r\n<data>...
 // MOK <size>\r\n<body>\r\n
+// MOK <size> <encoding>\r\n<body>\r\n
 // ERR <reason>\r\n
+// ERR <reason>: <message>\r\n
 // ERR\r\n
+//
+// The stream is 0 when the response isn't to an SREAD request but headroom
+// follows it. See SetHeadroom.
 type ClientResponse struct {
 	conf     *config.Config
 	ok       bool
 	offset   uint64
 	nbatches int
+	stream   uint64
+	headroom uint64
+	oldest   int64
+	hasRoom  bool
 	err      error
 	mokBuf   []byte
 	mokSize  int
 	nmok     int
+	encoding []byte
 	digitbuf [32]byte
 }
 
@@ -121,10 +178,15 @@ func (cr *ClientResponse) String() string {
 func (cr *ClientResponse) Reset() {
 	cr.offset = 0
 	cr.nbatches = 0
+	cr.stream = 0
+	cr.headroom = 0
+	cr.oldest = 0
+	cr.hasRoom = false
 	cr.err = nil
 	cr.mokBuf = nil
 	cr.ok = false
 	cr.nmok = 0
+	cr.encoding = cr.encoding[:0]
 }
 
 // SetOffset sets the offset number for a batch response
@@ -148,11 +210,41 @@ func (cr *ClientResponse) Batches() int {
 	return cr.nbatches
 }
 
+// SetStream sets the stream id an OK response to an SREAD request is tagged
+// with.
+func (cr *ClientResponse) SetStream(id uint64) {
+	cr.stream = id
+}
+
+// Stream returns the stream id the response is tagged with, or 0 if it isn't
+// a response to an SREAD request.
+func (cr *ClientResponse) Stream() uint64 {
+	return cr.stream
+}
+
+// SetHeadroom sets the retention headroom an OK response reports: how far the
+// response's offset is past the oldest offset retention has kept, and when
+// the oldest batch was written, in nanoseconds since the unix epoch, or 0 if
+// it isn't known.
+func (cr *ClientResponse) SetHeadroom(headroom uint64, oldest int64) {
+	cr.headroom = headroom
+	cr.oldest = oldest
+	cr.hasRoom = true
+}
+
+// Headroom returns the retention headroom the response reported. ok is false
+// if it didn't report any.
+func (cr *ClientResponse) Headroom() (headroom uint64, oldest int64, ok bool) {
+	return cr.headroom, cr.oldest, cr.hasRoom
+}
+
 // SetError sets the error on the response
 func (cr *ClientResponse) SetError(err error) {
 	cr.err = err
 }
 
+// Error returns the reason for an ERR response. If the response included a
+// message, the reason is wrapped in a *RespError.
 func (cr *ClientResponse) Error() error {
 	return cr.err
 }
@@ -162,6 +254,18 @@ func (cr *ClientResponse) SetMultiResp(p []byte) {
 	cr.mokBuf = p
 }
 
+// SetEncoding sets the encoding of the MOK response body, such as
+// CompressGzip. If it's empty, the body isn't encoded.
+func (cr *ClientResponse) SetEncoding(encoding []byte) {
+	cr.encoding = append(cr.encoding[:0], encoding...)
+}
+
+// Encoding returns the encoding of the MOK response body, or an empty string
+// if it isn't encoded.
+func (cr *ClientResponse) Encoding() string {
+	return string(cr.encoding)
+}
+
 func (cr *ClientResponse) SetOK() {
 	cr.ok = true
 }
@@ -205,6 +309,20 @@ func (cr *ClientResponse) writeMOK(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if len(cr.encoding) > 0 {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = w.Write(cr.encoding)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(bnewLine)
 	total += int64(n)
 	if err != nil {
@@ -233,7 +351,14 @@ func (cr *ClientResponse) writeERR(w io.Writer) (int64, error) {
 		return total, err
 	}
 
-	if p, ok := respBytes[cr.err]; ok {
+	reason, msg := cr.err, ""
+	if e, ok := cr.err.(*RespError); ok {
+		reason, msg = e.Err, e.Message
+	}
+
+	// messages are only sent along with a known reason, so internal errors
+	// aren't leaked to clients.
+	if p, ok := respBytes[reason]; ok {
 		n, err = w.Write(bspace)
 		total += int64(n)
 		if err != nil {
@@ -245,6 +370,20 @@ func (cr *ClientResponse) writeERR(w io.Writer) (int64, error) {
 		if err != nil {
 			return total, err
 		}
+
+		if msg != "" {
+			n, err = w.Write(berrSep)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+
+			n, err = w.Write(cleanErrMessage(msg))
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
 	}
 
 	n, err = w.Write(bnewLine)
@@ -297,6 +436,38 @@ func (cr *ClientResponse) writeBatchOK(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if cr.stream > 0 || cr.hasRoom {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l = uintToASCII(cr.stream, &cr.digitbuf)
+		n, err = w.Write(cr.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if cr.hasRoom {
+		for _, v := range [...]uint64{cr.headroom, uint64(cr.oldest)} {
+			n, err = w.Write(bspace)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+
+			l = uintToASCII(v, &cr.digitbuf)
+			n, err = w.Write(cr.digitbuf[l:])
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
 	n, err = w.Write(bnewLine)
 	total += int64(n)
 	if err != nil {
@@ -335,7 +506,7 @@ func (cr *ClientResponse) ReadFrom(r io.Reader) (int64, error) {
 func (cr *ClientResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 	var total int64
 
-	line, err := r.ReadSlice('\n')
+	line, err := readSlice(r, '\n')
 	total += int64(len(line))
 	if err != nil {
 		return total, err
@@ -387,7 +558,7 @@ func (cr *ClientResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 		}
 		cr.offset = n
 
-		_, word, err = parseWord(line)
+		line, word, err = parseWord(line)
 		if err != nil {
 			return total, err
 		}
@@ -398,13 +569,55 @@ func (cr *ClientResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 			return total, err
 		}
 		cr.nbatches = int(n)
+
+		// responses to SREAD requests are tagged with the stream id
+		if len(line) > 0 {
+			line, word, err = parseWord(line)
+			if err != nil {
+				return total, err
+			}
+
+			n, err = asciiToUint(word)
+			if err != nil {
+				return total, err
+			}
+			cr.stream = n
+		}
+
+		// followed by the retention headroom, if the server reports it
+		if len(line) > 0 {
+			err = cr.readHeadroom(line)
+		}
 	}
 
 	return total, err
 }
 
+// readHeadroom parses `<headroom> <oldest>` from the end of an OK response.
+func (cr *ClientResponse) readHeadroom(line []byte) error {
+	line, word, err := parseWord(line)
+	if err != nil {
+		return err
+	}
+	headroom, err := asciiToUint(word)
+	if err != nil {
+		return err
+	}
+
+	_, word, err = parseWord(line)
+	if err != nil {
+		return err
+	}
+	oldest, err := asciiToUint(word)
+	if err != nil {
+		return err
+	}
+	cr.SetHeadroom(headroom, int64(oldest))
+	return nil
+}
+
 func (cr *ClientResponse) readMOK(line []byte, r *bufio.Reader) (int64, error) {
-	_, word, err := parseWord(line)
+	line, word, err := parseWord(line)
 	if err != nil {
 		return 0, err
 	}
@@ -415,6 +628,16 @@ func (cr *ClientResponse) readMOK(line []byte, r *bufio.Reader) (int64, error) {
 	}
 	cr.mokSize = int(n)
 
+	// line is in the reader's buffer, so the encoding is copied before the
+	// body is read.
+	if len(line) > 0 {
+		_, word, err = parseWord(line)
+		if err != nil {
+			return 0, err
+		}
+		cr.encoding = append(cr.encoding[:0], word...)
+	}
+
 	if len(cr.mokBuf) < int(n) {
 		cr.mokBuf = make([]byte, n)
 	}
@@ -425,5 +648,12 @@ func (cr *ClientResponse) readMOK(line []byte, r *bufio.Reader) (int64, error) {
 		return int64(read), err
 	}
 
-	return int64(read), nil
+	// consume the trailing newline so it isn't read as part of the next
+	// response.
+	nl, err := readNewLine(r)
+	if err != nil {
+		return int64(read + nl), err
+	}
+
+	return int64(read + nl), nil
 }
@@ -2,13 +2,10 @@ package protocol
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 )
 
-const maxArgs = 4
-
-var errUnknownCmdType = errors.New("unknown command type")
+const maxArgs = 6
 
 // CmdType is the type for logd commands.
 type CmdType uint8
@@ -35,6 +32,72 @@ const (
 	// CmdConfig is a CONFIG command type
 	CmdConfig
 
+	// CmdAuth authenticates the connection.
+	CmdAuth
+
+	// CmdConns lists the server's connections. It requires admin access.
+	CmdConns
+
+	// CmdKillConn closes a connection by id. It requires admin access.
+	CmdKillConn
+
+	// CmdHead returns the offset of a topic's head.
+	CmdHead
+
+	// CmdSRead is a READ for one of several logical streams multiplexed over
+	// a connection. The response is tagged with the stream id.
+	CmdSRead
+
+	// CmdFormat returns a topic's format.
+	CmdFormat
+
+	// CmdSetFormat sets a topic's format.
+	CmdSetFormat
+
+	// CmdPause stops a topic from accepting batches.
+	CmdPause
+
+	// CmdResume allows a paused topic to accept batches again.
+	CmdResume
+
+	// CmdTailOffset returns the offset of a topic's oldest available batch.
+	CmdTailOffset
+
+	// CmdSync waits until a topic's log is synced to disk through an offset.
+	CmdSync
+
+	// CmdCompress enables compression of READ responses on the connection.
+	CmdCompress
+
+	// CmdHeads returns the head offsets of all topics.
+	CmdHeads
+
+	// CmdDryBatch validates a batch as BATCH would, without writing it.
+	CmdDryBatch
+
+	// CmdReadRange reads the batches between two offsets.
+	CmdReadRange
+
+	// CmdTopicInfo returns a topic's settings.
+	CmdTopicInfo
+
+	// CmdSetPartSize sets the size of a topic's new partitions.
+	CmdSetPartSize
+
+	// CmdRestore writes a batch at the offset it was read from. It requires
+	// admin access.
+	CmdRestore
+
+	// CmdErase overwrites a range of batches so their messages can't be read.
+	// It requires admin access.
+	CmdErase
+
+	// CmdInfo returns the server's version and uptime.
+	CmdInfo
+
+	// CmdOffsetTime returns the time the batch at an offset was logged.
+	CmdOffsetTime
+
 	// CmdShutdown is a shutdown command type.
 	// CmdShutdown
 )
@@ -53,6 +116,48 @@ func (cmd *CmdType) String() string {
 		return "CLOSE"
 	case CmdConfig:
 		return "CONFIG"
+	case CmdAuth:
+		return "AUTH"
+	case CmdConns:
+		return "CONNS"
+	case CmdKillConn:
+		return "KILLCONN"
+	case CmdHead:
+		return "HEAD"
+	case CmdSRead:
+		return "SREAD"
+	case CmdFormat:
+		return "FORMAT"
+	case CmdSetFormat:
+		return "SETFORMAT"
+	case CmdPause:
+		return "PAUSE"
+	case CmdResume:
+		return "RESUME"
+	case CmdTailOffset:
+		return "TAILOFFSET"
+	case CmdSync:
+		return "SYNC"
+	case CmdCompress:
+		return "COMPRESS"
+	case CmdHeads:
+		return "HEADS"
+	case CmdDryBatch:
+		return "DRYBATCH"
+	case CmdReadRange:
+		return "READRANGE"
+	case CmdTopicInfo:
+		return "TOPICINFO"
+	case CmdSetPartSize:
+		return "SETPARTSIZE"
+	case CmdRestore:
+		return "RESTORE"
+	case CmdErase:
+		return "ERASE"
+	case CmdInfo:
+		return "INFO"
+	case CmdOffsetTime:
+		return "OFFSETTIME"
 		// case CmdShutdown:
 		// 	return "SHUTDOWN"
 	}
@@ -74,6 +179,48 @@ func (cmd *CmdType) Bytes() []byte {
 		return []byte("CLOSE")
 	case CmdConfig:
 		return []byte("CONFIG")
+	case CmdAuth:
+		return []byte("AUTH")
+	case CmdConns:
+		return []byte("CONNS")
+	case CmdKillConn:
+		return []byte("KILLCONN")
+	case CmdHead:
+		return []byte("HEAD")
+	case CmdSRead:
+		return []byte("SREAD")
+	case CmdFormat:
+		return []byte("FORMAT")
+	case CmdSetFormat:
+		return []byte("SETFORMAT")
+	case CmdPause:
+		return []byte("PAUSE")
+	case CmdResume:
+		return []byte("RESUME")
+	case CmdTailOffset:
+		return []byte("TAILOFFSET")
+	case CmdSync:
+		return []byte("SYNC")
+	case CmdCompress:
+		return []byte("COMPRESS")
+	case CmdHeads:
+		return []byte("HEADS")
+	case CmdDryBatch:
+		return []byte("DRYBATCH")
+	case CmdReadRange:
+		return []byte("READRANGE")
+	case CmdTopicInfo:
+		return []byte("TOPICINFO")
+	case CmdSetPartSize:
+		return []byte("SETPARTSIZE")
+	case CmdRestore:
+		return []byte("RESTORE")
+	case CmdErase:
+		return []byte("ERASE")
+	case CmdInfo:
+		return []byte("INFO")
+	case CmdOffsetTime:
+		return []byte("OFFSETTIME")
 		// case CmdShutdown:
 		// 	return []byte("SHUTDOWN")
 	}
@@ -99,6 +246,69 @@ func cmdNamefromBytes(b []byte) CmdType {
 	if bytes.Equal(b, []byte("CONFIG")) {
 		return CmdConfig
 	}
+	if bytes.Equal(b, []byte("AUTH")) {
+		return CmdAuth
+	}
+	if bytes.Equal(b, []byte("CONNS")) {
+		return CmdConns
+	}
+	if bytes.Equal(b, []byte("KILLCONN")) {
+		return CmdKillConn
+	}
+	if bytes.Equal(b, []byte("HEAD")) {
+		return CmdHead
+	}
+	if bytes.Equal(b, []byte("SREAD")) {
+		return CmdSRead
+	}
+	if bytes.Equal(b, []byte("FORMAT")) {
+		return CmdFormat
+	}
+	if bytes.Equal(b, []byte("SETFORMAT")) {
+		return CmdSetFormat
+	}
+	if bytes.Equal(b, []byte("PAUSE")) {
+		return CmdPause
+	}
+	if bytes.Equal(b, []byte("RESUME")) {
+		return CmdResume
+	}
+	if bytes.Equal(b, []byte("TAILOFFSET")) {
+		return CmdTailOffset
+	}
+	if bytes.Equal(b, []byte("SYNC")) {
+		return CmdSync
+	}
+	if bytes.Equal(b, []byte("COMPRESS")) {
+		return CmdCompress
+	}
+	if bytes.Equal(b, []byte("HEADS")) {
+		return CmdHeads
+	}
+	if bytes.Equal(b, []byte("DRYBATCH")) {
+		return CmdDryBatch
+	}
+	if bytes.Equal(b, []byte("READRANGE")) {
+		return CmdReadRange
+	}
+	if bytes.Equal(b, []byte("TOPICINFO")) {
+		return CmdTopicInfo
+	}
+	if bytes.Equal(b, []byte("SETPARTSIZE")) {
+		return CmdSetPartSize
+	}
+	if bytes.Equal(b, []byte("RESTORE")) {
+		return CmdRestore
+	}
+	if bytes.Equal(b, []byte("ERASE")) {
+		return CmdErase
+	}
+	if bytes.Equal(b, []byte("INFO")) {
+		return CmdInfo
+	}
+	if bytes.Equal(b, []byte("OFFSETTIME")) {
+		return CmdOffsetTime
+	}
 	// if bytes.Equal(b, []byte("SHUTDOWN")) {
 	// 	return CmdShutdown
 	// }
@@ -106,11 +316,38 @@ func cmdNamefromBytes(b []byte) CmdType {
 }
 
 var argLens = map[CmdType]int{
-	CmdBatch:  4,
-	CmdRead:   3,
-	CmdTail:   2,
-	CmdStats:  0,
-	CmdClose:  0,
-	CmdConfig: 0,
+	CmdBatch:       4,
+	CmdRead:        3,
+	CmdTail:        2,
+	CmdStats:       0,
+	CmdClose:       0,
+	CmdConfig:      0,
+	CmdAuth:        1,
+	CmdConns:       0,
+	CmdKillConn:    1,
+	CmdHead:        1,
+	CmdSRead:       4,
+	CmdFormat:      1,
+	CmdSetFormat:   2,
+	CmdPause:       1,
+	CmdResume:      1,
+	CmdTailOffset:  1,
+	CmdSync:        2,
+	CmdCompress:    1,
+	CmdHeads:       0,
+	CmdDryBatch:    4,
+	CmdReadRange:   4,
+	CmdTopicInfo:   1,
+	CmdSetPartSize: 2,
+	CmdRestore:     6,
+	CmdErase:       3,
+	CmdInfo:        0,
+	CmdOffsetTime:  2,
 	// CmdShutdown: 0,
 }
+
+// optionalArgLens is the number of optional arguments commands can take after
+// the ones in argLens.
+var optionalArgLens = map[CmdType]int{
+	CmdStats: 1,
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestCommand(t *testing.T) {
-	cmds := []string{"BATCH", "READ", "TAIL", "STATS", "CLOSE"}
+	cmds := []string{"BATCH", "READ", "TAIL", "STATS", "CLOSE", "HEAD", "SREAD", "FORMAT", "SETFORMAT", "PAUSE", "RESUME", "TAILOFFSET", "SYNC", "COMPRESS", "HEADS", "DRYBATCH", "READRANGE", "TOPICINFO", "SETPARTSIZE", "RESTORE", "ERASE", "INFO", "OFFSETTIME"}
 
 	for _, s := range cmds {
 		b := []byte(s)
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// CompressGzip is the only supported compression codec.
+const CompressGzip = "gzip"
+
+var bcompressGzip = []byte(CompressGzip)
+
+// CompressRequest represents a COMPRESS request, which enables compression of
+// READ and READRANGE responses for the rest of the connection. Once it's
+// enabled, the batches in a response that has any are sent as a single gzip
+// stream following the response envelope. Error responses aren't compressed.
+// COMPRESS <codec>\r\n
+type CompressRequest struct {
+	conf   *config.Config
+	codec  []byte
+	ncodec int
+}
+
+// NewCompressRequest returns a new instance of a COMPRESS request
+func NewCompressRequest(conf *config.Config) *CompressRequest {
+	return &CompressRequest{
+		conf:  conf,
+		codec: make([]byte, len(bcompressGzip)),
+	}
+}
+
+// Reset puts COMPRESS in an initial state so it can be reused
+func (r *CompressRequest) Reset() {
+	r.ncodec = 0
+}
+
+// SetCodec sets the codec of the COMPRESS request. Codecs longer than any
+// supported codec are truncated, and will fail validation.
+func (r *CompressRequest) SetCodec(codec []byte) {
+	r.ncodec = copy(r.codec, codec)
+	if len(codec) > len(r.codec) {
+		r.ncodec = 0
+	}
+}
+
+// Codec returns the codec as a string
+func (r *CompressRequest) Codec() string {
+	return string(r.codec[:r.ncodec])
+}
+
+// FromRequest parses a request, populating the CompressRequest struct. If
+// validation fails, an error is returned.
+func (r *CompressRequest) FromRequest(req *Request) (*CompressRequest, error) {
+	if req.nargs != argLens[CmdCompress] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetCodec(req.args[0])
+	return r, r.Validate()
+}
+
+// Validate checks the COMPRESS arguments are valid
+func (r *CompressRequest) Validate() error {
+	if !bytes.Equal(r.codec[:r.ncodec], bcompressGzip) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *CompressRequest) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bcompressStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.codec[:r.ncodec])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestCompressRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	compreq := NewCompressRequest(conf)
+	fixture := []byte("COMPRESS gzip\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compreq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if compreq.Codec() != CompressGzip {
+		t.Fatalf("expected codec %q but got %q", CompressGzip, compreq.Codec())
+	}
+
+	if _, err := compreq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+
+	for _, codec := range []string{"snappy", "gzipp", "gzi"} {
+		req.Reset()
+		if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBufferString("COMPRESS " + codec + "\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+		compreq.Reset()
+		if _, err := compreq.FromRequest(req); err != ErrInvalid {
+			t.Fatalf("expected %v for codec %q but got %v", ErrInvalid, codec, err)
+		}
+	}
+}
@@ -93,3 +93,25 @@ func TestConfigRequestWriteErrors(t *testing.T) {
 		t.Fatal(w.String(), "\ndidn't contain a single valid close request")
 	}
 }
+
+func TestConfigResponseIdentity(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.NodeID = "node1"
+	conf.LogID = "log1"
+	b := NewConfigResponse(conf).MultiResponse()
+
+	confResp := NewConfigResponse(conf)
+	if err := confResp.Parse(b); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	rconf := confResp.Config()
+	if rconf.NodeID != conf.NodeID {
+		t.Errorf("expected node id %q but got %q", conf.NodeID, rconf.NodeID)
+	}
+	if rconf.LogID != conf.LogID {
+		t.Errorf("expected log id %q but got %q", conf.LogID, rconf.LogID)
+	}
+	if rconf.MaxBatchSize != conf.MaxBatchSize {
+		t.Errorf("expected %d but got %d", conf.MaxBatchSize, rconf.MaxBatchSize)
+	}
+}
@@ -14,6 +14,18 @@ var bhostport = []byte("Hostport: ")
 var btimeout = []byte("Timeout: ")
 var bidletimeout = []byte("IdleTimeout: ")
 var bmaxbatchsize = []byte("MaxBatchSize: ")
+var bnodeid = []byte("NodeID: ")
+var blogid = []byte("LogID: ")
+var bversion = []byte("ProtocolVersion: ")
+var bchecksum = []byte("Checksum: ")
+var bpartitionsize = []byte("PartitionSize: ")
+var bmaxreadbytes = []byte("MaxReadBytes: ")
+var bmaxreadbatches = []byte("MaxReadBatches: ")
+
+// Version is the version of the wire protocol. It's sent in CONFIG responses
+// so clients can check they're compatible with the server. It changes when a
+// request or response changes in a way older clients or servers can't handle.
+const Version = 1
 
 // ConfigResponse is a representation of the server-side config which is
 // intended as a client multi ok response.
@@ -23,6 +35,7 @@ type ConfigResponse struct {
 	b        *bytes.Buffer
 	cached   bool
 	readConf *config.Config
+	version  int
 }
 
 func NewConfigResponse(conf *config.Config) *ConfigResponse {
@@ -43,6 +56,13 @@ func (cr *ConfigResponse) Reset() {
 	cr.readConf.Timeout = 0
 	cr.readConf.IdleTimeout = 0
 	cr.readConf.MaxBatchSize = 0
+	cr.readConf.NodeID = ""
+	cr.readConf.LogID = ""
+	cr.readConf.Checksum = ""
+	cr.readConf.PartitionSize = 0
+	cr.readConf.MaxReadBytes = 0
+	cr.readConf.MaxReadBatches = 0
+	cr.version = 0
 }
 
 // MultiResponse returns a server-side MOK response body
@@ -138,6 +158,132 @@ func (cr *ConfigResponse) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	n, err = w.Write(bnodeid)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(cr.conf.NodeID))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(blogid)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(cr.conf.LogID))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bversion)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(strconv.Itoa(Version)))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bchecksum)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(cr.conf.Checksum))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bpartitionsize)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(strconv.Itoa(cr.conf.PartitionSize)))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bmaxreadbytes)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(strconv.Itoa(cr.conf.MaxReadBytes)))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bmaxreadbatches)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write([]byte(strconv.Itoa(cr.conf.MaxReadBatches)))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
 	return total, nil
 }
 
@@ -159,11 +305,14 @@ func (cr *ConfigResponse) ReadFrom(r io.Reader) (int64, error) {
 func (cr *ConfigResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 	var total int64
 
-	// TODO 4 shouldn't be a magic number. should be the total number of config
-	// fields.
-	for i := 0; i < 4; i++ {
-		kb, err := r.ReadSlice(' ')
+	// read until the end of the response, so servers that don't send every
+	// field can still be parsed.
+	for {
+		kb, err := readSlice(r, ' ')
 		total += int64(len(kb))
+		if err == io.EOF && len(kb) == 0 && total > 0 {
+			break
+		}
 		if err != nil {
 			return total, err
 		}
@@ -195,8 +344,41 @@ func (cr *ConfigResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 				return total, err
 			}
 			cr.readConf.MaxBatchSize = batchSize
+		case "NodeID: ":
+			cr.readConf.NodeID = string(vb)
+		case "LogID: ":
+			cr.readConf.LogID = string(vb)
+		case "ProtocolVersion: ":
+			version, err := strconv.Atoi(string(vb))
+			if err != nil {
+				return total, err
+			}
+			cr.version = version
+		case "Checksum: ":
+			cr.readConf.Checksum = string(vb)
+		case "PartitionSize: ":
+			partitionSize, err := strconv.Atoi(string(vb))
+			if err != nil {
+				return total, err
+			}
+			cr.readConf.PartitionSize = partitionSize
+		case "MaxReadBytes: ":
+			maxReadBytes, err := strconv.Atoi(string(vb))
+			if err != nil {
+				return total, err
+			}
+			cr.readConf.MaxReadBytes = maxReadBytes
+		case "MaxReadBatches: ":
+			maxReadBatches, err := strconv.Atoi(string(vb))
+			if err != nil {
+				return total, err
+			}
+			cr.readConf.MaxReadBatches = maxReadBatches
 		default:
-			return total, errInvalidProtocolLine
+			// skip fields added by newer servers
+			if !bytes.HasSuffix(kb, []byte(": ")) {
+				return total, errInvalidProtocolLine
+			}
 		}
 	}
 
@@ -207,3 +389,9 @@ func (cr *ConfigResponse) readFromBuf(r *bufio.Reader) (int64, error) {
 func (cr *ConfigResponse) Config() *config.Config {
 	return cr.readConf
 }
+
+// ProtocolVersion returns the protocol version from the most recently read
+// config. It's 0 if the server didn't send one.
+func (cr *ConfigResponse) ProtocolVersion() int {
+	return cr.version
+}
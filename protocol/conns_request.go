@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// ConnsRequest is an incoming CONNS command
+// CONNS\r\n
+type ConnsRequest struct {
+	conf *config.Config
+}
+
+// NewConnsRequest returns a new instance of ConnsRequest
+func NewConnsRequest(conf *config.Config) *ConnsRequest {
+	return &ConnsRequest{
+		conf: conf,
+	}
+}
+
+// Reset sets the ConnsRequest to its initial values
+func (r *ConnsRequest) Reset() {
+
+}
+
+// FromRequest parses a request, populating the ConnsRequest
+func (r *ConnsRequest) FromRequest(req *Request) (*ConnsRequest, error) {
+	if req.nargs > 0 {
+		return r, errInvalidNumArgs
+	}
+	return r, nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *ConnsRequest) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(bconns)
+	return int64(n), err
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestConnsRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	fixture := []byte("CONNS\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Name != CmdConns {
+		t.Fatalf("expected CONNS command but got %s", req.Name.String())
+	}
+
+	cr, err := NewConnsRequest(conf).FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestKillConnRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	kr := NewKillConnRequest(conf)
+	fixture := []byte("KILLCONN abc-123\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kr.ID(), []byte("abc-123")) {
+		t.Fatalf("expected id %q but got %q", "abc-123", kr.ID())
+	}
+
+	if _, err := kr.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+
+	req = NewRequestConfig(conf)
+	_, err := req.ReadFrom(bufio.NewReader(bytes.NewBufferString("KILLCONN\r\n")))
+	if _, rerr := kr.FromRequest(req); err == nil && rerr == nil {
+		t.Fatal("expected KILLCONN without an id to be invalid")
+	}
+}
+
+func TestConnsResponse(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	cr := NewConnsResponse(conf)
+	cr.Add(&ConnInfo{ID: "a", Addr: "127.0.0.1:1234", State: "ACTIVE", Principal: "admin"})
+	cr.Add(&ConnInfo{ID: "b", Addr: "127.0.0.1:5678", State: "INACTIVE"})
+
+	expected := []byte("a 127.0.0.1:1234 ACTIVE admin\r\nb 127.0.0.1:5678 INACTIVE\r\n")
+	b := cr.MultiResponse()
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", expected, b)
+	}
+
+	other := NewConnsResponse(conf)
+	if err := other.Parse(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.Conns()) != 2 {
+		t.Fatalf("expected 2 connections but got %d", len(other.Conns()))
+	}
+	for i, info := range other.Conns() {
+		if *info != *cr.Conns()[i] {
+			t.Fatalf("expected %+v but got %+v", cr.Conns()[i], info)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// ConnInfo describes a server connection.
+type ConnInfo struct {
+	ID        string
+	Addr      string
+	State     string
+	Principal string // empty if the connection hasn't authenticated
+}
+
+// ConnsResponse is a list of server connections which is intended as a client
+// multi ok response. Each connection is written on its own line:
+// <id> <addr> <state> [<principal>]\r\n
+type ConnsResponse struct {
+	conf  *config.Config
+	conns []*ConnInfo
+	b     *bytes.Buffer
+}
+
+// NewConnsResponse returns a new instance of ConnsResponse
+func NewConnsResponse(conf *config.Config) *ConnsResponse {
+	return &ConnsResponse{
+		conf: conf,
+		b:    &bytes.Buffer{},
+	}
+}
+
+// Reset sets the ConnsResponse to its initial values
+func (cr *ConnsResponse) Reset() {
+	cr.conns = nil
+	cr.b.Reset()
+}
+
+// Add adds a connection to the response
+func (cr *ConnsResponse) Add(info *ConnInfo) {
+	cr.conns = append(cr.conns, info)
+}
+
+// Conns returns the connections in the response
+func (cr *ConnsResponse) Conns() []*ConnInfo {
+	return cr.conns
+}
+
+// MultiResponse returns a server-side MOK response body
+func (cr *ConnsResponse) MultiResponse() []byte {
+	cr.b.Reset()
+	if _, err := cr.WriteTo(cr.b); err != nil {
+		cr.b.Reset()
+		return nil
+	}
+	return cr.b.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface.
+func (cr *ConnsResponse) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, info := range cr.conns {
+		fields := []string{info.ID, info.Addr, info.State}
+		if info.Principal != "" {
+			fields = append(fields, info.Principal)
+		}
+
+		for i, field := range fields {
+			if i > 0 {
+				n, err := w.Write(bspace)
+				total += int64(n)
+				if err != nil {
+					return total, err
+				}
+			}
+
+			n, err := io.WriteString(w, field)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+
+		n, err := w.Write(bnewLine)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Parse reads the connections from a byte slice
+func (cr *ConnsResponse) Parse(b []byte) error {
+	cr.Reset()
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		_, line, _, err := readLineFromBuf(r)
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := bytes.SplitN(line, bspace, 4)
+		if len(fields) < 3 {
+			return errInvalidProtocolLine
+		}
+		info := &ConnInfo{
+			ID:    string(fields[0]),
+			Addr:  string(fields[1]),
+			State: string(fields[2]),
+		}
+		if len(fields) == 4 {
+			info.Principal = string(fields[3])
+		}
+		cr.Add(info)
+	}
+}
@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// errEraseTooSmall is returned when an erased batch can't be made to fit the
+// space of the batch it replaces.
+var errEraseTooSmall = errors.New("batch too small to erase")
+
+// maxChecksumWidth is the most digits in a crc32 checksum
+const maxChecksumWidth = 10
+
+// maxSizePadding is the most leading zeros an erased message's size is padded
+// with to fill the space of the batch it replaces.
+const maxSizePadding = 8
+
+// Erase represents an ERASE request, which overwrites the batches starting
+// from Start up to End, so their messages can no longer be read. The offsets
+// of the batches don't change. See ErasedBatch.
+// ERASE <topic> <start> <end>\r\n
+type Erase struct {
+	conf     *config.Config
+	Start    uint64
+	End      uint64
+	topic    []byte
+	ntopic   int
+	digitbuf [32]byte
+}
+
+// NewErase returns a new instance of an ERASE request
+func NewErase(conf *config.Config) *Erase {
+	return &Erase{
+		conf:  conf,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts ERASE in an initial state so it can be reused
+func (r *Erase) Reset() {
+	r.Start = 0
+	r.End = 0
+	r.ntopic = 0
+}
+
+// SetTopic sets the topic of the ERASE request
+func (r *Erase) SetTopic(topic []byte) {
+	r.ntopic = copy(r.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (r *Erase) Topic() string {
+	return string(r.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (r *Erase) TopicSlice() []byte {
+	return r.topic[:r.ntopic]
+}
+
+// FromRequest parses a request, populating the Erase struct. If validation
+// fails, an error is returned.
+func (r *Erase) FromRequest(req *Request) (*Erase, error) {
+	if req.nargs != argLens[CmdErase] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetTopic(req.args[0])
+
+	n, err := asciiToUint(req.args[1])
+	if err != nil {
+		return r, err
+	}
+	r.Start = n
+
+	n, err = asciiToUint(req.args[2])
+	if err != nil {
+		return r, err
+	}
+	r.End = n
+
+	return r, r.Validate()
+}
+
+// Validate checks the ERASE arguments are valid. The range must include at
+// least one offset.
+func (r *Erase) Validate() error {
+	if r.ntopic < 1 {
+		return errNoTopic
+	}
+	if r.End <= r.Start {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *Erase) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(beraseStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, arg := range [...]uint64{r.Start, r.End} {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l := uintToASCII(arg, &r.digitbuf)
+		n, err = w.Write(r.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
+// ErasedBatch returns a batch to overwrite b with, where size is the size of
+// b in the log, including its envelope. It keeps b's topic and timestamp, and
+// holds a single message of NUL bytes sized so the batch takes up exactly
+// size bytes. Clients re-encode batch envelopes as they read them, so any
+// difference is made up by padding the message's size with leading zeros
+// instead. Consumers read an erased batch as one message of NUL bytes, though
+// for batches of a few bytes the last byte may be changed so the checksum
+// fits.
+func ErasedBatch(b *Batch, size int) ([]byte, error) {
+	// BATCH <size> <topic> <checksum> 1[ <timestamp>]\r\n, without the size
+	// and checksum
+	envelope := len(bbatchStart) + len(bspace) + b.ntopic + len(bspace) + len(bspace) + 1 + termLen
+	if b.Timestamp > 0 {
+		envelope += len(bspace) + asciiSize(int(b.Timestamp))
+	}
+
+	// the checksum's length changes with the message, so each padding is
+	// tried with the message sizes that come close to filling the space. If
+	// none fit, the last byte is changed, giving a different checksum.
+	for last := 0; last <= 0xff; last++ {
+		for pad := 0; pad <= maxSizePadding; pad++ {
+			if erased, ok := erasedBatch(b, size, envelope, pad, byte(last)); ok {
+				return erased, nil
+			}
+		}
+	}
+	return nil, errEraseTooSmall
+}
+
+// erasedBatch returns an erased batch of size bytes with its message size
+// padded by pad leading zeros, if there is one.
+func erasedBatch(b *Batch, size int, envelope int, pad int, last byte) ([]byte, bool) {
+	for bodySize := size - envelope - MessageSize(0) - pad; bodySize >= 0; bodySize-- {
+		if bodySize == 0 && last != 0 {
+			break
+		}
+		msg := erasedMessage(bodySize, pad, last)
+		checksum := crc32.Checksum(msg, checksumTable(b.conf))
+		n := envelope + asciiSize(len(msg)) + asciiSize(int(checksum)) + len(msg)
+		if n < size-maxChecksumWidth {
+			break
+		}
+		if n != size {
+			continue
+		}
+
+		buf := make([]byte, 0, size)
+		buf = append(buf, bbatchStart...)
+		buf = strconv.AppendInt(buf, int64(len(msg)), 10)
+		buf = append(buf, bspace...)
+		buf = append(buf, b.TopicSlice()...)
+		buf = append(buf, bspace...)
+		buf = strconv.AppendUint(buf, uint64(checksum), 10)
+		buf = append(buf, " 1"...)
+		if b.Timestamp > 0 {
+			buf = append(buf, bspace...)
+			buf = strconv.AppendInt(buf, b.Timestamp, 10)
+		}
+		buf = append(buf, bnewLine...)
+		return append(buf, msg...), true
+	}
+	return nil, false
+}
+
+// erasedMessage returns a message of bodySize NUL bytes ending in last, with
+// its size padded by pad leading zeros.
+func erasedMessage(bodySize int, pad int, last byte) []byte {
+	msg := make([]byte, 0, MessageSize(bodySize)+pad)
+	msg = append(msg, bmsgStart...)
+	for i := 0; i < pad; i++ {
+		msg = append(msg, '0')
+	}
+	msg = strconv.AppendInt(msg, int64(bodySize), 10)
+	msg = append(msg, bnewLine...)
+	msg = append(msg, make([]byte, bodySize)...)
+	if bodySize > 0 {
+		msg[len(msg)-1] = last
+	}
+	return append(msg, bnewLine...)
+}
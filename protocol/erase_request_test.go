@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestEraseRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	erasereq := NewErase(conf)
+	fixture := []byte("ERASE default 10 20\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := erasereq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if erasereq.Start != 10 || erasereq.End != 20 {
+		t.Fatalf("expected range 10-20 but got %d-%d", erasereq.Start, erasereq.End)
+	}
+
+	if _, err := erasereq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestEraseInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	invalid := map[string][]byte{
+		"no end":      []byte("ERASE default 10\r\n"),
+		"empty range": []byte("ERASE default 10 10\r\n"),
+		"backwards":   []byte("ERASE default 20 10\r\n"),
+		"not a num":   []byte("ERASE default 10 big\r\n"),
+	}
+
+	for name, b := range invalid {
+		t.Run(name, func(t *testing.T) {
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, eerr := NewErase(conf).FromRequest(req)
+			if err == nil && eerr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
+
+func TestErasedBatch(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.MaxBatchSize = 1024 * 1024
+	fixtures := map[string]int64{
+		"batch.smallest": 0,
+		"batch.small":    0,
+		"batch.medium":   1700000000000000000,
+		"batch.large":    1700000000000000000,
+	}
+
+	for name, ts := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			batch := NewBatch(conf)
+			if _, err := batch.ReadFrom(bufio.NewReader(bytes.NewReader(testhelper.LoadFixture(name)))); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			batch.Timestamp = ts
+			orig := &bytes.Buffer{}
+			if _, err := batch.WriteTo(orig); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			b, err := ErasedBatch(batch, orig.Len())
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if len(b) != orig.Len() {
+				t.Fatalf("expected erased batch of %d bytes but got %d: %q", orig.Len(), len(b), b)
+			}
+
+			erased := NewBatch(conf)
+			br := bufio.NewReader(bytes.NewReader(b))
+			if _, err := erased.ReadFrom(br); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if err := erased.Validate(); err != nil {
+				t.Fatalf("%+v: %q", err, b)
+			}
+			// clients re-encode the batches they read
+			reencoded := &bytes.Buffer{}
+			if _, err := erased.WriteTo(reencoded); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if !bytes.Equal(reencoded.Bytes(), b) {
+				t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", b, reencoded.Bytes())
+			}
+			if erased.Topic() != batch.Topic() || erased.Timestamp != ts || erased.Messages != 1 {
+				t.Fatalf("expected one message for topic %q at %d but got %d for %q at %d", batch.Topic(), ts, erased.Messages, erased.Topic(), erased.Timestamp)
+			}
+
+			msg := NewMessage(conf)
+			if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewReader(erased.MessageBytes()))); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if !bytes.Equal(msg.BodyBytes(), make([]byte, msg.Size)) {
+				t.Fatalf("expected message of NUL bytes but got %q", msg.BodyBytes())
+			}
+		})
+	}
+
+	if _, err := ErasedBatch(NewBatch(conf), 10); err != errEraseTooSmall {
+		t.Fatalf("expected %v but got %+v", errEraseTooSmall, err)
+	}
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var berrSep = []byte(": ")
+
+// RespError is a failed response with a message describing what went wrong, in
+// addition to the reason, which is one of the Err variables. It's sent as:
+//
+// ERR <reason>: <message>\r\n
+//
+// Clients that don't understand the message can still match the reason.
+type RespError struct {
+	// Err is the reason for the failure, which is compared against the Err
+	// variables in this package.
+	Err error
+
+	// Message is a human readable explanation.
+	Message string
+}
+
+// NewRespError returns a *RespError with a formatted message.
+func NewRespError(err error, format string, args ...interface{}) *RespError {
+	return &RespError{Err: err, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *RespError) Error() string {
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ": " + e.Message
+}
+
+// Cause returns the reason for the failure, so errors.Cause from
+// github.com/pkg/errors returns the Err variable the response was matched to.
+func (e *RespError) Cause() error {
+	return e.Err
+}
+
+// Unwrap supports errors.Is and errors.As from the standard library.
+func (e *RespError) Unwrap() error {
+	return e.Err
+}
+
+// Error categories, as returned by ErrorCategory.
+const (
+	// CategoryClient is a request that was invalid or not allowed.
+	CategoryClient = "client"
+	// CategoryNotFound is a request for an offset that isn't in the log.
+	CategoryNotFound = "not_found"
+	// CategoryLimit is a request refused by a configured limit, or by a
+	// paused topic.
+	CategoryLimit = "limit"
+	// CategoryDisk is a failure reading or writing the log.
+	CategoryDisk = "disk"
+	// CategoryTimeout is a request that ran out of time, or was cancelled
+	// before it was handled.
+	CategoryTimeout = "timeout"
+	// CategoryInternal is anything else.
+	CategoryInternal = "internal"
+)
+
+// ErrorCategory returns the category of a failed request's error, so failures
+// can be counted by what kind of problem they were rather than by message.
+func ErrorCategory(err error) string {
+	cause := errors.Cause(err)
+	switch cause {
+	case ErrNotFound:
+		return CategoryNotFound
+	case ErrInvalid, ErrUnknownCommand, ErrInvalidOffset, ErrUnauthorized,
+		ErrPermissionDenied, ErrLineTooLong, errTooLarge, errNoTopic,
+		errInvalidProtocolLine, errInvalidNumArgs, errInvalidBodyLength,
+		errCrcMismatch, errEraseTooSmall:
+		return CategoryClient
+	case ErrTooManySubscriptions, ErrTooBusy, ErrTooManyTopics, ErrTopicPaused:
+		return CategoryLimit
+	case ErrDiskFull:
+		return CategoryDisk
+	case context.DeadlineExceeded, context.Canceled:
+		return CategoryTimeout
+	}
+
+	if terr, ok := cause.(interface{ Timeout() bool }); ok && terr.Timeout() {
+		return CategoryTimeout
+	}
+	var perr *os.PathError
+	if stderrors.Is(cause, syscall.ENOSPC) || stderrors.As(cause, &perr) {
+		return CategoryDisk
+	}
+	return CategoryInternal
+}
+
+// cleanErrMessage replaces line breaks so the message can't end the response
+// line early.
+func cleanErrMessage(msg string) []byte {
+	b := []byte(msg)
+	for i, c := range b {
+		if c == '\r' || c == '\n' {
+			b[i] = ' '
+		}
+	}
+	return b
+}
+
+// splitError splits the body of an ERR response into its reason and message.
+func splitError(p []byte) ([]byte, []byte) {
+	i := bytes.Index(p, berrSep)
+	if i < 0 {
+		return p, nil
+	}
+	return p[:i], p[i+len(berrSep):]
+}
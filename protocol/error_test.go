@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err      error
+		category string
+	}{
+		{ErrNotFound, CategoryNotFound},
+		{NewRespError(ErrNotFound, "offset %d not found", 10), CategoryNotFound},
+		{errors.Wrap(ErrInvalid, "bad request"), CategoryClient},
+		{NewRespError(ErrUnknownCommand, "%q", "BOGUS"), CategoryClient},
+		{ErrPermissionDenied, CategoryClient},
+		{ErrTooBusy, CategoryLimit},
+		{ErrTopicPaused, CategoryLimit},
+		{ErrDiskFull, CategoryDisk},
+		{&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.EIO}, CategoryDisk},
+		{fmt.Errorf("writing: %w", syscall.ENOSPC), CategoryDisk},
+		{errors.Wrap(context.DeadlineExceeded, "request cancelled"), CategoryTimeout},
+		{syscall.ETIMEDOUT, CategoryTimeout},
+		{ErrInternal, CategoryInternal},
+		{errors.New("something else"), CategoryInternal},
+	}
+
+	for _, tt := range tests {
+		if cat := ErrorCategory(tt.err); cat != tt.category {
+			t.Errorf("expected %v to be %q but got %q", tt.err, tt.category, cat)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// MaxFormatSize is the maximum length of a topic's format.
+const MaxFormatSize = 255
+
+// Format represents a FORMAT request, which returns a topic's format. The
+// response body is the format, which is empty if none has been set.
+// FORMAT <topic>\r\n
+type Format struct {
+	topicRequest
+}
+
+// NewFormat returns a new instance of a FORMAT request
+func NewFormat(conf *config.Config) *Format {
+	return &Format{newTopicRequest(conf, bformatStart)}
+}
+
+// FromRequest parses a request, populating the Format struct. If validation
+// fails, an error is returned.
+func (f *Format) FromRequest(req *Request) (*Format, error) {
+	return f, f.parse(req)
+}
+
+// SetFormat represents a SETFORMAT request, which sets a topic's format,
+// creating the topic if it doesn't exist. The format is a single word, such
+// as "json" or "protobuf".
+// SETFORMAT <topic> <format>\r\n
+type SetFormat struct {
+	conf    *config.Config
+	topic   []byte
+	ntopic  int
+	format  []byte
+	nformat int
+}
+
+// NewSetFormat returns a new instance of a SETFORMAT request
+func NewSetFormat(conf *config.Config) *SetFormat {
+	return &SetFormat{
+		conf:   conf,
+		topic:  make([]byte, MaxTopicSize),
+		format: make([]byte, MaxFormatSize),
+	}
+}
+
+// Reset puts SETFORMAT in an initial state so it can be reused
+func (f *SetFormat) Reset() {
+	f.ntopic = 0
+	f.nformat = 0
+}
+
+// SetTopic sets the topic of the SETFORMAT request
+func (f *SetFormat) SetTopic(topic []byte) {
+	f.ntopic = copy(f.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (f *SetFormat) Topic() string {
+	return string(f.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (f *SetFormat) TopicSlice() []byte {
+	return f.topic[:f.ntopic]
+}
+
+// SetFormat sets the format of the SETFORMAT request. Formats longer than
+// MaxFormatSize are truncated.
+func (f *SetFormat) SetFormat(format []byte) {
+	f.nformat = copy(f.format, format)
+}
+
+// Format returns the format as a string
+func (f *SetFormat) Format() string {
+	return string(f.format[:f.nformat])
+}
+
+// FromRequest parses a request, populating the SetFormat struct. If
+// validation fails, an error is returned.
+func (f *SetFormat) FromRequest(req *Request) (*SetFormat, error) {
+	if req.nargs != argLens[CmdSetFormat] {
+		return f, errInvalidNumArgs
+	}
+	if len(req.args[1]) > MaxFormatSize {
+		return f, ErrInvalid
+	}
+
+	f.SetTopic(req.args[0])
+	f.SetFormat(req.args[1])
+	return f, f.Validate()
+}
+
+// Validate checks the SETFORMAT arguments are valid
+func (f *SetFormat) Validate() error {
+	if f.ntopic < 1 {
+		return errNoTopic
+	}
+	format := f.format[:f.nformat]
+	if f.nformat < 1 || bytes.ContainsAny(format, " \r\n") {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (f *SetFormat) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bsetFormatStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(f.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(f.format[:f.nformat])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
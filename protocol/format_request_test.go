@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestSetFormatRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	setreq := NewSetFormat(conf)
+	fixture := []byte("SETFORMAT default json\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := setreq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if setreq.Topic() != "default" || setreq.Format() != "json" {
+		t.Fatalf("expected topic %q and format %q but got %q and %q", "default", "json", setreq.Topic(), setreq.Format())
+	}
+
+	if _, err := setreq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestSetFormatInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	invalid := map[string][]byte{
+		"no format": []byte("SETFORMAT default\r\n"),
+		"too long":  []byte("SETFORMAT default " + strings.Repeat("a", MaxFormatSize+1) + "\r\n"),
+	}
+
+	for name, b := range invalid {
+		t.Run(name, func(t *testing.T) {
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, ferr := NewSetFormat(conf).FromRequest(req)
+			if err == nil && ferr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
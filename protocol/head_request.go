@@ -0,0 +1,21 @@
+package protocol
+
+import "github.com/jeffrom/logd/config"
+
+// Head represents a HEAD request, which returns the offset the next batch
+// written to a topic will have.
+// HEAD <topic>\r\n
+type Head struct {
+	topicRequest
+}
+
+// NewHead returns a new instance of a HEAD request
+func NewHead(conf *config.Config) *Head {
+	return &Head{newTopicRequest(conf, bheadStart)}
+}
+
+// FromRequest parses a request, populating the Head struct. If validation
+// fails, an error is returned.
+func (h *Head) FromRequest(req *Request) (*Head, error) {
+	return h, h.parse(req)
+}
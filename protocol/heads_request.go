@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// HeadsRequest is an incoming HEADS command
+// HEADS\r\n
+type HeadsRequest struct {
+	conf *config.Config
+}
+
+// NewHeadsRequest returns a new instance of HeadsRequest
+func NewHeadsRequest(conf *config.Config) *HeadsRequest {
+	return &HeadsRequest{
+		conf: conf,
+	}
+}
+
+// Reset sets the HeadsRequest to its initial values
+func (r *HeadsRequest) Reset() {
+
+}
+
+// FromRequest parses a request, populating the HeadsRequest
+func (r *HeadsRequest) FromRequest(req *Request) (*HeadsRequest, error) {
+	if req.nargs > 0 {
+		return r, errInvalidNumArgs
+	}
+	return r, nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *HeadsRequest) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(bheads)
+	return int64(n), err
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestHeadsRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	fixture := []byte("HEADS\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Name != CmdHeads {
+		t.Fatalf("expected HEADS command but got %s", req.Name.String())
+	}
+
+	hr, err := NewHeadsRequest(conf).FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hr.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestHeadsResponse(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	hr := NewHeadsResponse(conf)
+	hr.Add("default", 1024)
+	hr.Add("auth", 0)
+
+	expected := []byte("auth 0\r\ndefault 1024\r\n")
+	b := hr.MultiResponse()
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", expected, b)
+	}
+
+	other := NewHeadsResponse(conf)
+	if err := other.Parse(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(other.Heads(), hr.Heads()) {
+		t.Fatalf("expected %v but got %v", hr.Heads(), other.Heads())
+	}
+
+	if err := other.Parse([]byte("default\r\n")); err == nil {
+		t.Fatal("expected a line without a head to be invalid")
+	}
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// HeadsResponse is a list of topics and their head offsets which is intended
+// as a client multi ok response. Each topic is written on its own line, in
+// order of topic name:
+// <topic> <head>\r\n
+type HeadsResponse struct {
+	conf  *config.Config
+	heads map[string]uint64
+	b     *bytes.Buffer
+}
+
+// NewHeadsResponse returns a new instance of HeadsResponse
+func NewHeadsResponse(conf *config.Config) *HeadsResponse {
+	return &HeadsResponse{
+		conf:  conf,
+		heads: make(map[string]uint64),
+		b:     &bytes.Buffer{},
+	}
+}
+
+// Reset sets the HeadsResponse to its initial values
+func (hr *HeadsResponse) Reset() {
+	hr.heads = make(map[string]uint64)
+	hr.b.Reset()
+}
+
+// Add adds a topic's head offset to the response
+func (hr *HeadsResponse) Add(topic string, head uint64) {
+	hr.heads[topic] = head
+}
+
+// Heads returns the head offsets in the response, keyed by topic
+func (hr *HeadsResponse) Heads() map[string]uint64 {
+	return hr.heads
+}
+
+// MultiResponse returns a server-side MOK response body
+func (hr *HeadsResponse) MultiResponse() []byte {
+	hr.b.Reset()
+	if _, err := hr.WriteTo(hr.b); err != nil {
+		hr.b.Reset()
+		return nil
+	}
+	return hr.b.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface.
+func (hr *HeadsResponse) WriteTo(w io.Writer) (int64, error) {
+	topics := make([]string, 0, len(hr.heads))
+	for topic := range hr.heads {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var total int64
+	var buf []byte
+	for _, topic := range topics {
+		buf = append(buf[:0], topic...)
+		buf = append(buf, bspace...)
+		buf = strconv.AppendUint(buf, hr.heads[topic], 10)
+		buf = append(buf, bnewLine...)
+
+		n, err := w.Write(buf)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Parse reads the head offsets from a byte slice
+func (hr *HeadsResponse) Parse(b []byte) error {
+	hr.Reset()
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		_, line, _, err := readLineFromBuf(r)
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := bytes.Split(line, bspace)
+		if len(fields) != 2 || len(fields[0]) == 0 {
+			return errInvalidProtocolLine
+		}
+		head, err := asciiToUint(fields[1])
+		if err != nil {
+			return err
+		}
+		hr.Add(string(fields[0]), head)
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// InfoRequest is an incoming INFO command
+// INFO\r\n
+type InfoRequest struct {
+	conf *config.Config
+}
+
+// NewInfoRequest returns a new instance of InfoRequest
+func NewInfoRequest(conf *config.Config) *InfoRequest {
+	return &InfoRequest{
+		conf: conf,
+	}
+}
+
+// Reset sets the InfoRequest to its initial values
+func (r *InfoRequest) Reset() {
+
+}
+
+// FromRequest parses a request, populating the InfoRequest
+func (r *InfoRequest) FromRequest(req *Request) (*InfoRequest, error) {
+	if req.nargs > 0 {
+		return r, errInvalidNumArgs
+	}
+	return r, nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *InfoRequest) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(binfo)
+	return int64(n), err
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestInfoRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	fixture := []byte("INFO\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Name != CmdInfo {
+		t.Fatalf("expected INFO command but got %s", req.Name.String())
+	}
+
+	ir, err := NewInfoRequest(conf).FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ir.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestInfoResponse(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	ir := NewInfoResponse(conf)
+	ir.Version = "0.1.0"
+	ir.Started = time.Date(2018, 3, 4, 5, 6, 7, 8, time.UTC)
+	ir.Uptime = 1500 * time.Millisecond
+
+	expected := []byte("version 0.1.0\r\nstarted 2018-03-04T05:06:07.000000008Z\r\nuptime 1500\r\n")
+	b := ir.MultiResponse()
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", expected, b)
+	}
+
+	ir.Commit = "abc123"
+	other := NewInfoResponse(conf)
+	if err := other.Parse(ir.MultiResponse()); err != nil {
+		t.Fatal(err)
+	}
+	if other.Version != ir.Version || other.Commit != ir.Commit || !other.Started.Equal(ir.Started) || other.Uptime != ir.Uptime {
+		t.Fatalf("expected %+v but got %+v", ir, other)
+	}
+
+	if err := other.Parse([]byte("started yesterday\r\n")); err == nil {
+		t.Fatal("expected an invalid start time to be invalid")
+	}
+}
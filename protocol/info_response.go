@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jeffrom/logd/config"
+)
+
+var bversionKey = []byte("version")
+var bcommitKey = []byte("commit")
+var bstartedKey = []byte("started")
+var buptimeKey = []byte("uptime")
+
+// InfoResponse describes the server, which is intended as a client multi ok
+// response. Each field is written on its own line, and the commit is omitted
+// if the server wasn't built with one. The start time is in RFC 3339 format,
+// and the uptime is in milliseconds:
+// version <version>\r\n
+// commit <commit>\r\n
+// started <time>\r\n
+// uptime <ms>\r\n
+// Unknown fields are ignored when parsing.
+type InfoResponse struct {
+	conf    *config.Config
+	Version string
+	Commit  string
+	Started time.Time
+	Uptime  time.Duration
+	b       *bytes.Buffer
+}
+
+// NewInfoResponse returns a new instance of InfoResponse
+func NewInfoResponse(conf *config.Config) *InfoResponse {
+	return &InfoResponse{
+		conf: conf,
+		b:    &bytes.Buffer{},
+	}
+}
+
+// Reset sets the InfoResponse to its initial values
+func (ir *InfoResponse) Reset() {
+	ir.Version = ""
+	ir.Commit = ""
+	ir.Started = time.Time{}
+	ir.Uptime = 0
+	ir.b.Reset()
+}
+
+// MultiResponse returns a server-side MOK response body
+func (ir *InfoResponse) MultiResponse() []byte {
+	ir.b.Reset()
+	if _, err := ir.WriteTo(ir.b); err != nil {
+		ir.b.Reset()
+		return nil
+	}
+	return ir.b.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface.
+func (ir *InfoResponse) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	buf = append(buf, bversionKey...)
+	buf = append(buf, bspace...)
+	buf = append(buf, ir.Version...)
+	buf = append(buf, bnewLine...)
+	if ir.Commit != "" {
+		buf = append(buf, bcommitKey...)
+		buf = append(buf, bspace...)
+		buf = append(buf, ir.Commit...)
+		buf = append(buf, bnewLine...)
+	}
+	buf = append(buf, bstartedKey...)
+	buf = append(buf, bspace...)
+	buf = ir.Started.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, bnewLine...)
+	buf = append(buf, buptimeKey...)
+	buf = append(buf, bspace...)
+	buf = strconv.AppendInt(buf, int64(ir.Uptime/time.Millisecond), 10)
+	buf = append(buf, bnewLine...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// Parse reads the server's description from a byte slice
+func (ir *InfoResponse) Parse(b []byte) error {
+	ir.Reset()
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		_, line, _, err := readLineFromBuf(r)
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := bytes.SplitN(line, bspace, 2)
+		if len(fields) != 2 {
+			return errInvalidProtocolLine
+		}
+		switch {
+		case bytes.Equal(fields[0], bversionKey):
+			ir.Version = string(fields[1])
+		case bytes.Equal(fields[0], bcommitKey):
+			ir.Commit = string(fields[1])
+		case bytes.Equal(fields[0], bstartedKey):
+			started, err := time.Parse(time.RFC3339Nano, string(fields[1]))
+			if err != nil {
+				return errInvalidProtocolLine
+			}
+			ir.Started = started
+		case bytes.Equal(fields[0], buptimeKey):
+			n, err := asciiToUint(fields[1])
+			if err != nil {
+				return err
+			}
+			ir.Uptime = time.Duration(n) * time.Millisecond
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// KillConnRequest is an incoming KILLCONN command
+// KILLCONN <id>\r\n
+type KillConnRequest struct {
+	conf *config.Config
+	id   []byte
+}
+
+// NewKillConnRequest returns a new instance of KillConnRequest
+func NewKillConnRequest(conf *config.Config) *KillConnRequest {
+	return &KillConnRequest{
+		conf: conf,
+	}
+}
+
+// Reset sets the KillConnRequest to its initial values
+func (r *KillConnRequest) Reset() {
+	r.id = r.id[:0]
+}
+
+// SetID sets the id of the connection to close
+func (r *KillConnRequest) SetID(id []byte) {
+	r.id = append(r.id[:0], id...)
+}
+
+// ID returns the id of the connection to close. It is not copied.
+func (r *KillConnRequest) ID() []byte {
+	return r.id
+}
+
+// FromRequest parses a request, populating the KillConnRequest
+func (r *KillConnRequest) FromRequest(req *Request) (*KillConnRequest, error) {
+	if req.nargs != argLens[CmdKillConn] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetID(req.args[0])
+	return r, r.Validate()
+}
+
+// Validate checks the KILLCONN arguments are valid
+func (r *KillConnRequest) Validate() error {
+	if len(r.id) < 1 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *KillConnRequest) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bkillConnStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.id)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
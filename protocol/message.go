@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"time"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/pkg/errors"
@@ -11,11 +12,17 @@ import (
 
 // Message is a new message type
 type Message struct {
-	conf          *config.Config
-	Offset        uint64 // firstOffset + offsetDelta
-	Delta         uint64
+	conf      *config.Config
+	Offset    uint64 // firstOffset + offsetDelta
+	Delta     uint64
+	Timestamp int64 // when the server received the message's batch, in unix nanoseconds
+	// Tombstone is true if the message marks the deletion of a key, which is
+	// stored in Body. See Key.
+	Tombstone     bool
 	Body          []byte
-	Size          int // size of the message, not including \r\n
+	Size          int    // size of the message, not including \r\n
+	key           []byte // set for keyed messages. See Key.
+	keyBuf        []byte // holds the key of messages read from a batch
 	fullSize      int
 	firstOffset   uint64 // the offset of the beginning of the batch
 	offsetDelta   uint64 // the the offset of the message from firstOffset
@@ -27,6 +34,13 @@ type Message struct {
 
 // NewMessage returns a Message
 // MSG <size>\r\n<body>\r\n
+// Tombstones are flagged after the size, and the body is the key:
+// MSG <size> TOMBSTONE\r\n<key>\r\n
+// Keyed messages are flagged with the key's size, and the key comes before
+// the body. The size includes both:
+// MSG <size> KEY <keysize>\r\n<key><body>\r\n
+// Readers that don't understand tombstones or keys will fail to parse them, so
+// consumers should be upgraded before producers write them.
 func NewMessage(conf *config.Config) *Message {
 	return &Message{
 		conf: conf,
@@ -38,7 +52,10 @@ func NewMessage(conf *config.Config) *Message {
 func (m *Message) Reset() {
 	m.Offset = 0
 	m.Delta = 0
+	m.Timestamp = 0
+	m.Tombstone = false
 	m.Size = 0
+	m.key = nil
 	m.fullSize = 0
 	m.firstOffset = 0
 	m.offsetDelta = 0
@@ -49,14 +66,44 @@ func (m *Message) Reset() {
 
 // Copy returns a copy of the message. Convenient for clients.
 func (m *Message) Copy() *Message {
-	b := make([]byte, len(m.Body))
-	copy(b, m.Body)
+	b := make([]byte, m.Size)
+	copy(b, m.BodyBytes())
+	var key []byte
+	if m.key != nil {
+		key = make([]byte, len(m.key))
+		copy(key, m.key)
+	}
 	return &Message{
-		Offset: m.Offset,
-		Delta:  m.Delta,
-		Size:   m.Size,
-		Body:   b,
+		Offset:    m.Offset,
+		Delta:     m.Delta,
+		Timestamp: m.Timestamp,
+		Tombstone: m.Tombstone,
+		Size:      m.Size,
+		Body:      b,
+		key:       key,
+	}
+}
+
+// Time returns the time the server received the message. It's the zero time
+// if the message was logged before timestamps were stored.
+func (m *Message) Time() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, m.Timestamp)
+}
+
+// Key returns the message's key, or nil if it doesn't have one. For a
+// tombstone, it's the key the tombstone deletes. Keys are accepted, stored,
+// and delivered as part of the message, and are covered by the batch's
+// checksum. The server doesn't use them yet; they're intended to let
+// key-based consumers, such as compaction, group messages with the same key,
+// and tombstones let them drop earlier messages with the same key.
+func (m *Message) Key() []byte {
+	if m.Tombstone {
+		return m.BodyBytes()
 	}
+	return m.key
 }
 
 func (m *Message) String() string {
@@ -88,7 +135,7 @@ func (m *Message) readFromBuf(r *bufio.Reader) (int64, error) {
 	var total int64
 	var n uint64
 
-	word, err := r.ReadSlice(' ')
+	word, err := readSlice(r, ' ')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
@@ -98,17 +145,53 @@ func (m *Message) readFromBuf(r *bufio.Reader) (int64, error) {
 		return total, errInvalidProtocolLine
 	}
 
-	word, err = r.ReadSlice('\n')
+	word, err = readSlice(r, '\n')
 	total += int64(len(word))
 	if err != nil {
 		return total, err
 	}
-	n, err = asciiToUint(word[:len(word)-termLen])
+	word = word[:len(word)-termLen]
+
+	keySize := -1
+	if i := bytes.IndexByte(word, ' '); i >= 0 {
+		flag := word[i+1:]
+		switch {
+		case bytes.Equal(flag, btombstone):
+			m.Tombstone = true
+		case bytes.HasPrefix(flag, bkeyStart):
+			ks, err := asciiToUint(flag[len(bkeyStart):])
+			if err != nil {
+				return total, err
+			}
+			keySize = int(ks)
+		default:
+			return total, errInvalidProtocolLine
+		}
+		word = word[:i]
+	}
+
+	n, err = asciiToUint(word)
 	if err != nil {
 		return total, err
 	}
 	m.Size = int(n)
 
+	if keySize >= 0 {
+		if keySize > m.Size {
+			return total, errInvalidProtocolLine
+		}
+		if m.keyBuf == nil || cap(m.keyBuf) < keySize {
+			m.keyBuf = make([]byte, keySize)
+		}
+		m.key = m.keyBuf[:keySize]
+		keyRead, err := io.ReadFull(r, m.key)
+		total += int64(keyRead)
+		if err != nil {
+			return total, err
+		}
+		m.Size -= keySize
+	}
+
 	bodyRead, err := io.ReadFull(r, m.Body[:m.Size])
 	total += int64(bodyRead)
 	if err != nil {
@@ -171,19 +254,60 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
-	l := uintToASCII(uint64(m.Size), &m.digitbuf)
+	l := uintToASCII(uint64(len(m.key)+m.Size), &m.digitbuf)
 	n, err = w.Write(m.digitbuf[l:])
 	total += int64(n)
 	if err != nil {
 		return total, err
 	}
 
+	if m.key != nil {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = w.Write(bkeyStart)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l = uintToASCII(uint64(len(m.key)), &m.digitbuf)
+		n, err = w.Write(m.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if m.Tombstone {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = w.Write(btombstone)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(bnewLine)
 	total += int64(n)
 	if err != nil {
 		return total, err
 	}
 
+	n, err = w.Write(m.key)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
 	n, err = w.Write(m.BodyBytes())
 	total += int64(n)
 	if err != nil {
@@ -200,6 +324,12 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (m *Message) calcSize() int {
+	if m.Tombstone {
+		return TombstoneSize(len(m.Body))
+	}
+	if m.key != nil {
+		return KeyedMessageSize(len(m.key), len(m.Body))
+	}
 	return MessageSize(len(m.Body))
 }
 
@@ -212,3 +342,18 @@ func MessageSize(bodySize int) int {
 
 	return l
 }
+
+// TombstoneSize returns the size of a tombstone for a key of keySize,
+// including protocol
+func TombstoneSize(keySize int) int {
+	return MessageSize(keySize) + len(bspace) + len(btombstone)
+}
+
+// KeyedMessageSize returns the size of a message with a key of keySize,
+// including protocol
+func KeyedMessageSize(keySize int, bodySize int) int {
+	l := MessageSize(keySize + bodySize)
+	l += len(bspace) + len(bkeyStart) // ` KEY `
+	l += asciiSize(keySize)           // <keysize>
+	return l
+}
@@ -64,3 +64,150 @@ func TestReadMessage(t *testing.T) {
 		t.Fatalf("expected size to be 12 but was %d", msg.Size)
 	}
 }
+
+func TestTombstone(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	if err := batch.Append([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.AppendTombstone([]byte("mykey")); err != nil {
+		t.Fatal(err)
+	}
+	expectedSize := MessageSize(2) + TombstoneSize(5)
+	if batch.Size != expectedSize {
+		t.Fatalf("expected batch size %d but got %d", expectedSize, batch.Size)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("MSG 5 TOMBSTONE\r\nmykey\r\n")) {
+		t.Fatalf("expected tombstone in batch but got %q", b.Bytes())
+	}
+
+	other := NewBatch(conf)
+	if _, err := other.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error reading batch: %+v", err)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(other.MessageBytes()))
+	msg := NewMessage(conf)
+	if _, err := msg.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Tombstone || msg.Key() != nil {
+		t.Fatalf("expected a regular message but got tombstone %q", msg.Key())
+	}
+
+	msg.Reset()
+	if _, err := msg.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Tombstone || !bytes.Equal(msg.Key(), []byte("mykey")) {
+		t.Fatalf("expected tombstone for %q but got %+v", "mykey", msg)
+	}
+	if cp := msg.Copy(); !cp.Tombstone {
+		t.Fatal("expected copy to be a tombstone")
+	}
+}
+
+func TestKeyedMessage(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := NewBatch(conf)
+	batch.SetTopic([]byte("default"))
+	if err := batch.Append([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.AppendKeyed([]byte("mykey"), []byte("hallo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.AppendKeyed(nil, []byte("sup")); err != nil {
+		t.Fatal(err)
+	}
+	expectedSize := MessageSize(2) + KeyedMessageSize(5, 5) + KeyedMessageSize(0, 3)
+	if batch.Size != expectedSize {
+		t.Fatalf("expected batch size %d but got %d", expectedSize, batch.Size)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := batch.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("MSG 10 KEY 5\r\nmykeyhallo\r\nMSG 3 KEY 0\r\nsup\r\n")) {
+		t.Fatalf("expected keyed messages in batch but got %q", b.Bytes())
+	}
+	if len(b.Bytes()) != batch.CalcSize()-maxCRCSize+asciiSize(int(batch.Checksum)) {
+		t.Fatalf("expected batch of %d bytes but got %d", batch.CalcSize()-maxCRCSize+asciiSize(int(batch.Checksum)), len(b.Bytes()))
+	}
+
+	// the checksum covers the key
+	corrupt := bytes.Replace(b.Bytes(), []byte("mykey"), []byte("mykez"), 1)
+	corrupted := NewBatch(conf)
+	if _, err := corrupted.ReadFrom(bufio.NewReader(bytes.NewReader(corrupt))); err != nil {
+		t.Fatalf("unexpected error reading batch: %+v", err)
+	}
+	if err := corrupted.Validate(); err != errCrcMismatch {
+		t.Fatalf("expected a batch with a changed key to fail its checksum but got %v", err)
+	}
+
+	other := NewBatch(conf)
+	if _, err := other.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error reading batch: %+v", err)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(other.MessageBytes()))
+	msg := NewMessage(conf)
+	expected := []struct {
+		key  []byte
+		body []byte
+	}{
+		{nil, []byte("hi")},
+		{[]byte("mykey"), []byte("hallo")},
+		{[]byte{}, []byte("sup")},
+	}
+	for _, exp := range expected {
+		msg.Reset()
+		if _, err := msg.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+		if (exp.key == nil) != (msg.Key() == nil) || !bytes.Equal(msg.Key(), exp.key) {
+			t.Fatalf("expected key %q but got %q", exp.key, msg.Key())
+		}
+		if !bytes.Equal(msg.BodyBytes(), exp.body) {
+			t.Fatalf("expected body %q but got %q", exp.body, msg.BodyBytes())
+		}
+		if msg.Tombstone {
+			t.Fatal("expected a keyed message not to be a tombstone")
+		}
+	}
+
+	msg.Reset()
+	if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewBufferString("MSG 3 KEY 2\r\nabc\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	cp := msg.Copy()
+	msg.Reset()
+	if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewBufferString("MSG 3 KEY 1\r\nxyz\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cp.Key(), []byte("ab")) || !bytes.Equal(cp.BodyBytes(), []byte("c")) {
+		t.Fatalf("expected copy with key %q and body %q but got %q and %q", "ab", "c", cp.Key(), cp.BodyBytes())
+	}
+
+	msg.Reset()
+	if _, err := msg.ReadFrom(bufio.NewReader(bytes.NewBufferString("MSG 2 KEY 3\r\nhi\r\n"))); err == nil {
+		t.Fatal("expected error reading message with a key larger than the message")
+	}
+}
+
+func TestReadMessageInvalidFlag(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	msg := NewMessage(conf)
+	br := bufio.NewReader(bytes.NewBufferString("MSG 2 DELETED\r\nhi\r\n"))
+	if _, err := msg.ReadFrom(br); err == nil {
+		t.Fatal("expected error reading message with an unknown flag")
+	}
+}
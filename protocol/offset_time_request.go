@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// OffsetTime represents an OFFSETTIME request, which responds with the time
+// the batch at offset was logged, in nanoseconds since the unix epoch. Batches
+// logged before timestamps were stored respond with 0.
+// OFFSETTIME <topic> <offset>\r\n
+type OffsetTime struct {
+	conf     *config.Config
+	Offset   uint64
+	topic    []byte
+	ntopic   int
+	digitbuf [32]byte
+}
+
+// NewOffsetTime returns a new instance of an OFFSETTIME request
+func NewOffsetTime(conf *config.Config) *OffsetTime {
+	return &OffsetTime{
+		conf:  conf,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts OFFSETTIME in an initial state so it can be reused
+func (ot *OffsetTime) Reset() {
+	ot.Offset = 0
+	ot.ntopic = 0
+}
+
+// SetTopic sets the topic of the OFFSETTIME request
+func (ot *OffsetTime) SetTopic(topic []byte) {
+	ot.ntopic = copy(ot.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (ot *OffsetTime) Topic() string {
+	return string(ot.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (ot *OffsetTime) TopicSlice() []byte {
+	return ot.topic[:ot.ntopic]
+}
+
+// FromRequest parses a request, populating the OffsetTime struct. If
+// validation fails, an error is returned.
+func (ot *OffsetTime) FromRequest(req *Request) (*OffsetTime, error) {
+	if req.nargs != argLens[CmdOffsetTime] {
+		return ot, errInvalidNumArgs
+	}
+
+	ot.SetTopic(req.args[0])
+
+	n, err := asciiToUint(req.args[1])
+	if err != nil {
+		return ot, err
+	}
+	ot.Offset = n
+
+	return ot, ot.Validate()
+}
+
+// Validate checks the OFFSETTIME arguments are valid
+func (ot *OffsetTime) Validate() error {
+	if ot.ntopic < 1 {
+		return errNoTopic
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (ot *OffsetTime) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(boffsetTimeStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(ot.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	l := uintToASCII(ot.Offset, &ot.digitbuf)
+	n, err = w.Write(ot.digitbuf[l:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestOffsetTimeRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	otreq := NewOffsetTime(conf)
+	fixture := []byte("OFFSETTIME default 1234\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := otreq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if otreq.Topic() != "default" || otreq.Offset != 1234 {
+		t.Fatalf("expected topic %q and offset %d but got %q and %d", "default", 1234, otreq.Topic(), otreq.Offset)
+	}
+
+	if _, err := otreq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
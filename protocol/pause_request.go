@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// Pause represents a PAUSE or RESUME request. A paused topic rejects batches
+// with ErrTopicPaused, while reads continue as usual.
+// PAUSE <topic>\r\n
+// RESUME <topic>\r\n
+type Pause struct {
+	topicRequest
+
+	// Resume is set for RESUME requests.
+	Resume bool
+}
+
+// NewPause returns a new instance of a PAUSE request
+func NewPause(conf *config.Config) *Pause {
+	return &Pause{topicRequest: newTopicRequest(conf, bpauseStart)}
+}
+
+// Reset puts PAUSE in an initial state so it can be reused
+func (p *Pause) Reset() {
+	p.topicRequest.Reset()
+	p.Resume = false
+}
+
+// FromRequest parses a request, populating the Pause struct. If validation
+// fails, an error is returned.
+func (p *Pause) FromRequest(req *Request) (*Pause, error) {
+	p.Resume = req.Name == CmdResume
+	return p, p.parse(req)
+}
+
+// WriteTo implements io.WriterTo
+func (p *Pause) WriteTo(w io.Writer) (int64, error) {
+	if p.Resume {
+		return p.writeTo(w, bresumeStart)
+	}
+	return p.writeTo(w, bpauseStart)
+}
@@ -35,6 +35,7 @@ import (
 	"fmt"
 	"hash/crc32"
 
+	"github.com/jeffrom/logd/config"
 	"github.com/pkg/errors"
 )
 
@@ -48,16 +49,56 @@ var errInvalidProtocolLine = stderrors.New("invalid protocol line")
 var errInvalidBodyLength = stderrors.New("invalid body length")
 var errCrcMismatch = stderrors.New("crc checksum mismatch")
 
-var crcTable = crc32.MakeTable(crc32.IEEE)
+// ErrLineTooLong is returned when a protocol line doesn't end within the
+// reader's buffer. Lines are read in place, so the buffer size is the longest
+// line that can be read, and a peer that never sends a line ending can't make
+// the reader grow.
+var ErrLineTooLong = stderrors.New("protocol line too long")
+
+var ieeeTable = crc32.MakeTable(crc32.IEEE)
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumTable returns the crc32 table batch checksums are calculated with.
+// IEEE is used unless Castagnoli is configured.
+func checksumTable(conf *config.Config) *crc32.Table {
+	if conf != nil && conf.Checksum == config.ChecksumCastagnoli {
+		return castagnoliTable
+	}
+	return ieeeTable
+}
 
 var bnewLine = []byte("\r\n")
 var bspace = []byte(" ")
 var bmsg = []byte("MSG")
 var bmsgStart = []byte("MSG ")
+var btombstone = []byte("TOMBSTONE")
+var bkeyStart = []byte("KEY ")
 var bbatchStart = []byte("BATCH ")
+var bdryBatchStart = []byte("DRYBATCH ")
+var brestoreStart = []byte("RESTORE ")
+var beraseStart = []byte("ERASE ")
 var breadStart = []byte("READ ")
+var bsreadStart = []byte("SREAD ")
+var breadRangeStart = []byte("READRANGE ")
 var btailStart = []byte("TAIL ")
 var bconfig = []byte("CONFIG\r\n")
+var bstats = []byte("STATS")
+var bauthStart = []byte("AUTH ")
+var bconns = []byte("CONNS\r\n")
+var bkillConnStart = []byte("KILLCONN ")
+var bheadStart = []byte("HEAD ")
+var bformatStart = []byte("FORMAT ")
+var bsetFormatStart = []byte("SETFORMAT ")
+var bpauseStart = []byte("PAUSE ")
+var bresumeStart = []byte("RESUME ")
+var btailOffsetStart = []byte("TAILOFFSET ")
+var bsyncStart = []byte("SYNC ")
+var boffsetTimeStart = []byte("OFFSETTIME ")
+var bcompressStart = []byte("COMPRESS ")
+var btopicInfoStart = []byte("TOPICINFO ")
+var bsetPartSizeStart = []byte("SETPARTSIZE ")
+var bheads = []byte("HEADS\r\n")
+var binfo = []byte("INFO\r\n")
 var bok = []byte("OK")
 var bokResp = []byte("OK\r\n")
 var bokStart = []byte("OK ")
@@ -85,8 +126,18 @@ func parseWord(line []byte) ([]byte, []byte, error) {
 	return line[n+1:], word, nil
 }
 
+// readSlice is bufio.Reader.ReadSlice, but returns ErrLineTooLong if the
+// buffer fills before delim is found.
+func readSlice(r *bufio.Reader, delim byte) ([]byte, error) {
+	b, err := r.ReadSlice(delim)
+	if err == bufio.ErrBufferFull {
+		err = ErrLineTooLong
+	}
+	return b, err
+}
+
 func readLineFromBuf(r *bufio.Reader) (int64, []byte, []byte, error) {
-	word, err := r.ReadSlice('\n')
+	word, err := readSlice(r, '\n')
 	total := int64(len(word))
 	if err != nil {
 		if total < 2 {
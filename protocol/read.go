@@ -8,8 +8,12 @@ import (
 
 // Read represents a read request
 // READ <topic> <offset> <messages>\r\n
+// If Stream is set, the request is for a multiplexed stream, and the response
+// is tagged with the stream id:
+// SREAD <stream> <topic> <offset> <messages>\r\n
 type Read struct {
 	conf     *config.Config
+	Stream   uint64
 	Offset   uint64
 	Messages int
 	topic    []byte
@@ -29,6 +33,7 @@ func NewRead(conf *config.Config) *Read {
 
 // Reset puts READ in an initial state so it can be reused
 func (r *Read) Reset() {
+	r.Stream = 0
 	r.Offset = 0
 	r.Messages = 0
 	r.ntopic = 0
@@ -54,19 +59,33 @@ func (r *Read) TopicSlice() []byte {
 // FromRequest parses a request, populating the Read struct. If validation
 // fails, an error is returned
 func (r *Read) FromRequest(req *Request) (*Read, error) {
-	if req.nargs != argLens[CmdRead] {
+	nargs := 3
+	if req.Name == CmdSRead {
+		nargs = 4
+	}
+	if req.nargs != nargs {
 		return r, errInvalidNumArgs
 	}
 
-	r.SetTopic(req.args[0])
+	args := req.args[:req.nargs]
+	if req.Name == CmdSRead {
+		n, err := asciiToUint(args[0])
+		if err != nil {
+			return r, err
+		}
+		r.Stream = n
+		args = args[1:]
+	}
+
+	r.SetTopic(args[0])
 
-	n, err := asciiToUint(req.args[1])
+	n, err := asciiToUint(args[1])
 	if err != nil {
 		return r, err
 	}
 	r.Offset = n
 
-	n, err = asciiToUint(req.args[2])
+	n, err = asciiToUint(args[2])
 	if err != nil {
 		return r, err
 	}
@@ -85,14 +104,49 @@ func (r *Read) Validate() error {
 
 // WriteTo implements io.WriterTo
 func (r *Read) WriteTo(w io.Writer) (int64, error) {
+	if r.Stream > 0 {
+		return r.writeStream(w)
+	}
+
 	var total int64
 	n, err := w.Write(breadStart)
 	total += int64(n)
 	if err != nil {
 		return total, err
 	}
+	n2, err := r.writeArgs(w)
+	return total + n2, err
+}
+
+func (r *Read) writeStream(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bsreadStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
 
-	n, err = w.Write(r.TopicSlice())
+	l := uintToASCII(r.Stream, &r.digitbuf)
+	n, err = w.Write(r.digitbuf[l:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n2, err := r.writeArgs(w)
+	return total + n2, err
+}
+
+// writeArgs writes `<topic> <offset> <messages>\r\n`
+func (r *Read) writeArgs(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(r.TopicSlice())
 	total += int64(n)
 	if err != nil {
 		return total, err
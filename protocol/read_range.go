@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// ReadRange represents a READRANGE request, which reads the batches starting
+// from Start up to End. If Inclusive is set, the batch starting at End is
+// also read. The server clamps End to the topic's head, and may respond with
+// fewer batches if the response would be too large, so the range served ends
+// at the offset following the last batch in the response.
+// READRANGE <topic> <start> <end> <inclusive>\r\n
+// where inclusive is 1 or 0.
+type ReadRange struct {
+	conf      *config.Config
+	Start     uint64
+	End       uint64
+	Inclusive bool
+	topic     []byte
+	ntopic    int
+	digitbuf  [32]byte
+}
+
+// NewReadRange returns a new instance of a READRANGE request
+func NewReadRange(conf *config.Config) *ReadRange {
+	return &ReadRange{
+		conf:  conf,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts READRANGE in an initial state so it can be reused
+func (r *ReadRange) Reset() {
+	r.Start = 0
+	r.End = 0
+	r.Inclusive = false
+	r.ntopic = 0
+}
+
+// SetTopic sets the topic of the READRANGE request
+func (r *ReadRange) SetTopic(topic []byte) {
+	r.ntopic = copy(r.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (r *ReadRange) Topic() string {
+	return string(r.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (r *ReadRange) TopicSlice() []byte {
+	return r.topic[:r.ntopic]
+}
+
+// Limit returns the offset the range ends before. Batches starting before it
+// are in the range.
+func (r *ReadRange) Limit() uint64 {
+	if r.Inclusive {
+		return r.End + 1
+	}
+	return r.End
+}
+
+// FromRequest parses a request, populating the ReadRange struct. If
+// validation fails, an error is returned.
+func (r *ReadRange) FromRequest(req *Request) (*ReadRange, error) {
+	if req.nargs != argLens[CmdReadRange] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetTopic(req.args[0])
+
+	n, err := asciiToUint(req.args[1])
+	if err != nil {
+		return r, err
+	}
+	r.Start = n
+
+	n, err = asciiToUint(req.args[2])
+	if err != nil {
+		return r, err
+	}
+	r.End = n
+
+	n, err = asciiToUint(req.args[3])
+	if err != nil {
+		return r, err
+	}
+	if n > 1 {
+		return r, ErrInvalid
+	}
+	r.Inclusive = n == 1
+
+	return r, r.Validate()
+}
+
+// Validate checks the READRANGE arguments are valid. The range must include
+// at least one offset.
+func (r *ReadRange) Validate() error {
+	if r.ntopic < 1 {
+		return errNoTopic
+	}
+	if r.Limit() <= r.Start {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *ReadRange) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(breadRangeStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	var inclusive uint64
+	if r.Inclusive {
+		inclusive = 1
+	}
+	for _, arg := range [...]uint64{r.Start, r.End, inclusive} {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l := uintToASCII(arg, &r.digitbuf)
+		n, err = w.Write(r.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestReadRangeRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	rangereq := NewReadRange(conf)
+	fixture := []byte("READRANGE default 10 1234 1\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := rangereq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if rangereq.Topic() != "default" || rangereq.Start != 10 || rangereq.End != 1234 || !rangereq.Inclusive {
+		t.Fatalf("READRANGE request didn't parse: %+v", rangereq)
+	}
+	if rangereq.Limit() != 1235 {
+		t.Fatalf("expected inclusive limit %d but got %d", 1235, rangereq.Limit())
+	}
+
+	if _, err := rangereq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+
+	rangereq.Inclusive = false
+	if rangereq.Limit() != 1234 {
+		t.Fatalf("expected exclusive limit %d but got %d", 1234, rangereq.Limit())
+	}
+}
+
+var invalidReadRanges = map[string][]byte{
+	// "valid": []byte("READRANGE default 0 3 0"),
+	"no topic":       []byte("READRANGE  0 3 0"),
+	"end before":     []byte("READRANGE default 3 0 0"),
+	"empty":          []byte("READRANGE default 3 3 0"),
+	"bad flag":       []byte("READRANGE default 0 3 2"),
+	"missing flag":   []byte("READRANGE default 0 3"),
+	"non-number end": []byte("READRANGE default 0 head 0"),
+}
+
+func TestReadRangeInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	rangereq := NewReadRange(conf)
+
+	for name, b := range invalidReadRanges {
+		t.Run(name, func(t *testing.T) {
+			rangereq.Reset()
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(append(b, bnewLine...))))
+			_, rerr := rangereq.FromRequest(req)
+			if err == nil && rerr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
@@ -23,10 +23,40 @@ func TestWriteRead(t *testing.T) {
 	testhelper.CheckGoldenFile("read.simple", b.Bytes(), testhelper.Golden)
 }
 
+func TestReadStream(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	read := NewRead(conf)
+	read.Stream = 3
+	read.Offset = 1234567
+	read.Messages = 100
+	read.SetTopic([]byte("default"))
+
+	b := &bytes.Buffer{}
+	if _, err := read.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing SREAD request: %v", err)
+	}
+	if b.String() != "SREAD 3 default 1234567 100\r\n" {
+		t.Fatalf("unexpected SREAD request: %q", b.Bytes())
+	}
+
+	req := NewRequestConfig(conf)
+	if _, err := req.ReadFrom(bufio.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	actual := NewRead(conf)
+	if _, err := actual.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if actual.Stream != 3 || actual.Offset != 1234567 || actual.Messages != 100 || actual.Topic() != "default" {
+		t.Fatalf("SREAD request didn't round trip: %+v", actual)
+	}
+}
+
 var invalidReads = map[string][]byte{
 	// "valid": []byte("READ default 0 3"),
-	"no topic":      []byte("READ  0 3"),
-	"zero messages": []byte("READ default 0 0"),
+	"no topic":        []byte("READ  0 3"),
+	"zero messages":   []byte("READ default 0 0"),
+	"stream no topic": []byte("SREAD 1  0 3"),
 }
 
 func TestReadInvalid(t *testing.T) {
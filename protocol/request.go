@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"time"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
@@ -15,6 +16,8 @@ type Request struct {
 	Name      CmdType
 	responseC chan *Response
 	Response  *Response
+	// Queued is when the request was pushed to a topic's event queue.
+	Queued time.Time
 
 	respBuf *closingBuffer
 
@@ -60,6 +63,7 @@ func (req *Request) Reset() {
 	req.nargs = 0
 	req.body = nil
 	req.bodysize = 0
+	req.Queued = time.Time{}
 	req.respBuf.Reset()
 	req.Response.Reset()
 
@@ -87,10 +91,12 @@ func (req *Request) FullSize() int {
 // Topic returns the topic for the request, if any
 func (req *Request) Topic() string {
 	switch req.Name {
-	case CmdBatch:
+	case CmdBatch, CmdDryBatch, CmdRestore:
 		return string(req.args[1])
-	case CmdRead, CmdTail:
+	case CmdRead, CmdReadRange, CmdTail, CmdHead, CmdFormat, CmdSetFormat, CmdPause, CmdResume, CmdTailOffset, CmdSync, CmdOffsetTime, CmdTopicInfo, CmdSetPartSize, CmdErase:
 		return string(req.args[0])
+	case CmdSRead:
+		return string(req.args[1])
 	}
 	return ""
 }
@@ -99,7 +105,7 @@ func (req *Request) parseType() ([]byte, error) {
 	rest, word, err := parseWord(req.envelope)
 	req.Name = cmdNamefromBytes(word)
 	if req.Name == 0 {
-		return rest, errUnknownCmdType
+		return rest, NewRespError(ErrUnknownCommand, "%q", word)
 	}
 	return rest, err
 }
@@ -117,7 +123,7 @@ func (req *Request) parseArg(line []byte) ([]byte, error) {
 
 func (req *Request) hasBody() bool {
 	switch req.Name {
-	case CmdBatch:
+	case CmdBatch, CmdDryBatch, CmdRestore:
 		return true
 	}
 	return false
@@ -167,6 +173,9 @@ func (req *Request) Responded() chan *Response {
 
 func (req *Request) readEnvelope(r *bufio.Reader) (int64, error) {
 	total, _, raw, err := readLineFromBuf(r)
+	if total > int64(len(req.raw)) {
+		return total, ErrLineTooLong
+	}
 	copy(req.raw, raw)
 	req.envelope = req.raw[:total]
 	return total, err
@@ -192,6 +201,12 @@ func (req *Request) readFromBuf(r *bufio.Reader) (int64, error) {
 			return total, err
 		}
 	}
+	for i := 0; i < optionalArgLens[req.Name] && len(line) > 0; i++ {
+		line, err = req.parseArg(line)
+		if err != nil {
+			return total, err
+		}
+	}
 
 	// internal.Debugf(req.conf, "read envelope: %d bytes", total)
 	if req.hasBody() {
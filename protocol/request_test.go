@@ -3,6 +3,7 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/jeffrom/logd/testhelper"
@@ -24,3 +25,15 @@ func TestReadRequest(t *testing.T) {
 	actual := req.raw[:req.read]
 	testhelper.CheckGoldenFile("batch.small", actual, testhelper.Golden)
 }
+
+func TestReadRequestLineTooLong(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+
+	// no line ending, and longer than the reader's buffer
+	b := "READ default " + strings.Repeat("1", 4096)
+	_, err := req.ReadFrom(bufio.NewReaderSize(strings.NewReader(b), 1024))
+	if err != ErrLineTooLong {
+		t.Fatalf("expected %v but got %+v", ErrLineTooLong, err)
+	}
+}
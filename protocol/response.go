@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/internal"
 )
 
 // RespType is the response status return type
@@ -43,10 +44,42 @@ var (
 	// ErrInvalid refers to an invalid request.
 	ErrInvalid = errors.New("invalid request")
 
+	// ErrUnknownCommand is returned when a request's command isn't one the
+	// server recognizes. The response message is the quoted command name.
+	ErrUnknownCommand = errors.New("unknown command")
+
 	// ErrInvalidOffset is returned when a read is attempted from a batch
 	// offset that doesn't point to the beginning of a batch protocol message.
 	ErrInvalidOffset = errors.New("invalid offset")
 
+	// ErrUnauthorized is returned when authentication fails, or a request is
+	// made on a connection that hasn't authenticated.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrPermissionDenied is returned when the connection's principal isn't
+	// allowed to read or write the requested topic.
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrTooManySubscriptions is returned when a READ or TAIL is attempted
+	// while the server is already sending its maximum number of read
+	// responses.
+	ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+	// ErrTooBusy is returned when a READ is attempted while the server is
+	// already sending its maximum number of READ responses.
+	ErrTooBusy = errors.New("too busy")
+
+	// ErrTooManyTopics is returned when a request would create a new topic
+	// but the server already has its maximum number of topics.
+	ErrTooManyTopics = errors.New("too many topics")
+
+	// ErrTopicPaused is returned when a batch is sent to a paused topic.
+	ErrTopicPaused = errors.New("topic paused")
+
+	// ErrDiskFull is returned when a batch can't be written because the
+	// server's disk is full. Retrying won't help until space is freed.
+	ErrDiskFull = errors.New("disk full")
+
 	// errTooLarge is returned when the batch size is larger than the
 	// configured max batch size.
 	errTooLarge = errors.New("too large")
@@ -99,8 +132,12 @@ type Response struct {
 	conf           *config.Config
 	ClientResponse *ClientResponse
 	readers        []io.ReadCloser
+	openers        []func() (io.ReadCloser, error) // set for readers opened as they're scanned
+	releases       []func()                        // called once openers have run, or weren't needed
 	numReaders     int
 	numScanned     int
+	done           func()
+	copyBuf        []byte
 }
 
 // NewResponse returns a new response.
@@ -114,6 +151,8 @@ func (r *Response) WithConfig(conf *config.Config) *Response {
 	r.conf = conf
 	if len(r.readers) < conf.MaxPartitions+2 {
 		r.readers = make([]io.ReadCloser, conf.MaxPartitions+2)
+		r.openers = make([]func() (io.ReadCloser, error), conf.MaxPartitions+2)
+		r.releases = make([]func(), conf.MaxPartitions+2)
 	}
 	r.ClientResponse.WithConfig(conf)
 	return r
@@ -138,12 +177,41 @@ func NewResponseErr(conf *config.Config, req *Request, err error) (*Response, er
 func (r *Response) Reset() {
 	for i := 0; i < r.numReaders; i++ {
 		r.readers[i] = nil
+		r.openers[i] = nil
+		r.releases[i] = nil
 	}
 	r.numReaders = 0
 	r.numScanned = 0
+	r.done = nil
 	r.ClientResponse.Reset()
 }
 
+// SetDoneFunc sets a function to be called once the response has been sent,
+// or has failed to send.
+func (r *Response) SetDoneFunc(fn func()) {
+	r.done = fn
+}
+
+// Done should be called by servers once they've finished sending the
+// response. Any readers that weren't sent, because sending failed, are closed.
+// It's safe to call more than once.
+func (r *Response) Done() {
+	for ; r.numScanned < r.numReaders; r.numScanned++ {
+		if rdr := r.readers[r.numScanned]; rdr != nil {
+			internal.IgnoreError(r.conf.Verbose, rdr.Close())
+		}
+		if release := r.releases[r.numScanned]; release != nil {
+			release()
+		}
+	}
+
+	if r.done != nil {
+		fn := r.done
+		r.done = nil
+		fn()
+	}
+}
+
 // AddReader adds a reader for the server to send back over the conn
 func (r *Response) AddReader(rdr io.ReadCloser) error {
 	if r.numReaders > r.conf.MaxPartitions+1 {
@@ -154,17 +222,77 @@ func (r *Response) AddReader(rdr io.ReadCloser) error {
 	return nil
 }
 
-// ScanReader returns the next reader, or io.EOF if they've all been scanned
+// AddReaderFunc adds a reader that isn't opened until it's scanned. See
+// config.MaxResponseReaders. If release isn't nil, it's called once open has
+// been, or by Done if the reader was never scanned, so whatever open needs
+// can be held until then.
+func (r *Response) AddReaderFunc(open func() (io.ReadCloser, error), release func()) error {
+	if err := r.AddReader(nil); err != nil {
+		return err
+	}
+	r.openers[r.numReaders-1] = open
+	r.releases[r.numReaders-1] = release
+	return nil
+}
+
+// ScanReader returns the next reader, or io.EOF if they've all been scanned.
+// Readers added with AddReaderFunc are opened here, returning any error
+// opening them.
 func (r *Response) ScanReader() (io.ReadCloser, error) {
 	if r.numScanned > r.numReaders {
 		return nil, io.EOF
 	}
 
 	rdr := r.readers[r.numScanned]
+	open := r.openers[r.numScanned]
+	release := r.releases[r.numScanned]
 	r.numScanned++
+	if open != nil {
+		if release != nil {
+			defer release()
+		}
+		return open()
+	}
 	return rdr, nil
 }
 
+// WriteTo implements io.WriterTo. It streams the response's readers to w,
+// closing each one once it's been sent. If w implements io.ReaderFrom, each
+// reader is passed to it directly, otherwise the data is copied through a
+// buffer that's reused across responses.
+func (r *Response) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		rdr, err := r.ScanReader()
+		if err == io.EOF || (err == nil && rdr == nil) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+
+		n, err := r.copyReader(w, rdr)
+		total += n
+		cerr := rdr.Close()
+		if err != nil {
+			return total, err
+		}
+		if cerr != nil {
+			return total, cerr
+		}
+	}
+}
+
+func (r *Response) copyReader(w io.Writer, rdr io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(rdr)
+	}
+	if r.copyBuf == nil {
+		r.copyBuf = make([]byte, 32*1024)
+	}
+	return io.CopyBuffer(w, rdr, r.copyBuf)
+}
+
 // NumReaders returns the number of io.Readers available
 func (r *Response) NumReaders() int {
 	return r.numReaders
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"testing"
 )
@@ -18,3 +20,29 @@ func BenchmarkBatchResponseWrite(b *testing.B) {
 		}
 	}
 }
+
+// onlyReader hides any io.WriterTo implementation so the data is copied.
+type onlyReader struct {
+	io.Reader
+}
+
+func BenchmarkResponseWriteLarge(b *testing.B) {
+	conf := protocolBenchConfig()
+	resp := NewResponseConfig(conf)
+	data := bytes.Repeat([]byte("a"), 1024*1024)
+	rdr := bytes.NewReader(data)
+	w := &bytes.Buffer{}
+	w.Grow(len(data))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rdr.Reset(data)
+		w.Reset()
+		resp.Reset()
+		resp.AddReader(ioutil.NopCloser(onlyReader{rdr}))
+		if _, err := resp.WriteTo(struct{ io.Writer }{w}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
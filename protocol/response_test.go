@@ -2,6 +2,8 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/jeffrom/logd/testhelper"
@@ -25,3 +27,258 @@ func TestWriteClientResponse(t *testing.T) {
 		t.Fatalf("resulting batch response doesn't match fixture:\n\nexpected:\n\n\t%q\n\n\nactual:\n\n\t%q", fixture, actual)
 	}
 }
+
+func TestClientResponseStream(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewClientResponseConfig(conf)
+	resp.SetOffset(10)
+	resp.SetBatches(2)
+	resp.SetStream(5)
+	b := &bytes.Buffer{}
+
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	if b.String() != "OK 10 2 5\r\n" {
+		t.Fatalf("expected stream tagged response but got %q", b.Bytes())
+	}
+
+	actual := NewClientResponseConfig(conf)
+	if _, err := actual.ReadFrom(b); err != nil {
+		t.Fatalf("unexpected error reading response: %+v", err)
+	}
+	if actual.Offset() != 10 || actual.Batches() != 2 || actual.Stream() != 5 {
+		t.Fatalf("expected offset 10, 2 batches, stream 5 but got %d, %d, %d", actual.Offset(), actual.Batches(), actual.Stream())
+	}
+}
+
+func TestClientResponseHeadroom(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	tests := []struct {
+		stream   uint64
+		expected string
+	}{
+		{0, "OK 10 2 0 7 1500\r\n"},
+		{5, "OK 10 2 5 7 1500\r\n"},
+	}
+
+	for _, tt := range tests {
+		resp := NewClientBatchResponse(conf, 10, 2)
+		resp.SetStream(tt.stream)
+		resp.SetHeadroom(7, 1500)
+		b := &bytes.Buffer{}
+		if _, err := resp.WriteTo(b); err != nil {
+			t.Fatalf("unexpected error writing response: %+v", err)
+		}
+		if b.String() != tt.expected {
+			t.Fatalf("expected %q but got %q", tt.expected, b.Bytes())
+		}
+
+		actual := NewClientResponseConfig(conf)
+		if _, err := actual.ReadFrom(b); err != nil {
+			t.Fatalf("unexpected error reading response: %+v", err)
+		}
+		headroom, oldest, ok := actual.Headroom()
+		if !ok || headroom != 7 || oldest != 1500 || actual.Stream() != tt.stream {
+			t.Fatalf("expected headroom 7, oldest 1500, stream %d but got %d, %d, %d (ok: %t)", tt.stream, headroom, oldest, actual.Stream(), ok)
+		}
+	}
+
+	actual := NewClientResponseConfig(conf)
+	if _, err := actual.ReadFrom(bytes.NewBufferString("OK 10 2\r\n")); err != nil {
+		t.Fatalf("unexpected error reading response: %+v", err)
+	}
+	if _, _, ok := actual.Headroom(); ok {
+		t.Fatal("expected no headroom in a response without it")
+	}
+}
+
+func TestClientResponseEncoding(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewClientMultiResponse(conf, []byte("encoded"))
+	resp.SetEncoding([]byte(CompressGzip))
+	b := &bytes.Buffer{}
+
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	if b.String() != "MOK 7 gzip\r\nencoded\r\n" {
+		t.Fatalf("expected response with encoding but got %q", b.Bytes())
+	}
+
+	actual := NewClientResponseConfig(conf)
+	if _, err := actual.ReadFrom(b); err != nil {
+		t.Fatalf("unexpected error reading response: %+v", err)
+	}
+	if actual.Encoding() != CompressGzip || string(actual.MultiResp()) != "encoded" {
+		t.Fatalf("expected body %q encoded with %q but got %q encoded with %q", "encoded", CompressGzip, actual.MultiResp(), actual.Encoding())
+	}
+
+	actual.Reset()
+	if _, err := actual.ReadFrom(bytes.NewBufferString("MOK 5\r\nplain\r\n")); err != nil {
+		t.Fatalf("unexpected error reading response: %+v", err)
+	}
+	if actual.Encoding() != "" || string(actual.MultiResp()) != "plain" {
+		t.Fatalf("expected plain body but got %q encoded with %q", actual.MultiResp(), actual.Encoding())
+	}
+}
+
+func TestClientResponseErrorMessage(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewClientErrResponse(conf, NewRespError(ErrNotFound, "offset %d\r\nexpired", 500))
+	b := &bytes.Buffer{}
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	if b.String() != "ERR not found: offset 500  expired\r\n" {
+		t.Fatalf("unexpected error response: %q", b.Bytes())
+	}
+
+	actual := NewClientResponseConfig(conf)
+	if _, err := actual.ReadFrom(b); err != nil {
+		t.Fatalf("unexpected error reading response: %+v", err)
+	}
+	rerr, ok := actual.Error().(*RespError)
+	if !ok {
+		t.Fatalf("expected *RespError but got %#v", actual.Error())
+	}
+	if rerr.Err != ErrNotFound || rerr.Message != "offset 500  expired" {
+		t.Fatalf("expected %v with message but got %+v", ErrNotFound, rerr)
+	}
+
+	// unknown reasons don't send their message
+	resp = NewClientErrResponse(conf, NewRespError(errors.New("disk on fire"), "secret"))
+	b.Reset()
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	if b.String() != "ERR\r\n" {
+		t.Fatalf("unexpected error response: %q", b.Bytes())
+	}
+}
+
+type closeCounter struct {
+	*bytes.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestResponseWriteTo(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewResponseConfig(conf)
+	rdrs := []*closeCounter{
+		{Reader: bytes.NewReader([]byte("OK 0 1\r\n"))},
+		{Reader: bytes.NewReader([]byte("BATCH 0 default 0 0\r\n"))},
+	}
+	for _, rdr := range rdrs {
+		resp.AddReader(rdr)
+	}
+
+	b := &bytes.Buffer{}
+	n, err := resp.WriteTo(b)
+	if err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	expected := "OK 0 1\r\nBATCH 0 default 0 0\r\n"
+	if b.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, b.String())
+	}
+	if int(n) != len(expected) {
+		t.Fatalf("expected to write %d bytes but wrote %d", len(expected), n)
+	}
+	for i, rdr := range rdrs {
+		if rdr.closed != 1 {
+			t.Fatalf("expected reader %d to be closed once but was closed %d times", i, rdr.closed)
+		}
+	}
+}
+
+func TestResponseReaderFunc(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewResponseConfig(conf)
+	resp.AddReader(&closeCounter{Reader: bytes.NewReader([]byte("OK 0 1\r\n"))})
+	opened := 0
+	resp.AddReaderFunc(func() (io.ReadCloser, error) {
+		opened++
+		return &closeCounter{Reader: bytes.NewReader([]byte("BATCH 0 default 0 0\r\n"))}, nil
+	}, nil)
+	if opened != 0 {
+		t.Fatal("expected the reader not to be opened until it's scanned")
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := resp.WriteTo(b); err != nil {
+		t.Fatalf("unexpected error writing response: %+v", err)
+	}
+	if expected := "OK 0 1\r\nBATCH 0 default 0 0\r\n"; b.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, b.String())
+	}
+	if opened != 1 {
+		t.Fatalf("expected the reader to be opened once but was opened %d times", opened)
+	}
+
+	// errors opening a reader are returned, as the response can't be finished
+	errOpen := errors.New("partition removed")
+	resp.Reset()
+	resp.AddReader(&closeCounter{Reader: bytes.NewReader([]byte("OK 0 1\r\n"))})
+	resp.AddReaderFunc(func() (io.ReadCloser, error) {
+		return nil, errOpen
+	}, nil)
+	if _, err := resp.WriteTo(&bytes.Buffer{}); err != errOpen {
+		t.Fatalf("expected %v but got %+v", errOpen, err)
+	}
+}
+
+func TestResponseDoneReleasesUnsent(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	resp := NewResponseConfig(conf)
+	env := &closeCounter{Reader: bytes.NewReader([]byte("OK 0 2\r\n"))}
+	unsent := &closeCounter{Reader: bytes.NewReader([]byte("BATCH 0 default 0 0\r\n"))}
+	resp.AddReader(env)
+	resp.AddReader(unsent)
+	opened, released := 0, 0
+	resp.AddReaderFunc(func() (io.ReadCloser, error) {
+		opened++
+		return nil, errors.New("shouldn't be opened")
+	}, func() { released++ })
+
+	// as if sending failed after the envelope
+	rdr, err := resp.ScanReader()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	rdr.Close()
+
+	resp.Done()
+	resp.Done()
+	if env.closed != 1 {
+		t.Fatalf("expected the sent reader to be closed once but was closed %d times", env.closed)
+	}
+	if unsent.closed != 1 {
+		t.Fatalf("expected the unsent reader to be closed once but was closed %d times", unsent.closed)
+	}
+	if opened != 0 || released != 1 {
+		t.Fatalf("expected the unsent opener to be released once without opening, but was opened %d and released %d times", opened, released)
+	}
+
+	// once it's opened, it's released right away, and Done has nothing left
+	resp.Reset()
+	released = 0
+	resp.AddReaderFunc(func() (io.ReadCloser, error) {
+		return &closeCounter{Reader: bytes.NewReader([]byte("OK\r\n"))}, nil
+	}, func() { released++ })
+	if _, err := resp.WriteTo(&bytes.Buffer{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if released != 1 {
+		t.Fatalf("expected to be released once after opening but was released %d times", released)
+	}
+	resp.Done()
+	if released != 1 {
+		t.Fatalf("expected Done not to release again but was released %d times", released)
+	}
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"io"
+	"math"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// Restore represents a RESTORE request, which writes a batch at the offset it
+// was read from, such as when restoring a backup. The batch keeps the
+// timestamp it was logged with, so it takes up the same space in the log. The
+// offset must be the head of the topic, unless the topic is empty, in which
+// case the log starts at the offset. The timestamp is 0 for batches logged
+// before timestamps were stored.
+// RESTORE <size> <topic> <checksum> <messages> <timestamp> <offset>\r\n<data>
+type Restore struct {
+	conf     *config.Config
+	Batch    *Batch
+	Offset   uint64
+	digitbuf [32]byte
+}
+
+// NewRestore returns a new instance of a RESTORE request
+func NewRestore(conf *config.Config) *Restore {
+	return &Restore{
+		conf:  conf,
+		Batch: NewBatch(conf),
+	}
+}
+
+// Reset puts RESTORE in an initial state so it can be reused
+func (r *Restore) Reset() {
+	r.Batch.Reset()
+	r.Offset = 0
+}
+
+// FromRequest parses a request, populating the Restore struct. If validation
+// fails, an error is returned.
+func (r *Restore) FromRequest(req *Request) (*Restore, error) {
+	if req.nargs != argLens[CmdRestore] {
+		return r, errInvalidNumArgs
+	}
+
+	ts, err := asciiToUint(req.args[4])
+	if err != nil {
+		return r, err
+	}
+	if ts > math.MaxInt64 {
+		return r, ErrInvalid
+	}
+	off, err := asciiToUint(req.args[5])
+	if err != nil {
+		return r, err
+	}
+	r.Offset = off
+
+	if _, err := r.Batch.fromRequest(req); err != nil {
+		return r, err
+	}
+	r.Batch.Timestamp = int64(ts)
+	return r, nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *Restore) WriteTo(w io.Writer) (int64, error) {
+	b := r.Batch
+	if !b.wasRead && !b.fromReq {
+		if err := b.buildBodyBytes(); err != nil {
+			return 0, err
+		}
+
+		b.SetChecksum()
+	}
+
+	var total int64
+	n, err := w.Write(brestoreStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	l := uintToASCII(uint64(b.Size), &r.digitbuf)
+	n, err = w.Write(r.digitbuf[l:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(b.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, arg := range [...]uint64{uint64(b.Checksum), uint64(b.Messages), uint64(b.Timestamp), r.Offset} {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		l = uintToASCII(arg, &r.digitbuf)
+		n, err = w.Write(r.digitbuf[l:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(b.MessageBytes())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+// restoreFixture turns a BATCH fixture into a RESTORE request with the given
+// timestamp and offset arguments.
+func restoreFixture(batch []byte, args string) []byte {
+	i := bytes.Index(batch, bnewLine)
+	fixture := []byte("RESTORE")
+	fixture = append(fixture, batch[len("BATCH"):i]...)
+	fixture = append(fixture, args...)
+	return append(fixture, batch[i:]...)
+}
+
+func TestRestoreRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	fixture := restoreFixture(testhelper.LoadFixture("batch.small"), " 1700000000000000000 1024")
+
+	req := NewRequestConfig(conf)
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewReader(fixture))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if req.Name != CmdRestore || req.Topic() != "default" {
+		t.Fatalf("expected RESTORE for topic default but got %s for %q", &req.Name, req.Topic())
+	}
+
+	restore, err := NewRestore(conf).FromRequest(req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if restore.Offset != 1024 {
+		t.Fatalf("expected offset 1024 but got %d", restore.Offset)
+	}
+	if restore.Batch.Timestamp != 1700000000000000000 {
+		t.Fatalf("expected timestamp 1700000000000000000 but got %d", restore.Batch.Timestamp)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := restore.WriteTo(b); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(b.Bytes(), fixture) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, b.Bytes())
+	}
+
+	restore.Reset()
+	if restore.Offset != 0 || restore.Batch.Timestamp != 0 {
+		t.Fatal("expected reset to clear the offset and timestamp")
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	batch := testhelper.LoadFixture("batch.small")
+	invalid := map[string][]byte{
+		"no offset":         restoreFixture(batch, " 1700000000000000000"),
+		"bad offset":        restoreFixture(batch, " 1700000000000000000 abc"),
+		"bad timestamp":     restoreFixture(batch, " abc 1024"),
+		"timestamp too big": restoreFixture(batch, " 9223372036854775808 1024"),
+		"bad checksum":      restoreFixture(bytes.Replace(batch, []byte("hi"), []byte("ho"), 1), " 1700000000000000000 1024"),
+	}
+
+	for name, b := range invalid {
+		t.Run(name, func(t *testing.T) {
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, rerr := NewRestore(conf).FromRequest(req)
+			if err == nil && rerr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
@@ -1,11 +1,20 @@
 package protocol
 
-import "github.com/jeffrom/logd/config"
+import (
+	"bytes"
+	"io"
 
-// StatsRequest is an incoming STATS command
+	"github.com/jeffrom/logd/config"
+)
+
+// StatsRequest is an incoming STATS command. If an encoding is given, the
+// response body is encoded with it. CompressGzip is the only supported
+// encoding.
 // STATS\r\n
+// STATS <encoding>\r\n
 type StatsRequest struct {
-	conf *config.Config
+	conf     *config.Config
+	encoding []byte
 }
 
 // NewStatsRequest returns a new instance of StatsRequest
@@ -17,13 +26,66 @@ func NewStatsRequest(conf *config.Config) *StatsRequest {
 
 // Reset sets the StatsRequest to its initial values
 func (r *StatsRequest) Reset() {
+	r.encoding = r.encoding[:0]
+}
 
+// SetEncoding sets the encoding of the STATS response body.
+func (r *StatsRequest) SetEncoding(encoding []byte) {
+	r.encoding = append(r.encoding[:0], encoding...)
 }
 
-// FromRequest parses a request, populating the ReadRequest
+// Encoding returns the requested encoding, or an empty slice if the response
+// body shouldn't be encoded.
+func (r *StatsRequest) Encoding() []byte {
+	return r.encoding
+}
+
+// FromRequest parses a request, populating the StatsRequest
 func (r *StatsRequest) FromRequest(req *Request) (*StatsRequest, error) {
-	if req.nargs > 0 {
+	if req.nargs > optionalArgLens[CmdStats] {
 		return r, errInvalidNumArgs
 	}
-	return r, nil
+	if req.nargs > 0 {
+		r.SetEncoding(req.args[0])
+	}
+	return r, r.Validate()
+}
+
+// Validate checks the STATS arguments are valid
+func (r *StatsRequest) Validate() error {
+	if len(r.encoding) > 0 && !bytes.Equal(r.encoding, bcompressGzip) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *StatsRequest) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bstats)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	if len(r.encoding) > 0 {
+		n, err = w.Write(bspace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = w.Write(r.encoding)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+	return total, nil
 }
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestStatsRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	statsreq := NewStatsRequest(conf)
+
+	for fixture, encoding := range map[string]string{
+		"STATS\r\n":      "",
+		"STATS gzip\r\n": CompressGzip,
+	} {
+		req := NewRequestConfig(conf)
+		if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBufferString(fixture))); err != nil {
+			t.Fatal(err)
+		}
+		statsreq.Reset()
+		if _, err := statsreq.FromRequest(req); err != nil {
+			t.Fatal(err)
+		}
+		if string(statsreq.Encoding()) != encoding {
+			t.Fatalf("expected encoding %q but got %q", encoding, statsreq.Encoding())
+		}
+
+		buf := &bytes.Buffer{}
+		if _, err := statsreq.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != fixture {
+			t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+		}
+	}
+
+	req := NewRequestConfig(conf)
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBufferString("STATS snappy\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	statsreq.Reset()
+	if _, err := statsreq.FromRequest(req); err != ErrInvalid {
+		t.Fatalf("expected %v but got %v", ErrInvalid, err)
+	}
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// Sync represents a SYNC request, which responds once the batch at offset has
+// been synced to disk, syncing the topic's log if it hasn't been already.
+// SYNC <topic> <offset>\r\n
+type Sync struct {
+	conf     *config.Config
+	Offset   uint64
+	topic    []byte
+	ntopic   int
+	digitbuf [32]byte
+}
+
+// NewSync returns a new instance of a SYNC request
+func NewSync(conf *config.Config) *Sync {
+	return &Sync{
+		conf:  conf,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts SYNC in an initial state so it can be reused
+func (s *Sync) Reset() {
+	s.Offset = 0
+	s.ntopic = 0
+}
+
+// SetTopic sets the topic of the SYNC request
+func (s *Sync) SetTopic(topic []byte) {
+	s.ntopic = copy(s.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (s *Sync) Topic() string {
+	return string(s.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (s *Sync) TopicSlice() []byte {
+	return s.topic[:s.ntopic]
+}
+
+// FromRequest parses a request, populating the Sync struct. If validation
+// fails, an error is returned.
+func (s *Sync) FromRequest(req *Request) (*Sync, error) {
+	if req.nargs != argLens[CmdSync] {
+		return s, errInvalidNumArgs
+	}
+
+	s.SetTopic(req.args[0])
+
+	n, err := asciiToUint(req.args[1])
+	if err != nil {
+		return s, err
+	}
+	s.Offset = n
+
+	return s, s.Validate()
+}
+
+// Validate checks the SYNC arguments are valid
+func (s *Sync) Validate() error {
+	if s.ntopic < 1 {
+		return errNoTopic
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (s *Sync) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bsyncStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(s.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	l := uintToASCII(s.Offset, &s.digitbuf)
+	n, err = w.Write(s.digitbuf[l:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestSyncRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	syncreq := NewSync(conf)
+	fixture := []byte("SYNC default 1234\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := syncreq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if syncreq.Topic() != "default" || syncreq.Offset != 1234 {
+		t.Fatalf("expected topic %q and offset %d but got %q and %d", "default", 1234, syncreq.Topic(), syncreq.Offset)
+	}
+
+	if _, err := syncreq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "github.com/jeffrom/logd/config"
+
+// TailOffset represents a TAILOFFSET request, which returns the offset of the
+// oldest batch still available in a topic. Batches before it have been removed
+// by retention.
+// TAILOFFSET <topic>\r\n
+type TailOffset struct {
+	topicRequest
+}
+
+// NewTailOffset returns a new instance of a TAILOFFSET request
+func NewTailOffset(conf *config.Config) *TailOffset {
+	return &TailOffset{newTopicRequest(conf, btailOffsetStart)}
+}
+
+// FromRequest parses a request, populating the TailOffset struct. If validation
+// fails, an error is returned.
+func (t *TailOffset) FromRequest(req *Request) (*TailOffset, error) {
+	return t, t.parse(req)
+}
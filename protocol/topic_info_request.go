@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// TopicInfo represents a TOPICINFO request, which returns a topic's settings.
+// The response body is a TopicInfoResponse.
+// TOPICINFO <topic>\r\n
+type TopicInfo struct {
+	topicRequest
+}
+
+// NewTopicInfo returns a new instance of a TOPICINFO request
+func NewTopicInfo(conf *config.Config) *TopicInfo {
+	return &TopicInfo{newTopicRequest(conf, btopicInfoStart)}
+}
+
+// FromRequest parses a request, populating the TopicInfo struct. If
+// validation fails, an error is returned.
+func (r *TopicInfo) FromRequest(req *Request) (*TopicInfo, error) {
+	return r, r.parse(req)
+}
+
+// maxPartSize is the largest partition size that can be set, as partition
+// sizes are stored as ints.
+const maxPartSize = 1<<31 - 1
+
+// SetPartSize represents a SETPARTSIZE request, which sets the size in bytes
+// a topic's partitions are rotated at, creating the topic if it doesn't
+// exist. Only partitions created afterwards use the new size.
+// SETPARTSIZE <topic> <size>\r\n
+type SetPartSize struct {
+	conf     *config.Config
+	Size     int
+	topic    []byte
+	ntopic   int
+	digitbuf [32]byte
+}
+
+// NewSetPartSize returns a new instance of a SETPARTSIZE request
+func NewSetPartSize(conf *config.Config) *SetPartSize {
+	return &SetPartSize{
+		conf:  conf,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts SETPARTSIZE in an initial state so it can be reused
+func (r *SetPartSize) Reset() {
+	r.Size = 0
+	r.ntopic = 0
+}
+
+// SetTopic sets the topic of the SETPARTSIZE request
+func (r *SetPartSize) SetTopic(topic []byte) {
+	r.ntopic = copy(r.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (r *SetPartSize) Topic() string {
+	return string(r.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (r *SetPartSize) TopicSlice() []byte {
+	return r.topic[:r.ntopic]
+}
+
+// FromRequest parses a request, populating the SetPartSize struct. If
+// validation fails, an error is returned.
+func (r *SetPartSize) FromRequest(req *Request) (*SetPartSize, error) {
+	if req.nargs != argLens[CmdSetPartSize] {
+		return r, errInvalidNumArgs
+	}
+
+	r.SetTopic(req.args[0])
+	n, err := asciiToUint(req.args[1])
+	if err != nil {
+		return r, err
+	}
+	if n > maxPartSize {
+		return r, ErrInvalid
+	}
+	r.Size = int(n)
+	return r, r.Validate()
+}
+
+// Validate checks the SETPARTSIZE arguments are valid
+func (r *SetPartSize) Validate() error {
+	if r.ntopic < 1 {
+		return errNoTopic
+	}
+	if r.Size < 1 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *SetPartSize) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	n, err := w.Write(bsetPartSizeStart)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bspace)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	l := uintToASCII(uint64(r.Size), &r.digitbuf)
+	n, err = w.Write(r.digitbuf[l:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/jeffrom/logd/testhelper"
+)
+
+func TestSetPartSizeRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	req := NewRequestConfig(conf)
+	setreq := NewSetPartSize(conf)
+	fixture := []byte("SETPARTSIZE default 4096\r\n")
+	buf := &bytes.Buffer{}
+
+	if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+		t.Fatal(err)
+	}
+	if req.Topic() != "default" {
+		t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+	}
+	if _, err := setreq.FromRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if setreq.Topic() != "default" || setreq.Size != 4096 {
+		t.Fatalf("expected topic %q and size %d but got %q and %d", "default", 4096, setreq.Topic(), setreq.Size)
+	}
+
+	if _, err := setreq.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, buf.Bytes()) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+	}
+}
+
+func TestSetPartSizeInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	invalid := map[string][]byte{
+		"no size":   []byte("SETPARTSIZE default\r\n"),
+		"zero size": []byte("SETPARTSIZE default 0\r\n"),
+		"not a num": []byte("SETPARTSIZE default big\r\n"),
+		"too big":   []byte("SETPARTSIZE default 4294967296\r\n"),
+	}
+
+	for name, b := range invalid {
+		t.Run(name, func(t *testing.T) {
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, serr := NewSetPartSize(conf).FromRequest(req)
+			if err == nil && serr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
+
+func TestTopicInfoResponse(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	tr := NewTopicInfoResponse(conf)
+	tr.Format = "json"
+	tr.PartitionSize = 4096
+
+	expected := []byte("format json\r\npartition-size 4096\r\n")
+	b := tr.MultiResponse()
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", expected, b)
+	}
+
+	other := NewTopicInfoResponse(conf)
+	if err := other.Parse(append([]byte("retention 1h\r\n"), b...)); err != nil {
+		t.Fatal(err)
+	}
+	if other.Format != "json" || other.PartitionSize != 4096 {
+		t.Fatalf("expected format %q and partition size %d but got %q and %d", "json", 4096, other.Format, other.PartitionSize)
+	}
+
+	tr.Format = ""
+	expected = []byte("partition-size 4096\r\n")
+	if b := tr.MultiResponse(); !bytes.Equal(b, expected) {
+		t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", expected, b)
+	}
+}
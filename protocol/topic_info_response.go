@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/jeffrom/logd/config"
+)
+
+var bformatKey = []byte("format")
+var bpartSizeKey = []byte("partition-size")
+
+// TopicInfoResponse is a topic's settings, which is intended as a client
+// multi ok response. Each setting is written on its own line, and the format
+// is omitted if it hasn't been set:
+// format <format>\r\n
+// partition-size <size>\r\n
+// Unknown settings are ignored when parsing.
+type TopicInfoResponse struct {
+	conf          *config.Config
+	Format        string
+	PartitionSize int
+	b             *bytes.Buffer
+}
+
+// NewTopicInfoResponse returns a new instance of TopicInfoResponse
+func NewTopicInfoResponse(conf *config.Config) *TopicInfoResponse {
+	return &TopicInfoResponse{
+		conf: conf,
+		b:    &bytes.Buffer{},
+	}
+}
+
+// Reset sets the TopicInfoResponse to its initial values
+func (tr *TopicInfoResponse) Reset() {
+	tr.Format = ""
+	tr.PartitionSize = 0
+	tr.b.Reset()
+}
+
+// MultiResponse returns a server-side MOK response body
+func (tr *TopicInfoResponse) MultiResponse() []byte {
+	tr.b.Reset()
+	if _, err := tr.WriteTo(tr.b); err != nil {
+		tr.b.Reset()
+		return nil
+	}
+	return tr.b.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface.
+func (tr *TopicInfoResponse) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	if tr.Format != "" {
+		buf = append(buf, bformatKey...)
+		buf = append(buf, bspace...)
+		buf = append(buf, tr.Format...)
+		buf = append(buf, bnewLine...)
+	}
+	buf = append(buf, bpartSizeKey...)
+	buf = append(buf, bspace...)
+	buf = strconv.AppendInt(buf, int64(tr.PartitionSize), 10)
+	buf = append(buf, bnewLine...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// Parse reads the topic's settings from a byte slice
+func (tr *TopicInfoResponse) Parse(b []byte) error {
+	tr.Reset()
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		_, line, _, err := readLineFromBuf(r)
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := bytes.SplitN(line, bspace, 2)
+		if len(fields) != 2 {
+			return errInvalidProtocolLine
+		}
+		switch {
+		case bytes.Equal(fields[0], bformatKey):
+			tr.Format = string(fields[1])
+		case bytes.Equal(fields[0], bpartSizeKey):
+			n, err := asciiToUint(fields[1])
+			if err != nil {
+				return err
+			}
+			tr.PartitionSize = int(n)
+		}
+	}
+}
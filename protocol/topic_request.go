@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/jeffrom/logd/config"
+)
+
+// topicRequest is a request whose only argument is a topic. HEAD, TAILOFFSET,
+// FORMAT, TOPICINFO, PAUSE, and RESUME requests embed it.
+// <COMMAND> <topic>\r\n
+type topicRequest struct {
+	conf   *config.Config
+	start  []byte
+	topic  []byte
+	ntopic int
+}
+
+func newTopicRequest(conf *config.Config, start []byte) topicRequest {
+	return topicRequest{
+		conf:  conf,
+		start: start,
+		topic: make([]byte, MaxTopicSize),
+	}
+}
+
+// Reset puts the request in an initial state so it can be reused
+func (r *topicRequest) Reset() {
+	r.ntopic = 0
+}
+
+// SetTopic sets the topic of the request
+func (r *topicRequest) SetTopic(topic []byte) {
+	r.ntopic = copy(r.topic, topic)
+}
+
+// Topic returns the topic as a string
+func (r *topicRequest) Topic() string {
+	return string(r.TopicSlice())
+}
+
+// TopicSlice returns the topic as a byte slice reference. It is not copied.
+func (r *topicRequest) TopicSlice() []byte {
+	return r.topic[:r.ntopic]
+}
+
+// parse populates the request from req, returning an error if validation
+// fails.
+func (r *topicRequest) parse(req *Request) error {
+	if req.nargs != 1 {
+		return errInvalidNumArgs
+	}
+
+	r.SetTopic(req.args[0])
+	return r.Validate()
+}
+
+// Validate checks the request has a topic
+func (r *topicRequest) Validate() error {
+	if r.ntopic < 1 {
+		return errNoTopic
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo
+func (r *topicRequest) WriteTo(w io.Writer) (int64, error) {
+	return r.writeTo(w, r.start)
+}
+
+func (r *topicRequest) writeTo(w io.Writer, start []byte) (int64, error) {
+	var total int64
+	n, err := w.Write(start)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(r.TopicSlice())
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(bnewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
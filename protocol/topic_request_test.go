@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/testhelper"
+)
+
+type topicRequester interface {
+	Topic() string
+	WriteTo(w io.Writer) (int64, error)
+}
+
+var topicRequests = map[string]func(conf *config.Config, req *Request) (topicRequester, error){
+	"HEAD": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewHead(conf).FromRequest(req)
+	},
+	"TAILOFFSET": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewTailOffset(conf).FromRequest(req)
+	},
+	"FORMAT": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewFormat(conf).FromRequest(req)
+	},
+	"TOPICINFO": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewTopicInfo(conf).FromRequest(req)
+	},
+	"PAUSE": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewPause(conf).FromRequest(req)
+	},
+	"RESUME": func(conf *config.Config, req *Request) (topicRequester, error) {
+		return NewPause(conf).FromRequest(req)
+	},
+}
+
+func TestTopicRequest(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+
+	for name, fromRequest := range topicRequests {
+		t.Run(name, func(t *testing.T) {
+			fixture := []byte(name + " default\r\n")
+			req := NewRequestConfig(conf)
+			buf := &bytes.Buffer{}
+
+			if _, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(fixture))); err != nil {
+				t.Fatal(err)
+			}
+			if req.Topic() != "default" {
+				t.Fatalf("expected topic %q but got %q", "default", req.Topic())
+			}
+			r, err := fromRequest(conf, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Topic() != "default" {
+				t.Fatalf("expected topic %q but got %q", "default", r.Topic())
+			}
+			if p, ok := r.(*Pause); ok && p.Resume != (name == "RESUME") {
+				t.Fatalf("expected resume %t but got %t", name == "RESUME", p.Resume)
+			}
+
+			if _, err := r.WriteTo(buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fixture, buf.Bytes()) {
+				t.Fatalf("expected:\n\n\t%q\n\nbut got:\n\n\t%q", fixture, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestTopicRequestInvalid(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+
+	for name, fromRequest := range topicRequests {
+		t.Run(name, func(t *testing.T) {
+			b := []byte(name + "\r\n")
+			req := NewRequestConfig(conf)
+			_, err := req.ReadFrom(bufio.NewReader(bytes.NewBuffer(b)))
+			_, rerr := fromRequest(conf, req)
+			if err == nil && rerr == nil {
+				t.Fatalf("%s: request should not have been valid\n%q\n", name, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import "time"
+
+// acceptLimiter is a token bucket that limits how quickly a Socket accepts new
+// connections.
+type acceptLimiter struct {
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newAcceptLimiter returns a limiter allowing rate connections per second,
+// with bursts of up to burst connections. It returns nil if rate isn't
+// positive, which disables limiting.
+func newAcceptLimiter(rate float64, burst int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &acceptLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// reserve takes a token for the next connection, returning how long to wait
+// before accepting it.
+func (l *acceptLimiter) reserve() time.Duration {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
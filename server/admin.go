@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/stats"
+	"github.com/jeffrom/logd/transport"
+)
+
+// Admin is an http server for operating logd. It serves health checks, stats,
+// reads for dashboards, and, if config.AdminProfiling is set, profiling. It
+// listens on config.AdminHost, apart from the servers handling log requests,
+// so it can be firewalled separately. It implements transport.Server so it's
+// started and stopped with them.
+type Admin struct {
+	conf  *config.Config
+	ln    net.Listener
+	mux   *http.ServeMux
+	srv   *http.Server
+	readh *readHandler
+}
+
+// NewAdmin returns a new instance of *Admin.
+func NewAdmin(conf *config.Config) *Admin {
+	mux := http.NewServeMux()
+	s := &Admin{
+		conf: conf,
+		mux:  mux,
+		srv: &http.Server{
+			Handler: mux,
+		},
+	}
+	s.setupHandlers()
+	return s
+}
+
+// GoServe implements transport.Server interface. The server is listening when
+// it returns.
+func (s *Admin) GoServe() {
+	listener, err := net.Listen("tcp", s.conf.AdminHost)
+	if err != nil {
+		panic(err)
+	}
+	s.ln = listener
+	log.Printf("Serving admin at %s", s.ln.Addr())
+
+	go func() {
+		if err := s.srv.Serve(s.ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server error: %+v", err)
+		}
+	}()
+}
+
+func (s *Admin) setupHandlers() {
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.Handle("/debug/vars", expvar.Handler())
+	s.readh = &readHandler{conf: s.conf, auth: newAuthenticator(s.conf)}
+	s.mux.Handle("/read", s.readh)
+
+	if !s.conf.AdminProfiling {
+		return
+	}
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// handleHealth responds OK as long as the server is running, for load
+// balancers and process supervisors.
+func (s *Admin) handleHealth(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("OK\n"))
+}
+
+// handleMetrics responds with the same stats as the STATS command, one
+// "key: value" per line.
+func (s *Admin) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(stats.MultiOK())
+}
+
+// Stop implements transport.Server interface.
+func (s *Admin) Stop() error {
+	if s.ln != nil {
+		log.Printf("Shutting down admin server at %s", s.ln.Addr())
+	}
+	return s.srv.Shutdown(context.Background())
+}
+
+// ListenAddr implements transport.Server interface.
+func (s *Admin) ListenAddr() net.Addr {
+	return s.ln.Addr()
+}
+
+// SetHandler implements transport.Server interface. The handler serves the
+// reads made at /read.
+func (s *Admin) SetHandler(h transport.RequestHandler) {
+	s.readh.h = h
+}
+
+// SetAuthenticator sets the Authenticator used to check the bearer token of
+// reads made at /read. If it is nil, authentication is disabled.
+func (s *Admin) SetAuthenticator(auth Authenticator) {
+	s.readh.auth = auth
+}
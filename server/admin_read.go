@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/transport"
+)
+
+// readPollInterval is how long a followed read waits before asking for more
+// messages once it's caught up with the head.
+var readPollInterval = 200 * time.Millisecond
+
+// defaultReadLimit is the number of messages read when the limit isn't set.
+const defaultReadLimit = 100
+
+// readHandler serves a topic's messages over http, for consumers that don't
+// speak the protocol, like dashboards in a browser.
+//
+// GET /read?topic=<topic>&offset=<offset>&limit=<messages> responds with up to
+// limit messages as newline-delimited JSON. Without an offset, reading starts
+// from the tail, like TAIL. If the request accepts text/event-stream, the
+// topic is followed instead, sending each message as a server-sent event
+// until the client goes away, and limit is the number of messages asked for
+// at a time.
+//
+// Reads are pushed to the same handler as the socket's, as the principal of
+// the request's bearer token, so the usual limits and ACLs apply.
+type readHandler struct {
+	conf *config.Config
+	h    transport.RequestHandler
+	auth Authenticator
+}
+
+// readMessage is the JSON representation of a message. Offset is the offset
+// of the message's batch, and delta its position in the batch. Bodies that
+// aren't valid UTF-8 have the invalid bytes replaced.
+type readMessage struct {
+	Offset    uint64    `json:"offset"`
+	Delta     uint64    `json:"delta"`
+	Timestamp time.Time `json:"timestamp"`
+	Body      string    `json:"body"`
+}
+
+func (h *readHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	principal, err := bearerPrincipal(h.auth, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := transport.WithPrincipal(req.Context(), principal)
+
+	query := req.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		topic = "default"
+	}
+	limit := defaultReadLimit
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	var off uint64
+	tail := true
+	if s := query.Get("offset"); s != "" {
+		off, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "offset must be a number", http.StatusBadRequest)
+			return
+		}
+		tail = false
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		h.follow(ctx, w, topic, off, tail, limit)
+		return
+	}
+
+	msgs, _, err := h.read(ctx, topic, off, tail, limit)
+	if err != nil {
+		http.Error(w, err.Error(), readErrorStatus(err))
+		return
+	}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+	}
+}
+
+// follow sends messages as server-sent events, starting from off, or the tail
+// if tail is set, and asking for more until ctx is done. Errors after the
+// response has started are sent as error events, ending the stream.
+func (h *readHandler) follow(ctx context.Context, w http.ResponseWriter, topic string, off uint64, tail bool, limit int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		msgs, next, err := h.read(ctx, topic, off, tail, limit)
+		if errors.Cause(err) == protocol.ErrNotFound {
+			// caught up, or the topic hasn't been written to yet
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(readPollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.Replace(err.Error(), "\n", " ", -1))
+				flusher.Flush()
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			b, err := json.Marshal(msg)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d:%d\ndata: %s\n\n", msg.Offset, msg.Delta, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		off, tail = next, false
+	}
+}
+
+// read pushes a READ, or a TAIL if tail is set, for at least limit messages,
+// returning every message in the response and the offset following it.
+func (h *readHandler) read(ctx context.Context, topic string, off uint64, tail bool, limit int) ([]readMessage, uint64, error) {
+	b := &bytes.Buffer{}
+	var err error
+	if tail {
+		r := protocol.NewTail(h.conf)
+		r.SetTopic([]byte(topic))
+		r.Messages = limit
+		_, err = r.WriteTo(b)
+	} else {
+		r := protocol.NewRead(h.conf)
+		r.SetTopic([]byte(topic))
+		r.Offset = off
+		r.Messages = limit
+		_, err = r.WriteTo(b)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	logdreq := protocol.NewRequestConfig(h.conf)
+	if _, err := logdreq.ReadFrom(bufio.NewReader(b)); err != nil {
+		return nil, 0, err
+	}
+	resp, err := h.h.PushRequest(ctx, logdreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.Reset()
+	_, err = resp.WriteTo(b)
+	resp.Done()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	br := bufio.NewReader(b)
+	cr := protocol.NewClientResponseConfig(h.conf)
+	if _, err := cr.ReadFrom(br); err != nil {
+		return nil, 0, err
+	}
+	if err := cr.Error(); err != nil {
+		return nil, 0, err
+	}
+
+	var msgs []readMessage
+	bs := protocol.NewBatchScanner(h.conf, br)
+	bs.SetOffset(cr.Offset())
+	for bs.Scan() {
+		batch := bs.Batch()
+		mr := bufio.NewReader(bytes.NewReader(batch.MessageBytes()))
+		var delta uint64
+		for i := 0; i < batch.Messages; i++ {
+			msg := protocol.NewMessage(h.conf)
+			n, err := msg.ReadFrom(mr)
+			if err != nil {
+				return nil, 0, err
+			}
+			msgs = append(msgs, readMessage{
+				Offset:    bs.Offset(),
+				Delta:     delta,
+				Timestamp: time.Unix(0, batch.Timestamp).UTC(),
+				Body:      string(msg.BodyBytes()),
+			})
+			delta += uint64(n)
+		}
+	}
+	if err := bs.Error(); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return msgs, cr.Offset() + uint64(bs.Scanned()), nil
+}
+
+// readErrorStatus returns the http status for a failed read.
+func readErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case protocol.ErrUnauthorized:
+		return http.StatusUnauthorized
+	case protocol.ErrPermissionDenied:
+		return http.StatusForbidden
+	}
+	switch protocol.ErrorCategory(err) {
+	case protocol.CategoryNotFound:
+		return http.StatusNotFound
+	case protocol.CategoryClient:
+		return http.StatusBadRequest
+	case protocol.CategoryLimit:
+		return http.StatusTooManyRequests
+	case protocol.CategoryTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
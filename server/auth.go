@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/subtle"
+
+	"github.com/jeffrom/logd/config"
+	"github.com/jeffrom/logd/protocol"
+)
+
+// Authenticator validates the token sent in an AUTH request, returning the
+// principal the connection is acting as.
+type Authenticator interface {
+	Authenticate(token []byte) (string, error)
+}
+
+// DefaultPrincipal is the principal connections authenticated with the shared
+// secret act as.
+const DefaultPrincipal = "default"
+
+// AdminPrincipal is the principal allowed to use admin commands, such as
+// CONNS and KILLCONN.
+const AdminPrincipal = "admin"
+
+// StaticAuthenticator implements Authenticator, checking tokens against a
+// shared secret.
+type StaticAuthenticator struct {
+	secret      []byte
+	adminSecret []byte
+}
+
+// NewStaticAuthenticator returns a new instance of *StaticAuthenticator.
+func NewStaticAuthenticator(secret string) *StaticAuthenticator {
+	return &StaticAuthenticator{
+		secret: []byte(secret),
+	}
+}
+
+// SetAdminSecret sets the secret connections authenticate with to act as
+// AdminPrincipal. If it's empty, no connection can authenticate as
+// AdminPrincipal.
+func (a *StaticAuthenticator) SetAdminSecret(secret string) {
+	a.adminSecret = []byte(secret)
+}
+
+// Authenticate implements Authenticator.
+func (a *StaticAuthenticator) Authenticate(token []byte) (string, error) {
+	if len(a.adminSecret) > 0 && subtle.ConstantTimeCompare(token, a.adminSecret) == 1 {
+		return AdminPrincipal, nil
+	}
+	if subtle.ConstantTimeCompare(token, a.secret) != 1 {
+		return "", protocol.ErrUnauthorized
+	}
+	return DefaultPrincipal, nil
+}
+
+// newAuthenticator returns the configured Authenticator, or nil if
+// authentication is disabled.
+func newAuthenticator(conf *config.Config) Authenticator {
+	if conf.AuthSecret == "" {
+		return nil
+	}
+	auth := NewStaticAuthenticator(conf.AuthSecret)
+	auth.SetAdminSecret(conf.AdminSecret)
+	return auth
+}
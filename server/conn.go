@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"compress/gzip"
 	"crypto/rand"
 	"fmt"
 	"io"
@@ -14,6 +15,8 @@ import (
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/internal"
 	"github.com/jeffrom/logd/logger"
+	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 )
 
 type connState uint8
@@ -27,6 +30,9 @@ const (
 	// connection is currently handling a command.
 	connStateActive
 
+	// connection is currently sending a READ or TAIL response.
+	connStateReading
+
 	// connection has been manually closed.
 	connStateClosed
 
@@ -40,6 +46,8 @@ func (cs connState) String() string {
 		return "INACTIVE"
 	case connStateActive:
 		return "ACTIVE"
+	case connStateReading:
+		return "READING"
 	case connStateClosed:
 		return "CLOSED"
 	case connStateFailed:
@@ -56,30 +64,56 @@ type Conn struct {
 
 	id string
 
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	br           *bufio.Reader
-	bw           *bufio.Writer
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	readerTimeout time.Duration
+	br            *bufio.Reader
+	bw            *bufio.Writer
+
+	// set while bw holds response bytes that haven't been flushed, when
+	// responses are coalesced. see config.ConnFlushBytes.
+	bufferedAt time.Time
+
+	state     connState
+	principal string
+	closed    bool
+	pending   int // requests read whose responses haven't been written
 
-	state connState
+	// reads are the connection's READ and TAIL responses that haven't been
+	// released. see isRead.
+	reads sync.WaitGroup
 
 	done chan struct{}
 	mu   sync.Mutex
 
 	written int
+
+	// compress is set once the client sends COMPRESS. zw is reused for each
+	// compressed response.
+	compress bool
+	zw       *gzip.Writer
 }
 
 func newServerConn(c net.Conn, conf *config.Config) *Conn {
 	timeout := conf.Timeout
+	readerTimeout := conf.ReaderTimeout
+	if readerTimeout <= 0 {
+		readerTimeout = timeout
+	}
+	bufSize := 4096
+	if conf.ConnFlushBytes > bufSize {
+		bufSize = conf.ConnFlushBytes
+	}
 	conn := &Conn{
-		conf:         conf,
-		id:           newUUID(),
-		Conn:         c,
-		readTimeout:  timeout,
-		br:           bufio.NewReader(c),
-		bw:           bufio.NewWriter(c),
-		writeTimeout: timeout,
-		done:         make(chan struct{}, 10),
+		conf:          conf,
+		id:            newUUID(),
+		Conn:          c,
+		readTimeout:   timeout,
+		br:            bufio.NewReader(c),
+		bw:            bufio.NewWriterSize(c, bufSize),
+		writeTimeout:  timeout,
+		readerTimeout: readerTimeout,
+		done:          make(chan struct{}, 10),
 	}
 
 	return conn
@@ -126,6 +160,7 @@ func (c *Conn) Write(p []byte) (int, error) {
 
 // Flush sends all pending data over the connection
 func (c *Conn) Flush() error {
+	c.bufferedAt = time.Time{}
 	if c.bw.Buffered() > 0 {
 		internal.Debugf(c.conf, "%s: flush() (%d bytes buffered)", c.RemoteAddr(), c.bw.Buffered())
 		return c.bw.Flush()
@@ -133,10 +168,26 @@ func (c *Conn) Flush() error {
 	return nil
 }
 
+// shouldFlush returns true if a response that was just written should be
+// flushed. When responses are coalesced, they're only flushed once there are
+// no more ready to write, or the buffered bytes have waited long enough.
+func (c *Conn) shouldFlush(more bool) bool {
+	if c.conf.ConnFlushBytes <= 0 || !more || c.bufferedAt.IsZero() {
+		return true
+	}
+	return c.conf.ConnFlushInterval > 0 && time.Since(c.bufferedAt) >= c.conf.ConnFlushInterval
+}
+
 func (c *Conn) Read(p []byte) (int, error) {
 	return c.br.Read(p)
 }
 
+// ReadFrom implements io.ReaderFrom. Response data is sent directly over the
+// connection, using sendfile when r is a log partition.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return c.readFrom(r)
+}
+
 func (c *Conn) readFrom(r io.Reader) (int64, error) {
 	internal.Debugf(c.conf, "%s: Conn.readFrom(%+v)", c.RemoteAddr(), r)
 	if err := c.setWaitForReadFromDeadline(); err != nil {
@@ -144,26 +195,157 @@ func (c *Conn) readFrom(r io.Reader) (int64, error) {
 	}
 	var n int64
 	var err error
-	if p, ok := r.(*logger.Partition); ok {
-		// sendfile optimization
-		if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
-			n, err = tcpConn.ReadFrom(p.Reader())
-		} else {
-			n, err = io.Copy(c.Conn, p.Reader())
-		}
+	if c.conf.ConnFlushBytes > 0 {
+		n, err = c.coalesce(r)
+	} else if p, ok := r.(*logger.Partition); ok {
+		n, err = c.sendfile(p)
 	} else {
 		n, err = io.Copy(c.Conn, r)
 	}
 	internal.Debugf(c.conf, "%s: wrote %d bytes", c.RemoteAddr(), n)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.Reading() {
+		stats.ReaderTimeouts.Add(1)
+	}
 	return n, handleConnErr(c.conf, err, c)
 }
 
+func (c *Conn) sendfile(p *logger.Partition) (int64, error) {
+	// sendfile optimization
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConn.ReadFrom(p.Reader())
+	}
+	return io.Copy(c.Conn, p.Reader())
+}
+
+// coalesce buffers r until config.ConnFlushBytes bytes are waiting to be
+// sent. Partition reads that wouldn't fit are sent with sendfile once the
+// buffer has been flushed.
+func (c *Conn) coalesce(r io.Reader) (int64, error) {
+	if p, ok := r.(*logger.Partition); ok {
+		lr, ok := p.Reader().(*io.LimitedReader)
+		if !ok || int64(c.bw.Buffered())+lr.N > int64(c.conf.ConnFlushBytes) {
+			if err := c.Flush(); err != nil {
+				return 0, err
+			}
+			return c.sendfile(p)
+		}
+		r = lr
+	}
+
+	if c.bufferedAt.IsZero() {
+		c.bufferedAt = time.Now()
+	}
+	// bufio.Writer would hand an empty buffer's reads straight to the
+	// connection, so only its Write method is exposed.
+	n, err := io.Copy(writerOnly{c.bw}, r)
+	if err == nil && c.bw.Buffered() >= c.conf.ConnFlushBytes {
+		err = c.Flush()
+	}
+	return n, err
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// writeCompressed sends a READ response with its batches compressed. The
+// first reader is the response envelope, which is sent as is, and the rest are
+// sent as a single gzip stream, so sendfile can't be used.
+func (c *Conn) writeCompressed(resp *protocol.Response) (int64, error) {
+	rdr, err := resp.ScanReader()
+	if err == io.EOF || (err == nil && rdr == nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	total, err := c.readFrom(rdr)
+	cerr := rdr.Close()
+	if err != nil {
+		return total, err
+	}
+	if cerr != nil {
+		return total, cerr
+	}
+
+	cw := &countingWriter{w: c.bw}
+	if c.zw == nil {
+		c.zw = gzip.NewWriter(cw)
+	} else {
+		c.zw.Reset(cw)
+	}
+
+	var in int64
+	for {
+		rdr, err := resp.ScanReader()
+		if err == io.EOF || (err == nil && rdr == nil) {
+			break
+		}
+		if err != nil {
+			return total + cw.n, handleConnErr(c.conf, err, c)
+		}
+
+		n, err := io.Copy(c.zw, rdr)
+		in += n
+		cerr := rdr.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return total + cw.n, handleConnErr(c.conf, err, c)
+		}
+	}
+
+	err = c.zw.Close()
+	total += cw.n
+	stats.CompressionBytesIn.Add(in)
+	stats.CompressionBytesOut.Add(cw.n)
+	internal.Debugf(c.conf, "%s: compressed %d bytes to %d", c.RemoteAddr(), in, cw.n)
+	return total, handleConnErr(c.conf, err, c)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
 func (c *Conn) setState(state connState) {
 	c.mu.Lock()
 	c.state = state
 	c.mu.Unlock()
 }
 
+// startRequest marks the connection active once a request has been read,
+// unless it's still sending an earlier READ or TAIL response.
+func (c *Conn) startRequest() {
+	c.mu.Lock()
+	c.pending++
+	if c.state != connStateReading {
+		c.state = connStateActive
+	}
+	c.mu.Unlock()
+}
+
+// finishRequest marks the connection inactive once the responses to all the
+// requests it has read have been written.
+func (c *Conn) finishRequest() {
+	c.mu.Lock()
+	c.pending--
+	if c.state == connStateActive || c.state == connStateReading {
+		c.state = connStateActive
+		if c.pending == 0 {
+			c.state = connStateInactive
+		}
+	}
+	c.mu.Unlock()
+}
+
 func (c *Conn) getState() connState {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -172,11 +354,63 @@ func (c *Conn) getState() connState {
 
 func (c *Conn) isActive() bool {
 	state := c.getState()
-	return state == connStateActive
+	return state == connStateActive || state == connStateReading
+}
+
+// ID returns the connection's unique id.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Principal returns the principal the connection authenticated as. It
+// returns an empty string if the connection hasn't authenticated.
+func (c *Conn) Principal() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.principal
+}
+
+func (c *Conn) setPrincipal(principal string) {
+	c.mu.Lock()
+	c.principal = principal
+	c.mu.Unlock()
+}
+
+// Reading returns true if the connection is currently streaming a READ or TAIL
+// response to the client.
+func (c *Conn) Reading() bool {
+	return c.getState() == connStateReading
+}
+
+// shutdownTimeout returns how long shutdown waits for the connection to finish
+// its current request.
+func (c *Conn) shutdownTimeout() time.Duration {
+	timeout := c.conf.WriteShutdownTimeout
+	if c.Reading() {
+		timeout = c.conf.ReaderShutdownTimeout
+	}
+	if timeout <= 0 {
+		timeout = c.conf.ShutdownTimeout
+	}
+	return timeout
+}
+
+// Close implements net.Conn. It's safe to call more than once, as both the
+// connection's goroutine and the socket may close it.
+func (c *Conn) Close() error {
+	return c.close()
 }
 
 func (c *Conn) close() error {
-	c.setState(connStateClosed)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.state = connStateClosed
+	c.mu.Unlock()
+
 	err := c.Conn.Close()
 
 	// we only care about the channel if we're gracefully shutting down
@@ -190,8 +424,27 @@ func (c *Conn) close() error {
 	return err
 }
 
+// ReaderTimeout returns how long writing each part of a READ or TAIL response
+// can take before the connection is closed.
+func (c *Conn) ReaderTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readerTimeout
+}
+
+// SetReaderTimeout sets how long writing each part of a READ or TAIL response
+// can take before the connection is closed.
+func (c *Conn) SetReaderTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.readerTimeout = timeout
+	c.mu.Unlock()
+}
+
 func (c *Conn) setWaitForReadFromDeadline() error {
 	timeout := c.conf.Timeout
+	if c.Reading() {
+		timeout = c.ReaderTimeout()
+	}
 	err := c.SetWriteDeadline(time.Now().Add(timeout))
 	return handleConnErr(c.conf, err, c)
 }
@@ -2,11 +2,9 @@ package server
 
 import (
 	"context"
-	"expvar"
 	"log"
 	"net"
 	"net/http"
-	"net/http/pprof"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/transport"
@@ -19,6 +17,7 @@ type Http struct {
 	mux  *http.ServeMux
 	srv  *http.Server
 	h    transport.RequestHandler
+	logh *logHandler
 }
 
 // NewHttp returns a new instance of *Http.
@@ -35,32 +34,29 @@ func NewHttp(conf *config.Config) *Http {
 	return s
 }
 
-// GoServe implements transport.Server interface.
+// GoServe implements transport.Server interface. The server is listening when
+// it returns, so ListenAddr returns the address, including the port if it was
+// assigned by the OS.
 func (s *Http) GoServe() {
-	go func() {
-		listener, err := net.Listen("tcp", s.conf.HttpHost)
-		if err != nil {
-			panic(err)
-		}
-		s.ln = listener
+	listener, err := net.Listen("tcp", s.conf.HttpHost)
+	if err != nil {
+		panic(err)
+	}
+	s.ln = listener
+	log.Printf("Serving at %s", s.ln.Addr())
 
-		log.Printf("Serving at %s", s.ln.Addr())
+	go func() {
 		if err := s.srv.Serve(s.ln); err != nil {
 			// panic(err)
 		}
 	}()
 }
 
+// setupHandlers registers the log endpoint. Stats and profiling are served by
+// Admin, so they aren't exposed with the data.
 func (s *Http) setupHandlers() {
-	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
-	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-
-	s.mux.Handle("/debug/vars", expvar.Handler())
-
-	s.mux.Handle("/log", &logHandler{conf: s.conf, h: s.h})
+	s.logh = &logHandler{conf: s.conf, h: s.h, auth: newAuthenticator(s.conf)}
+	s.mux.Handle("/log", s.logh)
 }
 
 // Stop implements transport.Server interface.
@@ -80,3 +76,9 @@ func (s *Http) ListenAddr() net.Addr {
 func (s *Http) SetHandler(h transport.RequestHandler) {
 	s.h = h
 }
+
+// SetAuthenticator sets the Authenticator used to check the bearer token of
+// log requests. If it is nil, authentication is disabled.
+func (s *Http) SetAuthenticator(auth Authenticator) {
+	s.logh.auth = auth
+}
@@ -3,7 +3,6 @@ package server
 import (
 	"bufio"
 	"errors"
-	"io"
 	"log"
 	"mime"
 	"net/http"
@@ -17,10 +16,17 @@ import (
 type logHandler struct {
 	conf *config.Config
 	h    transport.RequestHandler
+	auth Authenticator
 }
 
 func (h *logHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
+	principal, err := bearerPrincipal(h.auth, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := transport.WithPrincipal(req.Context(), principal)
 	logdreq, err := h.readRequest(req)
 	if err != nil {
 		panic(err)
@@ -31,11 +37,23 @@ func (h *logHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		panic(err)
 	}
 
-	if _, err := h.respond(w, req, resp); err != nil {
+	_, err = h.respond(w, req, resp)
+	resp.Done()
+	if err != nil {
 		panic(err)
 	}
 }
 
+// bearerPrincipal checks the request's bearer token with auth, if
+// authentication is enabled, returning the principal it acts as.
+func bearerPrincipal(auth Authenticator, req *http.Request) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return auth.Authenticate([]byte(token))
+}
+
 func (h *logHandler) readRequest(req *http.Request) (*protocol.Request, error) {
 	ct, err := negotiateContentType(req.Header.Get("Content-type"))
 	if err != nil {
@@ -69,31 +87,12 @@ func (h *logHandler) respond(rw http.ResponseWriter, req *http.Request, resp *pr
 }
 
 func (h *logHandler) respondLogd(rw http.ResponseWriter, req *http.Request, resp *protocol.Response) (int64, error) {
-	var readOne bool
-	var total int64
-	var r io.ReadCloser
-	var err error
-
-	for {
-		r, err = resp.ScanReader()
-		if err != nil || r == nil {
-			break
-		}
-		readOne = true
-
-		n, rerr := io.Copy(rw, r)
-		total += n
-		if rerr != nil {
-			return total, rerr
-		}
-	}
-
-	if !readOne {
+	if resp.NumReaders() == 0 {
 		log.Printf("%s: no readers in Response", req.RemoteAddr)
 		// TODO should be a protocol.Err error
-		return total, errors.New("internal server error")
+		return 0, errors.New("internal server error")
 	}
-	return total, nil
+	return resp.WriteTo(rw)
 }
 
 var defaultContentType = "application/logd"
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// ConnEventType is the kind of connection lifecycle event.
+type ConnEventType uint8
+
+const (
+	// ConnAccepted is sent when a connection has been accepted.
+	ConnAccepted ConnEventType = iota
+
+	// ConnAuthenticated is sent when a connection authenticates successfully.
+	ConnAuthenticated
+
+	// ConnAuthFailed is sent when a connection's AUTH request is rejected.
+	ConnAuthFailed
+
+	// ConnClosed is sent after a connection has been closed and removed from
+	// the server.
+	ConnClosed
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnAccepted:
+		return "ACCEPTED"
+	case ConnAuthenticated:
+		return "AUTHENTICATED"
+	case ConnAuthFailed:
+		return "AUTH_FAILED"
+	case ConnClosed:
+		return "CLOSED"
+	}
+	return fmt.Sprintf("UNKNOWN(%+v)", uint8(t))
+}
+
+// ConnEvent describes a change in a connection's lifecycle.
+type ConnEvent struct {
+	Type       ConnEventType
+	ID         string
+	RemoteAddr net.Addr
+
+	// Principal is the principal the connection authenticated as, or empty if
+	// it hasn't authenticated.
+	Principal string
+
+	// Err is the reason authentication failed, for ConnAuthFailed events.
+	Err error
+}
+
+// ConnectionObserver is notified of connection lifecycle events, such as for
+// audit logging. ObserveConn is called from the connection's goroutine, never
+// from the accept loop or while the server holds a lock, but a slow observer
+// still delays the connection it's observing.
+type ConnectionObserver interface {
+	ObserveConn(ev ConnEvent)
+}
+
+func (s *Socket) observeConn(typ ConnEventType, conn *Conn, err error) {
+	if s.observer == nil {
+		return
+	}
+	s.observer.ObserveConn(ConnEvent{
+		Type:       typ,
+		ID:         conn.ID(),
+		RemoteAddr: conn.RemoteAddr(),
+		Principal:  conn.Principal(),
+		Err:        err,
+	})
+}
@@ -3,12 +3,17 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/jeffrom/logd/logd"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 	"github.com/jeffrom/logd/testhelper"
 	"github.com/jeffrom/logd/transport"
 )
@@ -57,3 +62,66 @@ func BenchmarkClientBatch(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkConnGoroutines reports the goroutines running while 64 connections
+// are open, with a goroutine per connection and with a pool of 8 workers.
+func BenchmarkConnGoroutines(b *testing.B) {
+	for _, workers := range []int{0, 8} {
+		name := "per-conn"
+		if workers > 0 {
+			name = fmt.Sprintf("workers-%d", workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkConnGoroutines(b, workers, 64)
+		})
+	}
+}
+
+func benchmarkConnGoroutines(b *testing.B, workers int, n int) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ConnWorkers = workers
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(b, srv, rh)
+
+	served := int64(n)
+	if workers > 0 && workers < n {
+		served = int64(workers)
+	}
+	waitActive := func(active int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for stats.ActiveConnections.Value() != active {
+			if time.Now().After(deadline) {
+				b.Fatalf("expected %d active connections but got %d", active, stats.ActiveConnections.Value())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	before := runtime.NumGoroutine()
+	peak := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		active := stats.ActiveConnections.Value()
+		conns := make([]net.Conn, n)
+		for j := range conns {
+			conn, err := net.Dial("tcp", srv.ListenAddr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			conns[j] = conn
+		}
+		waitActive(active + served)
+		if g := runtime.NumGoroutine() - before; g > peak {
+			peak = g
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		waitActive(active)
+	}
+	b.ReportMetric(float64(peak), "goroutines")
+}
@@ -3,12 +3,26 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"expvar"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/jeffrom/logd/config"
 	"github.com/jeffrom/logd/logd"
 	"github.com/jeffrom/logd/protocol"
+	"github.com/jeffrom/logd/stats"
 	"github.com/jeffrom/logd/testhelper"
 	"github.com/jeffrom/logd/transport"
 )
@@ -65,6 +79,287 @@ func TestLifecycle(t *testing.T) {
 	}
 }
 
+func TestListenRandomPort(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	srv := NewSocket(":0", conf)
+	if addr := srv.ListenAddr(); addr != nil {
+		t.Fatalf("expected no address before serving but got %s", addr)
+	}
+
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+
+	addr, ok := srv.ListenAddr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected a tcp address with an assigned port but got %v", srv.ListenAddr())
+	}
+
+	c, err := logd.Dial(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClose(rh)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	CloseTestServer(t, srv, rh)
+}
+
+func TestSocketWithListener(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := NewSocketWithListener(ln, conf)
+	if addr := srv.ListenAddr(); addr != ln.Addr() {
+		t.Fatalf("expected listener address %s but got %v", ln.Addr(), addr)
+	}
+
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+
+	c, err := logd.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClose(rh)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	CloseTestServer(t, srv, rh)
+}
+
+func TestHttpListenRandomPort(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.HttpHost = "127.0.0.1:0"
+	srv := NewHttp(conf)
+	srv.GoServe()
+	defer srv.Stop()
+
+	addr, ok := srv.ListenAddr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected a tcp address with an assigned port but got %v", srv.ListenAddr())
+	}
+
+	// stats are served by the admin server, not with the data
+	resp, err := http.Get("http://" + addr.String() + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AdminHost = "127.0.0.1:0"
+	conf.AdminProfiling = true
+	srv := NewAdmin(conf)
+	srv.GoServe()
+	defer srv.Stop()
+
+	tests := []struct {
+		path     string
+		contains string
+	}{
+		{"/health", "OK"},
+		{"/metrics", "requests.total: "},
+		{"/debug/vars", `"requests.total": `},
+		{"/debug/pprof/", "goroutine"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get("http://" + srv.ListenAddr().String() + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d from %s but got %d", http.StatusOK, tt.path, resp.StatusCode)
+		}
+		if !bytes.Contains(b, []byte(tt.contains)) {
+			t.Fatalf("expected %s to include %q but got %q", tt.path, tt.contains, b)
+		}
+	}
+}
+
+func TestAdminProfilingDisabled(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AdminHost = "127.0.0.1:0"
+	srv := NewAdmin(conf)
+	srv.GoServe()
+	defer srv.Stop()
+
+	resp, err := http.Get("http://" + srv.ListenAddr().String() + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func expectAdminRead(conf *config.Config, rh *transport.MockRequestHandler, requests chan<- string, batch []byte) {
+	rh.Expect(func(req *protocol.Request) *protocol.Response {
+		requests <- string(req.Bytes())
+		resp := protocol.NewResponseConfig(conf)
+		req.WriteResponse(resp, protocol.NewClientBatchResponse(conf, 0, 1))
+		resp.AddReader(ioutil.NopCloser(bytes.NewReader(batch)))
+		return resp
+	})
+}
+
+func TestAdminRead(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AdminHost = "127.0.0.1:0"
+	conf.AuthSecret = "secret"
+	srv := NewAdmin(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer srv.Stop()
+
+	u := "http://" + srv.ListenAddr().String() + "/read?topic=default&offset=0&limit=2"
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without a token but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	requests := make(chan string, 1)
+	expectAdminRead(conf, rh, requests, testhelper.LoadFixture("batch.small"))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if r := <-requests; r != "READ default 0 2\r\n" {
+		t.Fatalf("expected a READ request but got %q", r)
+	}
+
+	var msgs []readMessage
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg readMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	expected := []readMessage{
+		{Offset: 0, Delta: 0, Body: "hi"},
+		{Offset: 0, Delta: uint64(len("MSG 2\r\nhi\r\n")), Body: "hallo"},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages but got %+v", len(expected), msgs)
+	}
+	for i, msg := range msgs {
+		msg.Timestamp = time.Time{}
+		if msg != expected[i] {
+			t.Fatalf("expected %+v but got %+v", expected[i], msg)
+		}
+	}
+
+	if err := rh.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminReadFollow(t *testing.T) {
+	defer func(d time.Duration) { readPollInterval = d }(readPollInterval)
+	readPollInterval = time.Millisecond
+
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AdminHost = "127.0.0.1:0"
+	srv := NewAdmin(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer srv.Stop()
+
+	fixture := testhelper.LoadFixture("batch.small")
+	requests := make(chan string, 100)
+	expectAdminRead(conf, rh, requests, fixture)
+	rh.Expect(func(req *protocol.Request) *protocol.Response {
+		requests <- string(req.Bytes())
+		rh.Respond(func(req *protocol.Request) *protocol.Response {
+			resp, _ := protocol.NewResponseErr(conf, req, protocol.ErrNotFound)
+			return resp
+		})
+		resp, _ := protocol.NewResponseErr(conf, req, protocol.ErrNotFound)
+		return resp
+	})
+
+	req, err := http.NewRequest("GET", "http://"+srv.ListenAddr().String()+"/read?limit=3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream but got %q", ct)
+	}
+
+	var bodies []string
+	br := bufio.NewReader(resp.Body)
+	for len(bodies) < 3 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var msg readMessage
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, msg.Body)
+	}
+	if expected := []string{"hi", "hallo", "sup"}; !reflect.DeepEqual(bodies, expected) {
+		t.Fatalf("expected %q but got %q", expected, bodies)
+	}
+
+	// the stream starts at the tail, then reads on from the batch it sent
+	if r := <-requests; r != "TAIL default 3\r\n" {
+		t.Fatalf("expected a TAIL request but got %q", r)
+	}
+	if r, expected := <-requests, fmt.Sprintf("READ default %d 3\r\n", len(fixture)); r != expected {
+		t.Fatalf("expected %q but got %q", expected, r)
+	}
+	resp.Body.Close()
+}
+
 func TestClose(t *testing.T) {
 	conf := testhelper.DefaultConfig(testing.Verbose())
 	srv := NewTestServer(conf)
@@ -159,6 +454,555 @@ func TestFailedRequest(t *testing.T) {
 	}
 }
 
+func TestUnknownCommand(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.LogUnknownCommands = true
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	conn, err := net.Dial("tcp", srv.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	before := stats.UnknownCommands.Value()
+	if _, err := conn.Write([]byte("BOGUS 1 2\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	cr := protocol.NewClientResponseConfig(conf)
+	if _, err := cr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	if errors.Cause(cr.Error()) != protocol.ErrUnknownCommand {
+		t.Fatalf("expected %v but got %+v", protocol.ErrUnknownCommand, cr.Error())
+	}
+	if rerr, ok := cr.Error().(*protocol.RespError); !ok || rerr.Message != `"BOGUS"` {
+		t.Fatalf("expected the command name in the error but got %+v", cr.Error())
+	}
+	if n := stats.UnknownCommands.Value() - before; n != 1 {
+		t.Fatalf("expected 1 unknown command but counted %d", n)
+	}
+	if v, ok := stats.CommandErrors.Get("unknown.client").(*expvar.Int); !ok || v.Value() < 1 {
+		t.Fatalf("expected the unknown command in errors by command but got %v", stats.CommandErrors)
+	}
+
+	// the connection is still usable
+	expectClose(rh)
+	if _, err := conn.Write([]byte("CLOSE\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	cr = protocol.NewClientResponseConfig(conf)
+	if _, err := cr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	if !cr.Ok() {
+		t.Fatalf("expected OK after the unknown command but got %+v", cr.Error())
+	}
+}
+
+func TestReaderTimeout(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ReaderTimeout = 10 * time.Millisecond
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newServerConn(server, conf)
+	defer conn.close()
+
+	if conn.ReaderTimeout() != conf.ReaderTimeout {
+		t.Fatalf("expected reader timeout %s but got %s", conf.ReaderTimeout, conn.ReaderTimeout())
+	}
+
+	// nothing reads from the client side of the pipe, so the write can't
+	// complete.
+	before := stats.ReaderTimeouts.Value()
+	conn.setState(connStateReading)
+	fixture := testhelper.LoadFixture("batch.small")
+	_, err := conn.readFrom(bytes.NewReader(fixture))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout error but got %+v", err)
+	}
+	if n := stats.ReaderTimeouts.Value() - before; n != 1 {
+		t.Fatalf("expected 1 reader timeout but got %d", n)
+	}
+}
+
+func TestWriteCompressedOpenError(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newServerConn(server, conf)
+	defer conn.close()
+
+	openErr := errors.New("open failed")
+	resp := protocol.NewResponseConfig(conf)
+	if err := resp.AddReaderFunc(func() (io.ReadCloser, error) { return nil, openErr }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.writeCompressed(resp); err != openErr {
+		t.Fatalf("expected %v but got %+v", openErr, err)
+	}
+}
+
+func TestConnFlushBytes(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ConnFlushBytes = 64
+	server, client := net.Pipe()
+	defer client.Close()
+	cc := &countingConn{Conn: server}
+	conn := newServerConn(cc, conf)
+	defer conn.close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1024)
+		n, _ := client.Read(b)
+		received <- b[:n]
+	}()
+
+	envelope := []byte("OK 0 1\r\n")
+	if _, err := conn.readFrom(bytes.NewReader(envelope)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cc.writes != 0 {
+		t.Fatalf("expected the response to be buffered but it was written in %d writes", cc.writes)
+	}
+	if conn.shouldFlush(true) {
+		t.Fatal("expected the response to stay buffered while more are ready")
+	}
+	if !conn.shouldFlush(false) {
+		t.Fatal("expected the response to be flushed when no more are ready")
+	}
+
+	// the rest doesn't fit, so everything is flushed
+	fixture := testhelper.LoadFixture("batch.small")
+	if _, err := conn.readFrom(bytes.NewReader(fixture)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cc.writes != 1 {
+		t.Fatalf("expected 1 write but got %d", cc.writes)
+	}
+	if b := <-received; !bytes.Equal(b, append(envelope, fixture...)) {
+		t.Fatalf("expected %q but got %q", append(envelope, fixture...), b)
+	}
+
+	conf.ConnFlushInterval = time.Millisecond
+	go func() {
+		b := make([]byte, 1024)
+		n, _ := client.Read(b)
+		received <- b[:n]
+	}()
+	if _, err := conn.readFrom(bytes.NewReader(envelope)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	time.Sleep(2 * conf.ConnFlushInterval)
+	if !conn.shouldFlush(true) {
+		t.Fatal("expected the response to be flushed after the flush interval")
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if b := <-received; !bytes.Equal(b, envelope) {
+		t.Fatalf("expected %q but got %q", envelope, b)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newServerConn(server, conf)
+	defer conn.close()
+
+	conn.setState(connStateActive)
+	if timeout := conn.shutdownTimeout(); timeout != conf.ShutdownTimeout {
+		t.Fatalf("expected shutdown timeout %s but got %s", conf.ShutdownTimeout, timeout)
+	}
+
+	conf.WriteShutdownTimeout = 10 * time.Millisecond
+	conf.ReaderShutdownTimeout = 20 * time.Millisecond
+	if timeout := conn.shutdownTimeout(); timeout != conf.WriteShutdownTimeout {
+		t.Fatalf("expected shutdown timeout %s but got %s", conf.WriteShutdownTimeout, timeout)
+	}
+
+	conn.setState(connStateReading)
+	if timeout := conn.shutdownTimeout(); timeout != conf.ReaderShutdownTimeout {
+		t.Fatalf("expected shutdown timeout %s but got %s", conf.ReaderShutdownTimeout, timeout)
+	}
+}
+
+func TestConnCloseTwice(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection's goroutine closes it, and then the socket removes it,
+	// closing it again.
+	conn := newServerConn(server, conf)
+	if err := conn.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("expected closing twice to succeed but got %+v", err)
+	}
+	if n := len(conn.done); n != 1 {
+		t.Fatalf("expected one done signal but got %d", n)
+	}
+}
+
+func TestReauthFailure(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AuthSecret = "secret"
+	conf.AdminSecret = "admin-secret"
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	adminConf := logd.DefaultTestConfig(testing.Verbose())
+	adminConf.AuthToken = "admin-secret"
+	admin, err := logd.DialConfig(srv.ListenAddr().String(), adminConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expectServerClientClose(t, rh, admin)
+	if _, err := admin.Conns(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection is no longer authenticated as the admin
+	if err := admin.Auth([]byte("wrong")); errors.Cause(err) != protocol.ErrUnauthorized {
+		t.Fatalf("expected %v but got %+v", protocol.ErrUnauthorized, err)
+	}
+	if _, err := admin.Conns(); errors.Cause(err) != protocol.ErrUnauthorized {
+		t.Fatalf("expected %v but got %+v", protocol.ErrUnauthorized, err)
+	}
+}
+
+func TestKillConn(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AuthSecret = "secret"
+	conf.AdminSecret = "admin-secret"
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	userConf := logd.DefaultTestConfig(testing.Verbose())
+	userConf.AuthToken = "secret"
+	user, err := logd.DialConfig(srv.ListenAddr().String(), userConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminConf := logd.DefaultTestConfig(testing.Verbose())
+	adminConf.AuthToken = "admin-secret"
+	admin, err := logd.DialConfig(srv.ListenAddr().String(), adminConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expectServerClientClose(t, rh, admin)
+
+	if _, err := user.Conns(); err != protocol.ErrPermissionDenied {
+		t.Fatalf("expected %v but got %+v", protocol.ErrPermissionDenied, err)
+	}
+
+	conns, err := admin.Conns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections but got %d", len(conns))
+	}
+	var id string
+	for _, info := range conns {
+		if info.Principal == DefaultPrincipal {
+			id = info.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("expected a connection authenticated as %q in %+v", DefaultPrincipal, conns)
+	}
+
+	if err := admin.KillConn("nonexistent"); errors.Cause(err) != protocol.ErrNotFound {
+		t.Fatalf("expected %v but got %+v", protocol.ErrNotFound, err)
+	}
+	if err := admin.KillConn(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// the killed connection is removed once its goroutine notices it's closed
+	deadline := time.Now().Add(time.Second)
+	for len(srv.Conns()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected killed connection to be removed but got %d connections", len(srv.Conns()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []ConnEvent
+}
+
+func (o *recordingObserver) ObserveConn(ev ConnEvent) {
+	o.mu.Lock()
+	o.events = append(o.events, ev)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) eventsFor(id string) []ConnEventType {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var types []ConnEventType
+	for _, ev := range o.events {
+		if ev.ID == id {
+			types = append(types, ev.Type)
+		}
+	}
+	return types
+}
+
+func TestConnectionObserver(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AuthSecret = "secret"
+	conf.AdminSecret = "admin-secret"
+	srv := NewTestServer(conf)
+	obs := &recordingObserver{}
+	srv.SetConnectionObserver(obs)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	adminConf := logd.DefaultTestConfig(testing.Verbose())
+	adminConf.AuthToken = "admin-secret"
+	admin, err := logd.DialConfig(srv.ListenAddr().String(), adminConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expectServerClientClose(t, rh, admin)
+
+	c, err := logd.DialConfig(srv.ListenAddr().String(), logd.DefaultTestConfig(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth([]byte("wrong")); errors.Cause(err) != protocol.ErrUnauthorized {
+		t.Fatalf("expected %v but got %+v", protocol.ErrUnauthorized, err)
+	}
+	if err := c.Auth([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	conns, err := admin.Conns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, info := range conns {
+		if info.Principal == DefaultPrincipal {
+			id = info.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("expected a connection authenticated as %q in %+v", DefaultPrincipal, conns)
+	}
+	expectServerClientClose(t, rh, c)
+
+	expected := []ConnEventType{ConnAccepted, ConnAuthFailed, ConnAuthenticated, ConnClosed}
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(obs.eventsFor(id), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected events %v but got %v", expected, obs.eventsFor(id))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	for _, ev := range obs.events {
+		if ev.ID != id {
+			continue
+		}
+		if ev.RemoteAddr == nil {
+			t.Fatalf("expected a remote address for %s event", ev.Type)
+		}
+		if ev.Type == ConnAuthFailed && ev.Err != protocol.ErrUnauthorized {
+			t.Fatalf("expected %v for %s event but got %v", protocol.ErrUnauthorized, ev.Type, ev.Err)
+		}
+		if ev.Type == ConnClosed && ev.Principal != DefaultPrincipal {
+			t.Fatalf("expected principal %q for %s event but got %q", DefaultPrincipal, ev.Type, ev.Principal)
+		}
+	}
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	if l := newAcceptLimiter(0, 10); l != nil {
+		t.Fatal("expected no limiter when the rate is 0")
+	}
+
+	now := time.Unix(1500000000, 0)
+	l := newAcceptLimiter(10, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("expected burst connection %d not to wait but got %s", i, wait)
+		}
+	}
+	if wait := l.reserve(); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait %s but got %s", 100*time.Millisecond, wait)
+	}
+
+	// the throttled connection used the next token
+	now = now.Add(100 * time.Millisecond)
+	if wait := l.reserve(); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait %s but got %s", 100*time.Millisecond, wait)
+	}
+
+	// tokens don't accumulate past the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("expected burst connection %d not to wait but got %s", i, wait)
+		}
+	}
+	if wait := l.reserve(); wait == 0 {
+		t.Fatal("expected to wait after the burst")
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.AcceptRate = 100
+	conf.AcceptBurst = 1
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	before := stats.AcceptsThrottled.Value()
+	var clients []*logd.Client
+	for i := 0; i < 3; i++ {
+		c, err := logd.Dial(srv.ListenAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(srv.Conns()) < len(clients) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections but got %d", len(clients), len(srv.Conns()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := stats.AcceptsThrottled.Value() - before; n < 1 {
+		t.Fatalf("expected accepts to be throttled but got %d", n)
+	}
+
+	for _, c := range clients {
+		expectServerClientClose(t, rh, c)
+	}
+}
+
+func TestAcceptWaitStop(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+
+	waited := make(chan bool)
+	go func() { waited <- srv.waitToAccept(time.Hour) }()
+	CloseTestServer(t, srv, rh)
+
+	select {
+	case ok := <-waited:
+		if ok {
+			t.Fatal("expected waiting to accept to fail after shutdown")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected shutdown to stop waiting to accept")
+	}
+}
+
+func TestConnWorkers(t *testing.T) {
+	conf := testhelper.DefaultConfig(testing.Verbose())
+	conf.ConnWorkers = 1
+	srv := NewTestServer(conf)
+	rh := transport.NewMockRequestHandler(conf)
+	srv.SetHandler(rh)
+	srv.GoServe()
+	defer CloseTestServer(t, srv, rh)
+
+	request := func(conn net.Conn, timeout time.Duration) error {
+		if _, err := conn.Write([]byte("BOGUS\r\n")); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		cr := protocol.NewClientResponseConfig(conf)
+		_, err := cr.ReadFrom(bufio.NewReader(conn))
+		return err
+	}
+
+	first, err := net.Dial("tcp", srv.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if err := request(first, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the only worker is serving the first connection
+	second, err := net.Dial("tcp", srv.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := request(second, 50*time.Millisecond); err == nil {
+		t.Fatal("expected the second connection to wait for a worker")
+	}
+
+	first.Close()
+	if err := request(second, time.Second); err != nil {
+		t.Fatalf("expected the second connection to be served after the first closed but got %v", err)
+	}
+}
+
 func expectServerClientClose(t testing.TB, rh *transport.MockRequestHandler, c *logd.Client) {
 	expectClose(rh)
 	if err := c.Close(); err != nil {
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"strings"
@@ -39,8 +42,12 @@ type Socket struct {
 	stopC        chan struct{}
 	shutdownC    chan struct{}
 	shuttingDown bool
+	stoppingC    chan struct{} // closed when shutdown starts
 
-	h transport.RequestHandler
+	h        transport.RequestHandler
+	auth     Authenticator
+	observer ConnectionObserver
+	limiter  *acceptLimiter
 }
 
 // NewSocket will return a new instance of a log server
@@ -50,19 +57,38 @@ func NewSocket(addr string, conf *config.Config) *Socket {
 		addr:      addr,
 		readyC:    make(chan struct{}),
 		conns:     make(map[*Conn]bool),
-		connIn:    make(chan *Conn, 1000),
+		connIn:    make(chan *Conn, connQueueSize(conf)),
 		stopC:     make(chan struct{}),
 		shutdownC: make(chan struct{}),
+		stoppingC: make(chan struct{}),
+		auth:      newAuthenticator(conf),
+		limiter:   newAcceptLimiter(conf.AcceptRate, conf.AcceptBurst),
 	}
 }
 
+// NewSocketWithListener returns a new instance of a log server that accepts
+// connections from ln instead of listening itself, such as a listener passed
+// by systemd socket activation or an in-memory listener in tests.
+func NewSocketWithListener(ln net.Listener, conf *config.Config) *Socket {
+	s := NewSocket(ln.Addr().String(), conf)
+	s.ln = ln
+	return s
+}
+
 // ListenAndServe starts serving requests
 func (s *Socket) ListenAndServe() error {
 	return s.listenAndServe(false)
 }
 
-// ListenAddr returns the listen address of the server.
+// ListenAddr returns the listen address of the server, including the port if
+// it was assigned by the OS, or the address of the listener passed to
+// NewSocketWithListener. It returns nil if the server isn't listening.
 func (s *Socket) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
 	return s.ln.Addr()
 }
 
@@ -71,6 +97,20 @@ func (s *Socket) SetHandler(h transport.RequestHandler) {
 	s.h = h
 }
 
+// SetAuthenticator sets the Authenticator used to handle AUTH requests. If it
+// is nil, authentication is disabled. It should be called before the server
+// is started.
+func (s *Socket) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// SetConnectionObserver sets the ConnectionObserver notified when connections
+// are accepted, authenticate, and close. It should be called before the
+// server is started.
+func (s *Socket) SetConnectionObserver(obs ConnectionObserver) {
+	s.observer = obs
+}
+
 func (s *Socket) listenAndServe(wait bool) error {
 	var outerErr error
 
@@ -88,6 +128,18 @@ func (s *Socket) listenAndServe(wait bool) error {
 		s.readyC <- struct{}{}
 	}
 
+	// with a worker pool, the workers receive from connIn instead, and the
+	// nil channel here is never ready.
+	connIn := s.connIn
+	if n := s.conf.ConnWorkers; n > 0 {
+		workersDone := make(chan struct{})
+		defer close(workersDone)
+		for i := 0; i < n; i++ {
+			go s.connWorker(workersDone)
+		}
+		connIn = nil
+	}
+
 	go s.accept()
 
 	for {
@@ -96,12 +148,33 @@ func (s *Socket) listenAndServe(wait bool) error {
 			log.Printf("Shutting down server at %s", s.ln.Addr())
 			s.logConns()
 			return s.Shutdown()
-		case conn := <-s.connIn:
+		case conn := <-connIn:
 			go s.handleConnection(conn)
 		}
 	}
 }
 
+// connWorker serves connections one at a time until done is closed.
+func (s *Socket) connWorker(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case conn := <-s.connIn:
+			s.handleConnection(conn)
+		}
+	}
+}
+
+// connQueueSize returns the number of accepted connections that can wait to
+// be served, using 1000 if config.ConnQueueSize isn't set.
+func connQueueSize(conf *config.Config) int {
+	if conf.ConnQueueSize > 0 {
+		return conf.ConnQueueSize
+	}
+	return 1000
+}
+
 // ready signals that the application is ready to serve on this host:port
 func (s *Socket) ready() {
 	<-s.readyC
@@ -120,6 +193,17 @@ func (s *Socket) accept() {
 			break
 		}
 
+		// pause accepting instead of accepting and closing connections, so
+		// they wait in the listen backlog.
+		if s.limiter != nil {
+			if wait := s.limiter.reserve(); wait > 0 {
+				stats.AcceptsThrottled.Add(1)
+				if !s.waitToAccept(wait) {
+					break
+				}
+			}
+		}
+
 		rawConn, err := s.ln.Accept()
 		if err != nil {
 			break
@@ -140,9 +224,31 @@ func (s *Socket) accept() {
 	}
 }
 
-// GoServe starts a server without blocking the current goroutine
+// waitToAccept waits for the accept rate limit, returning false if the server
+// starts shutting down first.
+func (s *Socket) waitToAccept(wait time.Duration) bool {
+	s.mu.Lock()
+	stoppingC := s.stoppingC
+	s.mu.Unlock()
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return !s.isShuttingDown()
+	case <-stoppingC:
+		return false
+	}
+}
+
+// GoServe starts a server without blocking the current goroutine. The server
+// is listening when it returns, so ListenAddr can be used to find the port
+// when the server was started with port 0.
 func (s *Socket) GoServe() {
 	s.mu.Lock()
+	if s.shuttingDown {
+		s.stoppingC = make(chan struct{})
+	}
 	s.shuttingDown = false
 	s.mu.Unlock()
 
@@ -162,6 +268,9 @@ func (s *Socket) Shutdown() error {
 	}()
 
 	s.mu.Lock()
+	if !s.shuttingDown {
+		close(s.stoppingC)
+	}
 	s.shuttingDown = true
 	s.mu.Unlock()
 
@@ -178,7 +287,7 @@ func (s *Socket) Shutdown() error {
 				select {
 				case <-c.done:
 					internal.Debugf(s.conf, "%s(ACTIVE) closed gracefully", c.RemoteAddr())
-				case <-time.After(s.conf.ShutdownTimeout):
+				case <-time.After(c.shutdownTimeout()):
 					log.Printf("%s timed out", c.RemoteAddr())
 				}
 			} else {
@@ -221,14 +330,27 @@ func (s *Socket) logConns() {
 	log.Printf("connection states (%d): %s", len(states), strings.Join(states, ", "))
 }
 
+// stopTimeout returns the longest shutdown waits for any connection.
+func (s *Socket) stopTimeout() time.Duration {
+	timeout := s.conf.ShutdownTimeout
+	if s.conf.WriteShutdownTimeout > timeout {
+		timeout = s.conf.WriteShutdownTimeout
+	}
+	if s.conf.ReaderShutdownTimeout > timeout {
+		timeout = s.conf.ReaderShutdownTimeout
+	}
+	return timeout
+}
+
 // Stop can be called to shut down the server
 func (s *Socket) Stop() error {
 	s.stopC <- struct{}{}
 
+	timeout := s.stopTimeout()
 	select {
 	case <-s.shutdownC:
-	case <-time.After(s.conf.ShutdownTimeout):
-		log.Printf("hard shutdown after %s", s.conf.ShutdownTimeout)
+	case <-time.After(timeout):
+		log.Printf("hard shutdown after %s", timeout)
 	}
 
 	return nil
@@ -270,6 +392,22 @@ func (s *Socket) handleConnection(conn *Conn) {
 			internal.Debugf(s.conf, "error closing connection: %+v", err)
 		}
 		s.removeConn(conn)
+		s.observeConn(ConnClosed, conn, nil)
+	}()
+
+	s.observeConn(ConnAccepted, conn, nil)
+
+	// requests are read and handled in order while earlier responses are
+	// still being written, so clients can pipeline requests.
+	respC := make(chan pendingResponse, maxPipelined)
+	writeDone := make(chan struct{})
+	go func() {
+		s.writeResponses(conn, respC)
+		close(writeDone)
+	}()
+	defer func() {
+		close(respC)
+		<-writeDone
 	}()
 
 	for {
@@ -278,13 +416,31 @@ func (s *Socket) handleConnection(conn *Conn) {
 			break
 		}
 
-		if err := s.doRequest(ctx, conn); err != nil {
+		if err := s.doRequest(ctx, conn, respC); err != nil {
 			return
 		}
 	}
 }
 
-func (s *Socket) doRequest(ctx context.Context, conn *Conn) error {
+// maxPipelined is the number of responses a connection can have waiting to be
+// written. Once it's reached, the connection stops reading requests until a
+// response has been written.
+const maxPipelined = 32
+
+// pendingResponse is a response waiting to be written to its connection.
+type pendingResponse struct {
+	req      *protocol.Request
+	resp     *protocol.Response
+	compress bool
+	// abandoned is set when the topic's event queue may still be handling req,
+	// so it can't be reused.
+	abandoned bool
+}
+
+// errConnClosing is returned by doRequest after a CLOSE request has been read.
+var errConnClosing = errors.New("connection closing")
+
+func (s *Socket) doRequest(ctx context.Context, conn *Conn, respC chan<- pendingResponse) error {
 	if err := conn.setWaitForCmdDeadline(); err != nil {
 		log.Printf("%s error: %+v", conn.RemoteAddr(), err)
 		conn.setState(connStateFailed)
@@ -293,13 +449,16 @@ func (s *Socket) doRequest(ctx context.Context, conn *Conn) error {
 
 	req := reqPool.Get().(*protocol.Request).WithConfig(s.conf)
 	req.Reset()
-	// defer s.finishRequest(req)
 
 	internal.Debugf(s.conf, "%s: waiting for request", conn.RemoteAddr())
 	readn, rerr := req.ReadFrom(conn.br)
 	stats.BytesIn.Add(readn)
+	if errors.Is(rerr, protocol.ErrUnknownCommand) {
+		// the whole line has been read, so the connection can carry on after
+		// the error response.
+		return s.unknownCommand(conn, req, rerr, respC)
+	}
 	if rerr != nil {
-		// conn.Flush()
 		if rerr != io.EOF {
 			log.Printf("%s read error: %+v", conn.RemoteAddr(), rerr)
 		}
@@ -308,80 +467,357 @@ func (s *Socket) doRequest(ctx context.Context, conn *Conn) error {
 		s.finishRequest(req)
 		return rerr
 	}
-	conn.setState(connStateActive)
-
-	// start := s.startInstrumentation(req)
+	conn.startRequest()
 
 	internal.Debugf(s.conf, "%s: read request %v", conn.RemoteAddr(), req)
-	resp, rerr := s.h.PushRequest(ctx, req)
-	if rerr != nil {
-		// internal.LogError(conn.Flush())
+	var resp *protocol.Response
+	var abandoned bool
+	if req.Name == protocol.CmdAuth || !s.authenticated(conn, req) {
+		resp, rerr = s.handleAuth(conn, req)
+	} else if adminReqs[req.Name] {
+		resp, rerr = s.handleAdmin(conn, req)
+	} else if req.Name == protocol.CmdCompress {
+		resp, rerr = s.handleCompress(conn, req)
+	} else if (req.Name == protocol.CmdRestore || req.Name == protocol.CmdErase) && !s.isAdmin(conn) {
+		// RESTORE writes at offsets the client chooses, and ERASE overwrites
+		// the log, so they're limited to the admin, though they're handled by
+		// the topic like BATCH.
+		stats.DeniedErrors.Add(1)
+		stats.CommandError(req.Name.String(), protocol.CategoryClient)
+		resp, rerr = s.errResponse(req, protocol.ErrPermissionDenied)
+	} else {
+		if isRead(req.Name) {
+			conn.reads.Wait()
+		}
+		resp, rerr = s.h.PushRequest(transport.WithPrincipal(ctx, conn.Principal()), req)
+		abandoned = rerr != nil
+	}
+	if abandoned {
+		log.Printf("%s error: %+v", conn.RemoteAddr(), rerr)
+		resp = s.abandonedResponse(rerr)
+	} else if rerr != nil {
 		log.Printf("%s error: %+v", conn.RemoteAddr(), rerr)
 		resp = req.Response
 	}
 	internal.Debugf(s.conf, "%s: got response: %+v", conn.RemoteAddr(), resp)
 
-	// s.finishInstrumentation(req, start)
+	if isRead(req.Name) {
+		conn.reads.Add(1)
+	}
+	// compression is decided here, as later requests may enable it before
+	// this response is written.
+	respC <- pendingResponse{
+		req:       req,
+		resp:      resp,
+		compress:  conn.compress && (req.Name == protocol.CmdRead || req.Name == protocol.CmdReadRange),
+		abandoned: abandoned,
+	}
+	if req.Name == protocol.CmdClose {
+		return errConnClosing
+	}
+	return nil
+}
 
-	n, reqerr := s.sendResponse(conn, resp)
+// abandonedResponse returns an error response for a request that PushRequest
+// gave up on. The topic's event queue may still be handling it, as when the
+// queue was stopped forcibly, so the request's own response and buffer are
+// left alone.
+func (s *Socket) abandonedResponse(err error) *protocol.Response {
+	resp := protocol.NewResponseConfig(s.conf)
+	b := &bytes.Buffer{}
+	if _, werr := protocol.NewClientErrResponse(s.conf, err).WriteTo(b); werr != nil {
+		// without readers, the default error is sent
+		return resp
+	}
+	internal.LogError(resp.AddReader(ioutil.NopCloser(b)))
+	return resp
+}
+
+// unknownCommand responds to a request whose command the server doesn't
+// recognize. See config.LogUnknownCommands.
+func (s *Socket) unknownCommand(conn *Conn, req *protocol.Request, err error, respC chan<- pendingResponse) error {
+	conn.startRequest()
+	stats.TotalErrors.Add(1)
+	stats.UnknownCommands.Add(1)
+	stats.CommandError("unknown", protocol.CategoryClient)
+	if s.conf.LogUnknownCommands {
+		log.Printf("%s sent %v", conn.RemoteAddr(), err)
+	}
+	resp, _ := s.errResponse(req, err)
+	respC <- pendingResponse{req: req, resp: resp}
+	return nil
+}
+
+// writeResponses writes each connection's responses in the order their
+// requests were read. Once a response fails, the connection is closed, and the
+// rest are released without being written.
+func (s *Socket) writeResponses(conn *Conn, respC <-chan pendingResponse) {
+	var err error
+	for p := range respC {
+		if err == nil {
+			err = s.writeResponse(conn, p, len(respC) > 0)
+			if err != nil {
+				internal.IgnoreError(s.conf.Verbose, conn.close())
+			}
+		}
+		p.resp.Done()
+		if isRead(p.req.Name) {
+			conn.reads.Done()
+		}
+		if !p.abandoned {
+			s.finishRequest(p.req)
+		}
+		conn.finishRequest()
+	}
+}
+
+// isRead returns true for requests whose responses hold a subscription until
+// they're released. A connection's next read waits for them, so a response
+// the client has already received, but that hasn't been released yet, isn't
+// counted against the limits. See config.MaxSubscriptions and
+// config.MaxReads.
+func isRead(name protocol.CmdType) bool {
+	return name == protocol.CmdRead || name == protocol.CmdTail || name == protocol.CmdSRead || name == protocol.CmdReadRange
+}
+
+// writeResponse writes a response to conn. If more responses are ready to be
+// written, it may be left buffered. See config.ConnFlushBytes.
+func (s *Socket) writeResponse(conn *Conn, p pendingResponse, more bool) error {
+	req := p.req
+	if isRead(req.Name) {
+		conn.setState(connStateReading)
+	}
+	n, err := s.sendResponse(conn, p)
 	stats.BytesOut.Add(int64(n))
-	if reqerr != nil {
+	if err != nil {
+		if protocol.ErrorCategory(err) == protocol.CategoryTimeout {
+			// the request was handled, but the client didn't get the response.
+			stats.CommandError(req.Name.String(), protocol.CategoryTimeout)
+		}
 		internal.LogError(conn.Flush())
-		log.Printf("%s: response error: %+v", conn.RemoteAddr(), reqerr)
+		log.Printf("%s: response error: %+v", conn.RemoteAddr(), err)
 		conn.setState(connStateFailed)
-		s.finishRequest(req)
-		return reqerr
+		return err
 	}
 	internal.Debugf(s.conf, "%s: sent response (%d bytes)", conn.RemoteAddr(), n)
 
+	if req.Name != protocol.CmdClose && !conn.shouldFlush(more) {
+		return nil
+	}
 	if ferr := conn.Flush(); ferr != nil || req.Name == protocol.CmdClose {
 		internal.Debugf(s.conf, "%s: closing", conn.RemoteAddr())
 		conn.setState(connStateFailed)
-		s.finishRequest(req)
 		return ferr
 	}
-
-	conn.setState(connStateInactive)
-	s.finishRequest(req)
 	return nil
 }
 
-// TODO should this take context and wait for ctx.Done()?
-func (s *Socket) waitForRequest(conn *Conn) (*protocol.Request, error) {
-	// PING\r\n (6 bytes) is the shortest possible valid request
-	_, err := conn.br.Peek(6)
+// authenticated returns true if the request can be handled. If an
+// Authenticator is set, connections must authenticate before making any
+// request other than CLOSE.
+func (s *Socket) authenticated(conn *Conn, req *protocol.Request) bool {
+	if s.auth == nil || req.Name == protocol.CmdClose {
+		return true
+	}
+	return conn.Principal() != ""
+}
+
+// handleAuth handles AUTH requests, as well as rejecting requests from
+// connections that haven't authenticated. Authentication is a property of the
+// connection, so the event queue isn't involved.
+func (s *Socket) handleAuth(conn *Conn, req *protocol.Request) (*protocol.Response, error) {
+	resp, err := s.doAuth(conn, req)
+	stats.TotalRequests.Add(1)
 	if err != nil {
-		return nil, err
+		stats.AuthErrors.Add(1)
+		stats.CommandError(req.Name.String(), protocol.ErrorCategory(err))
+	} else {
+		stats.AuthRequests.Add(1)
 	}
-	return protocol.NewRequestConfig(s.conf), nil
+	return resp, err
 }
 
-func (s *Socket) sendResponse(conn *Conn, resp *protocol.Response) (int, error) {
-	var r io.ReadCloser
-	var err error
-	var total int
-	var readOne bool
-	for {
-		r, err = resp.ScanReader()
-		if err != nil || r == nil {
-			break
+func (s *Socket) doAuth(conn *Conn, req *protocol.Request) (*protocol.Response, error) {
+	if req.Name != protocol.CmdAuth {
+		return s.errResponse(req, protocol.NewRespError(protocol.ErrUnauthorized, "%s requires authentication", &req.Name))
+	}
+
+	authreq, err := protocol.NewAuthRequest(s.conf).FromRequest(req)
+	if err != nil {
+		conn.setPrincipal("")
+		return s.errResponse(req, err)
+	}
+
+	// authentication is disabled, so there's nothing to check
+	if s.auth == nil {
+		return s.okResponse(req)
+	}
+
+	principal, err := s.auth.Authenticate(authreq.Token())
+	if err != nil {
+		// a connection that fails to authenticate again doesn't keep the
+		// principal it authenticated as before
+		conn.setPrincipal("")
+		s.observeConn(ConnAuthFailed, conn, err)
+		return s.errResponse(req, err)
+	}
+
+	internal.Debugf(s.conf, "%s: authenticated as %q", conn.RemoteAddr(), principal)
+	conn.setPrincipal(principal)
+	s.observeConn(ConnAuthenticated, conn, nil)
+	return s.okResponse(req)
+}
+
+// handleCompress handles COMPRESS requests. Like authentication, compression
+// is a property of the connection.
+func (s *Socket) handleCompress(conn *Conn, req *protocol.Request) (*protocol.Response, error) {
+	stats.TotalRequests.Add(1)
+	if _, err := protocol.NewCompressRequest(s.conf).FromRequest(req); err != nil {
+		return s.errResponse(req, err)
+	}
+
+	internal.Debugf(s.conf, "%s: compressing read responses", conn.RemoteAddr())
+	conn.compress = true
+	return s.okResponse(req)
+}
+
+// adminReqs are requests that manage the server itself. They're handled by the
+// socket, and only AdminPrincipal may make them.
+var adminReqs = map[protocol.CmdType]bool{
+	protocol.CmdConns:    true,
+	protocol.CmdKillConn: true,
+}
+
+// handleAdmin handles CONNS and KILLCONN requests.
+func (s *Socket) handleAdmin(conn *Conn, req *protocol.Request) (*protocol.Response, error) {
+	resp, err := s.doAdmin(conn, req)
+	stats.TotalRequests.Add(1)
+	if err != nil {
+		stats.AdminErrors.Add(1)
+		stats.CommandError(req.Name.String(), protocol.ErrorCategory(err))
+	} else {
+		stats.AdminRequests.Add(1)
+	}
+	return resp, err
+}
+
+// isAdmin returns true if the connection has authenticated as AdminPrincipal.
+func (s *Socket) isAdmin(conn *Conn) bool {
+	return s.auth != nil && conn.Principal() == AdminPrincipal
+}
+
+func (s *Socket) doAdmin(conn *Conn, req *protocol.Request) (*protocol.Response, error) {
+	if !s.isAdmin(conn) {
+		return s.errResponse(req, protocol.ErrPermissionDenied)
+	}
+
+	switch req.Name {
+	case protocol.CmdConns:
+		if _, err := protocol.NewConnsRequest(s.conf).FromRequest(req); err != nil {
+			return s.errResponse(req, err)
+		}
+		return s.connsResponse(req)
+	case protocol.CmdKillConn:
+		killreq, err := protocol.NewKillConnRequest(s.conf).FromRequest(req)
+		if err != nil {
+			return s.errResponse(req, err)
 		}
+		if err := s.killConn(conn, string(killreq.ID())); err != nil {
+			return s.errResponse(req, err)
+		}
+		return s.okResponse(req)
+	}
+	return s.errResponse(req, protocol.ErrInvalid)
+}
 
-		readOne = true
+func (s *Socket) connsResponse(req *protocol.Request) (*protocol.Response, error) {
+	cr := protocol.NewConnsResponse(s.conf)
+	for _, c := range s.Conns() {
+		cr.Add(&protocol.ConnInfo{
+			ID:        c.ID(),
+			Addr:      c.RemoteAddr().String(),
+			State:     c.getState().String(),
+			Principal: c.Principal(),
+		})
+	}
 
-		n, serr := conn.readFrom(r)
-		internal.LogError(r.Close())
-		total += int(n)
-		if serr != nil {
-			return total, serr
+	resp := req.Response
+	if _, err := req.WriteResponse(resp, protocol.NewClientMultiResponse(s.conf, cr.MultiResponse())); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// killConn closes the connection with the given id. The connection's
+// goroutine cleans up after its next read fails. A connection can't close
+// itself this way, as it wouldn't receive the response.
+func (s *Socket) killConn(conn *Conn, id string) error {
+	if id == conn.ID() {
+		return protocol.NewRespError(protocol.ErrInvalid, "can't close the requesting connection")
+	}
+
+	s.connMu.Lock()
+	var target *Conn
+	for c := range s.conns {
+		if c.ID() == id {
+			target = c
+			break
 		}
 	}
+	s.connMu.Unlock()
 
-	if !readOne {
+	if target == nil {
+		return protocol.NewRespError(protocol.ErrNotFound, "no connection %s", id)
+	}
+	log.Printf("%s: closing connection %s (%s)", conn.RemoteAddr(), id, target.RemoteAddr())
+	return target.close()
+}
+
+func (s *Socket) okResponse(req *protocol.Request) (*protocol.Response, error) {
+	resp := req.Response
+	cr := resp.ClientResponse
+	cr.SetOK()
+	if _, err := req.WriteResponse(resp, cr); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+func (s *Socket) errResponse(req *protocol.Request, err error) (*protocol.Response, error) {
+	resp := req.Response
+	cr := resp.ClientResponse
+	cr.SetError(err)
+	if _, werr := req.WriteResponse(resp, cr); werr != nil {
+		return resp, werr
+	}
+	return resp, err
+}
+
+// TODO should this take context and wait for ctx.Done()?
+func (s *Socket) waitForRequest(conn *Conn) (*protocol.Request, error) {
+	// PING\r\n (6 bytes) is the shortest possible valid request
+	_, err := conn.br.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.NewRequestConfig(s.conf), nil
+}
+
+func (s *Socket) sendResponse(conn *Conn, p pendingResponse) (int, error) {
+	resp := p.resp
+	if resp.NumReaders() == 0 {
 		log.Printf("%s: no readers in Response", conn.RemoteAddr())
 		return conn.sendDefaultError()
 	}
-	return total, err
+
+	// only responses with batches following the envelope are compressed
+	if p.compress && resp.NumReaders() > 1 {
+		n, err := conn.writeCompressed(resp)
+		return int(n), err
+	}
+
+	n, err := resp.WriteTo(conn)
+	return int(n), err
 }
 
 func (s *Socket) finishRequest(req *protocol.Request) {
@@ -390,7 +826,7 @@ func (s *Socket) finishRequest(req *protocol.Request) {
 
 func (s *Socket) startInstrumentation(req *protocol.Request) time.Time {
 	switch req.Name {
-	case protocol.CmdBatch, protocol.CmdRead, protocol.CmdTail:
+	case protocol.CmdBatch, protocol.CmdRead, protocol.CmdTail, protocol.CmdSRead, protocol.CmdReadRange:
 		return time.Now()
 	default:
 		return time.Time{}
@@ -405,7 +841,7 @@ func (s *Socket) finishInstrumentation(req *protocol.Request, start time.Time) {
 	switch req.Name {
 	case protocol.CmdBatch:
 		// stats.Timing("batch.latency", start)
-	case protocol.CmdRead, protocol.CmdTail:
+	case protocol.CmdRead, protocol.CmdTail, protocol.CmdSRead, protocol.CmdReadRange:
 		// stats.Timing("read.latency", start)
 	default:
 	}
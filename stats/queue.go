@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Queue is a topic's event queue, reported in the queue stats while it's
+// running.
+type Queue interface {
+	// Depth returns the number of requests waiting in the queue.
+	Depth() int
+	// Handling returns when the request the queue is handling was pushed to
+	// it, or the zero time if it isn't handling one. Requests are handled in
+	// the order they're pushed, so it's the oldest the queue hasn't responded
+	// to.
+	Handling() time.Time
+}
+
+// queues are the running event queues. It's only locked when a queue starts
+// or stops, and when the stats are read.
+var queues = struct {
+	sync.Mutex
+	m map[Queue]struct{}
+}{m: make(map[Queue]struct{})}
+
+// RegisterQueue adds q to the queue stats.
+func RegisterQueue(q Queue) {
+	queues.Lock()
+	queues.m[q] = struct{}{}
+	queues.Unlock()
+}
+
+// UnregisterQueue removes q from the queue stats.
+func UnregisterQueue(q Queue) {
+	queues.Lock()
+	delete(queues.m, q)
+	queues.Unlock()
+}
+
+// queueDepth returns the number of requests waiting in all event queues.
+func queueDepth() int64 {
+	queues.Lock()
+	defer queues.Unlock()
+
+	var n int64
+	for q := range queues.m {
+		n += int64(q.Depth())
+	}
+	return n
+}
+
+// oldestQueued returns how long the oldest request being handled by an event
+// queue has been waiting since it was pushed, or 0 if none are being handled.
+func oldestQueued(now time.Time) time.Duration {
+	queues.Lock()
+	defer queues.Unlock()
+
+	var oldest time.Time
+	for q := range queues.m {
+		t := q.Handling()
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
+}
@@ -4,33 +4,100 @@ import (
 	"bytes"
 	"expvar"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jeffrom/logd/internal"
 )
 
 var (
-	TotalConnections  *expvar.Int
-	ActiveConnections *expvar.Int
-	BytesIn           *expvar.Int
-	BytesOut          *expvar.Int
-	TotalRequests     *expvar.Int
-	BatchRequests     *expvar.Int
-	ReadRequests      *expvar.Int
-	TailRequests      *expvar.Int
-	StatsRequests     *expvar.Int
-	CloseRequests     *expvar.Int
-	ConfigRequests    *expvar.Int
-	TotalErrors       *expvar.Int
-	BatchErrors       *expvar.Int
-	ReadErrors        *expvar.Int
-	TailErrors        *expvar.Int
-	StatsErrors       *expvar.Int
-	CloseErrors       *expvar.Int
-	ConfigErrors      *expvar.Int
+	TotalConnections   *expvar.Int
+	ActiveConnections  *expvar.Int
+	BytesIn            *expvar.Int
+	BytesOut           *expvar.Int
+	TotalRequests      *expvar.Int
+	BatchRequests      *expvar.Int
+	ReadRequests       *expvar.Int
+	TailRequests       *expvar.Int
+	HeadRequests       *expvar.Int
+	TailOffsetRequests *expvar.Int
+	FormatRequests     *expvar.Int
+	TopicRequests      *expvar.Int
+	PauseRequests      *expvar.Int
+	EraseRequests      *expvar.Int
+	SyncRequests       *expvar.Int
+	OffsetTimeRequests *expvar.Int
+	StatsRequests      *expvar.Int
+	InfoRequests       *expvar.Int
+	CloseRequests      *expvar.Int
+	ConfigRequests     *expvar.Int
+	AuthRequests       *expvar.Int
+	AdminRequests      *expvar.Int
+	TotalErrors        *expvar.Int
+	BatchErrors        *expvar.Int
+	ReadErrors         *expvar.Int
+	TailErrors         *expvar.Int
+	HeadErrors         *expvar.Int
+	TailOffsetErrors   *expvar.Int
+	FormatErrors       *expvar.Int
+	TopicErrors        *expvar.Int
+	PauseErrors        *expvar.Int
+	EraseErrors        *expvar.Int
+	SyncErrors         *expvar.Int
+	OffsetTimeErrors   *expvar.Int
+	StatsErrors        *expvar.Int
+	InfoErrors         *expvar.Int
+	CloseErrors        *expvar.Int
+	ConfigErrors       *expvar.Int
+	AuthErrors         *expvar.Int
+	AdminErrors        *expvar.Int
+	DeniedErrors       *expvar.Int
+	UnknownCommands    *expvar.Int
+	CommandErrors      *expvar.Map
+	HandlerPanics      *expvar.Int
+	ReaderTimeouts     *expvar.Int
+	AcceptsThrottled   *expvar.Int
+
+	PartitionRotations *expvar.Int
+	PartitionsDeleted  *expvar.Int
+	BytesReclaimed     *expvar.Int
+	Partitions         *expvar.Int
+	PartitionBytes     *expvar.Int
+	PartitionReaders   *expvar.Int
+	DiskFullErrors     *expvar.Int
+	DiskFullRetentions *expvar.Int
+
+	Subscriptions    *expvar.Int
+	MaxSubscriptions *expvar.Int
+	Reads            *expvar.Int
+	MaxReads         *expvar.Int
+
+	TopicCreationRejected *expvar.Int
+	TopicCreationWaits    *expvar.Int
+	PausedTopics          *expvar.Int
+
+	BatchesWritten *expvar.Int
+	BatchMessages  *expvar.Int
+	BatchBytes     *expvar.Int
+	BatchesErased  *expvar.Int
+
+	CoalescedWrites *expvar.Int
+	AgedFlushes     *expvar.Int
+
+	CompressionBytesIn  *expvar.Int
+	CompressionBytesOut *expvar.Int
+
+	Started *expvar.Int
 )
 
 func init() {
 	TotalConnections = expvar.NewInt("conns.total")
 	ActiveConnections = expvar.NewInt("conns.active")
+	// connections closed because a READ or TAIL response couldn't be written
+	// before the reader timeout
+	ReaderTimeouts = expvar.NewInt("conns.reader_timeouts")
+	// times accepting new connections was paused by the accept rate limit
+	AcceptsThrottled = expvar.NewInt("conns.accepts_throttled")
 
 	BytesIn = expvar.NewInt("bytes.in")
 	BytesOut = expvar.NewInt("bytes.out")
@@ -39,17 +106,136 @@ func init() {
 	BatchRequests = expvar.NewInt("requests.batch")
 	ReadRequests = expvar.NewInt("requests.read")
 	TailRequests = expvar.NewInt("requests.tail")
+	// HEAD and HEADS requests
+	HeadRequests = expvar.NewInt("requests.head")
+	TailOffsetRequests = expvar.NewInt("requests.tail_offset")
+	// FORMAT and SETFORMAT requests
+	FormatRequests = expvar.NewInt("requests.format")
+	// TOPICINFO and SETPARTSIZE requests
+	TopicRequests = expvar.NewInt("requests.topic")
+	// PAUSE and RESUME requests
+	PauseRequests = expvar.NewInt("requests.pause")
+	EraseRequests = expvar.NewInt("requests.erase")
+	SyncRequests = expvar.NewInt("requests.sync")
+	OffsetTimeRequests = expvar.NewInt("requests.offset_time")
 	StatsRequests = expvar.NewInt("requests.stats")
+	InfoRequests = expvar.NewInt("requests.info")
 	CloseRequests = expvar.NewInt("requests.close")
 	ConfigRequests = expvar.NewInt("requests.config")
+	AuthRequests = expvar.NewInt("requests.auth")
+	AdminRequests = expvar.NewInt("requests.admin")
 
 	TotalErrors = expvar.NewInt("errors.total")
 	BatchErrors = expvar.NewInt("errors.batch")
 	ReadErrors = expvar.NewInt("errors.read")
 	TailErrors = expvar.NewInt("errors.tail")
+	HeadErrors = expvar.NewInt("errors.head")
+	TailOffsetErrors = expvar.NewInt("errors.tail_offset")
+	FormatErrors = expvar.NewInt("errors.format")
+	TopicErrors = expvar.NewInt("errors.topic")
+	PauseErrors = expvar.NewInt("errors.pause")
+	EraseErrors = expvar.NewInt("errors.erase")
+	SyncErrors = expvar.NewInt("errors.sync")
+	OffsetTimeErrors = expvar.NewInt("errors.offset_time")
 	StatsErrors = expvar.NewInt("errors.stats")
+	InfoErrors = expvar.NewInt("errors.info")
 	CloseErrors = expvar.NewInt("errors.close")
 	ConfigErrors = expvar.NewInt("errors.config")
+	AuthErrors = expvar.NewInt("errors.auth")
+	AdminErrors = expvar.NewInt("errors.admin")
+	DeniedErrors = expvar.NewInt("errors.denied")
+	UnknownCommands = expvar.NewInt("errors.unknown_command")
+	// failed requests by command and error category, keyed like
+	// "read.not_found". see CommandError.
+	CommandErrors = expvar.NewMap("errors.by_command")
+	// requests that panicked in a topic's event queue
+	HandlerPanics = expvar.NewInt("errors.handler_panics")
+
+	PartitionRotations = expvar.NewInt("partitions.rotations")
+	PartitionsDeleted = expvar.NewInt("partitions.deleted")
+	BytesReclaimed = expvar.NewInt("partitions.bytes_reclaimed")
+	// gauges for all topics
+	Partitions = expvar.NewInt("partitions.total")
+	PartitionBytes = expvar.NewInt("partitions.bytes")
+	// partitions opened for reading, such as to send in READ responses
+	PartitionReaders = expvar.NewInt("partitions.open_readers")
+	// batch writes that failed because the disk was full, and partitions
+	// removed by disk-full-retention to make room
+	DiskFullErrors = expvar.NewInt("partitions.disk_full")
+	DiskFullRetentions = expvar.NewInt("partitions.disk_full_deleted")
+
+	// read responses currently being sent, and the configured limit
+	Subscriptions = expvar.NewInt("subscriptions.active")
+	MaxSubscriptions = expvar.NewInt("subscriptions.max")
+	// the READ and SREAD responses among them, and their limit
+	Reads = expvar.NewInt("reads.active")
+	MaxReads = expvar.NewInt("reads.max")
+
+	// requests that would have created a topic past the topic limit
+	TopicCreationRejected = expvar.NewInt("topics.creation_rejected")
+	// new topics that waited for others to be created first
+	TopicCreationWaits = expvar.NewInt("topics.creation_waits")
+	// topics currently rejecting batches
+	PausedTopics = expvar.NewInt("topics.paused")
+
+	// requests waiting in topic event queues, and how long the oldest request
+	// being handled has been waiting in milliseconds since it was queued. if
+	// they keep growing, the event queues can't keep up.
+	expvar.Publish("queue.depth", expvar.Func(func() interface{} {
+		return queueDepth()
+	}))
+	expvar.Publish("queue.oldest_age_ms", expvar.Func(func() interface{} {
+		return oldestQueued(time.Now()).Nanoseconds() / int64(time.Millisecond)
+	}))
+
+	// batches written to the log, and the messages and bytes in them. the
+	// averages are calculated when they're read.
+	BatchesWritten = expvar.NewInt("batches.written")
+	BatchMessages = expvar.NewInt("batches.messages")
+	BatchBytes = expvar.NewInt("batches.bytes")
+	// batches overwritten by ERASE
+	BatchesErased = expvar.NewInt("batches.erased")
+	// writes of small batches coalesced together. see config.CoalesceTopics.
+	CoalescedWrites = expvar.NewInt("batches.coalesced_writes")
+	// flushes of writes that waited config.MaxBufferAge to be flushed
+	AgedFlushes = expvar.NewInt("batches.aged_flushes")
+	expvar.Publish("batches.avg_messages", expvar.Func(func() interface{} {
+		return average(BatchMessages, BatchesWritten)
+	}))
+	expvar.Publish("batches.avg_bytes", expvar.Func(func() interface{} {
+		return average(BatchBytes, BatchesWritten)
+	}))
+
+	// batch bytes in compressed READ responses, before and after compression
+	CompressionBytesIn = expvar.NewInt("compression.bytes_in")
+	CompressionBytesOut = expvar.NewInt("compression.bytes_out")
+
+	// the server's version, and when it started as milliseconds since the
+	// unix epoch. the uptime is calculated when it's read.
+	expvar.NewString("server.version").Set(internal.Version)
+	expvar.NewString("server.commit").Set(internal.Commit)
+	Started = expvar.NewInt("server.started_ms")
+	expvar.Publish("server.uptime_ms", expvar.Func(func() interface{} {
+		started := Started.Value()
+		if started == 0 {
+			return int64(0)
+		}
+		return time.Now().UnixNano()/int64(time.Millisecond) - started
+	}))
+}
+
+func average(total *expvar.Int, n *expvar.Int) float64 {
+	count := n.Value()
+	if count == 0 {
+		return 0
+	}
+	return float64(total.Value()) / float64(count)
+}
+
+// CommandError counts a failed request in CommandErrors. category should be
+// one of the protocol.Category constants.
+func CommandError(cmd string, category string) {
+	CommandErrors.Add(strings.ToLower(cmd)+"."+category, 1)
 }
 
 // MultiOK returns an MOK response body
@@ -19,3 +19,18 @@ type Server interface {
 type RequestHandler interface {
 	PushRequest(context.Context, *protocol.Request) (*protocol.Response, error)
 }
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal the request's
+// connection authenticated as.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal stored in ctx. It returns an empty string
+// if the connection hasn't authenticated.
+func Principal(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}